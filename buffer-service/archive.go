@@ -0,0 +1,471 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	archiveFormat       = "noc-raven-buffer"
+	archiveVersion      = 1
+	archiveManifestName = "manifest.json"
+	archiveRecordsName  = "records.ndjson.gz"
+	// archiveChunk is how many rows an export reads per query
+	archiveChunk = 500
+
+	// Import limits: the request body, the manifest, one compressed data
+	// entry, that entry once decompressed, and one record line
+	archiveMaxImportBytes   = 4 << 30
+	archiveMaxManifestBytes = 1 << 20
+	archiveMaxFileBytes     = 4 << 30
+	archiveMaxDataBytes     = 16 << 30
+	archiveMaxLineBytes     = 16 << 20
+)
+
+// errArchiveInvalid marks an import that is not a readable, intact archive
+var errArchiveInvalid = errors.New("invalid archive")
+
+// ExportQuery selects the telemetry_buffer records written to an archive
+type ExportQuery struct {
+	Service   string `json:"service,omitempty"`
+	DataType  string `json:"data_type,omitempty"`
+	Since     int64  `json:"since,omitempty"`
+	Until     int64  `json:"until,omitempty"`
+	Forwarded *bool  `json:"forwarded,omitempty"`
+}
+
+// archiveManifest is the first entry of an archive and describes the rest
+type archiveManifest struct {
+	Format      string        `json:"format"`
+	Version     int           `json:"version"`
+	ApplianceID string        `json:"appliance_id"`
+	CreatedAt   int64         `json:"created_at"`
+	Selection   ExportQuery   `json:"selection"`
+	Records     int64         `json:"records"`
+	Files       []archiveFile `json:"files"`
+}
+
+// archiveFile is the checksum of one data entry
+type archiveFile struct {
+	Name    string `json:"name"`
+	Records int64  `json:"records"`
+	Bytes   int64  `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// archiveRecord is one NDJSON line of a data entry. Batch blobs are exported
+// as their individual records.
+type archiveRecord struct {
+	Hash      string `json:"hash"`
+	Service   string `json:"service"`
+	DataType  string `json:"data_type"`
+	Timestamp int64  `json:"timestamp"`
+	SourceIP  string `json:"source_ip,omitempty"`
+	Data      string `json:"data"`
+}
+
+// recordHash identifies a record by what it carries, so the same record
+// exported twice, or by two appliances, hashes the same
+func recordHash(r archiveRecord) string {
+	sum := sha256.Sum256([]byte(r.Service + "\x00" + r.DataType + "\x00" + strconv.FormatInt(r.Timestamp, 10) + "\x00" + r.SourceIP + "\x00" + r.Data))
+	return hex.EncodeToString(sum[:])
+}
+
+// ImportResult reports what an import stored
+type ImportResult struct {
+	ApplianceID string `json:"appliance_id"` // appliance the archive was exported from
+	Records     int64  `json:"records"`
+	Imported    int64  `json:"imported"`
+	Duplicates  int64  `json:"duplicates"` // already imported earlier
+	Failed      int64  `json:"failed"`
+	LastError   string `json:"last_error,omitempty"`
+}
+
+// exportSpool is an export whose records are written out and checksummed,
+// ready to be sent as an archive
+type exportSpool struct {
+	file     *os.File
+	size     int64
+	manifest archiveManifest
+}
+
+// prepareExport spools the selected records to a temporary file, since the
+// manifest that leads the archive carries their count and checksum
+func (bm *BufferManager) prepareExport(q ExportQuery) (*exportSpool, error) {
+	file, err := os.CreateTemp(filepath.Join(bm.dataPath, "buffer"), "export-*")
+	if err != nil {
+		return nil, err
+	}
+	spool := &exportSpool{file: file}
+
+	sum := sha256.New()
+	zw := gzip.NewWriter(io.MultiWriter(file, sum))
+	enc := json.NewEncoder(zw)
+	enc.SetEscapeHTML(false)
+	var count int64
+	err = bm.scanArchiveRecords(q, func(r archiveRecord) error {
+		count++
+		return enc.Encode(r)
+	})
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		spool.size, err = file.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	spool.manifest = archiveManifest{
+		Format:      archiveFormat,
+		Version:     archiveVersion,
+		ApplianceID: applianceID(),
+		CreatedAt:   time.Now().Unix(),
+		Selection:   q,
+		Records:     count,
+		Files:       []archiveFile{{Name: archiveRecordsName, Records: count, Bytes: spool.size, SHA256: hex.EncodeToString(sum.Sum(nil))}},
+	}
+	return spool, nil
+}
+
+// writeTo writes the archive: manifest.json followed by records.ndjson.gz
+func (s *exportSpool) writeTo(w io.Writer) error {
+	header, err := json.MarshalIndent(s.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	modTime := time.Unix(s.manifest.CreatedAt, 0)
+	if err := tw.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(header)), ModTime: modTime}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(header); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: archiveRecordsName, Mode: 0644, Size: s.size, ModTime: modTime}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, io.NewSectionReader(s.file, 0, s.size)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Close removes the spool file
+func (s *exportSpool) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// scanArchiveRecords calls fn for every selected record in id order, with
+// payloads decoded and blobs expanded
+func (bm *BufferManager) scanArchiveRecords(q ExportQuery, fn func(archiveRecord) error) error {
+	where := []string{"id > ?"}
+	var args []interface{}
+	if q.Service != "" {
+		where = append(where, "service = ?")
+		args = append(args, q.Service)
+	}
+	if q.DataType != "" {
+		where = append(where, "data_type = ?")
+		args = append(args, q.DataType)
+	}
+	if q.Forwarded != nil {
+		forwarded := 0
+		if *q.Forwarded {
+			forwarded = 1
+		}
+		where = append(where, "forwarded = ?")
+		args = append(args, forwarded)
+	}
+	if q.Since > 0 {
+		where = append(where, "(timestamp >= ? OR batch_count > 0)")
+		args = append(args, q.Since)
+	}
+	if q.Until > 0 {
+		where = append(where, "timestamp <= ?")
+		args = append(args, q.Until)
+	}
+	query := `SELECT id, service, timestamp, data_type, json_data, COALESCE(source_ip, ''), codec, batch_count
+		FROM telemetry_buffer WHERE ` + strings.Join(where, " AND ") + " ORDER BY id LIMIT ?"
+
+	var lastID int64
+	for {
+		rows, err := bm.db.Query(query, append(append([]interface{}{lastID}, args...), archiveChunk)...)
+		if err != nil {
+			return err
+		}
+		var chunk []TelemetryRecord
+		for rows.Next() {
+			var r TelemetryRecord
+			if err := rows.Scan(&r.ID, &r.Service, &r.Timestamp, &r.DataType, &r.JsonData, &r.SourceIP, &r.Codec, &r.BatchCount); err != nil {
+				rows.Close()
+				return err
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(chunk) == 0 {
+			return err
+		}
+		lastID = chunk[len(chunk)-1].ID
+
+		for _, r := range chunk {
+			err := bm.decodeRecord(&r)
+			members := []TelemetryRecord{r}
+			if err == nil && r.BatchCount > 0 {
+				members, err = unbatchRecord(r)
+			}
+			if err != nil {
+				logger.WithError(err).WithField("id", r.ID).Warn("Leaving undecodable record out of export")
+				continue
+			}
+			for _, m := range members {
+				if q.Since > 0 && m.Timestamp < q.Since || q.Until > 0 && m.Timestamp > q.Until {
+					continue
+				}
+				ar := archiveRecord{Service: m.Service, DataType: m.DataType, Timestamp: m.Timestamp, SourceIP: m.SourceIP, Data: m.JsonData}
+				ar.Hash = recordHash(ar)
+				if err := fn(ar); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// ImportArchive verifies an archive written by an export and buffers its
+// records for forwarding. Records whose hash was imported before are skipped,
+// so importing an archive twice stores nothing new.
+func (bm *BufferManager) ImportArchive(r io.Reader) (*ImportResult, error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != archiveManifestName {
+		return nil, fmt.Errorf("%w: %s must be the first entry", errArchiveInvalid, archiveManifestName)
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(io.LimitReader(tr, archiveMaxManifestBytes)).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: manifest: %w", errArchiveInvalid, err)
+	}
+	if manifest.Format != archiveFormat || manifest.Version != archiveVersion {
+		return nil, fmt.Errorf("%w: unsupported format %s version %d", errArchiveInvalid, manifest.Format, manifest.Version)
+	}
+
+	result := &ImportResult{ApplianceID: manifest.ApplianceID}
+	seen := make(map[string]bool)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("%w: %w", errArchiveInvalid, err)
+		}
+		var file *archiveFile
+		for i := range manifest.Files {
+			if manifest.Files[i].Name == hdr.Name {
+				file = &manifest.Files[i]
+			}
+		}
+		if file == nil || seen[hdr.Name] {
+			return result, fmt.Errorf("%w: unexpected entry %s", errArchiveInvalid, hdr.Name)
+		}
+		seen[hdr.Name] = true
+		if err := bm.importArchiveFile(tr, *file, result); err != nil {
+			return result, err
+		}
+	}
+	for _, file := range manifest.Files {
+		if !seen[file.Name] {
+			return result, fmt.Errorf("%w: %s is missing", errArchiveInvalid, file.Name)
+		}
+	}
+
+	if result.Imported > 0 {
+		bm.requestDrain()
+	}
+	return result, nil
+}
+
+// importArchiveFile checks one data entry against its manifest checksum
+// before storing any of its records
+func (bm *BufferManager) importArchiveFile(r io.Reader, file archiveFile, result *ImportResult) error {
+	if file.Bytes > archiveMaxFileBytes {
+		return fmt.Errorf("%w: %s is larger than %d bytes", errArchiveInvalid, file.Name, int64(archiveMaxFileBytes))
+	}
+	spool, err := os.CreateTemp(filepath.Join(bm.dataPath, "buffer"), "import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	sum := sha256.New()
+	// One byte past the listed size is enough to tell the entry does not match
+	size, err := io.Copy(io.MultiWriter(spool, sum), io.LimitReader(r, file.Bytes+1))
+	if err != nil {
+		return err
+	}
+	if size != file.Bytes || hex.EncodeToString(sum.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%w: %s does not match its checksum", errArchiveInvalid, file.Name)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(spool)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", errArchiveInvalid, file.Name, err)
+	}
+	defer zr.Close()
+
+	now := time.Now().Unix()
+	// Hashes are kept as long as any record could be
+	hashExpires := now + int64(bm.config.MaxRetentionDays*24*60*60)
+	fail := func(err error) {
+		result.Failed++
+		result.LastError = err.Error()
+	}
+
+	data := &io.LimitedReader{R: zr, N: archiveMaxDataBytes + 1}
+	lines := bufio.NewScanner(data)
+	lines.Buffer(make([]byte, 64*1024), archiveMaxLineBytes)
+	var count int64
+	for lines.Scan() {
+		line := lines.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		count++
+		result.Records++
+		var record archiveRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			fail(fmt.Errorf("record %d: %v", count, err))
+		} else if recordHash(record) != record.Hash {
+			fail(fmt.Errorf("record %d does not match its hash", count))
+		} else if err := bm.importRecord(record, now, hashExpires); errors.Is(err, errDuplicateRecord) {
+			result.Duplicates++
+		} else if err != nil {
+			fail(err)
+		} else {
+			result.Imported++
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return fmt.Errorf("%w: %s: %v", errArchiveInvalid, file.Name, err)
+	}
+	if data.N <= 0 {
+		return fmt.Errorf("%w: %s decompresses to more than %d bytes", errArchiveInvalid, file.Name, int64(archiveMaxDataBytes))
+	}
+	if count != file.Records {
+		return fmt.Errorf("%w: %s holds %d records, manifest lists %d", errArchiveInvalid, file.Name, count, file.Records)
+	}
+	return nil
+}
+
+// errDuplicateRecord marks an archived record imported before
+var errDuplicateRecord = errors.New("record already imported")
+
+// importRecord claims a record's hash and buffers it like any received
+// record. The claim and the stored record commit together.
+func (bm *BufferManager) importRecord(record archiveRecord, now, hashExpires int64) error {
+	// Skip known duplicates before making room for them
+	var known int
+	err := bm.db.QueryRow("SELECT COUNT(*) FROM imported_records WHERE hash = ?", record.Hash).Scan(&known)
+	if err != nil {
+		return err
+	}
+	if known > 0 {
+		return errDuplicateRecord
+	}
+
+	return bm.storeRecord(TelemetryRecord{
+		Service:   record.Service,
+		DataType:  record.DataType,
+		Timestamp: record.Timestamp,
+		SourceIP:  record.SourceIP,
+		JsonData:  record.Data,
+	}, func(tx *sql.Tx) error {
+		res, err := tx.Exec("INSERT OR IGNORE INTO imported_records (hash, imported_at, expires_at) VALUES (?, ?, ?)",
+			record.Hash, now, hashExpires)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errDuplicateRecord
+		}
+		return nil
+	})
+}
+
+// handleExport serves GET /api/buffer/export
+func (bm *BufferManager) handleExport(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := ExportQuery{Service: params.Get("service"), DataType: params.Get("data_type")}
+	var err error
+	if q.Since, err = parseTimeParam(params.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseTimeParam(params.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("forwarded"); v != "" {
+		forwarded, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid forwarded %q", v), http.StatusBadRequest)
+			return
+		}
+		q.Forwarded = &forwarded
+	}
+
+	spool, err := bm.prepareExport(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Export failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer spool.Close()
+
+	name := fmt.Sprintf("noc-raven-%s-%s.tar", applianceID(), time.Unix(spool.manifest.CreatedAt, 0).UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	if err := spool.writeTo(w); err != nil {
+		logger.WithError(err).Warn("Export interrupted")
+	}
+}
+
+// handleImport serves POST /api/buffer/import with an archive as the body
+func (bm *BufferManager) handleImport(w http.ResponseWriter, r *http.Request) {
+	result, err := bm.ImportArchive(http.MaxBytesReader(w, r.Body, archiveMaxImportBytes))
+	if err != nil {
+		status := http.StatusInternalServerError
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			status = http.StatusRequestEntityTooLarge
+		case errors.Is(err, errArchiveInvalid):
+			status = http.StatusBadRequest
+		}
+		http.Error(w, fmt.Sprintf("Import failed: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
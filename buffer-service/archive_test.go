@@ -0,0 +1,189 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportArchive runs an export through the API and returns the archive
+func exportArchive(t *testing.T, bm *BufferManager, query string) []byte {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	bm.handleExport(rec, httptest.NewRequest("GET", "/api/buffer/export?"+query, nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("export: status %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Body.Bytes()
+}
+
+func TestExportImport_RoundTripIsIdempotent(t *testing.T) {
+	src := newTestBufferManager(t, "")
+	src.config.Recompress.BatchSmallRecords = true
+	src.config.Recompress.RecordsPerBlob = 10
+	storeLinkEvents(t, src, 0, 20)
+	ageRecords(t, src)
+	if _, err := src.RecompressOldRecords(); err != nil {
+		t.Fatalf("RecompressOldRecords: %v", err)
+	}
+	storeLinkEvents(t, src, 20, 10)
+
+	archive := exportArchive(t, src, "service=fluent-bit&since=1005&until=1024")
+	tr := tar.NewReader(bytes.NewReader(archive))
+	if hdr, err := tr.Next(); err != nil || hdr.Name != archiveManifestName {
+		t.Fatalf("first entry: %v %v", hdr, err)
+	}
+	var manifest archiveManifest
+	json.NewDecoder(tr).Decode(&manifest)
+	if manifest.Records != 20 || len(manifest.Files) != 1 || manifest.Files[0].SHA256 == "" || manifest.Selection.Since != 1005 {
+		t.Fatalf("unexpected manifest %+v", manifest)
+	}
+
+	dst := newTestBufferManager(t, "")
+	// An import starts a drain of its own, so capture before importing
+	capture := useCapture(dst)
+	result, err := dst.ImportArchive(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("ImportArchive: %v", err)
+	}
+	if result.Records != 20 || result.Imported != 20 || result.Duplicates != 0 || result.Failed != 0 {
+		t.Fatalf("first import: %+v", result)
+	}
+	result, err = dst.ImportArchive(bytes.NewReader(archive))
+	if err != nil || result.Imported != 0 || result.Duplicates != 20 {
+		t.Fatalf("second import: %+v, %v", result, err)
+	}
+
+	dst.forwardBufferedRecords()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(capture.payloads()) < 20 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := capture.payloads(); len(got) != 20 {
+		t.Fatalf("forwarded %d imported records, want 20", len(got))
+	}
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	for _, r := range capture.records {
+		var n struct{ N int }
+		json.Unmarshal([]byte(r.JsonData), &n)
+		if r.Timestamp != int64(1000+n.N) || r.SourceIP == "" || n.N < 5 || n.N > 24 {
+			t.Fatalf("imported record %+v", r)
+		}
+	}
+}
+
+func TestImportArchive_RejectsDamagedArchive(t *testing.T) {
+	src := newTestBufferManager(t, "")
+	storeLinkEvents(t, src, 0, 5)
+	archive := exportArchive(t, src, "")
+
+	// Rewrite the archive with one byte of the records changed
+	var damaged bytes.Buffer
+	tr, tw := tar.NewReader(bytes.NewReader(archive)), tar.NewWriter(&damaged)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		data, _ := io.ReadAll(tr)
+		if hdr.Name == archiveRecordsName {
+			data[len(data)/2] ^= 0xff
+		}
+		tw.WriteHeader(hdr)
+		tw.Write(data)
+	}
+	tw.Close()
+
+	dst := newTestBufferManager(t, "")
+	if _, err := dst.ImportArchive(bytes.NewReader(damaged.Bytes())); !errors.Is(err, errArchiveInvalid) {
+		t.Fatalf("err = %v, want errArchiveInvalid", err)
+	}
+	var rows int
+	dst.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer").Scan(&rows)
+	if rows != 0 {
+		t.Fatalf("damaged archive stored %d records", rows)
+	}
+
+	rec := httptest.NewRecorder()
+	dst.handleImport(rec, httptest.NewRequest("POST", "/api/buffer/import", bytes.NewReader([]byte("not an archive"))))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("import of garbage: status %d", rec.Code)
+	}
+}
+
+func TestImportArchive_FailedStoreLeavesRecordImportable(t *testing.T) {
+	src := newTestBufferManager(t, "")
+	storeLinkEvents(t, src, 0, 5)
+	archive := exportArchive(t, src, "")
+
+	dst := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		cfg.OverflowAction = "drop_newest"
+		svc := cfg.Services["fluent-bit"]
+		svc.BufferMode = "database"
+		svc.MaxRecords = 2
+		cfg.Services["fluent-bit"] = svc
+	})
+	capture := useCapture(dst)
+	result, err := dst.ImportArchive(bytes.NewReader(archive))
+	if err != nil || result.Imported != 2 || result.Failed != 3 {
+		t.Fatalf("import into a full buffer: %+v, %v", result, err)
+	}
+	var claimed int
+	dst.db.QueryRow("SELECT COUNT(*) FROM imported_records").Scan(&claimed)
+	if claimed != 2 {
+		t.Fatalf("%d hashes claimed for 2 stored records", claimed)
+	}
+
+	// Let the drain the import started finish before changing the config
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		dst.drain.mu.Lock()
+		running := dst.drain.running
+		dst.drain.mu.Unlock()
+		if len(capture.payloads()) == 2 && !running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dst.config.Services["fluent-bit"] = ServiceCfg{Enabled: true, BufferMode: "database", MaxRecords: 10}
+	result, err = dst.ImportArchive(bytes.NewReader(archive))
+	if err != nil || result.Imported != 3 || result.Duplicates != 2 {
+		t.Fatalf("second import: %+v, %v", result, err)
+	}
+}
+
+func TestImportArchive_RejectsOverlongRecordLine(t *testing.T) {
+	var records bytes.Buffer
+	zw := gzip.NewWriter(&records)
+	zw.Write([]byte(`{"data":"` + strings.Repeat("x", archiveMaxLineBytes) + `"}` + "\n"))
+	zw.Close()
+	sum := sha256.Sum256(records.Bytes())
+	manifest, _ := json.Marshal(archiveManifest{
+		Format: archiveFormat, Version: archiveVersion, Records: 1,
+		Files: []archiveFile{{Name: archiveRecordsName, Records: 1, Bytes: int64(records.Len()), SHA256: hex.EncodeToString(sum[:])}},
+	})
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(manifest))})
+	tw.Write(manifest)
+	tw.WriteHeader(&tar.Header{Name: archiveRecordsName, Mode: 0644, Size: int64(records.Len())})
+	tw.Write(records.Bytes())
+	tw.Close()
+
+	dst := newTestBufferManager(t, "")
+	if _, err := dst.ImportArchive(&archive); !errors.Is(err, errArchiveInvalid) || !strings.Contains(err.Error(), "too long") {
+		t.Fatalf("err = %v, want an invalid archive with a line too long", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"buffer-service/flow"
+	"buffer-service/snmp"
+)
+
+const (
+	defaultApplianceConfigPath = "/opt/noc-raven/web/api/config.json"
+	collectionPollInterval     = 30 * time.Second
+)
+
+// ApplianceConfig is the subset of the config-service file that buffer-service acts on
+type ApplianceConfig struct {
+	Collection CollectionCfg          `json:"collection"`
+	Forwarding ApplianceForwardingCfg `json:"forwarding"`
+}
+
+// ApplianceForwardingCfg holds the forwarding sections buffer-service depends on
+type ApplianceForwardingCfg struct {
+	SNMP    SNMPUserCfg         `json:"snmp"`
+	Netflow FlowForwardingCfg   `json:"netflow"`
+	Syslog  SyslogForwardingCfg `json:"syslog"`
+}
+
+// SyslogForwardingCfg is forwarding.syslog; Protocol is "UDP", "TCP" or "TLS"
+// and Format is "RFC3164" or "RFC5424"
+type SyslogForwardingCfg struct {
+	Protocol string `json:"protocol"`
+	Format   string `json:"format"`
+}
+
+// override applies the appliance's forwarding choices to a destination from
+// the buffer config. Settings the appliance leaves empty are kept.
+func (c ApplianceForwardingCfg) override(dataType string, dest DestinationCfg) DestinationCfg {
+	switch dataType {
+	case "netflow":
+		if c.Netflow.Version != "" {
+			dest.Version = c.Netflow.Version
+		}
+	case "syslog":
+		if c.Syslog.Protocol != "" {
+			dest.Transport = strings.ToLower(c.Syslog.Protocol)
+		}
+		if c.Syslog.Format != "" {
+			dest.Format = c.Syslog.Format
+		}
+	}
+	return dest
+}
+
+// FlowForwardingCfg is forwarding.netflow; Version picks the export format
+// buffered flows are re-encoded in ("v9" or "ipfix")
+type FlowForwardingCfg struct {
+	Version string `json:"version"`
+}
+
+// CollectionCfg holds the collector sections buffer-service can serve natively
+type CollectionCfg struct {
+	Syslog  SyslogListenerCfg   `json:"syslog"`
+	Netflow FlowListenerCfg     `json:"netflow"`
+	SFlow   SFlowListenerCfg    `json:"sflow"`
+	SNMP    SNMPTrapListenerCfg `json:"snmp"`
+}
+
+// applianceConfigPath returns the config-service file, shared via NOC_RAVEN_CONFIG_PATH
+func applianceConfigPath() string {
+	if path := os.Getenv("NOC_RAVEN_CONFIG_PATH"); path != "" {
+		return path
+	}
+	return defaultApplianceConfigPath
+}
+
+// loadApplianceConfig reads the config-service file
+func loadApplianceConfig(path string) (ApplianceConfig, error) {
+	var cfg ApplianceConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	cfg.Collection.SNMP.USM = cfg.Forwarding.SNMP
+	return cfg, err
+}
+
+// collectorSet tracks the native collectors bound from the collection config
+type collectorSet struct {
+	mu          sync.Mutex
+	running     map[string]io.Closer
+	configs     map[string]interface{}
+	flowDecoder *flow.Decoder // outlives rebinds so template caches and counters survive
+	snmpEngine  *snmp.Engine  // one boot per process, whatever the rebinds
+}
+
+// applyCollection starts, stops or rebinds native collectors whose config changed
+func (bm *BufferManager) applyCollection(cfg CollectionCfg) {
+	bm.collectors.mu.Lock()
+	defer bm.collectors.mu.Unlock()
+
+	bm.rebindCollector("syslog", cfg.Syslog, cfg.Syslog.active(), func() (io.Closer, error) {
+		return startSyslogListener(bm, cfg.Syslog)
+	})
+	bm.rebindCollector("netflow", cfg.Netflow, cfg.Netflow.active(), func() (io.Closer, error) {
+		return startFlowListener(bm, cfg.Netflow)
+	})
+	bm.rebindCollector("sflow", cfg.SFlow, cfg.SFlow.active(), func() (io.Closer, error) {
+		return startSFlowListener(bm, cfg.SFlow)
+	})
+	bm.rebindCollector("snmp", cfg.SNMP, cfg.SNMP.active(), func() (io.Closer, error) {
+		return startSNMPTrapListener(bm, cfg.SNMP)
+	})
+}
+
+// rebindCollector restarts one collector when its config changed. The caller
+// holds collectors.mu.
+func (bm *BufferManager) rebindCollector(name string, cfg interface{}, active bool, start func() (io.Closer, error)) {
+	c := &bm.collectors
+	if c.running == nil {
+		c.running = make(map[string]io.Closer)
+		c.configs = make(map[string]interface{})
+	}
+	if !active {
+		cfg = nil
+	}
+	if _, running := c.running[name]; running == active && c.configs[name] == cfg {
+		return
+	}
+	if l, ok := c.running[name]; ok {
+		l.Close()
+		delete(c.running, name)
+	}
+	c.configs[name] = cfg
+	if !active {
+		return
+	}
+	l, err := start()
+	if err != nil {
+		logger.WithError(err).WithField("collector", name).Error("Failed to start native collector")
+		return
+	}
+	c.running[name] = l
+}
+
+// stopCollectors closes every native collector
+func (bm *BufferManager) stopCollectors() {
+	bm.applyCollection(CollectionCfg{})
+}
+
+// applyForwarding rebuilds the forwarders when the appliance's forwarding
+// settings change
+func (bm *BufferManager) applyForwarding(cfg ApplianceForwardingCfg) {
+	bm.fwdMutex.Lock()
+	changed := bm.applianceForwarding != cfg
+	bm.applianceForwarding = cfg
+	bm.fwdMutex.Unlock()
+	if changed {
+		bm.buildForwarders()
+	}
+}
+
+// startCollectors binds the native collectors and rebinds them whenever the
+// config-service file changes
+func (bm *BufferManager) startCollectors(path string) {
+	var lastMod time.Time
+	reload := func() {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastMod) {
+			return
+		}
+		lastMod = info.ModTime()
+		cfg, err := loadApplianceConfig(path)
+		if err != nil {
+			logger.WithError(err).WithField("path", path).Warn("Failed to read collection config")
+			return
+		}
+		bm.applyCollection(cfg.Collection)
+		bm.applyForwarding(cfg.Forwarding)
+	}
+
+	reload()
+	go func() {
+		ticker := time.NewTicker(collectionPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				reload()
+			case <-bm.stopChan:
+				bm.stopCollectors()
+				return
+			}
+		}
+	}()
+}
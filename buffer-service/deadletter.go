@@ -0,0 +1,312 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// DeadLetterRecord is a record that exhausted its forward attempts
+type DeadLetterRecord struct {
+	TelemetryRecord
+	OriginalID int64 `json:"original_id"`
+	DeadAt     int64 `json:"dead_at"`
+}
+
+const deadLetterColumns = `id, original_id, service, timestamp, data_type, data_size,
+	json_data, source_ip, codec, retry_count, last_error, created_at, expires_at, dead_at, batch_count`
+
+// deadLetterBufferedRecord moves a telemetry_buffer row into the dead-letter table
+func (bm *BufferManager) deadLetterBufferedRecord(id int64, attempts int, reason string) error {
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var service string
+	var size int64
+	var forwarded int
+	if err := tx.QueryRow("SELECT service, data_size, forwarded FROM telemetry_buffer WHERE id = ?", id).Scan(&service, &size, &forwarded); err != nil {
+		return err
+	}
+
+	insert := `
+		INSERT INTO dead_letter
+		(original_id, service, timestamp, data_type, data_size, json_data, source_ip,
+		 codec, raw_size, retry_count, last_error, created_at, expires_at, dead_at, batch_count)
+		SELECT id, service, timestamp, data_type, data_size, json_data, COALESCE(source_ip, ''),
+		       codec, raw_size, ?, ?, created_at, expires_at, ?, batch_count
+		FROM telemetry_buffer WHERE id = ?
+	`
+	if _, err := tx.Exec(insert, attempts, reason, time.Now().Unix(), id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM telemetry_buffer WHERE id = ?", id); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	bm.quota.add(service, quotaUsage{Records: -1, Bytes: -size, Pending: int64(forwarded) - 1})
+	bm.metrics.deadLettered.add(1, service)
+	return nil
+}
+
+// deadLetterStoredRecord writes a record read from another backend, still in
+// its stored (compressed) form, into the dead-letter table
+func (bm *BufferManager) deadLetterStoredRecord(record TelemetryRecord, rawSize int64, attempts int, reason string) error {
+	codec := record.Codec
+	if codec == "" {
+		codec = "none"
+	}
+
+	var data interface{} = record.JsonData
+	if codec != "none" {
+		data = []byte(record.JsonData)
+	}
+
+	insert := `
+		INSERT INTO dead_letter
+		(original_id, service, timestamp, data_type, data_size, json_data, source_ip,
+		 codec, raw_size, retry_count, last_error, created_at, expires_at, dead_at)
+		VALUES (0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := bm.db.Exec(insert, record.Service, record.Timestamp, record.DataType, record.DataSize,
+		data, record.SourceIP, codec, rawSize, attempts, reason, record.CreatedAt, record.ExpiresAt, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	bm.metrics.deadLettered.add(1, record.Service)
+	return nil
+}
+
+func scanDeadLetter(scanner interface{ Scan(...interface{}) error }) (DeadLetterRecord, error) {
+	var dl DeadLetterRecord
+	err := scanner.Scan(&dl.ID, &dl.OriginalID, &dl.Service, &dl.Timestamp, &dl.DataType, &dl.DataSize,
+		&dl.JsonData, &dl.SourceIP, &dl.Codec, &dl.RetryCount, &dl.LastError,
+		&dl.CreatedAt, &dl.ExpiresAt, &dl.DeadAt, &dl.BatchCount)
+	return dl, err
+}
+
+// ListDeadLetters returns dead-lettered records, newest first, without payloads
+func (bm *BufferManager) ListDeadLetters(service string, limit, offset int) ([]DeadLetterRecord, int64, error) {
+	where := ""
+	args := []interface{}{}
+	if service != "" {
+		where = "WHERE service = ?"
+		args = append(args, service)
+	}
+
+	var total int64
+	if err := bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter "+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM dead_letter %s ORDER BY dead_at DESC, id DESC LIMIT ? OFFSET ?", deadLetterColumns, where)
+	rows, err := bm.db.Query(query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	records := []DeadLetterRecord{}
+	for rows.Next() {
+		dl, err := scanDeadLetter(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		dl.JsonData = ""
+		records = append(records, dl)
+	}
+	return records, total, rows.Err()
+}
+
+// GetDeadLetter returns a single dead-lettered record with its decoded payload
+func (bm *BufferManager) GetDeadLetter(id int64) (*DeadLetterRecord, error) {
+	query := fmt.Sprintf("SELECT %s FROM dead_letter WHERE id = ?", deadLetterColumns)
+	dl, err := scanDeadLetter(bm.db.QueryRow(query, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := bm.decodeRecord(&dl.TelemetryRecord); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// RequeueDeadLetters moves dead-lettered records back into the buffer with a fresh retry budget.
+// id selects a single record; otherwise service (optional) filters which records are requeued.
+func (bm *BufferManager) RequeueDeadLetters(id int64, service string) (int64, error) {
+	where, args := deadLetterFilter(id, service)
+
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	insert := `
+		INSERT INTO telemetry_buffer
+		(service, timestamp, data_type, data_size, file_path, json_data, source_ip,
+		 forwarded, retry_count, created_at, expires_at, codec, raw_size, next_attempt_at, batch_count)
+		SELECT service, timestamp, data_type, data_size, '', json_data, source_ip,
+		       0, 0, created_at, expires_at, codec, raw_size, 0, batch_count
+		FROM dead_letter ` + where
+	result, err := tx.Exec(insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM dead_letter "+where, args...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if err := bm.resyncQuota(); err != nil {
+		logger.WithError(err).Warn("Failed to recount buffer usage")
+	}
+	return result.RowsAffected()
+}
+
+// PurgeDeadLetters permanently deletes dead-lettered records
+func (bm *BufferManager) PurgeDeadLetters(id int64, service string) (int64, error) {
+	where, args := deadLetterFilter(id, service)
+	result, err := bm.db.Exec("DELETE FROM dead_letter "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func deadLetterFilter(id int64, service string) (string, []interface{}) {
+	switch {
+	case id > 0:
+		return "WHERE id = ?", []interface{}{id}
+	case service != "":
+		return "WHERE service = ?", []interface{}{service}
+	default:
+		return "", nil
+	}
+}
+
+// deadLetterCount returns how many dead-lettered records a service has
+func (bm *BufferManager) deadLetterCount(service string) (int64, error) {
+	var count int64
+	err := bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter WHERE service = ?", service).Scan(&count)
+	return count, err
+}
+
+// HTTP Handlers
+
+func deadLetterID(r *http.Request) int64 {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	return id
+}
+
+// deadLetterTarget returns the dead letter id or service a bulk request
+// selects. An id that cannot exist is not found, and selecting every dead
+// letter requires all=true.
+func deadLetterTarget(w http.ResponseWriter, r *http.Request, action string) (int64, string, bool) {
+	if _, ok := mux.Vars(r)["id"]; ok {
+		id := deadLetterID(r)
+		if id <= 0 {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return 0, "", false
+		}
+		return id, "", true
+	}
+
+	service := r.URL.Query().Get("service")
+	if service == "" && r.URL.Query().Get("all") != "true" {
+		http.Error(w, action+" every dead letter requires all=true", http.StatusBadRequest)
+		return 0, "", false
+	}
+	return 0, service, true
+}
+
+func (bm *BufferManager) handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	records, total, err := bm.ListDeadLetters(r.URL.Query().Get("service"), limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error listing dead letters: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"records": records,
+		"total":   total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+func (bm *BufferManager) handleDeadLetterGet(w http.ResponseWriter, r *http.Request) {
+	record, err := bm.GetDeadLetter(deadLetterID(r))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading dead letter: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(record)
+}
+
+func (bm *BufferManager) handleDeadLetterRequeue(w http.ResponseWriter, r *http.Request) {
+	id, service, ok := deadLetterTarget(w, r, "Requeueing")
+	if !ok {
+		return
+	}
+
+	requeued, err := bm.RequeueDeadLetters(id, service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Requeue failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if id > 0 && requeued == 0 {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "requeued", "records": requeued})
+}
+
+func (bm *BufferManager) handleDeadLetterPurge(w http.ResponseWriter, r *http.Request) {
+	id, service, ok := deadLetterTarget(w, r, "Purging")
+	if !ok {
+		return
+	}
+
+	purged, err := bm.PurgeDeadLetters(id, service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Purge failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if id > 0 && purged == 0 {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "purged", "records": purged})
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultDrainBatchSize is the number of rows leased per drain batch
+	defaultDrainBatchSize = 500
+	// defaultDrainConcurrency bounds in-flight forwards per destination
+	defaultDrainConcurrency = 4
+	// drainLeaseSeconds is how long a leased batch is reserved before it can be leased again
+	drainLeaseSeconds = 300
+)
+
+// DrainProgress reports the state of the backlog drain
+type DrainProgress struct {
+	Running    bool    `json:"running"`
+	StartedAt  int64   `json:"started_at,omitempty"`
+	FinishedAt int64   `json:"finished_at,omitempty"`
+	Forwarded  int64   `json:"forwarded"`
+	Failed     int64   `json:"failed"`
+	Remaining  int64   `json:"remaining"`
+	RatePerSec float64 `json:"rate_per_sec"`
+	ETASeconds int64   `json:"eta_seconds"`
+}
+
+// drainCoordinator ensures only one drain runs at a time and tracks its progress
+type drainCoordinator struct {
+	mu       sync.Mutex
+	running  bool
+	rerun    bool
+	started  time.Time
+	progress DrainProgress
+}
+
+// begin claims the drain; if one is already running it asks that drain to
+// make another pass once it finishes and returns false
+func (d *drainCoordinator) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.running {
+		d.rerun = true
+		return false
+	}
+	d.running = true
+	return true
+}
+
+// finish releases the drain unless another pass was requested meanwhile
+func (d *drainCoordinator) finish() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.rerun {
+		d.rerun = false
+		return true
+	}
+	d.running = false
+	return false
+}
+
+func (d *drainCoordinator) start(remaining int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.started = time.Now()
+	d.progress = DrainProgress{Running: true, StartedAt: d.started.Unix(), Remaining: remaining}
+}
+
+func (d *drainCoordinator) advance(forwarded, failed int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := &d.progress
+	p.Forwarded += int64(forwarded)
+	p.Failed += int64(failed)
+	p.Remaining -= int64(forwarded)
+	if p.Remaining < 0 {
+		p.Remaining = 0
+	}
+	if elapsed := time.Since(d.started).Seconds(); elapsed > 0 {
+		p.RatePerSec = float64(p.Forwarded) / elapsed
+	}
+	if p.RatePerSec > 0 {
+		p.ETASeconds = int64(float64(p.Remaining) / p.RatePerSec)
+	}
+}
+
+func (d *drainCoordinator) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.progress.Running = false
+	d.progress.FinishedAt = time.Now().Unix()
+	d.progress.ETASeconds = 0
+}
+
+func (d *drainCoordinator) snapshot() DrainProgress {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.progress
+}
+
+// requestDrain starts a drain in the background, or schedules another pass of the running one
+func (bm *BufferManager) requestDrain() {
+	go bm.forwardBufferedRecords()
+}
+
+// forwardBufferedRecords drains the backlog until it is empty or destinations stop accepting records.
+// Only one drain runs at a time; concurrent calls fold into an extra pass of the running drain.
+func (bm *BufferManager) forwardBufferedRecords() {
+	if !bm.drain.begin() {
+		return
+	}
+	for {
+		bm.drainBacklog()
+		if !bm.drain.finish() {
+			return
+		}
+	}
+}
+
+// drainBacklog performs one full pass over the SQLite and segment-file backlogs.
+// Each round shares the batch between services by priority across both backends.
+func (bm *BufferManager) drainBacklog() {
+	logger.Info("Starting to forward buffered records")
+	bm.drain.start(bm.pendingCount())
+	defer bm.drain.stop()
+
+	batchSize := bm.config.DrainBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultDrainBatchSize
+	}
+
+	forwarded := 0
+	failing := make(map[string]bool) // data types whose destination stopped accepting records
+	stalled := make(map[string]bool) // services whose segment files made no progress this pass
+	for !bm.stopping() {
+		rows, err := bm.duePending(failing)
+		if err != nil {
+			logger.WithError(err).Error("Failed to count buffered records")
+			break
+		}
+		files := bm.segmentPending(stalled)
+		pending := make(map[string]int, len(rows)+len(files))
+		for service, n := range rows {
+			pending[service] += n
+		}
+		for service, n := range files {
+			pending[service] += n
+		}
+		shares := bm.drainShares(pending, batchSize)
+		if len(shares) == 0 {
+			break
+		}
+
+		// A service's share goes to its SQLite rows first, then to its segment files
+		rowShares := make(map[string]int)
+		fileShares := make(map[string]int)
+		for service, share := range shares {
+			n := min(share, rows[service])
+			if n > 0 {
+				rowShares[service] = n
+			}
+			if share > n && files[service] > 0 {
+				fileShares[service] = share - n
+			}
+		}
+
+		start := time.Now()
+		ok, failed := 0, 0
+		if len(rowShares) > 0 {
+			batch, err := bm.leaseShares(rowShares, failing)
+			if err != nil {
+				logger.WithError(err).Error("Failed to lease buffered records")
+				break
+			}
+			ok, failed = bm.forwardBatch(batch, failing)
+		}
+		fileOK, fileFailed := bm.forwardSegmentRecords(fileShares, stalled)
+		ok += fileOK
+		failed += fileFailed
+		bm.metrics.drainBatch.observe(time.Since(start).Seconds())
+		bm.drain.advance(ok, failed)
+		forwarded += ok
+		if ok == 0 {
+			// Nothing got through; leave the rest for the next pass
+			break
+		}
+	}
+
+	if forwarded > 0 {
+		logger.WithField("records", forwarded).Info("Forwarded buffered records")
+	}
+}
+
+// stopping reports whether the service is shutting down
+func (bm *BufferManager) stopping() bool {
+	select {
+	case <-bm.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// pendingCount returns how many records are waiting to be forwarded across all backends
+func (bm *BufferManager) pendingCount() int64 {
+	var pending int64
+	if err := bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending); err != nil {
+		logger.WithError(err).Warn("Failed to count pending records")
+	}
+	for _, store := range bm.segmentStoreList() {
+		pending += store.Stats().Pending
+	}
+	return pending
+}
+
+// dueFilter selects rows that are due for forwarding and not leased, skipping
+// data types listed in exclude
+func dueFilter(now int64, exclude map[string]bool) (string, []interface{}) {
+	where := "forwarded = 0 AND next_attempt_at <= ? AND lease_until <= ?"
+	args := []interface{}{now, now}
+	if len(exclude) > 0 {
+		placeholders := make([]string, 0, len(exclude))
+		for dataType := range exclude {
+			placeholders = append(placeholders, "?")
+			args = append(args, dataType)
+		}
+		where += fmt.Sprintf(" AND data_type NOT IN (%s)", strings.Join(placeholders, ", "))
+	}
+	return where, args
+}
+
+// duePending counts the rows due for forwarding by service
+func (bm *BufferManager) duePending(exclude map[string]bool) (map[string]int, error) {
+	where, args := dueFilter(time.Now().Unix(), exclude)
+	rows, err := bm.db.Query("SELECT service, COUNT(*) FROM telemetry_buffer WHERE "+where+" GROUP BY service", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pending := make(map[string]int)
+	for rows.Next() {
+		var service string
+		var count int
+		if err := rows.Scan(&service, &count); err != nil {
+			return nil, err
+		}
+		pending[service] = count
+	}
+	return pending, rows.Err()
+}
+
+// leaseBatch reserves up to size due records, skipping data types listed in exclude.
+// The batch is shared between services by priority, highest priority first.
+func (bm *BufferManager) leaseBatch(size int, exclude map[string]bool) ([]TelemetryRecord, error) {
+	pending, err := bm.duePending(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return bm.leaseShares(bm.drainShares(pending, size), exclude)
+}
+
+// leaseShares reserves up to shares[service] due records of each service,
+// oldest first, skipping data types listed in exclude
+func (bm *BufferManager) leaseShares(shares map[string]int, exclude map[string]bool) ([]TelemetryRecord, error) {
+	now := time.Now().Unix()
+	where, args := dueFilter(now, exclude)
+
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		SELECT id, service, timestamp, data_type, data_size, json_data, source_ip, codec, retry_count, batch_count
+		FROM telemetry_buffer
+		WHERE ` + where + ` AND service = ?
+		ORDER BY timestamp ASC
+		LIMIT ?
+	`
+
+	var batch []TelemetryRecord
+	for _, service := range bm.byPriority(mapKeys(shares)) {
+		serviceArgs := append(append([]interface{}{}, args...), service, shares[service])
+		rows, err := tx.Query(query, serviceArgs...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var record TelemetryRecord
+			if err := rows.Scan(&record.ID, &record.Service, &record.Timestamp, &record.DataType,
+				&record.DataSize, &record.JsonData, &record.SourceIP, &record.Codec, &record.RetryCount, &record.BatchCount); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			batch = append(batch, record)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	stmt, err := tx.Prepare("UPDATE telemetry_buffer SET lease_until = ? WHERE id = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	for _, record := range batch {
+		if _, err := stmt.Exec(now+drainLeaseSeconds, record.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return batch, tx.Commit()
+}
+
+// forwardBatch forwards a leased batch with bounded concurrency per destination, then
+// marks successes forwarded in a single transaction and schedules retries for failures
+func (bm *BufferManager) forwardBatch(batch []TelemetryRecord, failing map[string]bool) (int, int) {
+	groups := make(map[string][]TelemetryRecord)
+	for _, record := range batch {
+		groups[record.DataType] = append(groups[record.DataType], record)
+	}
+
+	type failure struct {
+		record TelemetryRecord
+		err    error
+	}
+
+	var mu sync.Mutex
+	var succeeded, released []int64
+	var failures []failure
+	var deadIDs []int64
+
+	var wg sync.WaitGroup
+	for dataType, records := range groups {
+		wg.Add(1)
+		go func(dataType string, records []TelemetryRecord) {
+			defer wg.Done()
+
+			// decode expands a stored payload in place; undecodable rows can never
+			// succeed, so they skip the retry schedule
+			decode := func(record *TelemetryRecord) bool {
+				if err := bm.decodeRecord(record); err != nil {
+					logger.WithError(err).WithField("id", record.ID).Warn("Dead-lettering undecodable record")
+					if err := bm.deadLetterBufferedRecord(record.ID, record.RetryCount, err.Error()); err != nil {
+						logger.WithError(err).WithField("id", record.ID).Error("Failed to dead-letter record")
+					}
+					mu.Lock()
+					deadIDs = append(deadIDs, record.ID)
+					mu.Unlock()
+					return false
+				}
+				return true
+			}
+
+			consecutive := 0
+			accepted := false
+			settle := func(record TelemetryRecord, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					consecutive = 0
+					accepted = true
+					succeeded = append(succeeded, record.ID)
+				case errors.Is(err, errNoDestination):
+					consecutive = maxConsecutiveFailures
+					released = append(released, record.ID)
+				case errors.Is(err, errRejected), errors.Is(err, errItemFailed):
+					// The destination answered, so it is not failing
+					logger.WithError(err).WithField("id", record.ID).Warn("Buffered record rejected by destination")
+					consecutive = 0
+					accepted = true
+					failures = append(failures, failure{record, err})
+				default:
+					logger.WithError(err).WithField("id", record.ID).Warn("Failed to forward buffered record")
+					consecutive++
+					failures = append(failures, failure{record, err})
+				}
+			}
+
+			// Batch-capable destinations take the whole group in one call
+			if fwd, ok := bm.getForwarder(dataType).(BatchForwarder); ok {
+				var decoded []TelemetryRecord
+				for _, record := range records {
+					if decode(&record) {
+						decoded = append(decoded, record)
+					}
+				}
+				for i, err := range bm.forwardBufferedBatch(fwd, decoded) {
+					settle(decoded[i], err)
+				}
+				if consecutive >= maxConsecutiveFailures {
+					mu.Lock()
+					failing[dataType] = true
+					mu.Unlock()
+				}
+				return
+			}
+
+			concurrency := bm.config.Destinations[dataType].Concurrency
+			if concurrency <= 0 {
+				concurrency = defaultDrainConcurrency
+			}
+			sem := make(chan struct{}, concurrency)
+			var groupWG sync.WaitGroup
+
+			for _, record := range records {
+				// Probe one record at a time until the destination accepts one,
+				// and again whenever it starts failing
+				mu.Lock()
+				serial := !accepted || consecutive > 0
+				mu.Unlock()
+				if serial {
+					groupWG.Wait()
+				}
+
+				mu.Lock()
+				stop := consecutive >= maxConsecutiveFailures
+				if stop {
+					released = append(released, record.ID)
+				}
+				mu.Unlock()
+				if stop {
+					continue
+				}
+
+				sem <- struct{}{}
+				groupWG.Add(1)
+				go func(record TelemetryRecord) {
+					defer groupWG.Done()
+					defer func() { <-sem }()
+
+					if decode(&record) {
+						settle(record, bm.forwardBuffered(record))
+					}
+				}(record)
+			}
+			groupWG.Wait()
+
+			if consecutive >= maxConsecutiveFailures {
+				mu.Lock()
+				failing[dataType] = true
+				mu.Unlock()
+			}
+		}(dataType, records)
+	}
+	wg.Wait()
+
+	if err := bm.markForwarded(succeeded); err != nil {
+		logger.WithError(err).Error("Failed to mark records as forwarded")
+	} else {
+		services := make(map[int64]string, len(batch))
+		for _, record := range batch {
+			services[record.ID] = record.Service
+		}
+		for _, id := range succeeded {
+			bm.quota.add(services[id], quotaUsage{Pending: -1})
+		}
+	}
+	for _, f := range failures {
+		if err := bm.recordForwardFailure(f.record, f.err); err != nil {
+			logger.WithError(err).WithField("id", f.record.ID).Error("Failed to record forward failure")
+		}
+	}
+	for _, f := range failures {
+		released = append(released, f.record.ID)
+	}
+	if err := bm.releaseLeases(released); err != nil {
+		logger.WithError(err).Error("Failed to release record leases")
+	}
+
+	return len(succeeded), len(failures) + len(deadIDs)
+}
+
+// forwardBufferedBatch forwards decoded rows through a batch forwarder in one
+// call, expanding batch blobs. It returns one error per row; a blob fails if
+// any of its members does, and is cut down to its failed members so a retry
+// does not send the others again.
+func (bm *BufferManager) forwardBufferedBatch(fwd BatchForwarder, records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	var members []TelemetryRecord
+	var owners []int
+	for i, record := range records {
+		if record.BatchCount == 0 {
+			members = append(members, record)
+			owners = append(owners, i)
+			continue
+		}
+		expanded, err := unbatchRecord(record)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		for _, member := range expanded {
+			members = append(members, member)
+			owners = append(owners, i)
+		}
+	}
+	if len(members) == 0 {
+		return errs
+	}
+
+	start := time.Now()
+	memberErrs := fwd.ForwardBatch(members)
+	bm.metrics.forwardLatency.observe(time.Since(start).Seconds(), members[0].DataType)
+	undelivered := make(map[int][]TelemetryRecord)
+	for i, err := range memberErrs {
+		member := members[i]
+		if err != nil {
+			bm.metrics.forwardFailures.add(1, member.Service, member.DataType)
+			if errs[owners[i]] == nil {
+				errs[owners[i]] = err
+			}
+			undelivered[owners[i]] = append(undelivered[owners[i]], member)
+			continue
+		}
+		bm.metrics.forwarded.add(1, member.Service, member.DataType)
+	}
+	for i, failed := range undelivered {
+		if blob := records[i]; blob.BatchCount > 0 && len(failed) < blob.BatchCount {
+			if err := bm.trimBatchBlob(blob, failed); err != nil {
+				logger.WithError(err).WithField("id", blob.ID).Warn("Failed to trim partly forwarded batch record")
+			}
+		}
+	}
+	return errs
+}
+
+// markForwarded flags records as forwarded in one transaction
+func (bm *BufferManager) markForwarded(ids []int64) error {
+	return bm.execForIDs("UPDATE telemetry_buffer SET forwarded = 1, lease_until = 0 WHERE id = ?", ids)
+}
+
+// releaseLeases makes records available to the next lease
+func (bm *BufferManager) releaseLeases(ids []int64) error {
+	return bm.execForIDs("UPDATE telemetry_buffer SET lease_until = 0 WHERE id = ?", ids)
+}
+
+// execForIDs runs a single-id statement for every id inside one transaction
+func (bm *BufferManager) execForIDs(query string, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
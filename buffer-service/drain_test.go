@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrainForwardsWholeBacklogInBatches(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.DrainBatchSize = 50
+
+	payloads := make([]string, 275)
+	for i := range payloads {
+		payloads[i] = fmt.Sprintf(`{"n":%d}`, i)
+	}
+	storeSyslog(t, bm, payloads...)
+	capture := useCapture(bm)
+
+	// Overlapping triggers must fold into the single running drain
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bm.forwardBufferedRecords()
+		}()
+	}
+	wg.Wait()
+	bm.forwardBufferedRecords()
+
+	got := capture.payloads()
+	seen := make(map[string]bool)
+	for _, p := range got {
+		if seen[p] {
+			t.Fatalf("record %s forwarded twice", p)
+		}
+		seen[p] = true
+	}
+	if len(seen) != len(payloads) {
+		t.Fatalf("forwarded %d of %d records", len(seen), len(payloads))
+	}
+
+	var pending, leased int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending)
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE lease_until > 0").Scan(&leased)
+	if pending != 0 || leased != 0 {
+		t.Fatalf("pending=%d leased=%d after drain", pending, leased)
+	}
+
+	rec := httptest.NewRecorder()
+	bm.handleStatus(rec, httptest.NewRequest("GET", "/api/buffer/status", nil))
+	var status struct {
+		Drain DrainProgress `json:"drain"`
+	}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if status.Drain.Running || status.Drain.Remaining != 0 || status.Drain.FinishedAt == 0 {
+		t.Fatalf("unexpected drain progress: %+v", status.Drain)
+	}
+}
+
+func TestLeaseBatchSkipsLeasedRows(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeSyslog(t, bm, `{"n":1}`, `{"n":2}`, `{"n":3}`)
+
+	first, err := bm.leaseBatch(2, nil)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("first lease: %d records, err %v", len(first), err)
+	}
+	second, err := bm.leaseBatch(2, nil)
+	if err != nil || len(second) != 1 || second[0].ID == first[0].ID || second[0].ID == first[1].ID {
+		t.Fatalf("second lease overlapped the first: %+v", second)
+	}
+
+	if err := bm.releaseLeases([]int64{first[0].ID}); err != nil {
+		t.Fatalf("releaseLeases: %v", err)
+	}
+	third, _ := bm.leaseBatch(2, nil)
+	if len(third) != 1 || third[0].ID != first[0].ID {
+		t.Fatalf("released row was not leased again: %+v", third)
+	}
+
+	if excluded, _ := bm.leaseBatch(10, map[string]bool{"syslog": true}); len(excluded) != 0 {
+		t.Fatalf("lease ignored excluded data type")
+	}
+}
+
+func TestDrain_SegmentFilesShareRoundsByPriorityAndConcurrency(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.DrainBatchSize = 10
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 40, 1000)
+	cfg := bm.config.Services["goflow2"]
+	cfg.BufferMode = "files"
+	bm.config.Services["goflow2"] = cfg
+	for i := 0; i < 40; i++ {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: int64(2000 + i), JsonData: `{"n":1}`}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var order []string
+	inFlight, maxInFlight := 0, 0
+	fwd := funcForwarder(func(r TelemetryRecord) error {
+		mu.Lock()
+		inFlight++
+		maxInFlight = max(maxInFlight, inFlight)
+		order = append(order, r.Service)
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return nil
+	})
+	bm.fwdMutex.Lock()
+	bm.forwarders = map[string]Forwarder{"metrics": fwd, "netflow": fwd}
+	bm.fwdMutex.Unlock()
+	bm.forwardBufferedRecords()
+
+	if len(order) != 80 {
+		t.Fatalf("forwarded %d of 80 records", len(order))
+	}
+	// goflow2 (priority 10) gets the larger share of the first round even
+	// though its records sit in segment files
+	first := 0
+	for _, service := range order[:10] {
+		if service == "goflow2" {
+			first++
+		}
+	}
+	if first < 5 {
+		t.Fatalf("goflow2 got %d of the first 10 forwards: %v", first, order[:10])
+	}
+	if maxInFlight < 2 {
+		t.Fatalf("segment records were forwarded one at a time")
+	}
+	if stats, _ := bm.files.Stats("goflow2"); stats.Pending != 0 {
+		t.Fatalf("%d segment records left pending", stats.Pending)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// elasticBatchBytes and elasticBatchDocs bound one _bulk request, within
+	// the 5-15MB Elastic recommends
+	elasticBatchBytes = 5 << 20
+	elasticBatchDocs  = 1000
+
+	defaultElasticIndex = "noc-raven-%{data_type}-%{+yyyy.MM.dd}"
+)
+
+var (
+	indexFieldPattern = regexp.MustCompile(`%\{([^}]+)\}`)
+	// indexDateLayout translates the Joda-style date patterns used by
+	// Logstash and Beats index settings to Go layouts
+	indexDateLayout = strings.NewReplacer("yyyy", "2006", "YYYY", "2006", "yy", "06", "MM", "01", "dd", "02", "HH", "15")
+)
+
+// isElastic reports whether a destination takes the Elasticsearch bulk API
+func isElastic(dest DestinationCfg) bool {
+	switch strings.ToLower(dest.Format) {
+	case "elasticsearch", "opensearch":
+		return true
+	}
+	return false
+}
+
+// elasticForwarder indexes buffered records into Elasticsearch or OpenSearch
+// through the _bulk API.
+//
+// Documents are indexed with create and an ID derived from the record, so a
+// document sent again after a partial failure is answered with a conflict
+// rather than indexed twice. Per-item errors fail only their own record.
+type elasticForwarder struct {
+	dataType  string
+	dest      DestinationCfg
+	url       string
+	index     string
+	appliance string
+	client    *http.Client
+}
+
+func newElasticForwarder(dataType string, dest DestinationCfg) (*elasticForwarder, error) {
+	path := dest.Path
+	if path == "" || path == "/" {
+		path = "/_bulk"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	index := dest.Index
+	if index == "" {
+		index = defaultElasticIndex
+	}
+	if name := renderIndex(index, TelemetryRecord{DataType: dataType, Service: "x"}); name == "" || name != strings.ToLower(name) {
+		return nil, fmt.Errorf("index %q must render to a lowercase name", index)
+	}
+	return &elasticForwarder{
+		dataType:  dataType,
+		dest:      dest,
+		url:       fmt.Sprintf("%s://%s%s", strings.ToLower(dest.Transport), net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)), path),
+		index:     index,
+		appliance: applianceID(),
+		client:    newHTTPClient(dest),
+	}, nil
+}
+
+// renderIndex fills in %{data_type}, %{service} and %{+<date pattern>}, the
+// date being the record's buffered time in UTC
+func renderIndex(template string, record TelemetryRecord) string {
+	return indexFieldPattern.ReplaceAllStringFunc(template, func(m string) string {
+		field := m[2 : len(m)-1]
+		switch {
+		case field == "data_type":
+			return record.DataType
+		case field == "service":
+			return record.Service
+		case strings.HasPrefix(field, "+"):
+			return time.Unix(record.Timestamp, 0).UTC().Format(indexDateLayout.Replace(field[1:]))
+		}
+		return m
+	})
+}
+
+func (f *elasticForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch sends the records in _bulk requests of up to elasticBatchDocs
+// documents or elasticBatchBytes
+func (f *elasticForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	var body bytes.Buffer
+	var pending []int
+	flush := func() {
+		if len(pending) > 0 {
+			f.bulk(body.Bytes(), pending, errs)
+		}
+		body.Reset()
+		pending = pending[:0]
+	}
+
+	for i, record := range records {
+		action, doc, err := f.document(record)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if len(pending) > 0 && (len(pending) >= elasticBatchDocs || body.Len()+len(action)+len(doc) > elasticBatchBytes) {
+			flush()
+		}
+		body.Write(action)
+		body.Write(doc)
+		pending = append(pending, i)
+	}
+	flush()
+	return errs
+}
+
+// document builds a record's action and source lines. The source is the
+// record's JSON object, or {"message": ...} for anything else, with
+// @timestamp added when missing and where the record came from under noc_raven.
+func (f *elasticForwarder) document(record TelemetryRecord) ([]byte, []byte, error) {
+	var doc map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(record.JsonData))
+	dec.UseNumber()
+	if dec.Decode(&doc) != nil || doc == nil {
+		doc = map[string]interface{}{"message": record.JsonData}
+	}
+	if _, ok := doc["@timestamp"]; !ok {
+		doc["@timestamp"] = time.Unix(record.Timestamp, 0).UTC().Format(time.RFC3339)
+	}
+	meta := map[string]interface{}{"appliance_id": f.appliance, "service": record.Service, "data_type": f.dataType}
+	if record.SourceIP != "" {
+		meta["source_ip"] = record.SourceIP
+	}
+	doc["noc_raven"] = meta
+
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256([]byte(record.Service + "\x00" + f.dataType + "\x00" + strconv.FormatInt(record.Timestamp, 10) + "\x00" + record.JsonData))
+	action, _ := json.Marshal(map[string]interface{}{"create": map[string]string{
+		"_index": renderIndex(f.index, TelemetryRecord{DataType: f.dataType, Service: record.Service, Timestamp: record.Timestamp}),
+		"_id":    base64.RawURLEncoding.EncodeToString(sum[:18]),
+	}})
+	return append(action, '\n'), append(source, '\n'), nil
+}
+
+// bulkResponse is the part of a _bulk response needed to settle each item
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends one request and sets the error of every document that failed.
+// Items answered 409 were indexed by an earlier attempt.
+func (f *elasticForwarder) bulk(body []byte, owners []int, errs []error) {
+	fail := func(err error) {
+		for _, i := range owners {
+			errs[i] = err
+		}
+	}
+
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		fail(err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.dest.Auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		fail(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && resp.StatusCode == http.StatusTooManyRequests {
+			err = &retryAfterError{err, after}
+		}
+		fail(err)
+		return
+	}
+
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		fail(fmt.Errorf("decode bulk response: %v", err))
+		return
+	}
+	if !result.Errors {
+		return
+	}
+	if len(result.Items) != len(owners) {
+		fail(fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(owners)))
+		return
+	}
+	for n, item := range result.Items {
+		for _, r := range item {
+			if r.Status < 300 || r.Status == http.StatusConflict {
+				continue
+			}
+			reason := http.StatusText(r.Status)
+			if r.Error != nil {
+				reason = r.Error.Type + ": " + r.Error.Reason
+			}
+			errs[owners[n]] = fmt.Errorf("%w: HTTP %d: %s", errItemFailed, r.Status, reason)
+		}
+	}
+}
+
+func (f *elasticForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRenderIndex_FillsFieldsAndDate(t *testing.T) {
+	record := TelemetryRecord{DataType: "windows_events", Service: "vector", Timestamp: 1735732800} // 2025-01-01T12:00:00Z
+	for template, want := range map[string]string{
+		defaultElasticIndex:                       "noc-raven-windows_events-2025.01.01",
+		"siem-%{service}-%{+yyyy.MM}":             "siem-vector-2025.01",
+		"logs-%{+YYYY-MM-dd-HH}-%{unknown}-fixed": "logs-2025-01-01-12-%{unknown}-fixed",
+	} {
+		if got := renderIndex(template, record); got != want {
+			t.Fatalf("renderIndex(%q) = %q, want %q", template, got, want)
+		}
+	}
+	if _, err := newElasticForwarder("syslog", DestinationCfg{Host: "es", Port: 9200, Transport: "https", Index: "Logs-%{data_type}"}); err == nil {
+		t.Fatal("expected error for an index with capitals")
+	}
+}
+
+func TestElasticForwarder_OnlyFailedItemsStayPending(t *testing.T) {
+	var actions []map[string]map[string]string
+	var docs []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Content-Type") != "application/x-ndjson" || r.Header.Get("Authorization") != "ApiKey c2VjcmV0" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			json.Unmarshal(scanner.Bytes(), &action)
+			scanner.Scan()
+			var doc map[string]interface{}
+			json.Unmarshal(scanner.Bytes(), &doc)
+			actions, docs = append(actions, action), append(docs, doc)
+
+			switch {
+			case strings.Contains(scanner.Text(), "bad mapping"):
+				items = append(items, `{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [n]"}}}`)
+			case strings.Contains(scanner.Text(), "already indexed"):
+				items = append(items, `{"create":{"status":409,"error":{"type":"version_conflict_engine_exception"}}}`)
+			default:
+				items = append(items, `{"create":{"status":201}}`)
+			}
+		}
+		w.Write([]byte(`{"took":3,"errors":true,"items":[` + strings.Join(items, ",") + `]}`))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	fwd, err := newForwarder("syslog", DestinationCfg{
+		Host: u.Hostname(), Port: port, Transport: "http", Format: "opensearch", Auth: AuthCfg{Type: "apikey", Token: "c2VjcmV0"},
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	bm := newTestBufferManager(t, "")
+	useForwarder(bm, fwd)
+	storeSyslog(t, bm, `{"message":"ok"}`, `{"message":"bad mapping"}`, `{"message":"already indexed"}`, `plain text`)
+
+	bm.forwardBufferedRecords()
+
+	var forwarded, pending, retries int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 1").Scan(&forwarded)
+	bm.db.QueryRow("SELECT COUNT(*), MAX(retry_count) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending, &retries)
+	if forwarded != 3 || pending != 1 || retries != 1 {
+		t.Fatalf("forwarded=%d pending=%d retries=%d, want only the failed document pending", forwarded, pending, retries)
+	}
+	var lastError string
+	bm.db.QueryRow("SELECT last_error FROM telemetry_buffer WHERE forwarded = 0").Scan(&lastError)
+	if !strings.Contains(lastError, "mapper_parsing_exception") {
+		t.Fatalf("last_error = %q", lastError)
+	}
+
+	create := actions[0]["create"]
+	if create["_index"] != "noc-raven-syslog-1970.01.01" || create["_id"] == "" || create["_id"] == actions[1]["create"]["_id"] {
+		t.Fatalf("unexpected action %v", actions[0])
+	}
+	if docs[3]["message"] != "plain text" || docs[0]["@timestamp"] != "1970-01-01T00:16:40Z" || docs[0]["noc_raven"].(map[string]interface{})["service"] != "fluent-bit" {
+		t.Fatalf("unexpected documents %v", docs)
+	}
+}
@@ -0,0 +1,228 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTemplateTimeout is how long a v9 or IPFIX template stays usable
+// without being refreshed by its exporter
+const DefaultTemplateTimeout = 30 * time.Minute
+
+// templateField is one field specifier of a v9 or IPFIX template
+type templateField struct {
+	id         uint16
+	length     uint16 // 65535 = variable length (IPFIX)
+	enterprise uint32
+}
+
+// template describes the layout of data records in a data set
+type template struct {
+	fields    []templateField
+	options   bool
+	minLength int // bytes of the smallest possible record
+	updated   time.Time
+}
+
+// templateKey scopes a template to the exporter and observation domain that sent it
+type templateKey struct {
+	exporter string
+	version  uint16
+	domain   uint32
+	id       uint16
+}
+
+// streamKey identifies one exporter's observation domain
+type streamKey struct {
+	exporter string
+	protocol string
+	version  uint16
+	domain   uint32
+}
+
+// streamState is the per-domain sequence and sampling state
+type streamState struct {
+	stats        ExporterStats
+	expected     uint32
+	haveExpected bool
+}
+
+// ExporterStats reports decoding counters for one exporter observation domain
+type ExporterStats struct {
+	Exporter            string    `json:"exporter"`
+	Protocol            string    `json:"protocol"` // "netflow", "ipfix" or "sflow"
+	Version             int       `json:"version"`
+	ObservationDomain   uint32    `json:"observation_domain"`
+	Packets             uint64    `json:"packets"`
+	Records             uint64    `json:"records"`
+	Templates           int       `json:"templates"`
+	TemplateUpdates     uint64    `json:"template_updates"`
+	TemplatesExpired    uint64    `json:"templates_expired"`
+	MissingTemplateSets uint64    `json:"missing_template_sets"` // data sets dropped before their template arrived
+	SequenceGaps        uint64    `json:"sequence_gaps"`
+	SequenceLost        uint64    `json:"sequence_lost"` // records (v5, IPFIX) or packets (v9) skipped per the sequence numbers
+	LastSequence        uint32    `json:"last_sequence"`
+	SamplingRate        uint32    `json:"sampling_rate,omitempty"` // from options data
+	LastSeen            time.Time `json:"last_seen"`
+}
+
+// Stats is a snapshot of the decoder's counters
+type Stats struct {
+	Exporters    []ExporterStats `json:"exporters"`
+	Templates    int             `json:"templates"`
+	DecodeErrors uint64          `json:"decode_errors"`
+}
+
+// Decoder decodes export packets, caching templates per exporter and
+// observation domain. It is safe for concurrent use.
+type Decoder struct {
+	mu           sync.Mutex
+	timeout      time.Duration
+	templates    map[templateKey]*template
+	streams      map[streamKey]*streamState
+	decodeErrors uint64
+}
+
+// NewDecoder returns a decoder whose templates expire after timeout (0 = DefaultTemplateTimeout)
+func NewDecoder(timeout time.Duration) *Decoder {
+	d := &Decoder{templates: make(map[templateKey]*template), streams: make(map[streamKey]*streamState)}
+	d.SetTemplateTimeout(timeout)
+	return d
+}
+
+// SetTemplateTimeout changes how long templates live without a refresh
+func (d *Decoder) SetTemplateTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultTemplateTimeout
+	}
+	d.mu.Lock()
+	d.timeout = timeout
+	d.mu.Unlock()
+}
+
+// Decode decodes one export packet received from exporter
+func (d *Decoder) Decode(exporter string, b []byte, now time.Time) ([]Record, error) {
+	if len(b) < 2 {
+		return nil, ErrTruncated
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var records []Record
+	var err error
+	switch version := u16(b); version {
+	case 5:
+		records, err = d.decodeV5(exporter, b, now)
+	case 9:
+		records, err = d.decodeV9(exporter, b, now)
+	case 10:
+		records, err = d.decodeIPFIX(exporter, b, now)
+	default:
+		err = fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if err != nil {
+		d.decodeErrors++
+	}
+	return records, err
+}
+
+// stream returns the state for an exporter's observation domain, counting the packet
+func (d *Decoder) stream(exporter, protocol string, version uint16, domain uint32, now time.Time) *streamState {
+	key := streamKey{exporter, protocol, version, domain}
+	s := d.streams[key]
+	if s == nil {
+		s = &streamState{stats: ExporterStats{Exporter: exporter, Protocol: protocol, Version: int(version), ObservationDomain: domain}}
+		d.streams[key] = s
+	}
+	s.stats.Packets++
+	s.stats.LastSeen = now
+	return s
+}
+
+// checkSequence compares seq with the value expected from the previous packet
+// and sets the expectation for the next one. A known=false expectation is used
+// when the next value cannot be computed, e.g. after unknown data sets.
+func (s *streamState) checkSequence(seq, next uint32, known bool) {
+	if s.haveExpected && seq != s.expected {
+		s.stats.SequenceGaps++
+		// A backwards jump is a restart or reordering, not loss
+		if lost := seq - s.expected; lost < 1<<31 {
+			s.stats.SequenceLost += uint64(lost)
+		}
+	}
+	s.expected, s.haveExpected = next, known
+	s.stats.LastSequence = seq
+}
+
+// lookup returns a live template, expiring it when it has not been refreshed
+func (d *Decoder) lookup(key templateKey, s *streamState, now time.Time) *template {
+	t := d.templates[key]
+	if t == nil {
+		return nil
+	}
+	if now.Sub(t.updated) > d.timeout {
+		delete(d.templates, key)
+		s.stats.TemplatesExpired++
+		return nil
+	}
+	return t
+}
+
+// store caches a template, or withdraws it when it has no fields
+func (d *Decoder) store(key templateKey, t *template, s *streamState) {
+	if len(t.fields) == 0 {
+		delete(d.templates, key)
+		return
+	}
+	for _, f := range t.fields {
+		if f.length == variableLength {
+			t.minLength++
+		} else {
+			t.minLength += int(f.length)
+		}
+	}
+	d.templates[key] = t
+	s.stats.TemplateUpdates++
+}
+
+// withdrawAll drops every template an observation domain has sent
+func (d *Decoder) withdrawAll(ctx exportContext) {
+	for key := range d.templates {
+		if key.exporter == ctx.exporter && key.version == ctx.version && key.domain == ctx.domain {
+			delete(d.templates, key)
+		}
+	}
+}
+
+// Stats returns a snapshot of the per-exporter counters
+func (d *Decoder) Stats() Stats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counts := make(map[streamKey]int)
+	for key := range d.templates {
+		counts[streamKey{key.exporter, protocolOf(key.version), key.version, key.domain}]++
+	}
+	stats := Stats{Templates: len(d.templates), DecodeErrors: d.decodeErrors, Exporters: []ExporterStats{}}
+	for key, s := range d.streams {
+		es := s.stats
+		es.Templates = counts[key]
+		stats.Exporters = append(stats.Exporters, es)
+	}
+	sort.Slice(stats.Exporters, func(i, j int) bool {
+		a, b := stats.Exporters[i], stats.Exporters[j]
+		if a.Exporter != b.Exporter {
+			return a.Exporter < b.Exporter
+		}
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.ObservationDomain < b.ObservationDomain
+	})
+	return stats
+}
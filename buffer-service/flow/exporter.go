@@ -0,0 +1,404 @@
+package flow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Export versions accepted by NewExporter
+const (
+	ExportV9    = 9
+	ExportIPFIX = 10
+)
+
+const (
+	// DefaultMaxMessageSize keeps export packets under a typical path MTU
+	DefaultMaxMessageSize = 1400
+	// DefaultTemplateRefresh is how often templates are resent over UDP
+	DefaultTemplateRefresh = time.Minute
+
+	ieExporterIPv4Address = 130
+	ieExporterIPv6Address = 131
+
+	// uptimeHeadroom places the v9 sysUpTime origin far enough back that
+	// buffered flows from earlier days still get non-negative uptimes
+	uptimeHeadroom = 12 * 24 * time.Hour
+	// uptimeLimit is when the origin moves forward again, before sysUpTime
+	// passes 2^31 ms (about 24.9 days) and collectors read it as wrapped
+	uptimeLimit = 24 * 24 * time.Hour
+)
+
+// ExportOptions configures an Exporter
+type ExportOptions struct {
+	Version         int           // ExportV9 or ExportIPFIX
+	DomainID        uint32        // v9 source ID or IPFIX observation domain
+	MaxMessageSize  int           // bytes per export packet, default DefaultMaxMessageSize
+	TemplateRefresh time.Duration // default DefaultTemplateRefresh
+}
+
+// Message is one encoded export packet
+type Message struct {
+	Data    []byte
+	Records []int // indexes of the records it carries, as passed to Encode
+}
+
+// exportField writes one information element of a record
+type exportField struct {
+	id     uint16
+	length uint16
+	put    func(b []byte, r *Record, boot int64)
+}
+
+// shape selects the template a record is exported with
+type shape struct {
+	family         int // 4 or 6
+	exporterFamily int // 0 when the exporter is not an address
+	l2             bool
+	sampled        bool
+}
+
+// exportTemplate is a template the exporter has defined
+type exportTemplate struct {
+	id       uint16
+	fields   []exportField
+	length   int // bytes per data record
+	record   []byte
+	lastSent time.Time
+}
+
+// Exporter encodes normalized records as NetFlow v9 or IPFIX, keeping
+// sequence numbers and template refresh state between calls
+type Exporter struct {
+	mu        sync.Mutex
+	opts      ExportOptions
+	boot      int64 // sysUpTime origin in unix ms (v9)
+	sequence  uint32
+	templates map[shape]*exportTemplate
+	nextID    uint16
+}
+
+// NewExporter returns an exporter for opts.Version
+func NewExporter(opts ExportOptions) (*Exporter, error) {
+	if opts.Version != ExportV9 && opts.Version != ExportIPFIX {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, opts.Version)
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if opts.TemplateRefresh <= 0 {
+		opts.TemplateRefresh = DefaultTemplateRefresh
+	}
+	return &Exporter{
+		opts:      opts,
+		boot:      millis(time.Now().Add(-uptimeHeadroom)),
+		templates: make(map[shape]*exportTemplate),
+		nextID:    256,
+	}, nil
+}
+
+// Encode packs records into export messages. Templates are sent ahead of their
+// first data set and again once TemplateRefresh has passed.
+func (e *Exporter) Encode(records []Record, now time.Time) []Message {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rebase(now)
+	var messages []Message
+	m := e.newMessage()
+	for i := range records {
+		r := &records[i]
+		t := e.template(shapeOf(r))
+		announce := now.Sub(t.lastSent) >= e.opts.TemplateRefresh && !m.announced(t)
+		if len(m.records) > 0 && !m.fits(t, announce, e.opts.MaxMessageSize) {
+			messages = append(messages, e.finish(m, now))
+			m = e.newMessage()
+			announce = now.Sub(t.lastSent) >= e.opts.TemplateRefresh
+		}
+		m.add(t, r, i, announce, e.boot)
+	}
+	if len(m.records) > 0 {
+		messages = append(messages, e.finish(m, now))
+	}
+	return messages
+}
+
+// rebase moves the v9 sysUpTime origin forward once uptimes reach
+// uptimeLimit. Collectors take the lower uptime for an exporter restart, so
+// sequencing starts over and every template is sent again.
+func (e *Exporter) rebase(now time.Time) {
+	if e.opts.Version != ExportV9 || millis(now)-e.boot < uptimeLimit.Milliseconds() {
+		return
+	}
+	e.boot = millis(now.Add(-uptimeHeadroom))
+	e.sequence = 0
+	for _, t := range e.templates {
+		t.lastSent = time.Time{}
+	}
+}
+
+// pendingMessage is an export message being assembled
+type pendingMessage struct {
+	templates []*exportTemplate
+	sets      []*pendingSet
+	records   []int
+	size      int
+}
+
+type pendingSet struct {
+	template *exportTemplate
+	data     []byte
+	count    int
+}
+
+func (e *Exporter) newMessage() *pendingMessage {
+	header := ipfixHeaderLen
+	if e.opts.Version == ExportV9 {
+		header = v9HeaderLen
+	}
+	return &pendingMessage{size: header}
+}
+
+func (m *pendingMessage) announced(t *exportTemplate) bool {
+	for _, a := range m.templates {
+		if a == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *pendingMessage) set(t *exportTemplate) *pendingSet {
+	for _, s := range m.sets {
+		if s.template == t {
+			return s
+		}
+	}
+	return nil
+}
+
+// fits reports whether one more record of t still fits the size limit
+func (m *pendingMessage) fits(t *exportTemplate, withTemplate bool, limit int) bool {
+	size := m.size + t.length
+	if m.set(t) == nil {
+		size += setHeaderLen
+	}
+	if withTemplate {
+		size += len(t.record)
+		if len(m.templates) == 0 {
+			size += setHeaderLen
+		}
+	}
+	return size <= limit
+}
+
+func (m *pendingMessage) add(t *exportTemplate, r *Record, index int, announce bool, boot int64) {
+	if announce {
+		if len(m.templates) == 0 {
+			m.size += setHeaderLen
+		}
+		m.templates = append(m.templates, t)
+		m.size += len(t.record)
+	}
+	s := m.set(t)
+	if s == nil {
+		s = &pendingSet{template: t}
+		m.sets = append(m.sets, s)
+		m.size += setHeaderLen
+	}
+	off := len(s.data)
+	s.data = append(s.data, make([]byte, t.length)...)
+	b := s.data[off:]
+	for _, f := range t.fields {
+		f.put(b[:f.length], r, boot)
+		b = b[f.length:]
+	}
+	s.count++
+	m.size += t.length
+	m.records = append(m.records, index)
+}
+
+// finish writes the header, template set and data sets of a message
+func (e *Exporter) finish(m *pendingMessage, now time.Time) Message {
+	var body []byte
+	count := 0
+	if len(m.templates) > 0 {
+		setID := uint16(2)
+		if e.opts.Version == ExportV9 {
+			setID = 0
+		}
+		var records []byte
+		for _, t := range m.templates {
+			records = append(records, t.record...)
+			t.lastSent = now
+		}
+		body = appendSet(body, setID, records)
+		count += len(m.templates)
+	}
+	dataRecords := 0
+	for _, s := range m.sets {
+		body = appendSet(body, s.template.id, s.data)
+		dataRecords += s.count
+	}
+	count += dataRecords
+
+	var header []byte
+	secs := uint32(now.Unix())
+	if e.opts.Version == ExportV9 {
+		// v9 sequence counts packets; uptime is chosen so collectors recover boot exactly
+		header = binary.BigEndian.AppendUint16(nil, ExportV9)
+		header = binary.BigEndian.AppendUint16(header, uint16(count))
+		header = binary.BigEndian.AppendUint32(header, uint32(int64(secs)*1000-e.boot))
+		header = binary.BigEndian.AppendUint32(header, secs)
+		header = binary.BigEndian.AppendUint32(header, e.sequence)
+		header = binary.BigEndian.AppendUint32(header, e.opts.DomainID)
+		e.sequence++
+	} else {
+		// IPFIX sequence counts data records sent before this message
+		header = binary.BigEndian.AppendUint16(nil, ExportIPFIX)
+		header = binary.BigEndian.AppendUint16(header, uint16(ipfixHeaderLen+len(body)))
+		header = binary.BigEndian.AppendUint32(header, secs)
+		header = binary.BigEndian.AppendUint32(header, e.sequence)
+		header = binary.BigEndian.AppendUint32(header, e.opts.DomainID)
+		e.sequence += uint32(dataRecords)
+	}
+	return Message{Data: append(header, body...), Records: m.records}
+}
+
+func appendSet(b []byte, id uint16, records []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, id)
+	b = binary.BigEndian.AppendUint16(b, uint16(setHeaderLen+len(records)))
+	return append(b, records...)
+}
+
+// shapeOf picks the template shape for a record
+func shapeOf(r *Record) shape {
+	s := shape{family: 4, l2: r.SrcMAC != "" || r.DstMAC != "" || r.VLAN != 0}
+	if ip := net.ParseIP(r.SrcIP); ip != nil && ip.To4() == nil {
+		s.family = 6
+	} else if ip == nil {
+		if ip := net.ParseIP(r.DstIP); ip != nil && ip.To4() == nil {
+			s.family = 6
+		}
+	}
+	if ip := net.ParseIP(r.Exporter); ip != nil {
+		s.exporterFamily = 6
+		if ip.To4() != nil {
+			s.exporterFamily = 4
+		}
+	}
+	// sFlow estimates are already scaled, so only NetFlow/IPFIX carry a sampling interval
+	s.sampled = r.SamplingRate > 1 && r.FlowType != TypeSFlow
+	return s
+}
+
+// template returns the template for a shape, defining it on first use
+func (e *Exporter) template(s shape) *exportTemplate {
+	if t, ok := e.templates[s]; ok {
+		return t
+	}
+	fields := []exportField{
+		{ieOctetDeltaCount, 8, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint64(b, r.Bytes) }},
+		{iePacketDeltaCount, 8, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint64(b, r.Packets) }},
+		{ieProtocolIdentifier, 1, func(b []byte, r *Record, _ int64) { b[0] = r.Protocol }},
+		{ieIPClassOfService, 1, func(b []byte, r *Record, _ int64) { b[0] = r.TOS }},
+		{ieTCPControlBits, 1, func(b []byte, r *Record, _ int64) { b[0] = r.TCPFlags }},
+		{ieSourceTransportPort, 2, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint16(b, r.SrcPort) }},
+		{ieDestinationTransportPort, 2, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint16(b, r.DstPort) }},
+		{ieIngressInterface, 4, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint32(b, r.InIf) }},
+		{ieEgressInterface, 4, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint32(b, r.OutIf) }},
+		{ieBGPSourceASNumber, 4, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint32(b, r.SrcAS) }},
+		{ieBGPDestinationASNumber, 4, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint32(b, r.DstAS) }},
+	}
+	if s.family == 6 {
+		fields = append(fields,
+			exportField{ieSourceIPv6Address, 16, func(b []byte, r *Record, _ int64) { putIP(b, r.SrcIP) }},
+			exportField{ieDestinationIPv6Address, 16, func(b []byte, r *Record, _ int64) { putIP(b, r.DstIP) }},
+			exportField{ieIPNextHopIPv6Address, 16, func(b []byte, r *Record, _ int64) { putIP(b, r.NextHop) }},
+			exportField{ieSourceIPv6PrefixLength, 1, func(b []byte, r *Record, _ int64) { b[0] = r.SrcMask }},
+			exportField{ieDestIPv6PrefixLength, 1, func(b []byte, r *Record, _ int64) { b[0] = r.DstMask }},
+		)
+	} else {
+		fields = append(fields,
+			exportField{ieSourceIPv4Address, 4, func(b []byte, r *Record, _ int64) { putIP(b, r.SrcIP) }},
+			exportField{ieDestinationIPv4Address, 4, func(b []byte, r *Record, _ int64) { putIP(b, r.DstIP) }},
+			exportField{ieIPNextHopIPv4Address, 4, func(b []byte, r *Record, _ int64) { putIP(b, r.NextHop) }},
+			exportField{ieSourceIPv4PrefixLength, 1, func(b []byte, r *Record, _ int64) { b[0] = r.SrcMask }},
+			exportField{ieDestIPv4PrefixLength, 1, func(b []byte, r *Record, _ int64) { b[0] = r.DstMask }},
+		)
+	}
+	if s.l2 {
+		fields = append(fields,
+			exportField{ieSourceMacAddress, 6, func(b []byte, r *Record, _ int64) { putMAC(b, r.SrcMAC) }},
+			exportField{ieDestinationMacAddress, 6, func(b []byte, r *Record, _ int64) { putMAC(b, r.DstMAC) }},
+			exportField{ieVlanID, 2, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint16(b, r.VLAN) }},
+		)
+	}
+	if s.sampled {
+		fields = append(fields, exportField{ieSamplingInterval, 4, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint32(b, r.SamplingRate) }})
+	}
+	// the original exporter, since the upstream sees buffer-service as the source
+	switch s.exporterFamily {
+	case 4:
+		fields = append(fields, exportField{ieExporterIPv4Address, 4, func(b []byte, r *Record, _ int64) { putIP(b, r.Exporter) }})
+	case 6:
+		fields = append(fields, exportField{ieExporterIPv6Address, 16, func(b []byte, r *Record, _ int64) { putIP(b, r.Exporter) }})
+	}
+	if e.opts.Version == ExportV9 {
+		fields = append(fields,
+			exportField{ieFlowStartSysUpTime, 4, func(b []byte, r *Record, boot int64) { binary.BigEndian.PutUint32(b, uptime(r.StartTime, boot)) }},
+			exportField{ieFlowEndSysUpTime, 4, func(b []byte, r *Record, boot int64) { binary.BigEndian.PutUint32(b, uptime(r.EndTime, boot)) }},
+		)
+	} else {
+		fields = append(fields,
+			exportField{ieFlowStartMilliseconds, 8, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint64(b, uint64(r.StartTime)) }},
+			exportField{ieFlowEndMilliseconds, 8, func(b []byte, r *Record, _ int64) { binary.BigEndian.PutUint64(b, uint64(r.EndTime)) }},
+		)
+	}
+
+	t := &exportTemplate{id: e.nextID, fields: fields}
+	e.nextID++
+	t.record = binary.BigEndian.AppendUint16(nil, t.id)
+	t.record = binary.BigEndian.AppendUint16(t.record, uint16(len(fields)))
+	for _, f := range fields {
+		t.record = binary.BigEndian.AppendUint16(t.record, f.id)
+		t.record = binary.BigEndian.AppendUint16(t.record, f.length)
+		t.length += int(f.length)
+	}
+	e.templates[s] = t
+	return t
+}
+
+// putIP writes an address into a 4 or 16 byte field, leaving it zero when absent
+func putIP(b []byte, s string) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return
+	}
+	if len(b) == net.IPv4len {
+		if v4 := ip.To4(); v4 != nil {
+			copy(b, v4)
+		}
+		return
+	}
+	if ip.To4() == nil {
+		copy(b, ip.To16())
+	}
+}
+
+func putMAC(b []byte, s string) {
+	if mac, err := net.ParseMAC(s); err == nil && len(mac) == len(b) {
+		copy(b, mac)
+	}
+}
+
+// uptime converts unix ms to v9 sysUpTime relative to boot, clamping times
+// before boot to zero
+func uptime(ms, boot int64) uint32 {
+	if ms <= boot {
+		return 0
+	}
+	return uint32(ms - boot)
+}
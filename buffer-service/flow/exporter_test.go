@@ -0,0 +1,154 @@
+package flow
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func exportFixtures(now time.Time) []Record {
+	start, end := millis(now.Add(-2*time.Hour)), millis(now.Add(-2*time.Hour+30*time.Second))
+	return []Record{
+		{
+			FlowType: TypeNetFlowV9, Exporter: "192.0.2.1", SrcIP: "10.0.0.1", DstIP: "192.0.2.80", NextHop: "10.0.0.254",
+			SrcPort: 40000, DstPort: 443, Protocol: 6, TCPFlags: 0x1b, TOS: 8, Bytes: 9000, Packets: 12,
+			InIf: 3, OutIf: 4, SrcAS: 64512, DstAS: 15169, SrcMask: 24, DstMask: 32, SamplingRate: 100,
+			StartTime: start, EndTime: end,
+		},
+		{
+			FlowType: TypeIPFIX, Exporter: "2001:db8::1", SrcIP: "2001:db8:1::10", DstIP: "2001:db8:2::20",
+			SrcPort: 5353, DstPort: 53, Protocol: 17, Bytes: 200, Packets: 2, SrcMask: 64,
+			SrcMAC: "00:11:22:33:44:55", DstMAC: "66:77:88:99:aa:bb", VLAN: 10,
+			StartTime: start, EndTime: end,
+		},
+		{
+			FlowType: TypeSFlow, Exporter: "192.0.2.9", SrcIP: "10.1.1.1", DstIP: "10.2.2.2", Protocol: 1,
+			Bytes: 64000, Packets: 1000, SamplingRate: 1000, StartTime: start, EndTime: start,
+		},
+	}
+}
+
+func TestExporter_RoundTripsThroughDecoder(t *testing.T) {
+	now := time.Now()
+	for _, version := range []int{ExportV9, ExportIPFIX} {
+		e, err := NewExporter(ExportOptions{Version: version, DomainID: 7})
+		if err != nil {
+			t.Fatalf("NewExporter: %v", err)
+		}
+		want := exportFixtures(now)
+		messages := e.Encode(want, now)
+		if len(messages) != 1 || len(messages[0].Records) != len(want) {
+			t.Fatalf("v%d: %d messages", version, len(messages))
+		}
+
+		d := NewDecoder(0)
+		got, err := d.Decode("198.51.100.1", messages[0].Data, now)
+		if err != nil || len(got) != len(want) {
+			t.Fatalf("v%d: decoded %d records: %v", version, len(got), err)
+		}
+		for i, g := range got {
+			w := want[i]
+			// The decoder reports the export protocol and the sender it heard
+			w.FlowType, w.Exporter, g.Sequence, g.ObservationDomain = g.FlowType, g.Exporter, 0, 0
+			if w.NextHop == "" && (g.NextHop == "0.0.0.0" || g.NextHop == "::") {
+				w.NextHop = g.NextHop
+			}
+			if w.FlowType == TypeSFlow || g.SamplingRate == 0 {
+				w.SamplingRate = g.SamplingRate
+			}
+			if g != w {
+				t.Errorf("v%d record %d\n got %+v\nwant %+v", version, i, g, w)
+			}
+		}
+		if got[2].SamplingRate != 0 {
+			t.Errorf("v%d: sFlow estimate exported with sampling interval %d", version, got[2].SamplingRate)
+		}
+	}
+}
+
+func TestExporter_SplitsMessagesKeepsSequenceAndRefreshesTemplates(t *testing.T) {
+	now := time.Now()
+	for _, version := range []int{ExportV9, ExportIPFIX} {
+		e, _ := NewExporter(ExportOptions{Version: version, MaxMessageSize: 512, TemplateRefresh: time.Minute})
+		records := make([]Record, 50)
+		for i := range records {
+			records[i] = Record{SrcIP: "10.0.0.1", DstIP: "10.0.0.2", SrcPort: uint16(i), Bytes: 1, Packets: 1, StartTime: millis(now), EndTime: millis(now)}
+		}
+
+		d := NewDecoder(0)
+		decoded := 0
+		for _, batch := range [][]Record{records[:30], records[30:]} {
+			for _, m := range e.Encode(batch, now) {
+				if len(m.Data) > 512 {
+					t.Fatalf("v%d: message of %d bytes", version, len(m.Data))
+				}
+				got, err := d.Decode("198.51.100.1", m.Data, now)
+				if err != nil {
+					t.Fatalf("v%d: decode: %v", version, err)
+				}
+				decoded += len(got)
+			}
+		}
+		if decoded != len(records) {
+			t.Fatalf("v%d: decoded %d of %d records", version, decoded, len(records))
+		}
+		es := d.Stats().Exporters[0]
+		if es.SequenceGaps != 0 || es.MissingTemplateSets != 0 {
+			t.Fatalf("v%d: unexpected stats %+v", version, es)
+		}
+
+		// Templates lead the first message and return once the refresh interval passes
+		header := ipfixHeaderLen
+		if version == ExportV9 {
+			header = v9HeaderLen
+		}
+		firstSet := func(m Message) uint16 { return u16(m.Data[header:]) }
+		if id := firstSet(e.Encode(records[:1], now.Add(30*time.Second))[0]); id < 256 {
+			t.Fatalf("v%d: template resent before the refresh interval", version)
+		}
+		if id := firstSet(e.Encode(records[:1], now.Add(2*time.Minute))[0]); id >= 256 {
+			t.Fatalf("v%d: template not refreshed, first set %d", version, id)
+		}
+	}
+}
+
+func TestExporter_V9RebasesUptimeBeforeItWraps(t *testing.T) {
+	now := time.Now()
+	e, _ := NewExporter(ExportOptions{Version: ExportV9})
+	e.Encode(exportFixtures(now), now)
+	e.Encode(exportFixtures(now), now)
+
+	// 30 days on, the original origin would put sysUpTime past 2^32 ms
+	later := now.Add(30 * 24 * time.Hour)
+	want := exportFixtures(later)
+	messages := e.Encode(want, later)
+	if len(messages) != 1 {
+		t.Fatalf("%d messages", len(messages))
+	}
+	data := messages[0].Data
+	if up := u32(data[4:]); up >= 1<<31 {
+		t.Fatalf("sysUpTime %d ms has wrapped", up)
+	}
+	if seq := u32(data[12:]); seq != 0 {
+		t.Fatalf("sequence %d, want a restart at 0", seq)
+	}
+	if id := u16(data[v9HeaderLen:]); id != 0 {
+		t.Fatalf("first set %d, want the templates resent", id)
+	}
+
+	got, err := NewDecoder(0).Decode("198.51.100.1", data, later)
+	if err != nil || len(got) != len(want) {
+		t.Fatalf("decoded %d records: %v", len(got), err)
+	}
+	for i, g := range got {
+		if g.StartTime != want[i].StartTime || g.EndTime != want[i].EndTime {
+			t.Errorf("record %d: times %d-%d, want %d-%d", i, g.StartTime, g.EndTime, want[i].StartTime, want[i].EndTime)
+		}
+	}
+}
+
+func TestNewExporter_RejectsOtherVersions(t *testing.T) {
+	if _, err := NewExporter(ExportOptions{Version: 5}); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("NewExporter(5) = %v", err)
+	}
+}
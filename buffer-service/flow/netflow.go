@@ -0,0 +1,439 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	v5HeaderLen    = 24
+	v5RecordLen    = 48
+	v9HeaderLen    = 20
+	ipfixHeaderLen = 16
+	setHeaderLen   = 4
+
+	// variableLength marks an IPFIX field whose length prefixes its value
+	variableLength = 65535
+)
+
+// Information elements shared by NetFlow v9 (RFC 3954) and IPFIX (RFC 7012)
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieIPClassOfService         = 5
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieSourceIPv4PrefixLength   = 9
+	ieIngressInterface         = 10
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieDestIPv4PrefixLength     = 13
+	ieEgressInterface          = 14
+	ieIPNextHopIPv4Address     = 15
+	ieBGPSourceASNumber        = 16
+	ieBGPDestinationASNumber   = 17
+	ieFlowEndSysUpTime         = 21
+	ieFlowStartSysUpTime       = 22
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieSourceIPv6PrefixLength   = 29
+	ieDestIPv6PrefixLength     = 30
+	ieSamplingInterval         = 34
+	ieSamplerRandomInterval    = 50
+	ieSourceMacAddress         = 56
+	iePostDestMacAddress       = 57
+	ieVlanID                   = 58
+	ieIPNextHopIPv6Address     = 62
+	ieDestinationMacAddress    = 80
+	ieOctetTotalCount          = 85
+	iePacketTotalCount         = 86
+	ieFlowStartSeconds         = 150
+	ieFlowEndSeconds           = 151
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+	ieSystemInitTimeMillis     = 160
+	ieSamplingPacketInterval   = 305
+)
+
+// exportContext carries packet header values needed to decode data records
+type exportContext struct {
+	flowType string
+	exporter string
+	version  uint16
+	domain   uint32
+	sequence uint32
+	boot     time.Time // exporter boot time, for sysUpTime-relative timestamps
+}
+
+// protocolOf names the protocol of a NetFlow/IPFIX export version
+func protocolOf(version uint16) string {
+	if version == 10 {
+		return "ipfix"
+	}
+	return "netflow"
+}
+
+// decodeV5 decodes a NetFlow v5 packet
+func (d *Decoder) decodeV5(exporter string, b []byte, now time.Time) ([]Record, error) {
+	if len(b) < v5HeaderLen {
+		return nil, ErrTruncated
+	}
+	count := int(u16(b[2:]))
+	if len(b) < v5HeaderLen+count*v5RecordLen {
+		return nil, ErrTruncated
+	}
+	uptime, secs, nsecs, seq := u32(b[4:]), u32(b[8:]), u32(b[12:]), u32(b[16:])
+	domain := uint32(u16(b[20:]))
+	sampling := uint32(u16(b[22:]) & 0x3fff)
+
+	s := d.stream(exporter, protocolOf(5), 5, domain, now)
+	s.checkSequence(seq, seq+uint32(count), true)
+	boot := time.Unix(int64(secs), int64(nsecs)).Add(-time.Duration(uptime) * time.Millisecond)
+
+	records := make([]Record, 0, count)
+	for i := 0; i < count; i++ {
+		r := b[v5HeaderLen+i*v5RecordLen:]
+		records = append(records, Record{
+			FlowType:          TypeNetFlowV5,
+			Exporter:          exporter,
+			ObservationDomain: domain,
+			Sequence:          seq,
+			SamplingRate:      sampling,
+			SrcIP:             ipString(r[0:4]),
+			DstIP:             ipString(r[4:8]),
+			NextHop:           ipString(r[8:12]),
+			InIf:              uint32(u16(r[12:])),
+			OutIf:             uint32(u16(r[14:])),
+			Packets:           uint64(u32(r[16:])),
+			Bytes:             uint64(u32(r[20:])),
+			StartTime:         millis(boot.Add(time.Duration(u32(r[24:])) * time.Millisecond)),
+			EndTime:           millis(boot.Add(time.Duration(u32(r[28:])) * time.Millisecond)),
+			SrcPort:           u16(r[32:]),
+			DstPort:           u16(r[34:]),
+			TCPFlags:          r[37],
+			Protocol:          r[38],
+			TOS:               r[39],
+			SrcAS:             uint32(u16(r[40:])),
+			DstAS:             uint32(u16(r[42:])),
+			SrcMask:           r[44],
+			DstMask:           r[45],
+		})
+	}
+	s.stats.Records += uint64(count)
+	return records, nil
+}
+
+// decodeV9 decodes a NetFlow v9 packet, whose sequence counts export packets
+func (d *Decoder) decodeV9(exporter string, b []byte, now time.Time) ([]Record, error) {
+	if len(b) < v9HeaderLen {
+		return nil, ErrTruncated
+	}
+	uptime, secs, seq, domain := u32(b[4:]), u32(b[8:]), u32(b[12:]), u32(b[16:])
+	s := d.stream(exporter, protocolOf(9), 9, domain, now)
+	s.checkSequence(seq, seq+1, true)
+
+	ctx := exportContext{
+		flowType: TypeNetFlowV9,
+		exporter: exporter,
+		version:  9,
+		domain:   domain,
+		sequence: seq,
+		boot:     time.Unix(int64(secs), 0).Add(-time.Duration(uptime) * time.Millisecond),
+	}
+	records, _, err := d.decodeSets(ctx, s, b[v9HeaderLen:], now)
+	return records, err
+}
+
+// decodeIPFIX decodes an IPFIX message, whose sequence counts data records
+func (d *Decoder) decodeIPFIX(exporter string, b []byte, now time.Time) ([]Record, error) {
+	if len(b) < ipfixHeaderLen {
+		return nil, ErrTruncated
+	}
+	length := int(u16(b[2:]))
+	if length < ipfixHeaderLen || length > len(b) {
+		return nil, ErrTruncated
+	}
+	seq, domain := u32(b[8:]), u32(b[12:])
+	s := d.stream(exporter, protocolOf(10), 10, domain, now)
+
+	ctx := exportContext{flowType: TypeIPFIX, exporter: exporter, version: 10, domain: domain, sequence: seq}
+	records, dataRecords, err := d.decodeSets(ctx, s, b[ipfixHeaderLen:length], now)
+	s.checkSequence(seq, seq+uint32(dataRecords), dataRecords >= 0)
+	return records, err
+}
+
+// decodeSets walks the flowsets of a v9 packet or the sets of an IPFIX
+// message. It returns the flows and the number of data records seen, or -1
+// when a data set could not be decoded for lack of a template.
+func (d *Decoder) decodeSets(ctx exportContext, s *streamState, b []byte, now time.Time) ([]Record, int, error) {
+	templateSet, optionsSet := uint16(0), uint16(1)
+	if ctx.version == 10 {
+		templateSet, optionsSet = 2, 3
+	}
+
+	var records []Record
+	dataRecords := 0
+	for len(b) >= setHeaderLen {
+		id, length := u16(b), int(u16(b[2:]))
+		if length < setHeaderLen || length > len(b) {
+			return records, -1, ErrTruncated
+		}
+		body := b[setHeaderLen:length]
+		b = b[length:]
+
+		switch {
+		case id == templateSet:
+			if err := d.parseTemplates(ctx, s, body, false, now); err != nil {
+				return records, -1, err
+			}
+		case id == optionsSet:
+			if err := d.parseTemplates(ctx, s, body, true, now); err != nil {
+				return records, -1, err
+			}
+		case id >= 256:
+			t := d.lookup(templateKey{ctx.exporter, ctx.version, ctx.domain, id}, s, now)
+			if t == nil {
+				s.stats.MissingTemplateSets++
+				dataRecords = -1
+				continue
+			}
+			flows, n, err := d.decodeData(ctx, s, t, body)
+			records = append(records, flows...)
+			if err != nil {
+				return records, -1, err
+			}
+			if dataRecords >= 0 {
+				dataRecords += n
+			}
+		}
+	}
+	s.stats.Records += uint64(len(records))
+	return records, dataRecords, nil
+}
+
+// parseTemplates caches the template or options template records in a set
+func (d *Decoder) parseTemplates(ctx exportContext, s *streamState, b []byte, options bool, now time.Time) error {
+	// Records are at least 4 bytes; anything shorter is set padding
+	for len(b) >= 4 {
+		id := u16(b)
+		var fieldCount int
+		switch {
+		case !options:
+			fieldCount = int(u16(b[2:]))
+			b = b[4:]
+		case ctx.version == 9:
+			// v9 options carry scope and option lengths in bytes
+			if len(b) < 6 {
+				return ErrTruncated
+			}
+			fieldCount = (int(u16(b[2:])) + int(u16(b[4:]))) / 4
+			b = b[6:]
+		default:
+			if len(b) < 6 && u16(b[2:]) != 0 {
+				return ErrTruncated
+			}
+			fieldCount = int(u16(b[2:]))
+			if fieldCount > 0 {
+				b = b[6:]
+			} else {
+				b = b[4:]
+			}
+		}
+
+		t := &template{options: options, updated: now}
+		for i := 0; i < fieldCount; i++ {
+			if len(b) < 4 {
+				return ErrTruncated
+			}
+			f := templateField{id: u16(b), length: u16(b[2:])}
+			b = b[4:]
+			if ctx.version == 10 && f.id&0x8000 != 0 {
+				if len(b) < 4 {
+					return ErrTruncated
+				}
+				f.id &^= 0x8000
+				f.enterprise = u32(b)
+				b = b[4:]
+			}
+			if f.length == 0 {
+				// A record of zero-length fields never consumes its data set
+				return fmt.Errorf("template %d has a zero-length field %d", id, f.id)
+			}
+			t.fields = append(t.fields, f)
+		}
+		if id < 256 {
+			// A withdrawal using the set ID withdraws every template of the domain
+			if len(t.fields) == 0 && ctx.version == 10 {
+				d.withdrawAll(ctx)
+				continue
+			}
+			return fmt.Errorf("invalid template id %d", id)
+		}
+		d.store(templateKey{ctx.exporter, ctx.version, ctx.domain, id}, t, s)
+	}
+	return nil
+}
+
+// decodeData decodes the records of a data set. Options records update the
+// stream's sampling rate and are not returned as flows.
+func (d *Decoder) decodeData(ctx exportContext, s *streamState, t *template, b []byte) ([]Record, int, error) {
+	var records []Record
+	n := 0
+	for len(b) >= t.minLength && len(b) > 0 {
+		r := Record{
+			FlowType:          ctx.flowType,
+			Exporter:          ctx.exporter,
+			ObservationDomain: ctx.domain,
+			Sequence:          ctx.sequence,
+			SamplingRate:      s.stats.SamplingRate,
+		}
+		var times recordTimes
+		for _, f := range t.fields {
+			length := int(f.length)
+			if f.length == variableLength {
+				if len(b) < 1 {
+					return records, n, ErrTruncated
+				}
+				length, b = int(b[0]), b[1:]
+				if length == 255 {
+					if len(b) < 2 {
+						return records, n, ErrTruncated
+					}
+					length, b = int(u16(b)), b[2:]
+				}
+			}
+			if len(b) < length {
+				return records, n, ErrTruncated
+			}
+			v := b[:length]
+			b = b[length:]
+			if f.enterprise != 0 {
+				continue
+			}
+			if t.options {
+				if rate := samplingField(f.id, v); rate > 0 {
+					s.stats.SamplingRate = rate
+				}
+				continue
+			}
+			applyField(&r, &times, f.id, v)
+		}
+		n++
+		if t.options {
+			continue
+		}
+		times.resolve(&r, ctx.boot)
+		records = append(records, r)
+	}
+	return records, n, nil
+}
+
+// samplingField returns the sampling rate carried by an options field, if any
+func samplingField(id uint16, v []byte) uint32 {
+	switch id {
+	case ieSamplingInterval, ieSamplerRandomInterval, ieSamplingPacketInterval:
+		return uint32(uintBE(v))
+	}
+	return 0
+}
+
+// recordTimes collects timestamp fields until the whole record is read, since
+// sysUpTime fields depend on a boot time that may appear later in the record
+type recordTimes struct {
+	startUptime, endUptime int64
+	haveUptime             bool
+	initMillis             int64
+}
+
+func (rt *recordTimes) resolve(r *Record, boot time.Time) {
+	if !rt.haveUptime {
+		return
+	}
+	var base int64
+	switch {
+	case rt.initMillis > 0:
+		base = rt.initMillis
+	case !boot.IsZero():
+		base = millis(boot)
+	default:
+		return
+	}
+	if r.StartTime == 0 {
+		r.StartTime = base + rt.startUptime
+	}
+	if r.EndTime == 0 {
+		r.EndTime = base + rt.endUptime
+	}
+}
+
+// applyField maps one information element onto the normalized record
+func applyField(r *Record, rt *recordTimes, id uint16, v []byte) {
+	switch id {
+	case ieOctetDeltaCount:
+		r.Bytes = uintBE(v)
+	case ieOctetTotalCount:
+		if r.Bytes == 0 {
+			r.Bytes = uintBE(v)
+		}
+	case iePacketDeltaCount:
+		r.Packets = uintBE(v)
+	case iePacketTotalCount:
+		if r.Packets == 0 {
+			r.Packets = uintBE(v)
+		}
+	case ieProtocolIdentifier:
+		r.Protocol = uint8(uintBE(v))
+	case ieIPClassOfService:
+		r.TOS = uint8(uintBE(v))
+	case ieTCPControlBits:
+		r.TCPFlags = uint8(uintBE(v))
+	case ieSourceTransportPort:
+		r.SrcPort = uint16(uintBE(v))
+	case ieDestinationTransportPort:
+		r.DstPort = uint16(uintBE(v))
+	case ieSourceIPv4Address, ieSourceIPv6Address:
+		r.SrcIP = ipString(v)
+	case ieDestinationIPv4Address, ieDestinationIPv6Address:
+		r.DstIP = ipString(v)
+	case ieIPNextHopIPv4Address, ieIPNextHopIPv6Address:
+		r.NextHop = ipString(v)
+	case ieSourceIPv4PrefixLength, ieSourceIPv6PrefixLength:
+		r.SrcMask = uint8(uintBE(v))
+	case ieDestIPv4PrefixLength, ieDestIPv6PrefixLength:
+		r.DstMask = uint8(uintBE(v))
+	case ieIngressInterface:
+		r.InIf = uint32(uintBE(v))
+	case ieEgressInterface:
+		r.OutIf = uint32(uintBE(v))
+	case ieBGPSourceASNumber:
+		r.SrcAS = uint32(uintBE(v))
+	case ieBGPDestinationASNumber:
+		r.DstAS = uint32(uintBE(v))
+	case ieSourceMacAddress:
+		r.SrcMAC = macString(v)
+	case ieDestinationMacAddress, iePostDestMacAddress:
+		if r.DstMAC == "" {
+			r.DstMAC = macString(v)
+		}
+	case ieVlanID:
+		r.VLAN = uint16(uintBE(v))
+	case ieSamplingInterval, ieSamplerRandomInterval:
+		r.SamplingRate = uint32(uintBE(v))
+	case ieFlowStartSysUpTime:
+		rt.startUptime, rt.haveUptime = int64(uintBE(v)), true
+	case ieFlowEndSysUpTime:
+		rt.endUptime, rt.haveUptime = int64(uintBE(v)), true
+	case ieSystemInitTimeMillis:
+		rt.initMillis = int64(uintBE(v))
+	case ieFlowStartSeconds:
+		r.StartTime = int64(uintBE(v)) * 1000
+	case ieFlowEndSeconds:
+		r.EndTime = int64(uintBE(v)) * 1000
+	case ieFlowStartMilliseconds:
+		r.StartTime = int64(uintBE(v))
+	case ieFlowEndMilliseconds:
+		r.EndTime = int64(uintBE(v))
+	}
+}
@@ -0,0 +1,212 @@
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// packet assembles big-endian export packets for tests
+type packet []byte
+
+func (p packet) u8(v uint8) packet   { return append(p, v) }
+func (p packet) u16(v uint16) packet { return binary.BigEndian.AppendUint16(p, v) }
+func (p packet) u32(v uint32) packet { return binary.BigEndian.AppendUint32(p, v) }
+func (p packet) u64(v uint64) packet { return binary.BigEndian.AppendUint64(p, v) }
+func (p packet) ip(s string) packet {
+	ip := net.ParseIP(s)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return append(p, ip...)
+}
+
+// set wraps a set body with its ID and length
+func set(id uint16, body packet) packet {
+	return packet{}.u16(id).u16(uint16(len(body) + setHeaderLen)).append(body)
+}
+
+func (p packet) append(b packet) packet { return append(p, b...) }
+
+var exportTime = time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+func v5Packet(seq uint32, flows int) []byte {
+	p := packet{}.u16(5).u16(uint16(flows)).u32(60000).u32(uint32(exportTime.Unix())).u32(0).u32(seq).u8(0).u8(1).u16(0x4000 | 100)
+	for i := 0; i < flows; i++ {
+		p = p.ip("10.0.0.1").ip("192.0.2.10").ip("10.0.0.254").
+			u16(3).u16(7).u32(10).u32(1500).u32(50000).u32(59000).
+			u16(51000).u16(443).u8(0).u8(0x18).u8(6).u8(0).
+			u16(64512).u16(15169).u8(24).u8(16).u16(0)
+	}
+	return p
+}
+
+func TestDecodeV5_FieldsAndSequenceGaps(t *testing.T) {
+	d := NewDecoder(0)
+	records, err := d.Decode("198.51.100.1", v5Packet(100, 2), exportTime)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("decoded %d records, want 2", len(records))
+	}
+	want := Record{
+		FlowType: TypeNetFlowV5, Exporter: "198.51.100.1", ObservationDomain: 1, Sequence: 100, SamplingRate: 100,
+		SrcIP: "10.0.0.1", DstIP: "192.0.2.10", NextHop: "10.0.0.254", InIf: 3, OutIf: 7,
+		Packets: 10, Bytes: 1500, SrcPort: 51000, DstPort: 443, TCPFlags: 0x18, Protocol: 6,
+		SrcAS: 64512, DstAS: 15169, SrcMask: 24, DstMask: 16,
+		StartTime: millis(exportTime.Add(-10 * time.Second)), EndTime: millis(exportTime.Add(-time.Second)),
+	}
+	if records[0] != want {
+		t.Fatalf("record\n got %+v\nwant %+v", records[0], want)
+	}
+
+	// 102 follows 100+2; 110 skips 5 flows after 105
+	d.Decode("198.51.100.1", v5Packet(102, 3), exportTime)
+	d.Decode("198.51.100.1", v5Packet(110, 1), exportTime)
+	stats := d.Stats().Exporters[0]
+	if stats.Packets != 3 || stats.Records != 6 || stats.SequenceGaps != 1 || stats.SequenceLost != 5 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if _, err := d.Decode("198.51.100.1", v5Packet(111, 2)[:80], exportTime); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("truncated packet returned %v", err)
+	}
+	if _, err := d.Decode("198.51.100.1", []byte{0, 7, 0, 0}, exportTime); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("version 7 returned %v", err)
+	}
+	if d.Stats().DecodeErrors != 2 {
+		t.Fatalf("decode errors = %d", d.Stats().DecodeErrors)
+	}
+}
+
+func v9Header(seq uint32) packet {
+	return packet{}.u16(9).u16(0).u32(60000).u32(uint32(exportTime.Unix())).u32(seq).u32(42)
+}
+
+var v9Template = set(0, packet{}.u16(256).u16(7).
+	u16(ieSourceIPv4Address).u16(4).u16(ieDestinationIPv4Address).u16(4).
+	u16(ieOctetDeltaCount).u16(4).u16(iePacketDeltaCount).u16(4).
+	u16(ieProtocolIdentifier).u16(1).u16(ieFlowStartSysUpTime).u16(4).u16(ieFlowEndSysUpTime).u16(4))
+
+var v9Data = set(256, packet{}.
+	ip("10.1.1.1").ip("10.2.2.2").u32(4000).u32(4).u8(17).u32(55000).u32(58000).
+	ip("10.1.1.2").ip("10.2.2.3").u32(64).u32(1).u8(1).u32(57000).u32(57000).
+	u8(0).u8(0).u8(0)) // padding
+
+func TestDecodeV9_TemplatesOptionsAndMissingTemplates(t *testing.T) {
+	d := NewDecoder(0)
+
+	// Data before its template is dropped and counted
+	records, err := d.Decode("198.51.100.2", v9Header(1).append(v9Data), exportTime)
+	if err != nil || len(records) != 0 {
+		t.Fatalf("decoded %d records before template (err %v)", len(records), err)
+	}
+
+	// Options template and data announcing 1-in-512 sampling, then flows
+	options := set(1, packet{}.u16(257).u16(4).u16(4).u16(1).u16(4).u16(ieSamplingInterval).u16(4))
+	optionsData := set(257, packet{}.u32(1).u32(512))
+	records, err = d.Decode("198.51.100.2", v9Header(2).append(v9Template).append(options).append(optionsData).append(v9Data), exportTime)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("decoded %d records, want 2", len(records))
+	}
+	want := Record{
+		FlowType: TypeNetFlowV9, Exporter: "198.51.100.2", ObservationDomain: 42, Sequence: 2, SamplingRate: 512,
+		SrcIP: "10.1.1.1", DstIP: "10.2.2.2", Bytes: 4000, Packets: 4, Protocol: 17,
+		StartTime: millis(exportTime.Add(-5 * time.Second)), EndTime: millis(exportTime.Add(-2 * time.Second)),
+	}
+	if records[0] != want {
+		t.Fatalf("record\n got %+v\nwant %+v", records[0], want)
+	}
+
+	// Packet 3 is lost
+	d.Decode("198.51.100.2", v9Header(4).append(v9Data), exportTime)
+	stats := d.Stats()
+	es := stats.Exporters[0]
+	if es.MissingTemplateSets != 1 || es.TemplateUpdates != 2 || es.Templates != 2 || es.SequenceGaps != 1 || es.SequenceLost != 1 || es.SamplingRate != 512 {
+		t.Fatalf("unexpected stats: %+v", es)
+	}
+
+	// Another exporter using the same template ID does not see this template
+	if records, _ := d.Decode("198.51.100.3", v9Header(1).append(v9Data), exportTime); len(records) != 0 {
+		t.Fatalf("template leaked across exporters")
+	}
+}
+
+func TestDecodeV9_RejectsZeroLengthTemplateField(t *testing.T) {
+	d := NewDecoder(0)
+	template := set(0, packet{}.u16(256).u16(1).u16(ieOctetDeltaCount).u16(0))
+	data := set(256, packet{}.u32(0))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.Decode("198.51.100.2", v9Header(1).append(template).append(data), exportTime)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("template with a zero-length field was accepted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Decode did not return")
+	}
+	if es := d.Stats().Exporters[0]; es.Templates != 0 {
+		t.Fatalf("zero-length template cached: %+v", es)
+	}
+}
+
+func ipfixMessage(seq uint32, sets ...packet) []byte {
+	var body packet
+	for _, s := range sets {
+		body = body.append(s)
+	}
+	return packet{}.u16(10).u16(uint16(ipfixHeaderLen + len(body))).u32(uint32(exportTime.Unix())).u32(seq).u32(7).append(body)
+}
+
+func TestDecodeIPFIX_VariableLengthEnterpriseAndExpiry(t *testing.T) {
+	d := NewDecoder(time.Minute)
+	tmpl := set(2, packet{}.u16(300).u16(6).
+		u16(ieSourceIPv6Address).u16(16).u16(ieDestinationIPv6Address).u16(16).
+		u16(ieOctetDeltaCount).u16(8).
+		u16(0x8000|100).u16(variableLength).u32(9). // enterprise string, skipped
+		u16(ieFlowStartMilliseconds).u16(8).u16(ieFlowEndMilliseconds).u16(8))
+	record := func(bytes uint64, name string) packet {
+		return packet{}.ip("2001:db8::1").ip("2001:db8::2").u64(bytes).u8(uint8(len(name))).append(packet(name)).
+			u64(uint64(millis(exportTime) - 1000)).u64(uint64(millis(exportTime)))
+	}
+
+	records, err := d.Decode("203.0.113.9", ipfixMessage(1000, tmpl, set(300, record(9000, "ge-0/0/1").append(record(10, "")))), exportTime)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if len(records) != 2 || records[0].SrcIP != "2001:db8::1" || records[0].Bytes != 9000 || records[1].Bytes != 10 ||
+		records[0].StartTime != millis(exportTime)-1000 || records[0].FlowType != TypeIPFIX || records[0].ObservationDomain != 7 {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+
+	// IPFIX sequence numbers count data records: 1002 follows two records
+	d.Decode("203.0.113.9", ipfixMessage(1002, set(300, record(1, "x"))), exportTime)
+	d.Decode("203.0.113.9", ipfixMessage(1010, set(300, record(1, "x"))), exportTime)
+	if es := d.Stats().Exporters[0]; es.SequenceGaps != 1 || es.SequenceLost != 7 || es.Records != 4 {
+		t.Fatalf("unexpected stats: %+v", es)
+	}
+
+	// Without a refresh the template expires
+	records, _ = d.Decode("203.0.113.9", ipfixMessage(1011, set(300, record(1, "x"))), exportTime.Add(2*time.Minute))
+	if es := d.Stats().Exporters[0]; len(records) != 0 || es.TemplatesExpired != 1 || es.Templates != 0 {
+		t.Fatalf("template did not expire: %d records, %+v", len(records), es)
+	}
+
+	// A withdrawal removes the template
+	d.Decode("203.0.113.9", ipfixMessage(1012, tmpl), exportTime)
+	d.Decode("203.0.113.9", ipfixMessage(1012, set(2, packet{}.u16(300).u16(0))), exportTime)
+	if d.Stats().Templates != 0 {
+		t.Fatalf("template not withdrawn")
+	}
+}
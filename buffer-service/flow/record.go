@@ -0,0 +1,87 @@
+// Package flow decodes NetFlow v5, NetFlow v9, IPFIX and sFlow v5 export
+// packets into normalized flow records.
+package flow
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+// Flow types reported in Record.FlowType. The forwarder's per-flow-type port
+// overrides are keyed by these values.
+const (
+	TypeNetFlowV5 = "netflow_v5"
+	TypeNetFlowV9 = "netflow_v9"
+	TypeIPFIX     = "ipfix"
+)
+
+var (
+	// ErrTruncated is returned when a packet is shorter than its headers claim
+	ErrTruncated = errors.New("truncated flow packet")
+	// ErrUnsupportedVersion is returned for export versions other than 5, 9 and 10
+	ErrUnsupportedVersion = errors.New("unsupported flow export version")
+)
+
+// Record is a single flow, independent of the protocol that carried it
+type Record struct {
+	FlowType          string `json:"flow_type"`
+	Exporter          string `json:"exporter"`
+	ObservationDomain uint32 `json:"observation_domain,omitempty"` // v9 source ID, IPFIX domain, v5 engine type/ID
+	Sequence          uint32 `json:"sequence"`
+	SamplingRate      uint32 `json:"sampling_rate,omitempty"`
+	SrcIP             string `json:"src_ip,omitempty"`
+	DstIP             string `json:"dst_ip,omitempty"`
+	NextHop           string `json:"next_hop,omitempty"`
+	SrcPort           uint16 `json:"src_port"`
+	DstPort           uint16 `json:"dst_port"`
+	Protocol          uint8  `json:"protocol"`
+	TCPFlags          uint8  `json:"tcp_flags,omitempty"`
+	TOS               uint8  `json:"tos,omitempty"`
+	Bytes             uint64 `json:"bytes"`
+	Packets           uint64 `json:"packets"`
+	InIf              uint32 `json:"in_if,omitempty"`
+	OutIf             uint32 `json:"out_if,omitempty"`
+	SrcAS             uint32 `json:"src_as,omitempty"`
+	DstAS             uint32 `json:"dst_as,omitempty"`
+	SrcMask           uint8  `json:"src_mask,omitempty"`
+	DstMask           uint8  `json:"dst_mask,omitempty"`
+	SrcMAC            string `json:"src_mac,omitempty"`
+	DstMAC            string `json:"dst_mac,omitempty"`
+	VLAN              uint16 `json:"vlan,omitempty"`
+	StartTime         int64  `json:"start_time,omitempty"` // unix milliseconds
+	EndTime           int64  `json:"end_time,omitempty"`   // unix milliseconds
+}
+
+func u16(b []byte) uint16 { return binary.BigEndian.Uint16(b) }
+func u32(b []byte) uint32 { return binary.BigEndian.Uint32(b) }
+
+// uintBE reads a big-endian unsigned integer of up to eight bytes, as used by
+// reduced-size encoding of template fields
+func uintBE(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// ipString renders a 4 or 16 byte address
+func ipString(b []byte) string {
+	if len(b) != net.IPv4len && len(b) != net.IPv6len {
+		return ""
+	}
+	return net.IP(append([]byte(nil), b...)).String()
+}
+
+func macString(b []byte) string {
+	if len(b) != 6 {
+		return ""
+	}
+	return net.HardwareAddr(append([]byte(nil), b...)).String()
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
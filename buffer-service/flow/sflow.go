@@ -0,0 +1,383 @@
+package flow
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Flow types of records decoded from sFlow datagrams
+const (
+	TypeSFlow         = "sflow"
+	TypeSFlowCounters = "sflow_counters"
+)
+
+// sFlow v5 structure formats, enterprise 0 (sflow.org/sflow_version_5.txt)
+const (
+	sflowFlowSample            = 1
+	sflowCounterSample         = 2
+	sflowExpandedFlowSample    = 3
+	sflowExpandedCounterSample = 4
+
+	sflowRawPacketHeader = 1
+	sflowIPv4Data        = 3
+	sflowIPv6Data        = 4
+	sflowExtendedSwitch  = 1001
+	sflowExtendedRouter  = 1002
+
+	sflowGenericInterfaceCounters = 1
+
+	headerProtocolEthernet = 1
+	headerProtocolIPv4     = 11
+	headerProtocolIPv6     = 12
+
+	// sflowUnknownInterface is the "interface not known" value of a format 0 interface
+	sflowUnknownInterface = 0x3fffffff
+)
+
+// InterfaceCounters is an sFlow generic interface counter record
+type InterfaceCounters struct {
+	FlowType         string `json:"flow_type"`
+	Exporter         string `json:"exporter"`
+	SubAgentID       uint32 `json:"sub_agent_id,omitempty"`
+	Sequence         uint32 `json:"sequence"`
+	IfIndex          uint32 `json:"if_index"`
+	IfType           uint32 `json:"if_type"`
+	IfSpeed          uint64 `json:"if_speed"`
+	IfDirection      uint32 `json:"if_direction"` // 0 unknown, 1 full duplex, 2 half duplex, 3 in, 4 out
+	IfStatus         uint32 `json:"if_status"`    // bit 0 admin up, bit 1 oper up
+	InOctets         uint64 `json:"in_octets"`
+	InUcastPkts      uint32 `json:"in_ucast_pkts"`
+	InMulticastPkts  uint32 `json:"in_multicast_pkts"`
+	InBroadcastPkts  uint32 `json:"in_broadcast_pkts"`
+	InDiscards       uint32 `json:"in_discards"`
+	InErrors         uint32 `json:"in_errors"`
+	InUnknownProtos  uint32 `json:"in_unknown_protos"`
+	OutOctets        uint64 `json:"out_octets"`
+	OutUcastPkts     uint32 `json:"out_ucast_pkts"`
+	OutMulticastPkts uint32 `json:"out_multicast_pkts"`
+	OutBroadcastPkts uint32 `json:"out_broadcast_pkts"`
+	OutDiscards      uint32 `json:"out_discards"`
+	OutErrors        uint32 `json:"out_errors"`
+	Promiscuous      uint32 `json:"promiscuous,omitempty"`
+}
+
+// SFlowDatagram holds the samples decoded from one sFlow datagram
+type SFlowDatagram struct {
+	Flows    []Record
+	Counters []InterfaceCounters
+}
+
+// xdrReader reads the XDR encoding used by sFlow, latching the first error
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+func (r *xdrReader) u32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = ErrTruncated
+		return 0
+	}
+	v := u32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *xdrReader) u64() uint64 {
+	if r.err != nil || len(r.b) < 8 {
+		r.err = ErrTruncated
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+// bytes reads n bytes of opaque data and its padding to a four-byte boundary
+func (r *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || len(r.b) < padded {
+		r.err = ErrTruncated
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+// structure reads a format and length prefixed structure
+func (r *xdrReader) structure() (uint32, *xdrReader) {
+	format, length := r.u32(), r.u32()
+	return format, &xdrReader{b: r.bytes(int(length)), err: r.err}
+}
+
+// address reads a typed IPv4 or IPv6 address
+func (r *xdrReader) address() string {
+	switch r.u32() {
+	case 1:
+		return ipString(r.bytes(4))
+	case 2:
+		return ipString(r.bytes(16))
+	default:
+		return ""
+	}
+}
+
+// DecodeSFlow decodes an sFlow v5 datagram received from source. Flow samples
+// become records whose bytes and packets are estimates scaled by the sampling
+// rate; generic interface counters are returned as they are.
+func (d *Decoder) DecodeSFlow(source string, b []byte, now time.Time) (SFlowDatagram, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	dg, err := d.decodeSFlow(source, b, now)
+	if err != nil {
+		d.decodeErrors++
+	}
+	return dg, err
+}
+
+func (d *Decoder) decodeSFlow(source string, b []byte, now time.Time) (SFlowDatagram, error) {
+	var dg SFlowDatagram
+	r := &xdrReader{b: b}
+	if version := r.u32(); r.err == nil && version != 5 {
+		return dg, ErrUnsupportedVersion
+	}
+	agent := r.address()
+	subAgent, seq := r.u32(), r.u32()
+	r.u32() // uptime
+	samples := r.u32()
+	if r.err != nil {
+		return dg, r.err
+	}
+	if agent == "" || agent == "0.0.0.0" || agent == "::" {
+		agent = source
+	}
+
+	s := d.stream(agent, TypeSFlow, 5, subAgent, now)
+	s.checkSequence(seq, seq+1, true)
+	for i := uint32(0); i < samples && r.err == nil; i++ {
+		format, body := r.structure()
+		if r.err != nil {
+			break
+		}
+		// Samples from other enterprises are skipped, as sFlow intends
+		if format>>12 != 0 {
+			continue
+		}
+		switch format & 0xfff {
+		case sflowFlowSample, sflowExpandedFlowSample:
+			rec := decodeFlowSample(body, format&0xfff == sflowExpandedFlowSample)
+			if body.err == nil {
+				rec.Exporter, rec.ObservationDomain = agent, subAgent
+				rec.StartTime, rec.EndTime = millis(now), millis(now)
+				dg.Flows = append(dg.Flows, rec)
+			}
+		case sflowCounterSample, sflowExpandedCounterSample:
+			counters := decodeCounterSample(body, format&0xfff == sflowExpandedCounterSample)
+			for _, c := range counters {
+				c.Exporter, c.SubAgentID = agent, subAgent
+				dg.Counters = append(dg.Counters, c)
+			}
+		}
+		if body.err != nil {
+			r.err = body.err
+		}
+	}
+	s.stats.Records += uint64(len(dg.Flows) + len(dg.Counters))
+	return dg, r.err
+}
+
+// sflowInterface decodes a format 0 interface index, ignoring discard,
+// multiple-interface and unknown values
+func sflowInterface(format, value uint32) uint32 {
+	if format != 0 || value == sflowUnknownInterface {
+		return 0
+	}
+	return value
+}
+
+// decodeFlowSample merges the records of a flow sample into one flow
+func decodeFlowSample(r *xdrReader, expanded bool) Record {
+	rec := Record{FlowType: TypeSFlow, Sequence: r.u32()}
+	if expanded {
+		r.u32() // source ID type
+		r.u32() // source ID index
+	} else {
+		r.u32() // source ID
+	}
+	rate := r.u32()
+	r.u32() // sample pool
+	r.u32() // drops
+	if expanded {
+		inFormat, in := r.u32(), r.u32()
+		outFormat, out := r.u32(), r.u32()
+		rec.InIf, rec.OutIf = sflowInterface(inFormat, in), sflowInterface(outFormat, out)
+	} else {
+		in, out := r.u32(), r.u32()
+		rec.InIf, rec.OutIf = sflowInterface(in>>30, in&0x3fffffff), sflowInterface(out>>30, out&0x3fffffff)
+	}
+
+	var frameLength uint32
+	records := r.u32()
+	for i := uint32(0); i < records && r.err == nil; i++ {
+		format, body := r.structure()
+		switch format {
+		case sflowRawPacketHeader:
+			protocol, length := body.u32(), body.u32()
+			body.u32() // stripped
+			header := body.bytes(int(body.u32()))
+			if body.err == nil {
+				frameLength = length
+				parseSampledHeader(&rec, protocol, header)
+			}
+		case sflowIPv4Data, sflowIPv6Data:
+			addrLen := 4
+			if format == sflowIPv6Data {
+				addrLen = 16
+			}
+			length, protocol := body.u32(), body.u32()
+			src, dst := body.bytes(addrLen), body.bytes(addrLen)
+			sport, dport, flags, tos := body.u32(), body.u32(), body.u32(), body.u32()
+			if body.err == nil && rec.SrcIP == "" {
+				if frameLength == 0 {
+					frameLength = length
+				}
+				rec.Protocol, rec.SrcIP, rec.DstIP = uint8(protocol), ipString(src), ipString(dst)
+				rec.SrcPort, rec.DstPort, rec.TCPFlags, rec.TOS = uint16(sport), uint16(dport), uint8(flags), uint8(tos)
+			}
+		case sflowExtendedSwitch:
+			srcVLAN := body.u32()
+			if body.err == nil && rec.VLAN == 0 {
+				rec.VLAN = uint16(srcVLAN)
+			}
+		case sflowExtendedRouter:
+			nextHop := body.address()
+			srcMask, dstMask := body.u32(), body.u32()
+			if body.err == nil {
+				rec.NextHop, rec.SrcMask, rec.DstMask = nextHop, uint8(srcMask), uint8(dstMask)
+			}
+		}
+	}
+
+	if rate == 0 {
+		rate = 1
+	}
+	rec.SamplingRate = rate
+	rec.Packets = uint64(rate)
+	rec.Bytes = uint64(frameLength) * uint64(rate)
+	return rec
+}
+
+// decodeCounterSample returns the generic interface counters of a counter sample
+func decodeCounterSample(r *xdrReader, expanded bool) []InterfaceCounters {
+	seq := r.u32()
+	r.u32() // source ID (type and index when expanded)
+	if expanded {
+		r.u32()
+	}
+
+	var counters []InterfaceCounters
+	records := r.u32()
+	for i := uint32(0); i < records && r.err == nil; i++ {
+		format, body := r.structure()
+		if format != sflowGenericInterfaceCounters {
+			continue
+		}
+		c := InterfaceCounters{
+			FlowType:         TypeSFlowCounters,
+			Sequence:         seq,
+			IfIndex:          body.u32(),
+			IfType:           body.u32(),
+			IfSpeed:          body.u64(),
+			IfDirection:      body.u32(),
+			IfStatus:         body.u32(),
+			InOctets:         body.u64(),
+			InUcastPkts:      body.u32(),
+			InMulticastPkts:  body.u32(),
+			InBroadcastPkts:  body.u32(),
+			InDiscards:       body.u32(),
+			InErrors:         body.u32(),
+			InUnknownProtos:  body.u32(),
+			OutOctets:        body.u64(),
+			OutUcastPkts:     body.u32(),
+			OutMulticastPkts: body.u32(),
+			OutBroadcastPkts: body.u32(),
+			OutDiscards:      body.u32(),
+			OutErrors:        body.u32(),
+			Promiscuous:      body.u32(),
+		}
+		if body.err == nil {
+			counters = append(counters, c)
+		}
+	}
+	return counters
+}
+
+// parseSampledHeader fills addresses and ports from a sampled packet header
+func parseSampledHeader(rec *Record, protocol uint32, h []byte) {
+	switch protocol {
+	case headerProtocolEthernet:
+		if len(h) < 14 {
+			return
+		}
+		rec.DstMAC, rec.SrcMAC = macString(h[0:6]), macString(h[6:12])
+		etherType := u16(h[12:])
+		h = h[14:]
+		// 802.1Q and 802.1ad tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(h) >= 4 {
+			if rec.VLAN == 0 {
+				rec.VLAN = u16(h) & 0x0fff
+			}
+			etherType = u16(h[2:])
+			h = h[4:]
+		}
+		switch etherType {
+		case 0x0800:
+			parseIPv4Header(rec, h)
+		case 0x86dd:
+			parseIPv6Header(rec, h)
+		}
+	case headerProtocolIPv4:
+		parseIPv4Header(rec, h)
+	case headerProtocolIPv6:
+		parseIPv6Header(rec, h)
+	}
+}
+
+func parseIPv4Header(rec *Record, h []byte) {
+	if len(h) < 20 {
+		return
+	}
+	ihl := int(h[0]&0x0f) * 4
+	rec.TOS, rec.Protocol = h[1], h[9]
+	rec.SrcIP, rec.DstIP = ipString(h[12:16]), ipString(h[16:20])
+	// Only the first fragment carries the transport header
+	if u16(h[6:])&0x1fff != 0 || len(h) < ihl {
+		return
+	}
+	parseTransportHeader(rec, h[ihl:])
+}
+
+func parseIPv6Header(rec *Record, h []byte) {
+	if len(h) < 40 {
+		return
+	}
+	rec.TOS = uint8(u16(h) >> 4)
+	rec.Protocol = h[6]
+	rec.SrcIP, rec.DstIP = ipString(h[8:24]), ipString(h[24:40])
+	parseTransportHeader(rec, h[40:])
+}
+
+func parseTransportHeader(rec *Record, h []byte) {
+	switch rec.Protocol {
+	case 6, 17, 132: // TCP, UDP, SCTP
+		if len(h) < 4 {
+			return
+		}
+		rec.SrcPort, rec.DstPort = u16(h), u16(h[2:])
+		if rec.Protocol == 6 && len(h) >= 14 {
+			rec.TCPFlags = h[13]
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package flow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readFixture loads an sFlow datagram from testdata
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("read fixture: %v", err)
+	}
+	return b
+}
+
+func TestDecodeSFlow_FlowSamples(t *testing.T) {
+	d := NewDecoder(0)
+	now := time.Date(2025, time.March, 1, 12, 0, 0, 0, time.UTC)
+	dg, err := d.DecodeSFlow("198.51.100.50", readFixture(t, "flow_samples.bin"), now)
+	if err != nil {
+		t.Fatalf("DecodeSFlow: %v", err)
+	}
+	if len(dg.Flows) != 2 || len(dg.Counters) != 0 {
+		t.Fatalf("decoded %d flows and %d counters", len(dg.Flows), len(dg.Counters))
+	}
+
+	// Raw Ethernet header with an 802.1Q tag, plus switch and router records
+	want := Record{
+		FlowType: TypeSFlow, Exporter: "192.0.2.1", Sequence: 77, SamplingRate: 1000,
+		SrcIP: "10.10.1.5", DstIP: "93.184.216.34", NextHop: "10.10.1.1", SrcPort: 51514, DstPort: 443,
+		Protocol: 6, TCPFlags: 0x18, TOS: 0x10, Bytes: 1518 * 1000, Packets: 1000, InIf: 5, OutIf: 7,
+		SrcMask: 24, SrcMAC: "66:77:88:99:aa:bb", DstMAC: "00:11:22:33:44:55", VLAN: 100,
+		StartTime: millis(now), EndTime: millis(now),
+	}
+	if dg.Flows[0] != want {
+		t.Fatalf("flow\n got %+v\nwant %+v", dg.Flows[0], want)
+	}
+
+	// IPv4 data record only, output interface unknown
+	f := dg.Flows[1]
+	if f.SrcIP != "10.10.2.9" || f.DstPort != 53 || f.Protocol != 17 || f.Bytes != 60*1000 || f.OutIf != 0 {
+		t.Fatalf("unexpected IPv4 data flow: %+v", f)
+	}
+}
+
+func TestDecodeSFlow_ExpandedSampleFromIPv6Agent(t *testing.T) {
+	d := NewDecoder(0)
+	dg, err := d.DecodeSFlow("198.51.100.50", readFixture(t, "expanded_flow_sample.bin"), time.Now())
+	if err != nil {
+		t.Fatalf("DecodeSFlow: %v", err)
+	}
+	if len(dg.Flows) != 1 {
+		t.Fatalf("decoded %d flows", len(dg.Flows))
+	}
+	f := dg.Flows[0]
+	if f.Exporter != "2001:db8::1" || f.ObservationDomain != 1 || f.SrcIP != "2001:db8:1::10" || f.DstIP != "2001:db8:2::20" ||
+		f.SrcPort != 5353 || f.Protocol != 17 || f.InIf != 1000001 || f.OutIf != 1000002 || f.Bytes != 200*512 || f.Packets != 512 {
+		t.Fatalf("unexpected flow: %+v", f)
+	}
+}
+
+func TestDecodeSFlow_CounterSamplesAndSequence(t *testing.T) {
+	d := NewDecoder(0)
+	d.DecodeSFlow("198.51.100.50", readFixture(t, "flow_samples.bin"), time.Now())
+	dg, err := d.DecodeSFlow("198.51.100.50", readFixture(t, "counter_samples.bin"), time.Now())
+	if err != nil {
+		t.Fatalf("DecodeSFlow: %v", err)
+	}
+	if len(dg.Flows) != 0 || len(dg.Counters) != 2 {
+		t.Fatalf("decoded %d flows and %d counters", len(dg.Flows), len(dg.Counters))
+	}
+	c := dg.Counters[0]
+	if c.FlowType != TypeSFlowCounters || c.Exporter != "192.0.2.1" || c.Sequence != 12 || c.IfIndex != 3 || c.IfSpeed != 1e9 ||
+		c.IfStatus != 3 || c.InOctets != 123456789012 || c.OutOctets != 987654321 || c.InErrors != 2 || c.OutErrors != 3 {
+		t.Fatalf("unexpected counters: %+v", c)
+	}
+	if dg.Counters[1].IfIndex != 4 || dg.Counters[1].InOctets != 42 {
+		t.Fatalf("unexpected expanded counters: %+v", dg.Counters[1])
+	}
+
+	// Datagram 1042 then 1043: no gap; replaying 1042 is a backwards jump
+	d.DecodeSFlow("198.51.100.50", readFixture(t, "flow_samples.bin"), time.Now())
+	es := d.Stats().Exporters[0]
+	if es.Protocol != "sflow" || es.Packets != 3 || es.Records != 6 || es.SequenceGaps != 1 || es.SequenceLost != 0 {
+		t.Fatalf("unexpected stats: %+v", es)
+	}
+}
+
+func TestDecodeSFlow_HostAgentCounters(t *testing.T) {
+	d := NewDecoder(0)
+	dg, err := d.DecodeSFlow("198.51.100.50", readFixture(t, "host_counters.bin"), time.Now())
+	if err != nil {
+		t.Fatalf("DecodeSFlow: %v", err)
+	}
+	// The host structures are skipped; only the interface counters are kept
+	if len(dg.Flows) != 0 || len(dg.Counters) != 1 {
+		t.Fatalf("decoded %d flows and %d counters", len(dg.Flows), len(dg.Counters))
+	}
+	want := InterfaceCounters{
+		FlowType: TypeSFlowCounters, Exporter: "192.0.2.20", SubAgentID: 100000, Sequence: 312,
+		IfIndex: 2, IfType: 6, IfSpeed: 1e9, IfDirection: 1, IfStatus: 3,
+		InOctets: 5815221427, InUcastPkts: 4815162, InMulticastPkts: 2310, InBroadcastPkts: 77,
+		OutOctets: 2147483648, OutUcastPkts: 3141592, OutMulticastPkts: 15, OutBroadcastPkts: 3,
+	}
+	if dg.Counters[0] != want {
+		t.Fatalf("counters\n got %+v\nwant %+v", dg.Counters[0], want)
+	}
+}
+
+func TestDecodeSFlow_RejectsTruncatedAndOtherVersions(t *testing.T) {
+	d := NewDecoder(0)
+	b := readFixture(t, "flow_samples.bin")
+	if _, err := d.DecodeSFlow("", b[:100], time.Now()); !errors.Is(err, ErrTruncated) {
+		t.Fatalf("truncated datagram returned %v", err)
+	}
+	if _, err := d.DecodeSFlow("", []byte{0, 0, 0, 4, 0, 0, 0, 1}, time.Now()); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Fatalf("sFlow v4 returned %v", err)
+	}
+}
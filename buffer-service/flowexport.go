@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"buffer-service/flow"
+)
+
+// errNotFlow is returned for netflow records that carry no recognisable flow.
+// No retry can change that, so the record is dead-lettered at once.
+var errNotFlow = fmt.Errorf("%w: record is not a flow", errRejected)
+
+// flowExportVersion maps forwarding.netflow.version to an export version
+func flowExportVersion(version string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(version)) {
+	case "", "v9", "9", "netflow_v9":
+		return flow.ExportV9, nil
+	case "ipfix", "v10", "10":
+		return flow.ExportIPFIX, nil
+	}
+	return 0, fmt.Errorf("unsupported flow export version %q", version)
+}
+
+// flowForwarder re-encodes buffered flows as NetFlow v9 or IPFIX over UDP
+type flowForwarder struct {
+	dest     DestinationCfg
+	exporter *flow.Exporter
+	addr     string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newFlowForwarder(dest DestinationCfg) (*flowForwarder, error) {
+	if network := strings.ToLower(dest.Transport); network != "" && network != "udp" {
+		return nil, fmt.Errorf("flow export requires UDP, not %q", dest.Transport)
+	}
+	version, err := flowExportVersion(dest.Version)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := flow.NewExporter(flow.ExportOptions{
+		Version:         version,
+		MaxMessageSize:  dest.MaxMessageBytes,
+		TemplateRefresh: time.Duration(dest.TemplateRefreshSec) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// IPFIX goes to the destination's IPFIX port when one is configured
+	port := dest.Port
+	if p := dest.FlowPorts["ipfix"]; version == flow.ExportIPFIX && p > 0 {
+		port = p
+	}
+	return &flowForwarder{dest: dest, exporter: exporter, addr: net.JoinHostPort(dest.Host, strconv.Itoa(port))}, nil
+}
+
+func (f *flowForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch packs the flows of every record into as few export messages as
+// the size limit allows. A record fails if any message carrying its flows does.
+func (f *flowForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	var flows []flow.Record
+	var owners []int
+	for i, record := range records {
+		parsed, err := parseFlowRecords(record.JsonData)
+		if err != nil {
+			if !errors.Is(err, errRejected) {
+				err = fmt.Errorf("%w: %v", errRejected, err)
+			}
+			errs[i] = err
+			continue
+		}
+		for _, fl := range parsed {
+			if fl.Exporter == "" {
+				fl.Exporter = record.SourceIP
+			}
+			flows = append(flows, fl)
+			owners = append(owners, i)
+		}
+	}
+
+	for _, m := range f.exporter.Encode(flows, time.Now()) {
+		if err := f.send(m.Data); err != nil {
+			for _, idx := range m.Records {
+				errs[owners[idx]] = err
+			}
+		}
+	}
+	return errs
+}
+
+// send writes one message on the persistent socket, redialing after an error
+func (f *flowForwarder) send(b []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == nil {
+		conn, err := net.DialTimeout("udp", f.addr, secondsOr(f.dest.DialTimeoutSec, 5))
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+	f.conn.SetWriteDeadline(time.Now().Add(secondsOr(f.dest.WriteTimeoutSec, 5)))
+	if _, err := f.conn.Write(b); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (f *flowForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+	return nil
+}
+
+// goflowRecord is the JSON GoFlow2 posts to /api/v1/ingest/netflow
+type goflowRecord struct {
+	Type            string          `json:"type"`
+	SamplerAddress  string          `json:"sampler_address"`
+	SequenceNum     uint32          `json:"sequence_num"`
+	SamplingRate    uint32          `json:"sampling_rate"`
+	TimeFlowStartNs int64           `json:"time_flow_start_ns"`
+	TimeFlowEndNs   int64           `json:"time_flow_end_ns"`
+	Bytes           uint64          `json:"bytes"`
+	Packets         uint64          `json:"packets"`
+	SrcAddr         string          `json:"src_addr"`
+	DstAddr         string          `json:"dst_addr"`
+	NextHop         string          `json:"next_hop"`
+	Proto           json.RawMessage `json:"proto"` // a number, or a name such as "TCP"
+	SrcPort         uint16          `json:"src_port"`
+	DstPort         uint16          `json:"dst_port"`
+	InIf            uint32          `json:"in_if"`
+	OutIf           uint32          `json:"out_if"`
+	SrcAS           uint32          `json:"src_as"`
+	DstAS           uint32          `json:"dst_as"`
+	SrcNet          string          `json:"src_net"` // prefix such as 10.0.0.0/24
+	DstNet          string          `json:"dst_net"`
+	SrcMac          string          `json:"src_mac"`
+	DstMac          string          `json:"dst_mac"`
+	VlanID          uint16          `json:"vlan_id"`
+	IPTos           uint8           `json:"ip_tos"`
+	TCPFlags        uint8           `json:"tcp_flags"`
+}
+
+var ipProtocols = map[string]uint8{"ICMP": 1, "TCP": 6, "UDP": 17, "GRE": 47, "ESP": 50, "ICMPV6": 58, "SCTP": 132}
+
+// normalize converts a GoFlow2 record to a flow record
+func (g goflowRecord) normalize() flow.Record {
+	r := flow.Record{
+		FlowType: strings.ToLower(g.Type), Exporter: g.SamplerAddress, Sequence: g.SequenceNum, SamplingRate: g.SamplingRate,
+		SrcIP: g.SrcAddr, DstIP: g.DstAddr, NextHop: g.NextHop, SrcPort: g.SrcPort, DstPort: g.DstPort,
+		TCPFlags: g.TCPFlags, TOS: g.IPTos, Bytes: g.Bytes, Packets: g.Packets, InIf: g.InIf, OutIf: g.OutIf,
+		SrcAS: g.SrcAS, DstAS: g.DstAS, SrcMAC: g.SrcMac, DstMAC: g.DstMac, VLAN: g.VlanID,
+		StartTime: g.TimeFlowStartNs / int64(time.Millisecond), EndTime: g.TimeFlowEndNs / int64(time.Millisecond),
+	}
+	var number uint8
+	var name string
+	if json.Unmarshal(g.Proto, &number) == nil {
+		r.Protocol = number
+	} else if json.Unmarshal(g.Proto, &name) == nil {
+		r.Protocol = ipProtocols[strings.ToUpper(name)]
+	}
+	if _, n, err := net.ParseCIDR(g.SrcNet); err == nil {
+		ones, _ := n.Mask.Size()
+		r.SrcMask = uint8(ones)
+	}
+	if _, n, err := net.ParseCIDR(g.DstNet); err == nil {
+		ones, _ := n.Mask.Size()
+		r.DstMask = uint8(ones)
+	}
+	return r
+}
+
+// parseFlowRecords reads the flows of one netflow record: a flow from the
+// native collector, GoFlow2 JSON, or an array of either
+func parseFlowRecords(data string) ([]flow.Record, error) {
+	trimmed := bytes.TrimSpace([]byte(data))
+	var raw []json.RawMessage
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raw); err != nil {
+			return nil, err
+		}
+	} else {
+		raw = []json.RawMessage{trimmed}
+	}
+
+	flows := make([]flow.Record, 0, len(raw))
+	for _, item := range raw {
+		var r flow.Record
+		if err := json.Unmarshal(item, &r); err != nil {
+			return nil, err
+		}
+		if r.SrcIP == "" && r.DstIP == "" {
+			var g goflowRecord
+			if err := json.Unmarshal(item, &g); err != nil {
+				return nil, err
+			}
+			r = g.normalize()
+		}
+		if r.SrcIP == "" && r.DstIP == "" {
+			return nil, errNotFlow
+		}
+		flows = append(flows, r)
+	}
+	return flows, nil
+}
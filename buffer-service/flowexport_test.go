@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"buffer-service/flow"
+)
+
+// listenFlows returns a UDP socket standing in for the upstream flow collector
+func listenFlows(t *testing.T) (net.PacketConn, int) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc, pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+// readFlows decodes export messages until want flows arrive or the socket goes quiet
+func readFlows(t *testing.T, pc net.PacketConn, want int) ([]flow.Record, int) {
+	t.Helper()
+	d := flow.NewDecoder(0)
+	var flows []flow.Record
+	messages := 0
+	buf := make([]byte, 65535)
+	for len(flows) < want {
+		pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read after %d of %d flows: %v", len(flows), want, err)
+		}
+		got, err := d.Decode("127.0.0.1", buf[:n], time.Now())
+		if err != nil {
+			t.Fatalf("collector could not decode export: %v", err)
+		}
+		flows = append(flows, got...)
+		messages++
+	}
+	return flows, messages
+}
+
+func TestFlowForwarder_SendsGoFlowRecordsAsIPFIX(t *testing.T) {
+	pc, port := listenFlows(t)
+	fwd, err := newForwarder("netflow", DestinationCfg{
+		Enabled:   true,
+		Host:      "127.0.0.1",
+		Port:      1, // IPFIX goes to flow_ports["ipfix"]
+		Transport: "udp",
+		Version:   "ipfix",
+		FlowPorts: map[string]int{"ipfix": port},
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	payload := `{"type":"NETFLOW_V9","sampler_address":"192.0.2.1","src_addr":"10.0.0.1","dst_addr":"10.0.0.2",` +
+		`"proto":"TCP","src_port":51000,"dst_port":443,"bytes":123456,"packets":98,"src_net":"10.0.0.0/24"}`
+	if err := fwd.Forward(TelemetryRecord{DataType: "netflow", JsonData: payload}); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+
+	flows, _ := readFlows(t, pc, 1)
+	f := flows[0]
+	if f.FlowType != flow.TypeIPFIX || f.SrcIP != "10.0.0.1" || f.DstIP != "10.0.0.2" || f.Protocol != 6 ||
+		f.DstPort != 443 || f.Bytes != 123456 || f.Packets != 98 || f.SrcMask != 24 {
+		t.Fatalf("unexpected exported flow %+v", f)
+	}
+
+	if err := fwd.Forward(TelemetryRecord{DataType: "netflow", JsonData: `{"n":1}`}); !errors.Is(err, errRejected) {
+		t.Fatalf("record that is not a flow returned %v, want errRejected", err)
+	}
+}
+
+func TestNewForwarder_RejectsUnknownFlowVersion(t *testing.T) {
+	if _, err := newForwarder("netflow", DestinationCfg{Host: "x", Port: 1, Transport: "udp", Version: "v5"}); err == nil {
+		t.Fatal("expected error for NetFlow v5 export")
+	}
+}
+
+func TestDrain_ExportsBufferedFlowsInBatches(t *testing.T) {
+	pc, port := listenFlows(t)
+	bm := newTestBufferManager(t, "")
+	bm.config.Destinations["netflow"] = DestinationCfg{Enabled: true, Host: "127.0.0.1", Port: port, Transport: "udp"}
+	bm.applyForwarding(ApplianceForwardingCfg{Netflow: FlowForwardingCfg{Version: "v9"}})
+
+	cfg := bm.config.Services["goflow2"]
+	cfg.BufferMode = "database"
+	bm.config.Services["goflow2"] = cfg
+	const flows = 40
+	for i := 0; i < flows; i++ {
+		payload := fmt.Sprintf(`{"flow_type":"netflow_v9","src_ip":"10.0.0.%d","dst_ip":"192.0.2.1","protocol":17,"dst_port":53,"bytes":100,"packets":1}`, i+1)
+		if err := bm.StoreRecord(TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: int64(1000 + i), JsonData: payload, SourceIP: "198.51.100.7"}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+	bm.StoreRecord(TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: 2000, JsonData: `{"not":"a flow"}`})
+
+	bm.forwardBufferedRecords()
+
+	got, messages := readFlows(t, pc, flows)
+	if messages >= flows {
+		t.Fatalf("%d flows took %d messages; expected them to share packets", flows, messages)
+	}
+	for _, f := range got {
+		if f.FlowType != flow.TypeNetFlowV9 || f.DstPort != 53 {
+			t.Fatalf("unexpected exported flow %+v", f)
+		}
+	}
+
+	// A record that is not a flow can never be exported, so it is dead-lettered at once
+	var pending int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending)
+	if pending != 0 {
+		t.Fatalf("%d records pending, want none", pending)
+	}
+	if dl, err := bm.GetDeadLetter(1); err != nil || dl.JsonData != `{"not":"a flow"}` || dl.RetryCount != 1 {
+		t.Fatalf("dead letter = %+v, err %v", dl, err)
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"buffer-service/flow"
+)
+
+// errNoDestination is returned when a record's data type has no usable destination
+var errNoDestination = errors.New("no forwarding destination configured")
+
+// DestinationCfg describes where records of a single data type are forwarded
+type DestinationCfg struct {
+	Enabled         bool              `json:"enabled"`
+	Host            string            `json:"host"`
+	Port            int               `json:"port"`
+	Transport       string            `json:"transport"` // "udp", "tcp", "tls" (syslog), "http", "https"
+	Path            string            `json:"path,omitempty"`
+	Auth            AuthCfg           `json:"auth"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	FlowPorts       map[string]int    `json:"flow_ports,omitempty"` // netflow only: "ipfix" -> port for IPFIX export
+	DialTimeoutSec  int               `json:"dial_timeout_seconds"`
+	WriteTimeoutSec int               `json:"write_timeout_seconds"`
+	Concurrency     int               `json:"concurrency,omitempty"` // in-flight forwards while draining the backlog
+
+	// syslog: "rfc3164" (default) or "rfc5424"; metrics: "influx" (default) or "remote_write".
+	// "otlp" or "otlp_json" exports syslog, windows_events and metrics over OTLP/HTTP;
+	// "loki" or "loki_json" pushes syslog and windows_events to Grafana Loki;
+	// "elasticsearch" or "opensearch" indexes any data type through _bulk.
+	Format string `json:"format,omitempty"`
+
+	// tls transport
+	TLSCAFile     string `json:"tls_ca_file,omitempty"`     // verify the server against this CA instead of the system pool
+	TLSServerName string `json:"tls_server_name,omitempty"` // defaults to host
+	TLSCertFile   string `json:"tls_cert_file,omitempty"`   // optional client certificate
+	TLSKeyFile    string `json:"tls_key_file,omitempty"`
+
+	// metrics only: remote_write is also chosen by a path ending /api/v1/write.
+	// OutOfOrderWindowSec should match the receiver's out_of_order_time_window.
+	// For Loki it is the unordered-write window, one hour unless set.
+	OutOfOrderWindowSec int `json:"out_of_order_window_seconds,omitempty"`
+
+	// Loki only: stream label name -> record field, dotted for nested fields.
+	// Syslog fields include host, app, facility and severity.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Elasticsearch only: index name template with %{data_type}, %{service}
+	// and a %{+yyyy.MM.dd} style date
+	Index string `json:"index,omitempty"`
+
+	// metrics only: InfluxDB v2 write target. SecretsFile is a JSON file with
+	// "org", "bucket" and "token" that fills in whatever is not set here.
+	Org         string `json:"org,omitempty"`
+	Bucket      string `json:"bucket,omitempty"`
+	SecretsFile string `json:"secrets_file,omitempty"`
+
+	// netflow only: buffered flows are re-encoded rather than sent as JSON
+	Version            string `json:"version,omitempty"`                  // "v9" (default) or "ipfix"
+	MaxMessageBytes    int    `json:"max_message_bytes,omitempty"`        // export packet size limit; syslog: longest message
+	TemplateRefreshSec int    `json:"template_refresh_seconds,omitempty"` // how often templates are resent
+}
+
+// AuthCfg holds destination credentials
+type AuthCfg struct {
+	Type      string `json:"type"` // "none", "basic", "bearer", "token", "apikey"
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Token     string `json:"token,omitempty"`
+	TokenEnv  string `json:"token_env,omitempty"`  // environment variable holding the token
+	TokenFile string `json:"token_file,omitempty"` // file holding the token, e.g. a container secret
+}
+
+// redactedSecret stands in for credentials in config returned by the API
+const redactedSecret = "********"
+
+// redacted returns the auth settings with credentials masked
+func (a AuthCfg) redacted() AuthCfg {
+	if a.Password != "" {
+		a.Password = redactedSecret
+	}
+	if a.Token != "" {
+		a.Token = redactedSecret
+	}
+	return a
+}
+
+// unredacted restores credentials that a client sent back masked from prev
+func (a AuthCfg) unredacted(prev AuthCfg) AuthCfg {
+	if a.Password == redactedSecret {
+		a.Password = prev.Password
+	}
+	if a.Token == redactedSecret {
+		a.Token = prev.Token
+	}
+	return a
+}
+
+// redacted returns the destination with its credentials masked. Header
+// values often carry API keys, so every one of them is masked too.
+func (d DestinationCfg) redacted() DestinationCfg {
+	d.Auth = d.Auth.redacted()
+	if len(d.Headers) > 0 {
+		headers := make(map[string]string, len(d.Headers))
+		for name := range d.Headers {
+			headers[name] = redactedSecret
+		}
+		d.Headers = headers
+	}
+	return d
+}
+
+// unredacted restores credentials and header values that a client sent back
+// masked from prev. It updates d's Headers map in place.
+func (d DestinationCfg) unredacted(prev DestinationCfg) DestinationCfg {
+	d.Auth = d.Auth.unredacted(prev.Auth)
+	for name, value := range d.Headers {
+		if value == redactedSecret {
+			d.Headers[name] = prev.Headers[name]
+		}
+	}
+	return d
+}
+
+// Forwarder delivers telemetry records to an upstream collector
+type Forwarder interface {
+	Forward(record TelemetryRecord) error
+	Close() error
+}
+
+// BatchForwarder is a Forwarder that can deliver many records in one request.
+// ForwardBatch returns one error per record, nil where the record was accepted.
+type BatchForwarder interface {
+	Forwarder
+	ForwardBatch(records []TelemetryRecord) []error
+}
+
+// defaultDestinations returns the destinations used when none are configured
+func defaultDestinations() map[string]DestinationCfg {
+	return map[string]DestinationCfg{
+		"syslog": {
+			Enabled:         true,
+			Host:            "obs.rectitude.net",
+			Port:            1514,
+			Transport:       "udp",
+			DialTimeoutSec:  5,
+			WriteTimeoutSec: 5,
+		},
+		"netflow": {
+			Enabled:         true,
+			Host:            "obs.rectitude.net",
+			Port:            2055,
+			Transport:       "udp",
+			FlowPorts:       map[string]int{"ipfix": 4739},
+			DialTimeoutSec:  5,
+			WriteTimeoutSec: 5,
+		},
+		"snmp": {
+			Enabled:         true,
+			Host:            "obs.rectitude.net",
+			Port:            162,
+			Transport:       "udp",
+			DialTimeoutSec:  5,
+			WriteTimeoutSec: 5,
+		},
+		"windows_events": {
+			Enabled:         true,
+			Host:            "obs.rectitude.net",
+			Port:            8084,
+			Transport:       "http",
+			Path:            "/",
+			DialTimeoutSec:  5,
+			WriteTimeoutSec: 10,
+		},
+		"metrics": {
+			Enabled:         true,
+			Host:            "obs.rectitude.net",
+			Port:            8086,
+			Transport:       "http",
+			Path:            "/api/v2/write",
+			SecretsFile:     "/run/secrets/influxdb.json",
+			Auth:            AuthCfg{Type: "token", TokenEnv: "INFLUXDB_TOKEN"},
+			DialTimeoutSec:  5,
+			WriteTimeoutSec: 10,
+		},
+	}
+}
+
+// newForwarder builds a forwarder for a destination based on its transport
+func newForwarder(dataType string, dest DestinationCfg) (Forwarder, error) {
+	if dest.Host == "" || dest.Port <= 0 {
+		return nil, fmt.Errorf("destination for %s requires host and port", dataType)
+	}
+
+	transport := strings.ToLower(dest.Transport)
+	if isOTLP(dest) {
+		if transport != "http" && transport != "https" {
+			return nil, fmt.Errorf("OTLP export for %s requires http or https transport", dataType)
+		}
+		return newOTLPForwarder(dataType, dest)
+	}
+	if isElastic(dest) {
+		if transport != "http" && transport != "https" {
+			return nil, fmt.Errorf("Elasticsearch output for %s requires http or https transport", dataType)
+		}
+		return newElasticForwarder(dataType, dest)
+	}
+	if (dataType == "syslog" || dataType == "windows_events") && isLoki(dest) {
+		if transport != "http" && transport != "https" {
+			return nil, fmt.Errorf("Loki output for %s requires http or https transport", dataType)
+		}
+		return newLokiForwarder(dataType, dest)
+	}
+	if dataType == "syslog" && (transport == "udp" || transport == "tcp" || transport == "tls" || transport == "") {
+		return newSyslogForwarder(dest)
+	}
+	switch transport {
+	case "udp", "":
+		if dataType == "netflow" {
+			return newFlowForwarder(dest)
+		}
+		return &socketForwarder{dest: dest, network: transport}, nil
+	case "tcp":
+		return &socketForwarder{dest: dest, network: transport}, nil
+	case "http", "https":
+		if dataType == "metrics" && isRemoteWrite(dest) {
+			return newRemoteWriteForwarder(dest)
+		}
+		if dataType == "metrics" {
+			return newInfluxForwarder(dest)
+		}
+		return &httpForwarder{dest: dest, scheme: transport, client: newHTTPClient(dest)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transport %q for %s", dest.Transport, dataType)
+	}
+}
+
+// newHTTPClient returns a client honoring the destination's timeouts
+func newHTTPClient(dest DestinationCfg) *http.Client {
+	return &http.Client{
+		Timeout: secondsOr(dest.WriteTimeoutSec, 10),
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: secondsOr(dest.DialTimeoutSec, 5)}).DialContext,
+		},
+	}
+}
+
+// secondsOr converts a seconds setting to a duration, using def when unset
+func secondsOr(seconds, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// buildForwarders creates forwarders for every enabled destination
+func (bm *BufferManager) buildForwarders() {
+	bm.fwdMutex.RLock()
+	appliance := bm.applianceForwarding
+	bm.fwdMutex.RUnlock()
+
+	forwarders := make(map[string]Forwarder)
+	problems := make(map[string]string)
+	for dataType, dest := range bm.config.Destinations {
+		if !dest.Enabled {
+			continue
+		}
+		dest = appliance.override(dataType, dest)
+		fwd, err := newForwarder(dataType, dest)
+		if err != nil {
+			logger.WithError(err).WithField("data_type", dataType).Error("Forwarding destination is invalid; its records stay buffered")
+			problems[dataType] = err.Error()
+			continue
+		}
+		forwarders[dataType] = fwd
+	}
+
+	bm.fwdMutex.Lock()
+	old := bm.forwarders
+	bm.forwarders = forwarders
+	bm.destinationErrors = problems
+	bm.fwdMutex.Unlock()
+
+	for _, fwd := range old {
+		fwd.Close()
+	}
+}
+
+// destinationProblems returns why each enabled destination could not be built
+func (bm *BufferManager) destinationProblems() map[string]string {
+	bm.fwdMutex.RLock()
+	defer bm.fwdMutex.RUnlock()
+	problems := make(map[string]string, len(bm.destinationErrors))
+	for dataType, problem := range bm.destinationErrors {
+		problems[dataType] = problem
+	}
+	return problems
+}
+
+// getForwarder returns the forwarder for a data type, or nil if none is configured.
+// sFlow interface counters are metrics and go out through the metrics destination.
+func (bm *BufferManager) getForwarder(dataType string) Forwarder {
+	if dataType == flow.TypeSFlowCounters {
+		dataType = "metrics"
+	}
+	bm.fwdMutex.RLock()
+	defer bm.fwdMutex.RUnlock()
+	return bm.forwarders[dataType]
+}
+
+// socketForwarder writes raw record payloads over UDP or TCP
+type socketForwarder struct {
+	dest    DestinationCfg
+	network string
+}
+
+func (f *socketForwarder) Forward(record TelemetryRecord) error {
+	network := f.network
+	if network == "" {
+		network = "udp"
+	}
+
+	conn, err := net.DialTimeout(network, f.address(), secondsOr(f.dest.DialTimeoutSec, 5))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(secondsOr(f.dest.WriteTimeoutSec, 5)))
+
+	payload := []byte(record.JsonData)
+	if network == "tcp" {
+		payload = append(payload, '\n')
+	}
+	_, err = conn.Write(payload)
+	return err
+}
+
+// address returns the destination's host and port
+func (f *socketForwarder) address() string {
+	return net.JoinHostPort(f.dest.Host, strconv.Itoa(f.dest.Port))
+}
+
+func (f *socketForwarder) Close() error {
+	return nil
+}
+
+// httpForwarder POSTs record payloads to an HTTP endpoint
+type httpForwarder struct {
+	dest   DestinationCfg
+	scheme string
+	client *http.Client
+}
+
+func (f *httpForwarder) url() string {
+	path := f.dest.Path
+	if path == "" {
+		path = "/"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return fmt.Sprintf("%s://%s%s", f.scheme, net.JoinHostPort(f.dest.Host, strconv.Itoa(f.dest.Port)), path)
+}
+
+func (f *httpForwarder) Forward(record TelemetryRecord) error {
+	req, err := http.NewRequest("POST", f.url(), bytes.NewBufferString(record.JsonData))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.dest.Auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// applyAuth sets the Authorization header according to the destination auth config
+func applyAuth(req *http.Request, auth AuthCfg) {
+	switch strings.ToLower(auth.Type) {
+	case "basic":
+		req.SetBasicAuth(auth.Username, auth.Password)
+	case "bearer":
+		if token := resolveToken(auth); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	case "token":
+		if token := resolveToken(auth); token != "" {
+			req.Header.Set("Authorization", "Token "+token)
+		}
+	case "apikey":
+		if token := resolveToken(auth); token != "" {
+			req.Header.Set("Authorization", "ApiKey "+token)
+		}
+	}
+}
+
+// resolveToken returns the configured token, falling back to its file and
+// then its environment variable
+func resolveToken(auth AuthCfg) string {
+	if auth.Token != "" {
+		return auth.Token
+	}
+	if auth.TokenFile != "" {
+		if data, err := os.ReadFile(auth.TokenFile); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	if auth.TokenEnv != "" {
+		return os.Getenv(auth.TokenEnv)
+	}
+	return ""
+}
+
+func (f *httpForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestHTTPForwarder_LocalCollector(t *testing.T) {
+	var gotBody, gotAuth, gotPath string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+		gotAuth = r.Header.Get("Authorization")
+		gotPath = r.URL.RequestURI()
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	fwd, err := newForwarder("windows_events", DestinationCfg{
+		Enabled:   true,
+		Host:      u.Hostname(),
+		Port:      port,
+		Transport: "http",
+		Path:      "/events",
+		Auth:      AuthCfg{Type: "bearer", Token: "secret"},
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	if err := fwd.Forward(TelemetryRecord{DataType: "windows_events", JsonData: `{"a":1}`}); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	if gotBody != `{"a":1}` || gotAuth != "Bearer secret" || gotPath != "/events" {
+		t.Fatalf("unexpected request: body=%q auth=%q path=%q", gotBody, gotAuth, gotPath)
+	}
+}
+
+func TestNewForwarder_RejectsIncompleteDestination(t *testing.T) {
+	if _, err := newForwarder("syslog", DestinationCfg{Enabled: true, Transport: "udp"}); err == nil {
+		t.Fatal("expected error for destination without host")
+	}
+	if _, err := newForwarder("syslog", DestinationCfg{Host: "x", Port: 1, Transport: "carrier-pigeon"}); err == nil {
+		t.Fatal("expected error for unknown transport")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxMaxLines is how many lines go into one write, as InfluxDB recommends
+const influxMaxLines = 5000
+
+var (
+	// errNoMetrics is permanent, like a record that is not valid JSON, so the
+	// record is dead-lettered at once
+	errNoMetrics = fmt.Errorf("%w: record holds no metrics with fields", errRejected)
+
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	stringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// influxSecrets is the JSON held in a destination's secrets_file
+type influxSecrets struct {
+	Org    string `json:"org"`
+	Bucket string `json:"bucket"`
+	Token  string `json:"token"`
+}
+
+// influxForwarder writes buffered Telegraf metrics to InfluxDB v2 as
+// gzip-compressed line protocol
+type influxForwarder struct {
+	dest   DestinationCfg
+	url    string
+	auth   AuthCfg
+	client *http.Client
+}
+
+// newInfluxForwarder resolves the write target. Org and bucket come from the
+// destination, then its secrets file, then a legacy ?org=&bucket= path.
+func newInfluxForwarder(dest DestinationCfg) (*influxForwarder, error) {
+	var secrets influxSecrets
+	if dest.SecretsFile != "" {
+		data, err := os.ReadFile(dest.SecretsFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("read secrets file: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &secrets); err != nil {
+				return nil, fmt.Errorf("parse secrets file %s: %v", dest.SecretsFile, err)
+			}
+		}
+	}
+
+	path := dest.Path
+	if path == "" {
+		path = "/api/v2/write"
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics path %q: %v", dest.Path, err)
+	}
+	query := u.Query()
+	org := firstNonEmpty(dest.Org, secrets.Org, query.Get("org"))
+	bucket := firstNonEmpty(dest.Bucket, secrets.Bucket, query.Get("bucket"))
+	if org == "" || bucket == "" {
+		return nil, fmt.Errorf("metrics destination requires org and bucket in its config or %s", firstNonEmpty(dest.SecretsFile, "secrets_file"))
+	}
+	query.Set("org", org)
+	query.Set("bucket", bucket)
+	query.Set("precision", "ns")
+	u.RawQuery = query.Encode()
+	u.Scheme = strings.ToLower(dest.Transport)
+	u.Host = net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port))
+
+	auth := dest.Auth
+	if auth.Type == "" || strings.EqualFold(auth.Type, "none") {
+		auth.Type = "token"
+	}
+	if auth.Token = resolveToken(auth); auth.Token == "" {
+		auth.Token = secrets.Token
+	}
+	return &influxForwarder{dest: dest, url: u.String(), auth: auth, client: newHTTPClient(dest)}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (f *influxForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch encodes every record and writes the lines in gzip batches of
+// up to influxMaxLines. A record fails with the batch that carried it.
+func (f *influxForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	var body bytes.Buffer
+	var pending []int
+	lines := 0
+
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := f.write(body.Bytes()); err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+		}
+		body.Reset()
+		pending = pending[:0]
+		lines = 0
+	}
+
+	for i, record := range records {
+		encoded, n, err := encodeLineProtocol(record)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if lines > 0 && lines+n > influxMaxLines {
+			flush()
+		}
+		body.Write(encoded)
+		pending = append(pending, i)
+		lines += n
+	}
+	flush()
+	return errs
+}
+
+// write posts one gzip-compressed batch of lines
+func (f *influxForwarder) write(lines []byte) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(lines)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", f.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		// InfluxDB explains rejected writes in a JSON message
+		var reason struct {
+			Message string `json:"message"`
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		err := fmt.Errorf("HTTP %d", resp.StatusCode)
+		if json.Unmarshal(msg, &reason) == nil && reason.Message != "" {
+			err = fmt.Errorf("HTTP %d: %s", resp.StatusCode, reason.Message)
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+			resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+			resp.StatusCode >= 500:
+			return err
+		default:
+			// Any other client error means InfluxDB will never accept these lines
+			return fmt.Errorf("%w: %v", errRejected, err)
+		}
+	}
+	return nil
+}
+
+func (f *influxForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+// telegrafMetric is one metric from Telegraf's JSON serializer
+type telegrafMetric struct {
+	Name      string                 `json:"name"`
+	Tags      map[string]interface{} `json:"tags"`
+	Fields    map[string]interface{} `json:"fields"`
+	Timestamp json.Number            `json:"timestamp"`
+}
+
+// encodeLineProtocol converts a buffered metrics record to line protocol. The
+// record holds one Telegraf metric, a {"metrics": [...]} batch, or an array.
+// It returns the lines and how many there are.
+func encodeLineProtocol(record TelemetryRecord) ([]byte, int, error) {
+	metrics, err := parseTelegrafMetrics(record.JsonData)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, m := range metrics {
+		if appendLine(&b, m, record.Timestamp) {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, 0, errNoMetrics
+	}
+	return b.Bytes(), n, nil
+}
+
+func parseTelegrafMetrics(data string) ([]telegrafMetric, error) {
+	dec := func(raw []byte, v interface{}) error {
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		return d.Decode(v)
+	}
+
+	raw := bytes.TrimSpace([]byte(data))
+	var metrics []telegrafMetric
+	switch {
+	case len(raw) > 0 && raw[0] == '[':
+		if err := dec(raw, &metrics); err != nil {
+			return nil, fmt.Errorf("%w: %v", errRejected, err)
+		}
+	default:
+		var batch struct {
+			Metrics []telegrafMetric `json:"metrics"`
+			telegrafMetric
+		}
+		if err := dec(raw, &batch); err != nil {
+			return nil, fmt.Errorf("%w: %v", errRejected, err)
+		}
+		metrics = batch.Metrics
+		if len(metrics) == 0 {
+			metrics = []telegrafMetric{batch.telegrafMetric}
+		}
+	}
+	return metrics, nil
+}
+
+// appendLine writes one metric as measurement,tags fields timestamp. Tags are
+// sorted, nested fields are flattened with "_" and metrics without a usable
+// field are skipped.
+func appendLine(b *bytes.Buffer, m telegrafMetric, recordTime int64) bool {
+	if m.Name == "" {
+		return false
+	}
+	fields := make(map[string]string)
+	flattenFields(fields, "", m.Fields)
+	if len(fields) == 0 {
+		return false
+	}
+
+	line := measurementEscaper.Replace(m.Name)
+	for _, k := range sortedKeys(m.Tags) {
+		v := tagValue(m.Tags[k])
+		if k == "" || v == "" {
+			continue
+		}
+		line += "," + tagEscaper.Replace(k) + "=" + tagEscaper.Replace(v)
+	}
+	b.WriteString(line)
+	for i, k := range sortedKeys(fields) {
+		if i == 0 {
+			b.WriteByte(' ')
+		} else {
+			b.WriteByte(',')
+		}
+		b.WriteString(tagEscaper.Replace(k) + "=" + fields[k])
+	}
+	fmt.Fprintf(b, " %d\n", timestampNanos(m.Timestamp, recordTime))
+	return true
+}
+
+// flattenFields renders field values in line protocol. Numbers are written as
+// floats: Telegraf's JSON does not tell 1 from 1.0, and writing whole floats
+// as integers would conflict with the field's type in InfluxDB.
+func flattenFields(out map[string]string, prefix string, fields map[string]interface{}) {
+	for k, v := range fields {
+		key := k
+		if prefix != "" {
+			key = prefix + "_" + k
+		}
+		switch v := v.(type) {
+		case json.Number:
+			f, err := v.Float64()
+			if err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+				out[key] = strconv.FormatFloat(f, 'g', -1, 64)
+			}
+		case bool:
+			out[key] = strconv.FormatBool(v)
+		case string:
+			out[key] = `"` + stringEscaper.Replace(v) + `"`
+		case map[string]interface{}:
+			flattenFields(out, key, v)
+		}
+	}
+}
+
+func tagValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+// timestampNanos scales a Telegraf timestamp to nanoseconds. Its unit follows
+// json_timestamp_units, so it is inferred from the magnitude; metrics without
+// one take the time they were buffered.
+func timestampNanos(ts json.Number, recordTime int64) int64 {
+	f, err := ts.Float64()
+	if err != nil || f <= 0 {
+		return recordTime * int64(time.Second)
+	}
+	scale := int64(1)
+	switch {
+	case f < 1e11: // seconds
+		scale = 1e9
+	case f < 1e14: // milliseconds
+		scale = 1e6
+	case f < 1e17: // microseconds
+		scale = 1e3
+	}
+	if n, err := ts.Int64(); err == nil {
+		return n * scale
+	}
+	return int64(f * float64(scale))
+}
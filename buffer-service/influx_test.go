@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestEncodeLineProtocol_EscapesAndScalesTimestamps(t *testing.T) {
+	record := TelemetryRecord{Timestamp: 1700000100, JsonData: `{"metrics":[
+		{"name":"cpu load","tags":{"host":"edge 01","region":"eu,west","empty":""},
+		 "fields":{"usage":97.5,"up":true,"note":"say \"hi\" \\","disk":{"used":3}},"timestamp":1700000000},
+		{"name":"mem","fields":{"free":1024},"timestamp":1700000000123},
+		{"name":"no_time","fields":{"v":1}},
+		{"name":"no_fields","fields":{}}
+	]}`}
+
+	got, n, err := encodeLineProtocol(record)
+	if err != nil {
+		t.Fatalf("encodeLineProtocol: %v", err)
+	}
+	want := `cpu\ load,host=edge\ 01,region=eu\,west disk_used=3,note="say \"hi\" \\",up=true,usage=97.5 1700000000000000000` + "\n" +
+		"mem free=1024 1700000000123000000\n" +
+		"no_time v=1 1700000100000000000\n"
+	if n != 3 || string(got) != want {
+		t.Fatalf("got %d lines:\n%s\nwant:\n%s", n, got, want)
+	}
+
+	if _, _, err := encodeLineProtocol(TelemetryRecord{JsonData: `{"name":"empty","fields":{}}`}); err != errNoMetrics {
+		t.Fatalf("metric without fields: err = %v", err)
+	}
+}
+
+func TestInfluxForwarder_WritesGzipLineProtocolBatches(t *testing.T) {
+	var bodies []string
+	var query url.Values
+	var auth, encoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth, encoding = r.URL.Query(), r.Header.Get("Authorization"), r.Header.Get("Content-Encoding")
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	secrets := filepath.Join(t.TempDir(), "influxdb.json")
+	os.WriteFile(secrets, []byte(`{"org":"acme","bucket":"noc","token":"s3cret"}`), 0600)
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	fwd, err := newForwarder("metrics", DestinationCfg{
+		Host: u.Hostname(), Port: port, Transport: "http", Bucket: "override", SecretsFile: secrets,
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	errs := fwd.(BatchForwarder).ForwardBatch([]TelemetryRecord{
+		{JsonData: `{"name":"cpu","tags":{"host":"a"},"fields":{"idle":97.5},"timestamp":1700000000}`},
+		{JsonData: `not json`},
+		{JsonData: `[{"name":"mem","fields":{"free":1},"timestamp":1700000001},{"name":"mem","fields":{"free":2},"timestamp":1700000002}]`},
+	})
+	if errs[0] != nil || !errors.Is(errs[1], errRejected) || errs[2] != nil {
+		t.Fatalf("unexpected per-record errors %v", errs)
+	}
+	if len(bodies) != 1 || strings.Count(bodies[0], "\n") != 3 {
+		t.Fatalf("expected one write of three lines, got %q", bodies)
+	}
+	if query.Get("org") != "acme" || query.Get("bucket") != "override" || query.Get("precision") != "ns" {
+		t.Fatalf("unexpected write target %v", query)
+	}
+	if auth != "Token s3cret" || encoding != "gzip" {
+		t.Fatalf("auth=%q encoding=%q", auth, encoding)
+	}
+}
+
+func TestInfluxForwarder_RejectsOnlyPermanentFailures(t *testing.T) {
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"code":"invalid","message":"partial write: field type conflict"}`))
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	fwd, err := newForwarder("metrics", DestinationCfg{
+		Host: u.Hostname(), Port: port, Transport: "http", Org: "acme", Bucket: "noc",
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	metric := TelemetryRecord{JsonData: `{"name":"cpu","fields":{"idle":97.5}}`}
+	err = fwd.Forward(metric)
+	if !errors.Is(err, errRejected) || !strings.Contains(err.Error(), "field type conflict") {
+		t.Fatalf("HTTP 400 returned %v, want errRejected with InfluxDB's message", err)
+	}
+	for _, status = range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusServiceUnavailable} {
+		if err := fwd.Forward(metric); err == nil || errors.Is(err, errRejected) {
+			t.Fatalf("HTTP %d returned %v, want a retryable error", status, err)
+		}
+	}
+	if err := fwd.Forward(TelemetryRecord{JsonData: `{"name":"cpu","fields":{}}`}); !errors.Is(err, errRejected) {
+		t.Fatalf("record without fields returned %v, want errRejected", err)
+	}
+}
+
+func TestNewInfluxForwarder_RequiresOrgAndBucket(t *testing.T) {
+	dest := DestinationCfg{Host: "influx", Port: 8086, Transport: "https", SecretsFile: filepath.Join(t.TempDir(), "missing.json")}
+	if _, err := newInfluxForwarder(dest); err == nil {
+		t.Fatal("expected error without org and bucket")
+	}
+
+	// Paths saved before org and bucket had their own settings still work
+	dest.Path = "/api/v2/write?org=rectitude&bucket=r369"
+	fwd, err := newInfluxForwarder(dest)
+	if err != nil {
+		t.Fatalf("newInfluxForwarder: %v", err)
+	}
+	if want := "https://influx:8086/api/v2/write?bucket=r369&org=rectitude&precision=ns"; fwd.url != want {
+		t.Fatalf("url = %s, want %s", fwd.url, want)
+	}
+}
+
+func TestBufferStatus_ReportsDestinationWithoutOrgAndBucket(t *testing.T) {
+	// An upgraded appliance keeps the default metrics destination, which has no org or bucket
+	secrets := filepath.Join(t.TempDir(), "missing.json")
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		dest := cfg.Destinations["metrics"]
+		dest.SecretsFile = secrets
+		cfg.Destinations["metrics"] = dest
+	})
+	if bm.getForwarder("metrics") != nil {
+		t.Fatal("metrics forwarder built without org and bucket")
+	}
+
+	rec := httptest.NewRecorder()
+	bm.handleStatus(rec, httptest.NewRequest("GET", "/api/buffer/status", nil))
+	var status struct {
+		DestinationErrors map[string]string `json:"destination_errors"`
+	}
+	json.NewDecoder(rec.Body).Decode(&status)
+	if !strings.Contains(status.DestinationErrors["metrics"], "org and bucket") {
+		t.Fatalf("status destination_errors = %v", status.DestinationErrors)
+	}
+}
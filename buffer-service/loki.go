@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	// lokiBatchBytes bounds the log lines in one push, as Promtail's batchsize
+	lokiBatchBytes = 1 << 20
+	// lokiDefaultWindow is how far behind a stream's newest entry Loki
+	// accepts writes by default (half of max_chunk_age)
+	lokiDefaultWindow = time.Hour
+	// lokiMaxStreams bounds the per-stream newest-entry memory
+	lokiMaxStreams = 100000
+)
+
+// defaultLokiLabels maps stream label names to the record fields they are
+// read from when a destination sets no labels
+var defaultLokiLabels = map[string]map[string]string{
+	"syslog":         {"host": "host", "facility": "facility"},
+	"windows_events": {"host": "computer", "channel": "channel"},
+}
+
+// isLoki reports whether a destination takes the Loki push API
+func isLoki(dest DestinationCfg) bool {
+	switch strings.ToLower(dest.Format) {
+	case "loki", "loki_json":
+		return true
+	case "":
+		path := strings.SplitN(dest.Path, "?", 2)[0]
+		return strings.HasSuffix(path, "/loki/api/v1/push")
+	}
+	return false
+}
+
+type lokiEntry struct {
+	timestamp int64 // unix nanoseconds
+	line      string
+	owner     int // index of the record the entry came from
+}
+
+type lokiStream struct {
+	labels  string // {name="value", ...}, sorted by name
+	pairs   []promLabel
+	entries []lokiEntry
+}
+
+// lokiForwarder pushes buffered syslog and Windows events to Grafana Loki as
+// snappy-compressed protobuf, or as JSON with loki_json.
+//
+// Each record becomes one entry in the stream named by its labels: service,
+// data_type and those extracted from the record. Loki refuses an entry that
+// is further behind the newest one in its stream than its unordered-write
+// window, so entries are sorted per stream, pushes are serialized, and an
+// entry already further behind what was pushed than out_of_order_window_seconds
+// (default one hour) is rejected here instead of being retried. One forwarder
+// serves each data type, and data_type is always a label, so streams are never
+// shared between the concurrently drained data types.
+type lokiForwarder struct {
+	dataType string
+	dest     DestinationCfg
+	url      string
+	json     bool
+	labels   map[string]string
+	window   int64 // nanoseconds
+	client   *http.Client
+
+	mu     sync.Mutex
+	newest map[string]int64
+}
+
+func newLokiForwarder(dataType string, dest DestinationCfg) (*lokiForwarder, error) {
+	if dataType != "syslog" && dataType != "windows_events" {
+		return nil, fmt.Errorf("Loki output does not support %s", dataType)
+	}
+	path := dest.Path
+	if path == "" || path == "/" {
+		path = "/loki/api/v1/push"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	labels := dest.Labels
+	if len(labels) == 0 {
+		labels = defaultLokiLabels[dataType]
+	}
+	window := time.Duration(dest.OutOfOrderWindowSec) * time.Second
+	if window <= 0 {
+		window = lokiDefaultWindow
+	}
+	return &lokiForwarder{
+		dataType: dataType,
+		dest:     dest,
+		url:      fmt.Sprintf("%s://%s%s", strings.ToLower(dest.Transport), net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)), path),
+		json:     strings.EqualFold(dest.Format, "loki_json"),
+		labels:   labels,
+		window:   int64(window),
+		client:   newHTTPClient(dest),
+		newest:   make(map[string]int64),
+	}, nil
+}
+
+func (f *lokiForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch pushes the records in batches of about lokiBatchBytes of log
+// lines. A record fails with the push that carried it.
+func (f *lokiForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	streams := make(map[string]*lokiStream)
+	var keys []string
+	var owners []int
+	size := 0
+	flush := func() {
+		if len(owners) > 0 {
+			ordered := make([]*lokiStream, len(keys))
+			for i, key := range keys {
+				ordered[i] = streams[key]
+			}
+			f.push(ordered, owners, errs)
+		}
+		streams, keys, owners, size = make(map[string]*lokiStream), nil, nil, 0
+	}
+
+	for i, record := range records {
+		pairs, entry := f.entry(record, i)
+		if size > 0 && size+len(entry.line) > lokiBatchBytes {
+			flush()
+		}
+		labels := lokiLabels(pairs)
+		s, ok := streams[labels]
+		if !ok {
+			s = &lokiStream{labels: labels, pairs: pairs}
+			streams[labels] = s
+			keys = append(keys, labels)
+		}
+		s.entries = append(s.entries, entry)
+		owners = append(owners, i)
+		size += len(entry.line)
+	}
+	flush()
+	return errs
+}
+
+// entry converts a record to its stream labels and log entry. Syslog lines
+// are the message text; Windows events are kept as JSON for Loki's json parser.
+func (f *lokiForwarder) entry(record TelemetryRecord, owner int) ([]promLabel, lokiEntry) {
+	fields := make(map[string]string)
+	var data map[string]interface{}
+	if json.Unmarshal([]byte(record.JsonData), &data) == nil {
+		flattenLabelFields(fields, "", data)
+	}
+	entry := lokiEntry{timestamp: record.Timestamp * int64(time.Second), line: record.JsonData, owner: owner}
+
+	if f.dataType == "syslog" {
+		msg := syslogFromRecord(record)
+		fields["host"] = msg.Hostname
+		fields["app"] = msg.AppName
+		fields["facility"] = syslogFacilities[msg.Facility]
+		fields["severity"] = syslogSeverities[msg.Severity]
+		entry.line = msg.Message
+		entry.timestamp = syslogTime(msg.Timestamp).UnixNano()
+	} else if ts, ok := firstString(data, "event_timestamp", "timestamp"); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			entry.timestamp = t.UnixNano()
+		}
+	}
+
+	values := map[string]string{"data_type": f.dataType, "service": record.Service}
+	for name, field := range f.labels {
+		values[promName(name, false)] = fields[field]
+	}
+	var pairs []promLabel
+	for _, name := range sortedKeys(values) {
+		if values[name] != "" {
+			pairs = append(pairs, promLabel{name, values[name]})
+		}
+	}
+	return pairs, entry
+}
+
+// lokiLabels renders sorted label pairs as a LogQL stream selector
+func lokiLabels(pairs []promLabel) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, p := range pairs {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(p.name + "=" + strconv.Quote(p.value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// flattenLabelFields renders scalar record fields as strings, nested ones
+// under dotted names
+func flattenLabelFields(out map[string]string, prefix string, fields map[string]interface{}) {
+	for k, v := range fields {
+		switch v := v.(type) {
+		case string:
+			out[prefix+k] = v
+		case float64:
+			out[prefix+k] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			out[prefix+k] = strconv.FormatBool(v)
+		case map[string]interface{}:
+			flattenLabelFields(out, prefix+k+".", v)
+		}
+	}
+}
+
+// push sorts each stream, holds back entries Loki would refuse as too old and
+// sends the rest
+func (f *lokiForwarder) push(streams []*lokiStream, owners []int, errs []error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sent := make(map[int]bool)
+	late := make(map[int]bool)
+	var kept []*lokiStream
+	for _, s := range streams {
+		sort.SliceStable(s.entries, func(i, j int) bool { return s.entries[i].timestamp < s.entries[j].timestamp })
+		newest, seen := f.newest[s.labels]
+		entries := s.entries[:0]
+		for _, e := range s.entries {
+			if seen && e.timestamp < newest-f.window {
+				late[e.owner] = true
+				continue
+			}
+			entries = append(entries, e)
+			sent[e.owner] = true
+		}
+		if len(entries) > 0 {
+			s.entries = entries
+			kept = append(kept, s)
+		}
+	}
+	for owner := range late {
+		errs[owner] = fmt.Errorf("%w: entry older than the stream's out-of-order window", errRejected)
+	}
+	if len(kept) == 0 {
+		return
+	}
+	if n := len(late); n > 0 {
+		logger.WithField("records", n).Warn("Dropped Loki entries older than the out-of-order window")
+	}
+
+	if err := f.post(kept); err != nil {
+		for _, owner := range owners {
+			if sent[owner] {
+				errs[owner] = err
+			}
+		}
+		return
+	}
+
+	if len(f.newest) > lokiMaxStreams {
+		f.newest = make(map[string]int64)
+	}
+	for _, s := range kept {
+		if last := s.entries[len(s.entries)-1].timestamp; last > f.newest[s.labels] {
+			f.newest[s.labels] = last
+		}
+	}
+}
+
+// post sends one push request. Loki answers entries it will never accept,
+// such as out-of-order or oversized ones, with 400; those are not retried.
+func (f *lokiForwarder) post(streams []*lokiStream) error {
+	var body []byte
+	contentType, encoding := "application/x-protobuf", "snappy"
+	if f.json {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		json.NewEncoder(zw).Encode(lokiJSONPush(streams))
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body, contentType, encoding = buf.Bytes(), "application/json", "gzip"
+	} else {
+		body = snappy.Encode(nil, lokiPushRequest(streams))
+	}
+
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.dest.Auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusBadRequest:
+			return fmt.Errorf("%w: %v", errRejected, err)
+		case http.StatusTooManyRequests:
+			if after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				return &retryAfterError{err, after}
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *lokiForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+// lokiPushRequest encodes PushRequest{streams = 1},
+// StreamAdapter{labels = 1, entries = 2} and EntryAdapter{timestamp = 1,
+// line = 2}, the timestamp being google.protobuf.Timestamp{seconds = 1, nanos = 2}
+func lokiPushRequest(streams []*lokiStream) []byte {
+	var req []byte
+	for _, s := range streams {
+		stream := appendProtoBytes(nil, 1, []byte(s.labels))
+		for _, e := range s.entries {
+			var ts []byte
+			ts = binary.AppendUvarint(ts, 1<<3|0)
+			ts = binary.AppendUvarint(ts, uint64(e.timestamp/1e9))
+			ts = binary.AppendUvarint(ts, 2<<3|0)
+			ts = binary.AppendUvarint(ts, uint64(e.timestamp%1e9))
+			entry := appendProtoBytes(nil, 1, ts)
+			entry = appendProtoBytes(entry, 2, []byte(e.line))
+			stream = appendProtoBytes(stream, 2, entry)
+		}
+		req = appendProtoBytes(req, 1, stream)
+	}
+	return req
+}
+
+// lokiJSONPush builds the JSON push body, which takes labels as an object and
+// entries as [nanosecond timestamp string, line] pairs
+func lokiJSONPush(streams []*lokiStream) map[string]interface{} {
+	var out []interface{}
+	for _, s := range streams {
+		labels := make(map[string]string, len(s.pairs))
+		for _, p := range s.pairs {
+			labels[p.name] = p.value
+		}
+		values := make([][2]string, len(s.entries))
+		for i, e := range s.entries {
+			values[i] = [2]string{strconv.FormatInt(e.timestamp, 10), e.line}
+		}
+		out = append(out, map[string]interface{}{"stream": labels, "values": values})
+	}
+	return map[string]interface{}{"streams": out}
+}
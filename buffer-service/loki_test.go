@@ -0,0 +1,162 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// decodedStream is a pushed stream as the test receiver sees it
+type decodedStream struct {
+	labels string
+	times  []int64
+	lines  []string
+}
+
+func decodePushRequest(t *testing.T, body []byte) []decodedStream {
+	t.Helper()
+	var out []decodedStream
+	protoFields(t, body, func(_ int, _ int, stream []byte, _ uint64) {
+		var s decodedStream
+		protoFields(t, stream, func(f int, _ int, v []byte, _ uint64) {
+			if f == 1 {
+				s.labels = string(v)
+				return
+			}
+			protoFields(t, v, func(f int, _ int, v []byte, _ uint64) {
+				if f == 2 {
+					s.lines = append(s.lines, string(v))
+					return
+				}
+				var ts int64
+				protoFields(t, v, func(f int, _ int, _ []byte, n uint64) {
+					if f == 1 {
+						ts += int64(n) * 1e9
+					} else {
+						ts += int64(n)
+					}
+				})
+				s.times = append(s.times, ts)
+			})
+		})
+		out = append(out, s)
+	})
+	return out
+}
+
+func lokiDest(ts *httptest.Server, format string) DestinationCfg {
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return DestinationCfg{Host: u.Hostname(), Port: port, Transport: "http", Path: "/loki/api/v1/push", Format: format}
+}
+
+func TestLokiForwarder_PushesOrderedStreamsWithExtractedLabels(t *testing.T) {
+	var streams []decodedStream
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "bad request", http.StatusUnsupportedMediaType)
+			return
+		}
+		streams = append(streams, decodePushRequest(t, body)...)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	fwd, err := newForwarder("syslog", lokiDest(ts, ""))
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	// A retried record replayed after newer ones from the same host
+	errs := fwd.(BatchForwarder).ForwardBatch([]TelemetryRecord{
+		{Service: "fluent-bit", JsonData: `{"pri":30,"time":"2025-01-01T00:00:02Z","host":"sw1","message":"second"}`},
+		{Service: "fluent-bit", JsonData: `{"pri":187,"time":"2025-01-01T00:00:03Z","host":"sw2","message":"other host"}`},
+		{Service: "fluent-bit", JsonData: `{"pri":30,"time":"2025-01-01T00:00:01Z","host":"sw1","message":"first"}`},
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want one per host: %+v", len(streams), streams)
+	}
+	sw1 := streams[0]
+	if sw1.labels != `{data_type="syslog", facility="daemon", host="sw1", service="fluent-bit"}` {
+		t.Fatalf("labels = %s", sw1.labels)
+	}
+	if fmt.Sprint(sw1.lines) != "[first second]" || sw1.times[0] != 1735689601e9 || sw1.times[1] != 1735689602e9 {
+		t.Fatalf("stream not in timestamp order: %+v", sw1)
+	}
+	if streams[1].labels != `{data_type="syslog", facility="local7", host="sw2", service="fluent-bit"}` {
+		t.Fatalf("labels = %s", streams[1].labels)
+	}
+}
+
+func TestLokiForwarder_JSONLabelsAndLateEntries(t *testing.T) {
+	status := http.StatusNoContent
+	var push struct {
+		Streams []struct {
+			Stream map[string]string
+			Values [][2]string
+		}
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+		json.NewDecoder(zr).Decode(&push)
+		http.Error(w, "entry out of order", status)
+	}))
+	defer ts.Close()
+
+	dest := lokiDest(ts, "loki_json")
+	dest.Labels = map[string]string{"channel": "channel", "event_id": "event_id", "user": "event_data.TargetUserName"}
+	dest.OutOfOrderWindowSec = 600
+	fwd, err := newLokiForwarder("windows_events", dest)
+	if err != nil {
+		t.Fatalf("newLokiForwarder: %v", err)
+	}
+
+	event := func(ts string) TelemetryRecord {
+		return TelemetryRecord{Service: "vector", JsonData: fmt.Sprintf(
+			`{"channel":"Security","event_id":4625,"event_timestamp":"%s","event_data":{"TargetUserName":"bob"}}`, ts)}
+	}
+	if err := fwd.Forward(event("2025-01-01T01:00:00Z")); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+	labels := push.Streams[0].Stream
+	if labels["channel"] != "Security" || labels["event_id"] != "4625" || labels["user"] != "bob" || labels["service"] != "vector" || len(labels) != 5 {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if v := push.Streams[0].Values[0]; v[0] != "1735693200000000000" {
+		t.Fatalf("entry timestamp = %s", v[0])
+	}
+
+	if err := fwd.Forward(event("2025-01-01T00:55:00Z")); err != nil {
+		t.Fatalf("entry inside the window: %v", err)
+	}
+	if err := fwd.Forward(event("2025-01-01T00:00:00Z")); !errors.Is(err, errRejected) {
+		t.Fatalf("entry beyond the window: err = %v", err)
+	}
+
+	status = http.StatusBadRequest
+	if err := fwd.Forward(event("2025-01-01T02:00:00Z")); !errors.Is(err, errRejected) {
+		t.Fatalf("400 from Loki: err = %v", err)
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"compress/gzip"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,6 +18,7 @@ import (
 	"syscall"
 	"time"
 
+	"buffer-service/flow"
 	"github.com/gorilla/mux"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -58,56 +59,77 @@ func initLogger() {
 
 // BufferConfig represents the buffer manager configuration
 type BufferConfig struct {
-	Enabled            bool                  `json:"enabled"`
-	MaxRetentionDays   int                   `json:"max_retention_days"`
-	MaxDbSizeGB        int                   `json:"max_db_size_gb"`
-	MaxFileSizeGB      int                   `json:"max_file_size_gb"`
-	CleanupIntervalMin int                   `json:"cleanup_interval_minutes"`
-	CompressionEnabled bool                  `json:"compression_enabled"`
-	VPNFailoverEnabled bool                  `json:"vpn_failover_enabled"`
-	VPNCheckInterval   int                   `json:"vpn_check_interval_seconds"`
-	ForwardingEnabled  bool                  `json:"forwarding_enabled"`
-	ForwardingURL      string                `json:"forwarding_url"`
-	MaxBufferSizeMB    int                   `json:"max_buffer_size_mb"`
-	OverflowAction     string                `json:"overflow_action"` // "drop_oldest", "drop_newest", "compress_more"
-	Services           map[string]ServiceCfg `json:"services"`
+	Enabled            bool                      `json:"enabled"`
+	MaxRetentionDays   int                       `json:"max_retention_days"`
+	MaxDbSizeGB        int                       `json:"max_db_size_gb"`
+	MaxFileSizeGB      int                       `json:"max_file_size_gb"`
+	CleanupIntervalMin int                       `json:"cleanup_interval_minutes"`
+	CompressionEnabled bool                      `json:"compression_enabled"`
+	VPNFailoverEnabled bool                      `json:"vpn_failover_enabled"`
+	VPNCheckInterval   int                       `json:"vpn_check_interval_seconds"`
+	ForwardingEnabled  bool                      `json:"forwarding_enabled"`
+	ForwardingURL      string                    `json:"forwarding_url"`
+	MaxBufferSizeMB    int                       `json:"max_buffer_size_mb"`
+	OverflowAction     string                    `json:"overflow_action"` // "drop_oldest", "drop_newest", "compress_more"
+	Services           map[string]ServiceCfg     `json:"services"`
+	Destinations       map[string]DestinationCfg `json:"destinations"` // keyed by data type
+	Retry              RetryCfg                  `json:"retry"`
+	DrainBatchSize     int                       `json:"drain_batch_size,omitempty"` // rows leased per drain batch
+	Recompress         RecompressCfg             `json:"recompress"`                 // compress_more overflow strategy
+	Search             SearchCfg                 `json:"search"`                     // GET /api/buffer/records full-text index
 }
 
 type ServiceCfg struct {
-	Enabled         bool   `json:"enabled"`
-	BufferMode      string `json:"buffer_mode"` // "database" or "files"
-	MaxRecords      int    `json:"max_records"`
-	MaxFileSizeMB   int    `json:"max_file_size_mb"`
-	CompressionMode string `json:"compression_mode"` // "none", "gzip", "zstd"
-	Priority        int    `json:"priority"`         // 1-10, higher numbers = higher priority
-	RetentionHours  int    `json:"retention_hours"`
+	Enabled          bool   `json:"enabled"`
+	BufferMode       string `json:"buffer_mode"` // "database" or "files"
+	MaxRecords       int    `json:"max_records"`
+	MaxFileSizeMB    int    `json:"max_file_size_mb"`
+	CompressionMode  string `json:"compression_mode"` // "none", "gzip", "zstd"
+	Priority         int    `json:"priority"`         // 1-10, higher numbers = higher priority
+	RetentionHours   int    `json:"retention_hours"`
+	CompressionLevel int    `json:"compression_level,omitempty"` // gzip 1-9, zstd 1-22; 0 = codec default
+	ZstdDictionary   bool   `json:"zstd_dictionary,omitempty"`   // use the service's trained zstd dictionary
 }
 
 // TelemetryRecord represents a buffered telemetry record
 type TelemetryRecord struct {
-	ID         int64  `json:"id"`
-	Service    string `json:"service"`
-	Timestamp  int64  `json:"timestamp"`
-	DataType   string `json:"data_type"`
-	DataSize   int64  `json:"data_size"`
-	FilePath   string `json:"file_path,omitempty"`
-	JsonData   string `json:"json_data,omitempty"`
-	SourceIP   string `json:"source_ip,omitempty"`
-	Forwarded  int    `json:"forwarded"`
-	RetryCount int    `json:"retry_count"`
-	CreatedAt  int64  `json:"created_at"`
-	ExpiresAt  int64  `json:"expires_at"`
+	ID          int64  `json:"id"`
+	Service     string `json:"service"`
+	Timestamp   int64  `json:"timestamp"`
+	DataType    string `json:"data_type"`
+	DataSize    int64  `json:"data_size"`
+	FilePath    string `json:"file_path,omitempty"`
+	JsonData    string `json:"json_data,omitempty"`
+	Codec       string `json:"codec,omitempty"` // compression codec of the stored json_data
+	NextAttempt int64  `json:"next_attempt_at,omitempty"`
+	LastError   string `json:"last_error,omitempty"`
+	SourceIP    string `json:"source_ip,omitempty"`
+	Forwarded   int    `json:"forwarded"`
+	RetryCount  int    `json:"retry_count"`
+	CreatedAt   int64  `json:"created_at"`
+	ExpiresAt   int64  `json:"expires_at"`
+	BatchCount  int    `json:"batch_count,omitempty"` // records rolled into this row by compress_more
 }
 
 // BufferStats represents buffer statistics
 type BufferStats struct {
-	Service      string `json:"service"`
-	TotalRecords int64  `json:"total_records"`
-	TotalSize    int64  `json:"total_size"`
-	OldestRecord int64  `json:"oldest_record"`
-	NewestRecord int64  `json:"newest_record"`
-	Forwarded    int64  `json:"forwarded"`
-	Pending      int64  `json:"pending"`
+	Service      string                `json:"service"`
+	TotalRecords int64                 `json:"total_records"`
+	TotalSize    int64                 `json:"total_size"`
+	OldestRecord int64                 `json:"oldest_record"`
+	NewestRecord int64                 `json:"newest_record"`
+	Forwarded    int64                 `json:"forwarded"`
+	Pending      int64                 `json:"pending"`
+	DeadLettered int64                 `json:"dead_lettered"`
+	Compression  map[string]CodecStats `json:"compression"`
+}
+
+// CodecStats represents compression effectiveness for a single codec
+type CodecStats struct {
+	Records     int64   `json:"records"`
+	RawBytes    int64   `json:"raw_bytes"`
+	StoredBytes int64   `json:"stored_bytes"`
+	Ratio       float64 `json:"ratio"` // raw / stored
 }
 
 // VPNStatus represents the current VPN connection state
@@ -128,6 +150,79 @@ type BufferManager struct {
 	vpnMutex    sync.RWMutex
 	forwardChan chan TelemetryRecord
 	stopChan    chan bool
+	forwarders  map[string]Forwarder
+	fwdMutex    sync.RWMutex
+	// destinationErrors holds why an enabled destination has no forwarder,
+	// by data type; its records stay buffered until the config is fixed
+	destinationErrors map[string]string
+	// applianceForwarding is the config-service forwarding section, applied
+	// over the destinations by buildForwarders
+	applianceForwarding ApplianceForwardingCfg
+	zstd                *zstdState
+	store               Store         // records of services buffering to SQLite
+	files               *segmentFiles // records of services buffering to segment files
+	drain               drainCoordinator
+	quota               quotaAccountant
+	recompress          recompressState
+	search              searchState
+	replay              replayState
+	metrics             *bufferMetrics
+	collectors          collectorSet
+}
+
+// defaultBufferConfig returns the configuration used when no config file exists
+func defaultBufferConfig() BufferConfig {
+	return BufferConfig{
+		Enabled:            true,
+		MaxRetentionDays:   14,
+		MaxDbSizeGB:        2,
+		MaxFileSizeGB:      10,
+		CleanupIntervalMin: 60,
+		CompressionEnabled: true,
+		VPNFailoverEnabled: true,
+		VPNCheckInterval:   30,
+		ForwardingEnabled:  false,
+		ForwardingURL:      "https://obs.rectitude.net/api/ingest",
+		MaxBufferSizeMB:    1000,
+		OverflowAction:     "drop_oldest",
+		Services: map[string]ServiceCfg{
+			"vector": {
+				Enabled:         true,
+				BufferMode:      "database",
+				MaxRecords:      1000000,
+				CompressionMode: "gzip",
+				Priority:        8,
+				RetentionHours:  336, // 14 days
+			},
+			"fluent-bit": {
+				Enabled:         true,
+				BufferMode:      "files",
+				MaxFileSizeMB:   100,
+				CompressionMode: "gzip",
+				Priority:        9,
+				RetentionHours:  336,
+			},
+			"goflow2": {
+				Enabled:         true,
+				BufferMode:      "files",
+				MaxRecords:      10000000,
+				CompressionMode: "gzip",
+				Priority:        10,
+				RetentionHours:  168, // 7 days for flows
+			},
+			"telegraf": {
+				Enabled:         true,
+				BufferMode:      "database",
+				MaxRecords:      500000,
+				CompressionMode: "gzip",
+				Priority:        7,
+				RetentionHours:  720, // 30 days for metrics
+			},
+		},
+		Destinations: defaultDestinations(),
+		Retry:        defaultRetryCfg(),
+		Recompress:   defaultRecompressCfg(),
+	}
 }
 
 // NewBufferManager creates a new buffer manager instance
@@ -135,88 +230,90 @@ func NewBufferManager(dataPath string) (*BufferManager, error) {
 	bm := &BufferManager{
 		dataPath:    dataPath,
 		forwardChan: make(chan TelemetryRecord, 1000),
+		metrics:     newBufferMetrics(),
 		stopChan:    make(chan bool, 1),
+		recompress:  recompressState{trigger: make(chan struct{}, 1)},
 		vpnStatus: VPNStatus{
 			Connected: false,
 			LastCheck: time.Now(),
 		},
-		config: BufferConfig{
-			Enabled:            true,
-			MaxRetentionDays:   14,
-			MaxDbSizeGB:        2,
-			MaxFileSizeGB:      10,
-			CleanupIntervalMin: 60,
-			CompressionEnabled: true,
-			VPNFailoverEnabled: true,
-			VPNCheckInterval:   30,
-			ForwardingEnabled:  false,
-			ForwardingURL:      "https://obs.rectitude.net/api/ingest",
-			MaxBufferSizeMB:    1000,
-			OverflowAction:     "drop_oldest",
-			Services: map[string]ServiceCfg{
-				"vector": {
-					Enabled:         true,
-					BufferMode:      "database",
-					MaxRecords:      1000000,
-					CompressionMode: "gzip",
-					Priority:        8,
-					RetentionHours:  336, // 14 days
-				},
-				"fluent-bit": {
-					Enabled:         true,
-					BufferMode:      "files",
-					MaxFileSizeMB:   100,
-					CompressionMode: "gzip",
-					Priority:        9,
-					RetentionHours:  336,
-				},
-				"goflow2": {
-					Enabled:         true,
-					BufferMode:      "files",
-					MaxRecords:      10000000,
-					CompressionMode: "gzip",
-					Priority:        10,
-					RetentionHours:  168, // 7 days for flows
-				},
-				"telegraf": {
-					Enabled:         true,
-					BufferMode:      "database",
-					MaxRecords:      500000,
-					CompressionMode: "gzip",
-					Priority:        7,
-					RetentionHours:  720, // 30 days for metrics
-				},
-			},
-		},
+		config: defaultBufferConfig(),
 	}
 
 	// Initialize database
 	if err := bm.initDatabase(); err != nil {
 		return nil, fmt.Errorf("failed to initialize database: %v", err)
 	}
+	bm.store = &sqliteStore{db: bm.db}
+	if err := bm.resyncQuota(); err != nil {
+		return nil, fmt.Errorf("failed to load buffer usage: %v", err)
+	}
+
+	// Open segment-file stores
+	files, err := openSegmentFiles(filepath.Join(dataPath, "buffer", "files"), bm.segmentBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment stores: %v", err)
+	}
+	bm.files = files
 
 	// Load configuration
 	if err := bm.loadConfig(); err != nil {
 		logger.WithError(err).Warn("Failed to load config, using defaults")
 	}
+	bm.buildForwarders()
+
+	// Load trained zstd dictionaries
+	zs, err := newZstdState(filepath.Join(dataPath, "buffer", "dict"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize zstd: %v", err)
+	}
+	bm.zstd = zs
+	bm.initSearchIndex()
 
 	// Start background workers
-	go bm.startVPNMonitor()
+	if bm.config.VPNFailoverEnabled {
+		go bm.startVPNMonitor()
+	}
 	go bm.startForwardingWorker()
+	go bm.startRecompressWorker()
 
 	return bm, nil
 }
 
-// compressData compresses data using the specified compression mode
-func (bm *BufferManager) compressData(data []byte, mode string) ([]byte, error) {
+// storageCodec returns the codec actually applied when storing data for a compression mode
+func (bm *BufferManager) storageCodec(mode string) string {
+	if !bm.config.CompressionEnabled {
+		return "none"
+	}
+	switch mode {
+	case "gzip", "zstd":
+		return mode
+	default:
+		return "none"
+	}
+}
+
+// compressData compresses data for a service using the specified compression mode
+func (bm *BufferManager) compressData(service string, data []byte, mode string) ([]byte, error) {
 	if mode == "none" || !bm.config.CompressionEnabled {
 		return data, nil
 	}
 
+	return bm.compressAt(service, data, mode, bm.config.Services[service].CompressionLevel)
+}
+
+// compressAt compresses data with the given codec at an explicit level (0 = codec default)
+func (bm *BufferManager) compressAt(service string, data []byte, mode string, level int) ([]byte, error) {
 	switch mode {
 	case "gzip":
+		if level < gzip.BestSpeed || level > gzip.BestCompression {
+			level = gzip.DefaultCompression
+		}
 		var buf bytes.Buffer
-		gzWriter := gzip.NewWriter(&buf)
+		gzWriter, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
 		if _, err := gzWriter.Write(data); err != nil {
 			return nil, err
 		}
@@ -224,6 +321,8 @@ func (bm *BufferManager) compressData(data []byte, mode string) ([]byte, error)
 			return nil, err
 		}
 		return buf.Bytes(), nil
+	case "zstd":
+		return bm.zstd.compress(service, data, level, bm.config.Services[service].ZstdDictionary)
 	default:
 		return data, nil
 	}
@@ -244,6 +343,8 @@ func (bm *BufferManager) decompressData(data []byte, mode string) ([]byte, error
 		}
 		defer gzReader.Close()
 		return io.ReadAll(gzReader)
+	case "zstd":
+		return bm.zstd.decompress(data)
 	default:
 		return data, nil
 	}
@@ -267,6 +368,11 @@ func (bm *BufferManager) checkVPNConnection() VPNStatus {
 		start := time.Now()
 		resp, err := client.Get(strings.Replace(bm.config.ForwardingURL, "/api/ingest", "/health", 1))
 		latency := time.Since(start)
+		result := "success"
+		if err != nil || resp.StatusCode >= 400 {
+			result = "failure"
+		}
+		bm.metrics.vpnProbe.observe(latency.Seconds(), result)
 
 		if err == nil && resp.StatusCode < 400 {
 			status.Connected = true
@@ -291,10 +397,6 @@ func (bm *BufferManager) checkVPNConnection() VPNStatus {
 
 // startVPNMonitor runs the VPN connection monitoring loop
 func (bm *BufferManager) startVPNMonitor() {
-	if !bm.config.VPNFailoverEnabled {
-		return
-	}
-
 	ticker := time.NewTicker(time.Duration(bm.config.VPNCheckInterval) * time.Second)
 	defer ticker.Stop()
 
@@ -307,7 +409,7 @@ func (bm *BufferManager) startVPNMonitor() {
 
 			// If VPN came back online, start forwarding buffered data
 			if status.Connected && bm.config.ForwardingEnabled {
-				go bm.forwardBufferedRecords()
+				bm.requestDrain()
 			}
 		case <-bm.stopChan:
 			return
@@ -344,20 +446,25 @@ func (bm *BufferManager) startForwardingWorker() {
 	}
 }
 
-// forwardRecord sends a single record to the remote endpoint using appropriate protocol
+// forwardRecord sends a single record to the destination configured for its data type
 func (bm *BufferManager) forwardRecord(record TelemetryRecord) error {
-	// Route to appropriate forwarding method based on data type and service
+	// Route to the configured forwarder based on data type
 	switch record.DataType {
-	case "syslog":
-		return bm.forwardSyslogUDP(record)
-	case "netflow":
-		return bm.forwardNetFlowUDP(record)
-	case "snmp":
-		return bm.forwardSNMPUDP(record)
-	case "windows_events":
-		return bm.forwardWindowsHTTP(record)
-	case "metrics":
-		return bm.forwardMetricsHTTP(record)
+	case "syslog", "netflow", "snmp", "windows_events", "metrics", flow.TypeSFlowCounters:
+		fwd := bm.getForwarder(record.DataType)
+		if fwd == nil {
+			bm.metrics.forwardFailures.add(1, record.Service, record.DataType)
+			return fmt.Errorf("%w for %s", errNoDestination, record.DataType)
+		}
+		start := time.Now()
+		err := fwd.Forward(record)
+		bm.metrics.forwardLatency.observe(time.Since(start).Seconds(), record.DataType)
+		if err != nil {
+			bm.metrics.forwardFailures.add(1, record.Service, record.DataType)
+			return err
+		}
+		bm.metrics.forwarded.add(1, record.Service, record.DataType)
+		return nil
 	default:
 		logger.WithFields(logrus.Fields{
 			"data_type": record.DataType,
@@ -367,218 +474,57 @@ func (bm *BufferManager) forwardRecord(record TelemetryRecord) error {
 	}
 }
 
-// forwardSyslogUDP forwards syslog data via UDP to obs.rectitude.net:1514
-func (bm *BufferManager) forwardSyslogUDP(record TelemetryRecord) error {
-	conn, err := net.Dial("udp", "obs.rectitude.net:1514")
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	// Set write deadline
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	
-	// Send raw JSON data
-	_, err = conn.Write([]byte(record.JsonData))
-	return err
-}
-
-// forwardNetFlowUDP forwards NetFlow/sFlow/IPFIX data via UDP
-func (bm *BufferManager) forwardNetFlowUDP(record TelemetryRecord) error {
-	// Parse JSON to determine flow type and route to appropriate port
-	var flowData map[string]interface{}
-	if err := json.Unmarshal([]byte(record.JsonData), &flowData); err != nil {
-		return err
-	}
-
-	port := "2055" // Default NetFlow port
-	if flowType, ok := flowData["flow_type"].(string); ok {
-		switch flowType {
-		case "sflow":
-			port = "6343"
-		case "ipfix":
-			port = "4739"
-		}
-	}
-
-	conn, err := net.Dial("udp", fmt.Sprintf("obs.rectitude.net:%s", port))
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	_, err = conn.Write([]byte(record.JsonData))
-	return err
-}
-
-// forwardSNMPUDP forwards SNMP trap data via UDP to port 162
-func (bm *BufferManager) forwardSNMPUDP(record TelemetryRecord) error {
-	conn, err := net.Dial("udp", "obs.rectitude.net:162")
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	_, err = conn.Write([]byte(record.JsonData))
-	return err
-}
-
-// forwardWindowsHTTP forwards Windows Events via HTTP to Vector endpoint
-func (bm *BufferManager) forwardWindowsHTTP(record TelemetryRecord) error {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
-	}
-
-	req, err := http.NewRequest("POST", "http://obs.rectitude.net:8084/", bytes.NewBufferString(record.JsonData))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("User-Agent", "noc-raven/2.0")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
-
-	return nil
-}
-
-// forwardMetricsHTTP forwards metrics to InfluxDB
-func (bm *BufferManager) forwardMetricsHTTP(record TelemetryRecord) error {
-	client := &http.Client{
-		Timeout: 10 * time.Second,
+// decodeRecord replaces a stored record's payload with its decompressed form
+func (bm *BufferManager) decodeRecord(record *TelemetryRecord) error {
+	if record.Codec == "" || record.Codec == "none" {
+		return nil
 	}
-
-	// InfluxDB write endpoint
-	url := "http://obs.rectitude.net:8086/api/v2/write?org=rectitude&bucket=r369"
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(record.JsonData))
+	data, err := bm.decompressData([]byte(record.JsonData), record.Codec)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to decode %s record %d: %v", record.Codec, record.ID, err)
 	}
-
-	// Add InfluxDB auth token from environment
-	token := os.Getenv("INFLUXDB_TOKEN")
-	if token == "" {
-		token = "4DhBMQYYZZRlI_ER8WyVusydNbTC8JTDjvf8vD-MJIgfGdtXdF0cJB6DwjyjJ7hZxtpLtvqwJ7gAfCCHFXh5ow=="
-	}
-
-	req.Header.Set("Authorization", "Token "+token)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("HTTP %d", resp.StatusCode)
-	}
-
+	record.JsonData = string(data)
+	record.Codec = "none"
 	return nil
 }
 
-// forwardBufferedRecords forwards all buffered records when VPN comes online
-func (bm *BufferManager) forwardBufferedRecords() {
-	log.Println("Starting to forward buffered records...")
-
-	// Get all unforwarded records
-	query := `
-		SELECT id, service, timestamp, data_type, data_size, json_data, source_ip
-		FROM telemetry_buffer 
-		WHERE forwarded = 0 
-		ORDER BY timestamp ASC
-		LIMIT 1000
-	`
-
-	rows, err := bm.db.Query(query)
+// dropOldestRecords removes up to count of the oldest records, evicting from the
+// lowest-priority services first
+func (bm *BufferManager) dropOldestRecords(count int) (int64, error) {
+	services, err := bm.store.Services()
 	if err != nil {
-		log.Printf("Failed to query buffered records: %v", err)
-		return
+		return 0, err
 	}
-	defer rows.Close()
 
-	forwarded := 0
-	for rows.Next() {
-		var record TelemetryRecord
-		err := rows.Scan(&record.ID, &record.Service, &record.Timestamp,
-			&record.DataType, &record.DataSize, &record.JsonData, &record.SourceIP)
+	ordered := bm.byPriority(services)
+	var dropped int64
+	for i := len(ordered) - 1; i >= 0 && dropped < int64(count); i-- {
+		n, err := bm.dropServiceRecords(ordered[i], int64(count)-dropped)
 		if err != nil {
-			log.Printf("Failed to scan record: %v", err)
-			continue
+			return dropped, err
 		}
-
-		if err := bm.forwardRecord(record); err != nil {
-			log.Printf("Failed to forward buffered record %d: %v", record.ID, err)
-			break // Stop if forwarding fails
-		}
-
-		// Mark as forwarded
-		updateQuery := "UPDATE telemetry_buffer SET forwarded = 1 WHERE id = ?"
-		if _, err := bm.db.Exec(updateQuery, record.ID); err != nil {
-			log.Printf("Failed to mark record as forwarded: %v", err)
-		}
-
-		forwarded++
-	}
-
-	if forwarded > 0 {
-		log.Printf("Forwarded %d buffered records", forwarded)
+		dropped += n
 	}
+	return dropped, nil
 }
 
-// handleBufferOverflow handles buffer overflow based on configuration
-func (bm *BufferManager) handleBufferOverflow() error {
-	switch bm.config.OverflowAction {
-	case "drop_oldest":
-		return bm.dropOldestRecords(1000)
-	case "drop_newest":
-		return fmt.Errorf("buffer full, dropping newest records")
-	case "compress_more":
-		return bm.compressOldRecords()
-	default:
-		return bm.dropOldestRecords(1000)
-	}
-}
-
-// dropOldestRecords removes the oldest records from buffer
-func (bm *BufferManager) dropOldestRecords(count int) error {
-	query := "DELETE FROM telemetry_buffer WHERE id IN (SELECT id FROM telemetry_buffer ORDER BY timestamp ASC LIMIT ?)"
-	result, err := bm.db.Exec(query, count)
-	if err != nil {
-		return err
+// dropServiceRecords removes a service's oldest records and updates its quota usage
+func (bm *BufferManager) dropServiceRecords(service string, count int64) (int64, error) {
+	drop, err := bm.store.DropOldest(service, count)
+	if err != nil || drop.Records == 0 {
+		return 0, err
 	}
+	records := drop.Records
 
-	rowsAffected, _ := result.RowsAffected()
-	log.Printf("Dropped %d oldest records due to buffer overflow", rowsAffected)
-	return nil
+	bm.quota.add(service, quotaUsage{Records: -records, Bytes: -drop.Bytes, Pending: -drop.Pending})
+	bm.metrics.overflowDropped.add(float64(records), service)
+	log.Printf("Dropped %d oldest %s records due to buffer overflow", records, service)
+	return records, nil
 }
 
-// compressOldRecords applies additional compression to old records
-func (bm *BufferManager) compressOldRecords() error {
-	// This is a placeholder for more advanced compression logic
-	log.Println("Applying additional compression to old records")
-	return nil
-}
-
-// getBufferSizeMB returns current buffer size in MB
+// getBufferSizeMB returns current SQLite buffer size in MB
 func (bm *BufferManager) getBufferSizeMB() (int, error) {
-	query := "SELECT COALESCE(SUM(data_size), 0) FROM telemetry_buffer"
-	var totalSize int64
-	err := bm.db.QueryRow(query).Scan(&totalSize)
-	if err != nil {
-		return 0, err
-	}
-	return int(totalSize / 1024 / 1024), nil
+	return int(bm.quota.total().Bytes / 1024 / 1024), nil
 }
 
 // initDatabase initializes the SQLite database
@@ -605,6 +551,11 @@ func (bm *BufferManager) initDatabase() error {
 		return fmt.Errorf("failed to create tables: %v", err)
 	}
 
+	// Apply schema migrations
+	if err := bm.migrateSchema(); err != nil {
+		return fmt.Errorf("failed to migrate schema: %v", err)
+	}
+
 	return nil
 }
 
@@ -644,6 +595,99 @@ func (bm *BufferManager) createTables() error {
 	return err
 }
 
+// schemaMigrations are applied in order; PRAGMA user_version records how many have run
+var schemaMigrations = []string{
+	// 1: track the compression codec of each row. Rows written before this
+	// column existed are tagged from the gzip magic bytes.
+	`
+	ALTER TABLE telemetry_buffer ADD COLUMN codec TEXT NOT NULL DEFAULT 'none';
+	UPDATE telemetry_buffer SET codec = 'gzip'
+		WHERE hex(substr(CAST(json_data AS BLOB), 1, 2)) = '1F8B';
+	`,
+	// 2: remember the uncompressed size so per-codec ratios can be reported.
+	// Legacy compressed rows keep raw_size 0 and are left out of the ratios.
+	`
+	ALTER TABLE telemetry_buffer ADD COLUMN raw_size INTEGER NOT NULL DEFAULT 0;
+	UPDATE telemetry_buffer SET raw_size = data_size WHERE codec = 'none';
+	`,
+	// 3: per-record retry scheduling and the dead-letter queue
+	`
+	ALTER TABLE telemetry_buffer ADD COLUMN next_attempt_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE telemetry_buffer ADD COLUMN last_error TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_telemetry_pending ON telemetry_buffer(forwarded, next_attempt_at);
+
+	CREATE TABLE IF NOT EXISTS dead_letter (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		original_id INTEGER NOT NULL,
+		service TEXT NOT NULL,
+		timestamp INTEGER NOT NULL,
+		data_type TEXT NOT NULL,
+		data_size INTEGER NOT NULL,
+		json_data TEXT,
+		source_ip TEXT NOT NULL DEFAULT '',
+		codec TEXT NOT NULL DEFAULT 'none',
+		raw_size INTEGER NOT NULL DEFAULT 0,
+		retry_count INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		dead_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_dead_letter_service ON dead_letter(service);
+	CREATE INDEX IF NOT EXISTS idx_dead_letter_expires ON dead_letter(expires_at);
+	`,
+	// 4: drain batches lease rows so overlapping passes never forward a row twice
+	`
+	ALTER TABLE telemetry_buffer ADD COLUMN lease_until INTEGER NOT NULL DEFAULT 0;
+	`,
+	// 5: compress_more remembers the level each row was recompressed at and
+	// how many records a batch blob holds
+	`
+	ALTER TABLE telemetry_buffer ADD COLUMN compression_level INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE telemetry_buffer ADD COLUMN batch_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE dead_letter ADD COLUMN batch_count INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS idx_telemetry_recompress ON telemetry_buffer(compression_level, created_at);
+	`,
+	// 6: hashes of records imported from archives, so an import is idempotent
+	`
+	CREATE TABLE IF NOT EXISTS imported_records (
+		hash TEXT PRIMARY KEY,
+		imported_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_imported_expires ON imported_records(expires_at);
+	`,
+}
+
+// migrateSchema applies any schema migrations the database has not seen yet
+func (bm *BufferManager) migrateSchema() error {
+	var version int
+	if err := bm.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(schemaMigrations); i++ {
+		tx, err := bm.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(schemaMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %v", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logger.WithField("version", i+1).Info("Applied buffer schema migration")
+	}
+
+	return nil
+}
+
 // loadConfig loads configuration from file
 func (bm *BufferManager) loadConfig() error {
 	configPath := filepath.Join(bm.dataPath, "buffer", "config", "buffer-config.json")
@@ -674,25 +718,98 @@ func (bm *BufferManager) saveConfig() error {
 		return err
 	}
 
-	return os.WriteFile(configPath, data, 0644)
+	// The config holds destination credentials
+	if err := os.WriteFile(configPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(configPath, 0600)
+}
+
+// redactedConfig returns the config with destination credentials masked
+func (bm *BufferManager) redactedConfig() BufferConfig {
+	cfg := bm.config
+	cfg.Destinations = make(map[string]DestinationCfg, len(bm.config.Destinations))
+	for dataType, dest := range bm.config.Destinations {
+		cfg.Destinations[dataType] = dest.redacted()
+	}
+	return cfg
+}
+
+// mergeConfig applies a JSON config update over a copy of the current config.
+// Settings the update leaves out keep their values, down to the fields of
+// each service and destination it names, and masked secrets are restored.
+func (bm *BufferManager) mergeConfig(update []byte) (BufferConfig, error) {
+	var merged BufferConfig
+	current, err := json.Marshal(bm.config)
+	if err != nil {
+		return merged, err
+	}
+	if err := json.Unmarshal(current, &merged); err != nil {
+		return merged, err
+	}
+
+	// Map entries would decode into zero values, so each one is merged over
+	// its current value instead
+	var entries struct {
+		Services     map[string]json.RawMessage `json:"services"`
+		Destinations map[string]json.RawMessage `json:"destinations"`
+	}
+	if err := json.Unmarshal(update, &entries); err != nil {
+		return merged, err
+	}
+	services, destinations := merged.Services, merged.Destinations
+	merged.Services, merged.Destinations = nil, nil
+	if err := json.Unmarshal(update, &merged); err != nil {
+		return merged, err
+	}
+	merged.Services, merged.Destinations = services, destinations
+
+	if merged.Services == nil {
+		merged.Services = make(map[string]ServiceCfg)
+	}
+	for name, raw := range entries.Services {
+		svc := merged.Services[name]
+		if err := json.Unmarshal(raw, &svc); err != nil {
+			return merged, fmt.Errorf("service %s: %v", name, err)
+		}
+		merged.Services[name] = svc
+	}
+	if merged.Destinations == nil {
+		merged.Destinations = make(map[string]DestinationCfg)
+	}
+	for dataType, raw := range entries.Destinations {
+		dest := merged.Destinations[dataType]
+		if err := json.Unmarshal(raw, &dest); err != nil {
+			return merged, fmt.Errorf("destination %s: %v", dataType, err)
+		}
+		merged.Destinations[dataType] = dest.unredacted(bm.config.Destinations[dataType])
+	}
+	return merged, nil
 }
 
 // StoreRecord stores a telemetry record in the buffer with compression and overflow handling
 func (bm *BufferManager) StoreRecord(record TelemetryRecord) error {
-	// Check buffer size and handle overflow if necessary
-	currentSize, err := bm.getBufferSizeMB()
-	if err == nil && currentSize > bm.config.MaxBufferSizeMB {
-		log.Printf("Buffer size (%dMB) exceeds limit (%dMB), handling overflow",
-			currentSize, bm.config.MaxBufferSizeMB)
-		if err := bm.handleBufferOverflow(); err != nil {
-			log.Printf("Failed to handle buffer overflow: %v", err)
+	return bm.storeRecord(record, nil)
+}
+
+// storeRecord stores a record. A non-nil claim runs in the SQLite transaction
+// that stores the record, and the record is stored only when claim succeeds.
+// For segment files the transaction commits after the append.
+func (bm *BufferManager) storeRecord(record TelemetryRecord, claim func(*sql.Tx) error) error {
+	serviceCfg, exists := bm.config.Services[record.Service]
+	fileMode := exists && serviceCfg.BufferMode == "files"
+
+	// Make room under the service, backend and buffer quotas
+	if err := bm.enforceQuotas(record.Service, fileMode); err != nil {
+		if errors.Is(err, errBufferFull) {
+			bm.metrics.overflowReject.add(1, record.Service)
 		}
+		return err
 	}
 
 	now := time.Now().Unix()
 
 	// Use service-specific retention if configured
-	serviceCfg, exists := bm.config.Services[record.Service]
 	var expiresAt int64
 	if exists && serviceCfg.RetentionHours > 0 {
 		expiresAt = now + int64(serviceCfg.RetentionHours*60*60)
@@ -701,71 +818,150 @@ func (bm *BufferManager) StoreRecord(record TelemetryRecord) error {
 	}
 
 	// Compress JSON data if compression is enabled for this service
-	jsonData := record.JsonData
-	if exists && serviceCfg.CompressionMode != "none" {
-		compressed, err := bm.compressData([]byte(record.JsonData), serviceCfg.CompressionMode)
+	payload := []byte(record.JsonData)
+	rawSize := len(record.JsonData)
+	if record.DataSize == 0 {
+		record.DataSize = int64(rawSize)
+	}
+	codec := "none"
+	if exists {
+		codec = bm.storageCodec(serviceCfg.CompressionMode)
+	}
+	if codec != "none" {
+		compressed, err := bm.compressData(record.Service, []byte(record.JsonData), codec)
 		if err != nil {
 			log.Printf("Failed to compress data for service %s: %v", record.Service, err)
+			codec = "none"
 		} else {
-			jsonData = string(compressed)
+			payload = compressed
 			// Update data size to compressed size
 			record.DataSize = int64(len(compressed))
 		}
 	}
+	record.Codec = codec
+	record.CreatedAt = now
+	record.ExpiresAt = expiresAt
 
-	query := `
-		INSERT INTO telemetry_buffer 
-		(service, timestamp, data_type, data_size, file_path, json_data, source_ip, 
-		 forwarded, retry_count, created_at, expires_at) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`
+	var tx *sql.Tx
+	if claim != nil {
+		var err error
+		if tx, err = bm.db.Begin(); err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := claim(tx); err != nil {
+			return err
+		}
+	}
 
-	_, err = bm.db.Exec(query,
-		record.Service, record.Timestamp, record.DataType, record.DataSize,
-		record.FilePath, jsonData, record.SourceIP,
-		record.Forwarded, record.RetryCount, now, expiresAt)
+	// High-volume services append to segment files instead of SQLite
+	if fileMode {
+		if err := bm.files.Append(record, payload, int64(rawSize)); err != nil {
+			return err
+		}
+		if tx != nil {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+		bm.metrics.stored.add(1, record.Service, record.DataType, "files")
+		return nil
+	}
 
-	return err
+	if tx != nil {
+		if err := insertBufferedRecord(tx, record, payload, int64(rawSize)); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	} else if err := bm.store.Append(record, payload, int64(rawSize)); err != nil {
+		return err
+	}
+	bm.quota.add(record.Service, quotaUsage{Records: 1, Bytes: record.DataSize, Pending: int64(1 - record.Forwarded)})
+	bm.metrics.stored.add(1, record.Service, record.DataType, "database")
+	return nil
 }
 
 // GetStats returns buffer statistics for a service
 func (bm *BufferManager) GetStats(service string) (*BufferStats, error) {
 	stats := &BufferStats{Service: service}
 
-	query := `
-		SELECT 
-			COUNT(*) as total_records,
-			COALESCE(SUM(data_size), 0) as total_size,
-			COALESCE(MIN(timestamp), 0) as oldest_record,
-			COALESCE(MAX(timestamp), 0) as newest_record,
-			COALESCE(SUM(CASE WHEN forwarded = 1 THEN 1 ELSE 0 END), 0) as forwarded,
-			COALESCE(SUM(CASE WHEN forwarded = 0 THEN 1 ELSE 0 END), 0) as pending
-		FROM telemetry_buffer 
-		WHERE service = ?
-	`
+	db, err := bm.store.Stats(service)
+	if err != nil {
+		return stats, err
+	}
+	// Merge records held in segment files
+	files, err := bm.files.Stats(service)
+	if err != nil {
+		return stats, err
+	}
+	db.merge(files)
 
-	err := bm.db.QueryRow(query, service).Scan(
-		&stats.TotalRecords,
-		&stats.TotalSize,
-		&stats.OldestRecord,
-		&stats.NewestRecord,
-		&stats.Forwarded,
-		&stats.Pending,
-	)
+	stats.TotalRecords = db.Records
+	stats.TotalSize = db.Bytes
+	stats.OldestRecord = db.Oldest
+	stats.NewestRecord = db.Newest
+	stats.Forwarded = db.Forwarded
+	stats.Pending = db.Pending
+	stats.Compression = db.Codecs
 
-	return stats, err
+	stats.DeadLettered, err = bm.deadLetterCount(service)
+	if err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+// bufferTotals sums the records of every service across both backends
+func (bm *BufferManager) bufferTotals() (StoreStats, error) {
+	var totals StoreStats
+	for _, backend := range []Store{bm.store, bm.files} {
+		services, err := backend.Services()
+		if err != nil {
+			return totals, err
+		}
+		for _, service := range services {
+			stats, err := backend.Stats(service)
+			if err != nil {
+				return totals, err
+			}
+			totals.merge(stats)
+		}
+	}
+	return totals, nil
 }
 
 // CleanupExpiredRecords removes expired records
 func (bm *BufferManager) CleanupExpiredRecords() error {
 	now := time.Now().Unix()
-	query := "DELETE FROM telemetry_buffer WHERE expires_at < ?"
-	result, err := bm.db.Exec(query, now)
+	rowsAffected, err := bm.store.Cleanup(now)
 	if err != nil {
 		return err
 	}
 
-	rowsAffected, _ := result.RowsAffected()
+	if err := bm.resyncQuota(); err != nil {
+		log.Printf("Failed to recount buffer usage: %v", err)
+	}
+
+	// Dead letters follow the same retention as the records they came from
+	if result, err := bm.db.Exec("DELETE FROM dead_letter WHERE expires_at < ?", now); err == nil {
+		dead, _ := result.RowsAffected()
+		rowsAffected += dead
+	} else {
+		log.Printf("Failed to clean up dead letters: %v", err)
+	}
+	if _, err := bm.db.Exec("DELETE FROM imported_records WHERE expires_at < ?", now); err != nil {
+		log.Printf("Failed to clean up imported record hashes: %v", err)
+	}
+
+	// Remove segment files whose records have all expired
+	removed, err := bm.files.Cleanup(now)
+	if err != nil {
+		log.Printf("Failed to clean up segment files: %v", err)
+	}
+	rowsAffected += removed
+
 	if rowsAffected > 0 {
 		log.Printf("Cleaned up %d expired records", rowsAffected)
 	}
@@ -784,16 +980,19 @@ func (bm *BufferManager) handleStatus(w http.ResponseWriter, r *http.Request) {
 	bm.vpnMutex.RUnlock()
 
 	status := map[string]interface{}{
-		"enabled":            bm.config.Enabled,
-		"compression":        bm.config.CompressionEnabled,
-		"vpn_failover":       bm.config.VPNFailoverEnabled,
-		"forwarding":         bm.config.ForwardingEnabled,
-		"buffer_size_mb":     bufferSizeMB,
-		"max_buffer_size_mb": bm.config.MaxBufferSizeMB,
-		"buffer_usage_pct":   float64(bufferSizeMB) / float64(bm.config.MaxBufferSizeMB) * 100,
-		"vpn_status":         vpnStatus,
-		"services":           make(map[string]*BufferStats),
-		"updated_at":         time.Now().Unix(),
+		"enabled":             bm.config.Enabled,
+		"compression":         bm.config.CompressionEnabled,
+		"vpn_failover":        bm.config.VPNFailoverEnabled,
+		"forwarding":          bm.config.ForwardingEnabled,
+		"buffer_size_mb":      bufferSizeMB,
+		"file_buffer_size_mb": bm.segmentBufferSize() / 1024 / 1024,
+		"max_buffer_size_mb":  bm.config.MaxBufferSizeMB,
+		"buffer_usage_pct":    float64(bufferSizeMB) / float64(bm.config.MaxBufferSizeMB) * 100,
+		"vpn_status":          vpnStatus,
+		"drain":               bm.drain.snapshot(),
+		"destination_errors":  bm.destinationProblems(),
+		"services":            make(map[string]*BufferStats),
+		"updated_at":          time.Now().Unix(),
 	}
 
 	for _, service := range services {
@@ -837,15 +1036,21 @@ func (bm *BufferManager) handleConfig(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(bm.config)
+		json.NewEncoder(w).Encode(bm.redactedConfig())
 	case "POST":
-		var newConfig BufferConfig
-		if err := json.NewDecoder(r.Body).Decode(&newConfig); err != nil {
+		update, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read config: %v", err), http.StatusBadRequest)
+			return
+		}
+		newConfig, err := bm.mergeConfig(update)
+		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid JSON: %v", err), http.StatusBadRequest)
 			return
 		}
 
 		bm.config = newConfig
+		bm.buildForwarders()
 		if err := bm.saveConfig(); err != nil {
 			http.Error(w, fmt.Sprintf("Failed to save config: %v", err), http.StatusInternalServerError)
 			return
@@ -884,10 +1089,10 @@ func (bm *BufferManager) handleForwardBuffer(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	go bm.forwardBufferedRecords()
+	bm.requestDrain()
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "forwarding started"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "forwarding started", "drain": bm.drain.snapshot()})
 }
 
 // handleBufferStats returns comprehensive buffer statistics
@@ -905,27 +1110,25 @@ func (bm *BufferManager) handleBufferStats(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	// Get total record count
-	var totalRecords int64
-	query := "SELECT COUNT(*) FROM telemetry_buffer"
-	bm.db.QueryRow(query).Scan(&totalRecords)
-
-	// Get oldest and newest record timestamps
-	var oldestRecord, newestRecord int64
-	query = "SELECT COALESCE(MIN(timestamp), 0), COALESCE(MAX(timestamp), 0) FROM telemetry_buffer"
-	bm.db.QueryRow(query).Scan(&oldestRecord, &newestRecord)
+	// Totals span both the SQLite and the segment-file backends
+	totals, err := bm.bufferTotals()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to total buffered records")
+	}
 
 	stats := map[string]interface{}{
 		"buffer_size_mb":      bufferSize,
 		"max_buffer_size_mb":  bm.config.MaxBufferSizeMB,
 		"usage_percentage":    float64(bufferSize) / float64(bm.config.MaxBufferSizeMB) * 100,
-		"total_records":       totalRecords,
-		"oldest_record":       oldestRecord,
-		"newest_record":       newestRecord,
+		"total_records":       totals.Records,
+		"oldest_record":       totals.Oldest,
+		"newest_record":       totals.Newest,
 		"retention_days":      bm.config.MaxRetentionDays,
 		"compression_enabled": bm.config.CompressionEnabled,
 		"overflow_action":     bm.config.OverflowAction,
 		"service_records":     serviceCounts,
+		"quotas":              bm.QuotaReport(),
+		"last_recompress":     bm.lastRecompressRun(),
 		"timestamp":           time.Now().Unix(),
 	}
 
@@ -933,6 +1136,24 @@ func (bm *BufferManager) handleBufferStats(w http.ResponseWriter, r *http.Reques
 	json.NewEncoder(w).Encode(stats)
 }
 
+// acceptRecord takes a newly received record, handing it to the forwarding
+// worker when VPN failover is enabled and buffering it otherwise
+func (bm *BufferManager) acceptRecord(record TelemetryRecord) error {
+	bm.metrics.ingested.add(1, record.Service, record.DataType)
+
+	// Try to forward immediately via channel if VPN failover is enabled
+	if bm.config.VPNFailoverEnabled {
+		select {
+		case bm.forwardChan <- record:
+			// Record sent to forwarding worker
+			return nil
+		default:
+			// Channel full, store in buffer
+		}
+	}
+	return bm.StoreRecord(record)
+}
+
 // Generic ingestion handler
 func (bm *BufferManager) ingestData(w http.ResponseWriter, r *http.Request, service string, dataType string) {
 	var payload interface{}
@@ -959,24 +1180,9 @@ func (bm *BufferManager) ingestData(w http.ResponseWriter, r *http.Request, serv
 		Forwarded: 0,
 	}
 
-	// Try to forward immediately via channel if VPN failover is enabled
-	if bm.config.VPNFailoverEnabled {
-		select {
-		case bm.forwardChan <- record:
-			// Record sent to forwarding worker
-		default:
-			// Channel full, store in buffer
-			if err := bm.StoreRecord(record); err != nil {
-				http.Error(w, fmt.Sprintf("Storage error: %v", err), http.StatusInternalServerError)
-				return
-			}
-		}
-	} else {
-		// Store directly in buffer
-		if err := bm.StoreRecord(record); err != nil {
-			http.Error(w, fmt.Sprintf("Storage error: %v", err), http.StatusInternalServerError)
-			return
-		}
+	if err := bm.acceptRecord(record); err != nil {
+		http.Error(w, fmt.Sprintf("Storage error: %v", err), storeErrorStatus(err))
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -1065,7 +1271,7 @@ func (bm *BufferManager) handleIngest(w http.ResponseWriter, r *http.Request) {
 		// Serialize event data
 		jsonData, err := json.Marshal(event)
 		if err != nil {
-			log.Printf("Failed to marshal event data: %v", err)
+			logger.WithError(err).WithField("service", service).Warn("Failed to marshal event data")
 			errors++
 			continue
 		}
@@ -1081,26 +1287,10 @@ func (bm *BufferManager) handleIngest(w http.ResponseWriter, r *http.Request) {
 			Forwarded: 0, // Start as buffered
 		}
 
-		// Try to forward immediately via channel if VPN failover is enabled
-		if bm.config.VPNFailoverEnabled {
-			select {
-			case bm.forwardChan <- record:
-				// Record sent to forwarding worker
-			default:
-				// Channel full, store in buffer
-				if err := bm.StoreRecord(record); err != nil {
-					log.Printf("Failed to store record: %v", err)
-					errors++
-					continue
-				}
-			}
-		} else {
-			// Store directly in buffer
-			if err := bm.StoreRecord(record); err != nil {
-				log.Printf("Failed to store record: %v", err)
-				errors++
-				continue
-			}
+		if err := bm.acceptRecord(record); err != nil {
+			logger.WithError(err).WithField("service", service).Warn("Failed to store record")
+			errors++
+			continue
 		}
 
 		processed++
@@ -1126,6 +1316,9 @@ func (bm *BufferManager) startCleanupWorker() {
 			if err := bm.CleanupExpiredRecords(); err != nil {
 				log.Printf("Cleanup worker error: %v", err)
 			}
+			if err := bm.indexSearchText(); err != nil {
+				log.Printf("Full-text indexing error: %v", err)
+			}
 		}
 	}()
 }
@@ -1153,6 +1346,9 @@ func main() {
 	// Start cleanup worker
 	bm.startCleanupWorker()
 
+	// Bind native collectors configured through the config-service
+	bm.startCollectors(applianceConfigPath())
+
 	// Setup HTTP routes
 	r := mux.NewRouter()
 	api := r.PathPrefix("/api/buffer").Subrouter()
@@ -1161,9 +1357,24 @@ func main() {
 	api.HandleFunc("/status", bm.handleStatus).Methods("GET")
 	api.HandleFunc("/stats", bm.handleBufferStats).Methods("GET")
 	api.HandleFunc("/stats/{service}", bm.handleServiceStats).Methods("GET")
+	api.HandleFunc("/records", bm.handleSearchRecords).Methods("GET")
+	api.HandleFunc("/export", bm.handleExport).Methods("GET")
+	api.HandleFunc("/import", bm.handleImport).Methods("POST")
 	api.HandleFunc("/cleanup", bm.handleCleanup).Methods("POST")
+	api.HandleFunc("/recompress", bm.handleRecompress).Methods("POST")
 	api.HandleFunc("/config", bm.handleConfig).Methods("GET", "POST")
 	api.HandleFunc("/ingest", bm.handleIngest).Methods("POST")
+	api.HandleFunc("/dictionaries", bm.handleDictionaries).Methods("GET")
+	api.HandleFunc("/flows/stats", bm.handleFlowStats).Methods("GET")
+	api.HandleFunc("/dictionaries/{service}/train", bm.handleTrainDictionary).Methods("POST")
+
+	// Dead-letter queue
+	api.HandleFunc("/deadletter", bm.handleDeadLetterList).Methods("GET")
+	api.HandleFunc("/deadletter", bm.handleDeadLetterPurge).Methods("DELETE")
+	api.HandleFunc("/deadletter/requeue", bm.handleDeadLetterRequeue).Methods("POST")
+	api.HandleFunc("/deadletter/{id:[0-9]+}", bm.handleDeadLetterGet).Methods("GET")
+	api.HandleFunc("/deadletter/{id:[0-9]+}", bm.handleDeadLetterPurge).Methods("DELETE")
+	api.HandleFunc("/deadletter/{id:[0-9]+}/requeue", bm.handleDeadLetterRequeue).Methods("POST")
 
 	// V1 API - Per-service ingestion endpoints
 	v1 := r.PathPrefix("/api/v1").Subrouter()
@@ -1178,8 +1389,13 @@ func main() {
 	// VPN and forwarding operations
 	api.HandleFunc("/vpn/status", bm.handleVPNStatus).Methods("GET")
 	api.HandleFunc("/forward", bm.handleForwardBuffer).Methods("POST")
+	api.HandleFunc("/replay", bm.handleReplayStart).Methods("POST")
+	api.HandleFunc("/replay", bm.handleReplayList).Methods("GET")
+	api.HandleFunc("/replay/{id}", bm.handleReplayGet).Methods("GET")
+	api.HandleFunc("/replay/{id}/cancel", bm.handleReplayCancel).Methods("POST")
 
 	// Health check with enhanced status
+	r.HandleFunc("/metrics", bm.handleMetrics).Methods("GET")
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		bufferSize, _ := bm.getBufferSizeMB()
 		bm.vpnMutex.RLock()
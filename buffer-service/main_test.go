@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureForwarder records every forwarded record instead of sending it
+type captureForwarder struct {
+	mu      sync.Mutex
+	records []TelemetryRecord
+}
+
+func (c *captureForwarder) Forward(record TelemetryRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.records = append(c.records, record)
+	return nil
+}
+
+func (c *captureForwarder) Close() error { return nil }
+
+func (c *captureForwarder) payloads() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]string, len(c.records))
+	for i, r := range c.records {
+		out[i] = r.JsonData
+	}
+	return out
+}
+
+func newTestBufferManager(t *testing.T, dataPath string) *BufferManager {
+	t.Helper()
+	if dataPath == "" {
+		dataPath = t.TempDir()
+	}
+	bm, err := NewBufferManager(dataPath)
+	if err != nil {
+		t.Fatalf("NewBufferManager: %v", err)
+	}
+	t.Cleanup(func() {
+		close(bm.stopChan)
+		bm.db.Close()
+	})
+	return bm
+}
+
+// newTestBufferManagerWith starts a buffer manager from a config file that
+// configure has adjusted, so no background worker sees the config change
+func newTestBufferManagerWith(t *testing.T, configure func(*BufferConfig)) *BufferManager {
+	t.Helper()
+	dataPath := t.TempDir()
+	cfg := defaultBufferConfig()
+	configure(&cfg)
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatalf("marshal config: %v", err)
+	}
+	configDir := filepath.Join(dataPath, "buffer", "config")
+	if err := os.MkdirAll(configDir, 0755); err != nil {
+		t.Fatalf("create config dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(configDir, "buffer-config.json"), data, 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return newTestBufferManager(t, dataPath)
+}
+
+// useCapture routes every known data type to a single capturing forwarder
+func useCapture(bm *BufferManager) *captureForwarder {
+	c := &captureForwarder{}
+	bm.fwdMutex.Lock()
+	bm.forwarders = map[string]Forwarder{}
+	for _, dt := range []string{"syslog", "netflow", "snmp", "windows_events", "metrics"} {
+		bm.forwarders[dt] = c
+	}
+	bm.fwdMutex.Unlock()
+	return c
+}
+
+var roundTripCases = []struct {
+	service  string
+	dataType string
+	payload  string
+}{
+	{"fluent-bit", "syslog", `{"host":"core-sw1","facility":"local7","severity":"notice","message":"%LINK-3-UPDOWN: Interface Gi0/1, changed state to up"}`},
+	{"goflow2", "netflow", `{"flow_type":"netflow_v9","src_addr":"10.0.0.1","dst_addr":"10.0.0.2","bytes":123456,"packets":98}`},
+	{"telegraf", "snmp", `{"oid":"1.3.6.1.6.3.1.1.5.3","agent":"192.0.2.10","varbinds":[{"oid":"1.3.6.1.2.1.2.2.1.1","value":3}]}`},
+	{"vector", "windows_events", `{"channel":"Security","event_id":4625,"message":"An account failed to log on.\r\nÜñíçødé ✓"}`},
+	{"telegraf", "metrics", `{"name":"cpu","tags":{"host":"edge-01"},"fields":{"usage_idle":97.5},"timestamp":1700000000}`},
+}
+
+func TestBufferedRecordsRoundTrip(t *testing.T) {
+	for _, bufferMode := range []string{"database", "files"} {
+		for _, mode := range []string{"none", "gzip", "zstd"} {
+			for _, tc := range roundTripCases {
+				t.Run(bufferMode+"/"+mode+"/"+tc.dataType, func(t *testing.T) {
+					bm := newTestBufferManager(t, "")
+					cfg := bm.config.Services[tc.service]
+					cfg.BufferMode = bufferMode
+					cfg.CompressionMode = mode
+					bm.config.Services[tc.service] = cfg
+
+					if err := bm.StoreRecord(TelemetryRecord{
+						Service:   tc.service,
+						Timestamp: time.Now().Unix(),
+						DataType:  tc.dataType,
+						DataSize:  int64(len(tc.payload)),
+						JsonData:  tc.payload,
+						SourceIP:  "192.0.2.1",
+					}); err != nil {
+						t.Fatalf("StoreRecord: %v", err)
+					}
+
+					stats, err := bm.GetStats(tc.service)
+					if err != nil {
+						t.Fatalf("GetStats: %v", err)
+					}
+					want := bm.storageCodec(mode)
+					if cs := stats.Compression[want]; cs.Records != 1 || cs.RawBytes != int64(len(tc.payload)) {
+						t.Fatalf("codec stats = %+v, want one %s record", stats.Compression, want)
+					}
+
+					capture := useCapture(bm)
+					bm.forwardBufferedRecords()
+
+					got := capture.payloads()
+					if len(got) != 1 || got[0] != tc.payload {
+						t.Fatalf("forwarded %q, want %q", got, tc.payload)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestBufferedRecordsRoundTrip_CompressionDisabled(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.CompressionEnabled = false
+
+	tc := roundTripCases[3]
+	if err := bm.StoreRecord(TelemetryRecord{Service: tc.service, DataType: tc.dataType, JsonData: tc.payload}); err != nil {
+		t.Fatalf("StoreRecord: %v", err)
+	}
+
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+	if got := capture.payloads(); len(got) != 1 || got[0] != tc.payload {
+		t.Fatalf("forwarded %q, want %q", got, tc.payload)
+	}
+}
+
+func TestMigrateSchema_TagsLegacyGzipRows(t *testing.T) {
+	dataPath := t.TempDir()
+	dbDir := filepath.Join(dataPath, "buffer", "db")
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Build a pre-migration database holding one gzip row and one plain row
+	db, err := sql.Open("sqlite3", filepath.Join(dbDir, "telemetry.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &BufferManager{db: db}
+	if err := legacy.createTables(); err != nil {
+		t.Fatalf("createTables: %v", err)
+	}
+
+	payload := roundTripCases[0].payload
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	gw.Write([]byte(payload))
+	gw.Close()
+
+	insert := `INSERT INTO telemetry_buffer (service, timestamp, data_type, data_size, json_data, source_ip, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, '', ?, ?)`
+	now := time.Now().Unix()
+	for _, data := range []string{buf.String(), payload} {
+		if _, err := db.Exec(insert, "fluent-bit", now, "syslog", len(data), data, now, now+3600); err != nil {
+			t.Fatalf("insert legacy row: %v", err)
+		}
+	}
+	db.Close()
+
+	bm := newTestBufferManager(t, dataPath)
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+
+	got := capture.payloads()
+	if len(got) != 2 || got[0] != payload || got[1] != payload {
+		t.Fatalf("forwarded %q, want two copies of %q", got, payload)
+	}
+}
+
+func TestHandleConfig_RedactsSecretsAndMergesUpdates(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		dest := cfg.Destinations["metrics"]
+		dest.Auth = AuthCfg{Type: "token", Token: "s3cret"}
+		dest.Headers = map[string]string{"X-API-Key": "k3y"}
+		cfg.Destinations["metrics"] = dest
+	})
+
+	rec := httptest.NewRecorder()
+	bm.handleConfig(rec, httptest.NewRequest("GET", "/api/buffer/config", nil))
+	if strings.Contains(rec.Body.String(), "s3cret") || strings.Contains(rec.Body.String(), "k3y") {
+		t.Fatalf("GET returned a credential: %s", rec.Body)
+	}
+	var got BufferConfig
+	json.NewDecoder(rec.Body).Decode(&got)
+
+	// Echo the redacted config back with one change, then send a partial update
+	got.MaxRetentionDays = 3
+	body, _ := json.Marshal(got)
+	for _, update := range []string{
+		string(body),
+		`{"drain_batch_size": 250}`,
+		`{"destinations": {"metrics": {"port": 8087}}, "services": {"vector": {"priority": 3}}}`,
+	} {
+		rec = httptest.NewRecorder()
+		bm.handleConfig(rec, httptest.NewRequest("POST", "/api/buffer/config", strings.NewReader(update)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s: status %d: %s", update, rec.Code, rec.Body)
+		}
+	}
+	metrics, defaults := bm.config.Destinations["metrics"], defaultDestinations()["metrics"]
+	if metrics.Auth.Token != "s3cret" || metrics.Headers["X-API-Key"] != "k3y" || len(bm.config.Destinations) != len(defaultDestinations()) {
+		t.Fatalf("destinations after update: %+v", bm.config.Destinations)
+	}
+	if metrics.Port != 8087 || metrics.Host != defaults.Host || metrics.Transport != defaults.Transport ||
+		metrics.Path != defaults.Path || metrics.WriteTimeoutSec != defaults.WriteTimeoutSec {
+		t.Fatalf("partial destination update lost settings: %+v", metrics)
+	}
+	if vector := bm.config.Services["vector"]; vector.Priority != 3 || vector.BufferMode != "database" || vector.MaxRecords == 0 {
+		t.Fatalf("partial service update lost settings: %+v", vector)
+	}
+	if bm.config.MaxRetentionDays != 3 || bm.config.DrainBatchSize != 250 {
+		t.Fatalf("updates not applied: %+v", bm.config)
+	}
+
+	info, err := os.Stat(filepath.Join(bm.dataPath, "buffer", "config", "buffer-config.json"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("config file mode %v, %v", info.Mode(), err)
+	}
+}
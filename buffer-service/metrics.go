@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const metricsNamespace = "noc_raven_buffer_"
+
+var (
+	latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	drainBuckets   = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders label pairs in exposition format
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a labelled series map in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metricVec is a family of float series keyed by label values, used for counters and gauges
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: metricsNamespace + name, help: help, kind: "counter", labels: labels, values: make(map[string]float64)}
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return &metricVec{name: metricsNamespace + name, help: help, kind: "gauge", labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metricVec) add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelKey(labelValues)] += v
+}
+
+func (m *metricVec) set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[labelKey(labelValues)] = v
+}
+
+func (m *metricVec) get(labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[labelKey(labelValues)]
+}
+
+func (m *metricVec) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, strings.Split(key, "\xff")), formatValue(m.values[key]))
+	}
+}
+
+// histogram holds cumulative bucket counts for one label set
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a family of histograms keyed by label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: metricsNamespace + name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(labelValues)
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		values := strings.Split(key, "\xff")
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", formatValue(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+// bufferMetrics holds the service's Prometheus metrics
+type bufferMetrics struct {
+	ingested        *metricVec
+	stored          *metricVec
+	forwarded       *metricVec
+	forwardFailures *metricVec
+	deadLettered    *metricVec
+	overflowDropped *metricVec
+	overflowReject  *metricVec
+	forwardLatency  *histogramVec
+	drainBatch      *histogramVec
+	vpnProbe        *histogramVec
+	collected       *metricVec
+	collectorErrors *metricVec
+}
+
+func newBufferMetrics() *bufferMetrics {
+	return &bufferMetrics{
+		ingested:        newCounterVec("ingested_records_total", "Records received for buffering or forwarding.", "service", "data_type"),
+		stored:          newCounterVec("stored_records_total", "Records written to the buffer.", "service", "data_type", "backend"),
+		forwarded:       newCounterVec("forwarded_records_total", "Records forwarded successfully.", "service", "data_type"),
+		forwardFailures: newCounterVec("forward_failures_total", "Failed forward attempts.", "service", "data_type"),
+		deadLettered:    newCounterVec("dead_lettered_records_total", "Records moved to the dead-letter queue.", "service"),
+		overflowDropped: newCounterVec("overflow_dropped_records_total", "Buffered records evicted to stay within quotas.", "service"),
+		overflowReject:  newCounterVec("overflow_rejected_records_total", "Incoming records rejected because a quota was full.", "service"),
+		forwardLatency:  newHistogramVec("forward_duration_seconds", "Time taken to forward one record.", latencyBuckets, "data_type"),
+		drainBatch:      newHistogramVec("drain_batch_duration_seconds", "Time taken to forward one leased drain batch.", drainBuckets),
+		vpnProbe:        newHistogramVec("vpn_probe_duration_seconds", "Latency of VPN health probes.", latencyBuckets, "result"),
+		collected:       newCounterVec("collector_messages_total", "Messages received by native collectors.", "collector", "transport"),
+		collectorErrors: newCounterVec("collector_errors_total", "Native collector receive, parse and store errors.", "collector", "reason"),
+	}
+}
+
+// handleMetrics serves metrics in Prometheus exposition format. Backlog gauges
+// come from the running usage totals, so a scrape never scans the buffer.
+func (bm *BufferManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m := bm.metrics
+	for _, vec := range []*metricVec{m.ingested, m.stored, m.forwarded, m.forwardFailures, m.deadLettered, m.overflowDropped, m.overflowReject, m.collected, m.collectorErrors} {
+		vec.write(w)
+	}
+	for _, h := range []*histogramVec{m.forwardLatency, m.drainBatch, m.vpnProbe} {
+		h.write(w)
+	}
+
+	records := newGaugeVec("records", "Records held in the buffer.", "service", "backend")
+	pending := newGaugeVec("pending_records", "Buffered records waiting to be forwarded.", "service", "backend")
+	bytes := newGaugeVec("bytes", "Bytes held in the buffer.", "service", "backend")
+	for service, u := range bm.quota.snapshot() {
+		records.set(float64(u.Records), service, "database")
+		pending.set(float64(u.Pending), service, "database")
+		bytes.set(float64(u.Bytes), service, "database")
+	}
+	for service, store := range bm.segmentStoreList() {
+		stats := store.Stats()
+		records.set(float64(stats.Records), service, "files")
+		pending.set(float64(stats.Pending), service, "files")
+		bytes.set(float64(stats.Bytes), service, "files")
+	}
+	records.write(w)
+	pending.write(w)
+	bytes.write(w)
+
+	drain := bm.drain.snapshot()
+	drainGauge := newGaugeVec("drain_remaining_records", "Records left in the running drain.")
+	drainGauge.set(float64(drain.Remaining))
+	drainGauge.write(w)
+	rate := newGaugeVec("drain_rate_records_per_second", "Forwarding rate of the running drain.")
+	rate.set(drain.RatePerSec)
+	rate.write(w)
+
+	bm.vpnMutex.RLock()
+	vpn := bm.vpnStatus
+	bm.vpnMutex.RUnlock()
+	connected := newGaugeVec("vpn_connected", "Whether the VPN to the collectors is up.")
+	if vpn.Connected {
+		connected.set(1)
+	} else {
+		connected.set(0)
+	}
+	connected.write(w)
+	latency := newGaugeVec("vpn_probe_latency_seconds", "Latency of the most recent successful VPN probe.")
+	latency.set(float64(vpn.Latency) / 1000)
+	latency.write(w)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrape(t *testing.T, bm *BufferManager) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	bm.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectSeries(t *testing.T, body string, series ...string) {
+	t.Helper()
+	for _, s := range series {
+		if !strings.Contains(body, s+"\n") {
+			t.Fatalf("metrics missing %q in:\n%s", s, body)
+		}
+	}
+}
+
+func TestMetrics_IngestForwardAndBacklog(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services["telegraf"]
+		svc.BufferMode = "database"
+		cfg.Services["telegraf"] = svc
+	})
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		bm.ingestData(rec, httptest.NewRequest("POST", "/api/v1/ingest/metrics", bytes.NewBufferString(`{"name":"cpu"}`)), "telegraf", "metrics")
+		if rec.Code != 200 {
+			t.Fatalf("ingest returned %d", rec.Code)
+		}
+	}
+
+	expectSeries(t, scrape(t, bm),
+		`noc_raven_buffer_ingested_records_total{service="telegraf",data_type="metrics"} 3`,
+		`noc_raven_buffer_stored_records_total{service="telegraf",data_type="metrics",backend="database"} 3`,
+		`noc_raven_buffer_pending_records{service="telegraf",backend="database"} 3`,
+	)
+
+	calls := 0
+	bm.fwdMutex.Lock()
+	bm.forwarders = map[string]Forwarder{"metrics": funcForwarder(func(TelemetryRecord) error {
+		calls++
+		if calls == 1 {
+			return errors.New("HTTP 503")
+		}
+		return nil
+	})}
+	bm.fwdMutex.Unlock()
+	bm.db.Exec("UPDATE telemetry_buffer SET next_attempt_at = 0")
+	bm.forwardBufferedRecords()
+	bm.db.Exec("UPDATE telemetry_buffer SET next_attempt_at = 0")
+	bm.forwardBufferedRecords()
+
+	body := scrape(t, bm)
+	expectSeries(t, body,
+		`noc_raven_buffer_forwarded_records_total{service="telegraf",data_type="metrics"} 3`,
+		`noc_raven_buffer_forward_failures_total{service="telegraf",data_type="metrics"} 1`,
+		`noc_raven_buffer_pending_records{service="telegraf",backend="database"} 0`,
+		`noc_raven_buffer_forward_duration_seconds_count{data_type="metrics"} 4`,
+		`noc_raven_buffer_forward_duration_seconds_bucket{data_type="metrics",le="+Inf"} 4`,
+		`noc_raven_buffer_vpn_connected 0`,
+	)
+	if !strings.Contains(body, "# TYPE noc_raven_buffer_drain_batch_duration_seconds histogram") {
+		t.Fatalf("drain histogram missing")
+	}
+}
+
+func TestMetrics_OverflowDrops(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["vector"]
+	cfg.MaxRecords = 2
+	bm.config.Services["vector"] = cfg
+	storeDatabaseRecords(t, bm, "vector", "windows_events", 4, 1000)
+
+	bm.config.OverflowAction = "drop_newest"
+	bm.StoreRecord(TelemetryRecord{Service: "vector", DataType: "windows_events", JsonData: `{}`})
+
+	expectSeries(t, scrape(t, bm),
+		`noc_raven_buffer_overflow_dropped_records_total{service="vector"} 2`,
+		`noc_raven_buffer_overflow_rejected_records_total{service="vector"} 1`,
+	)
+}
+
+func TestFormatLabels_Escapes(t *testing.T) {
+	got := formatLabels([]string{"service"}, []string{"a\"b\\c\nd"})
+	if got != `{service="a\"b\\c\nd"}` {
+		t.Fatalf("formatLabels = %s", got)
+	}
+}
+
+func TestMetrics_VectorIngestCountsRecords(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+	})
+
+	rec := httptest.NewRecorder()
+	body := `[{"source_type":"vector","data_type":"windows_events","event_id":4625},{"source_type":"vector","data_type":"windows_events","event_id":4624}]`
+	bm.handleIngest(rec, httptest.NewRequest("POST", "/api/v1/ingest", bytes.NewBufferString(body)))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"processed":2`) {
+		t.Fatalf("ingest returned %d: %s", rec.Code, rec.Body)
+	}
+
+	expectSeries(t, scrape(t, bm),
+		`noc_raven_buffer_ingested_records_total{service="vector",data_type="windows_events"} 2`,
+	)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"buffer-service/flow"
+	"github.com/sirupsen/logrus"
+)
+
+// flowService is the buffer service that owns flow records, whichever
+// collector decoded them
+const flowService = "goflow2"
+
+// FlowListenerCfg is collection.netflow from the config-service file. As with
+// syslog, the native decoder only binds when Native is set, since GoFlow2 owns
+// the same ports by default.
+type FlowListenerCfg struct {
+	Enabled            bool         `json:"enabled"`
+	Native             bool         `json:"native"` // decode in buffer-service instead of GoFlow2
+	Port               int          `json:"port"`
+	BindAddress        string       `json:"bindAddress"`
+	Ports              FlowPortsCfg `json:"ports"`
+	TemplateTimeoutMin int          `json:"template_timeout_minutes,omitempty"` // default 30
+}
+
+// FlowPortsCfg holds the per-protocol flow ports
+type FlowPortsCfg struct {
+	NetflowV5 int `json:"netflow_v5"`
+	IPFIX     int `json:"ipfix"`
+	SFlow     int `json:"sflow"`
+}
+
+func (c FlowListenerCfg) active() bool {
+	return c.Enabled && c.Native
+}
+
+// netflowPorts returns the distinct UDP ports that accept NetFlow and IPFIX.
+// Every port accepts every version, since exporters are often pointed at the
+// wrong one.
+func (c FlowListenerCfg) netflowPorts() []int {
+	var ports []int
+	seen := make(map[int]bool)
+	for _, p := range []int{c.Port, c.Ports.NetflowV5, c.Ports.IPFIX} {
+		if p > 0 && !seen[p] {
+			seen[p] = true
+			ports = append(ports, p)
+		}
+	}
+	return ports
+}
+
+func (c FlowListenerCfg) bindAddr(port int) string {
+	host := c.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// udpCollector reads datagrams from one or more UDP sockets
+type udpCollector struct {
+	name   string
+	conns  []net.PacketConn
+	wg     sync.WaitGroup
+	handle func(packet []byte, remote net.Addr) (reply []byte)
+}
+
+// startUDPCollector binds every address and serves each socket with handle.
+// A non-nil reply from handle is sent back to the remote address.
+func startUDPCollector(bm *BufferManager, name string, addrs []string, handle func([]byte, net.Addr) []byte) (*udpCollector, error) {
+	c := &udpCollector{name: name, handle: handle}
+	for _, addr := range addrs {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s listen on %s: %v", name, addr, err)
+		}
+		c.conns = append(c.conns, conn)
+	}
+	if len(c.conns) == 0 {
+		return nil, fmt.Errorf("no %s ports configured", name)
+	}
+
+	bound := make([]string, 0, len(c.conns))
+	for _, conn := range c.conns {
+		bound = append(bound, conn.LocalAddr().String())
+		c.wg.Add(1)
+		go c.serve(bm, conn)
+	}
+	logger.WithFields(logrus.Fields{"collector": name, "addresses": bound}).Info("Native collector started")
+	return c, nil
+}
+
+// Close stops every socket and waits for the readers to exit
+func (c *udpCollector) Close() error {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.wg.Wait()
+	return nil
+}
+
+func (c *udpCollector) serve(bm *BufferManager, conn net.PacketConn) {
+	defer c.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			bm.metrics.collectorErrors.add(1, c.name, "read")
+			continue
+		}
+		bm.metrics.collected.add(1, c.name, "udp")
+		if reply := c.handle(buf[:n], addr); reply != nil {
+			if _, err := conn.WriteTo(reply, addr); err != nil {
+				bm.metrics.collectorErrors.add(1, c.name, "write")
+			}
+		}
+	}
+}
+
+// flowDecoder returns the shared decoder, creating it on first use. The
+// caller holds collectors.mu.
+func (bm *BufferManager) flowDecoder(templateTimeout time.Duration) *flow.Decoder {
+	if bm.collectors.flowDecoder == nil {
+		bm.collectors.flowDecoder = flow.NewDecoder(templateTimeout)
+	} else if templateTimeout > 0 {
+		bm.collectors.flowDecoder.SetTemplateTimeout(templateTimeout)
+	}
+	return bm.collectors.flowDecoder
+}
+
+// startFlowListener binds the NetFlow/IPFIX ports. The caller holds collectors.mu.
+func startFlowListener(bm *BufferManager, cfg FlowListenerCfg) (*udpCollector, error) {
+	decoder := bm.flowDecoder(time.Duration(cfg.TemplateTimeoutMin) * time.Minute)
+	var addrs []string
+	for _, port := range cfg.netflowPorts() {
+		addrs = append(addrs, cfg.bindAddr(port))
+	}
+	return startUDPCollector(bm, "netflow", addrs, func(packet []byte, remote net.Addr) []byte {
+		now := time.Now()
+		exporter := remoteIP(remote)
+		flows, err := decoder.Decode(exporter, packet, now)
+		if err != nil {
+			bm.metrics.collectorErrors.add(1, "netflow", "decode")
+			logger.WithError(err).WithField("exporter", exporter).Debug("Failed to decode flow packet")
+		}
+		for _, f := range flows {
+			bm.storeFlowRecord("netflow", "netflow", f, exporter, now)
+		}
+		return nil
+	})
+}
+
+// storeFlowRecord buffers one decoded flow or counter record under dataType
+func (bm *BufferManager) storeFlowRecord(collector, dataType string, v interface{}, source string, now time.Time) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		bm.metrics.collectorErrors.add(1, collector, "encode")
+		return
+	}
+	record := TelemetryRecord{
+		Service:   flowService,
+		Timestamp: now.Unix(),
+		DataType:  dataType,
+		DataSize:  int64(len(data)),
+		JsonData:  string(data),
+		SourceIP:  source,
+	}
+	if err := bm.acceptRecord(record); err != nil {
+		bm.metrics.collectorErrors.add(1, collector, "store")
+	}
+}
+
+// handleFlowStats reports template and sequence counters of the native flow decoder
+func (bm *BufferManager) handleFlowStats(w http.ResponseWriter, r *http.Request) {
+	bm.collectors.mu.Lock()
+	decoder := bm.collectors.flowDecoder
+	_, running := bm.collectors.running["netflow"]
+	_, sflowRunning := bm.collectors.running["sflow"]
+	bm.collectors.mu.Unlock()
+
+	stats := flow.Stats{Exporters: []flow.ExporterStats{}}
+	if decoder != nil {
+		stats = decoder.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"running":       running,
+		"sflow_running": sflowRunning,
+		"netflow":       stats,
+	})
+}
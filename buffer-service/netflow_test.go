@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"buffer-service/flow"
+)
+
+// netflowV5Packet builds a v5 export packet with one TCP flow per source port
+func netflowV5Packet(seq uint32, srcPorts ...uint16) []byte {
+	now := uint32(time.Now().Unix())
+	b := binary.BigEndian.AppendUint16(nil, 5)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(srcPorts)))
+	for _, v := range []uint32{10000, now, 0, seq, 0} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	for _, port := range srcPorts {
+		rec := make([]byte, 48)
+		copy(rec[0:], net.IPv4(10, 0, 0, 1).To4())
+		copy(rec[4:], net.IPv4(192, 0, 2, 1).To4())
+		binary.BigEndian.PutUint32(rec[16:], 2)
+		binary.BigEndian.PutUint32(rec[20:], 120)
+		binary.BigEndian.PutUint16(rec[32:], port)
+		binary.BigEndian.PutUint16(rec[34:], 443)
+		rec[38] = 6
+		b = append(b, rec...)
+	}
+	return b
+}
+
+func TestFlowListener_BuffersDecodedFlows(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services[flowService]
+		svc.BufferMode = "database"
+		cfg.Services[flowService] = svc
+	})
+
+	port := freePort(t)
+	bm.applyCollection(CollectionCfg{Netflow: FlowListenerCfg{Enabled: true, Native: true, Port: port, BindAddress: "127.0.0.1"}})
+	defer bm.stopCollectors()
+	if bm.collectors.running["netflow"] == nil {
+		t.Fatalf("flow collector not running")
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(netflowV5Packet(1, 40001, 40002))
+	conn.Write(netflowV5Packet(10, 40003))
+
+	var flows []flow.Record
+	deadline := time.Now().Add(5 * time.Second)
+	for len(flows) < 3 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		flows = flows[:0]
+		rows, _ := bm.db.Query("SELECT json_data, codec FROM telemetry_buffer WHERE service = ? AND data_type = 'netflow'", flowService)
+		for rows.Next() {
+			var r TelemetryRecord
+			rows.Scan(&r.JsonData, &r.Codec)
+			bm.decodeRecord(&r)
+			var f flow.Record
+			json.Unmarshal([]byte(r.JsonData), &f)
+			flows = append(flows, f)
+		}
+		rows.Close()
+	}
+	if len(flows) != 3 {
+		t.Fatalf("buffered %d flows, want 3", len(flows))
+	}
+	if f := flows[0]; f.FlowType != flow.TypeNetFlowV5 || f.SrcIP != "10.0.0.1" || f.DstPort != 443 || f.Bytes != 120 || f.Exporter != "127.0.0.1" {
+		t.Fatalf("unexpected flow: %+v", f)
+	}
+
+	rec := httptest.NewRecorder()
+	bm.handleFlowStats(rec, httptest.NewRequest("GET", "/api/buffer/flows/stats", nil))
+	var resp struct {
+		Running bool       `json:"running"`
+		Netflow flow.Stats `json:"netflow"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !resp.Running || len(resp.Netflow.Exporters) != 1 {
+		t.Fatalf("unexpected stats: %+v", resp)
+	}
+	if es := resp.Netflow.Exporters[0]; es.Packets != 2 || es.SequenceGaps != 1 || es.SequenceLost != 7 {
+		t.Fatalf("unexpected exporter stats: %+v", es)
+	}
+}
+
+func TestSFlowListener_BuffersSampledEstimates(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services[flowService]
+		svc.BufferMode = "database"
+		cfg.Services[flowService] = svc
+	})
+
+	port := freePort(t)
+	bm.applyCollection(CollectionCfg{SFlow: SFlowListenerCfg{Enabled: true, Native: true, Port: port, BindAddress: "127.0.0.1"}})
+	defer bm.stopCollectors()
+	if bm.collectors.running["sflow"] == nil {
+		t.Fatalf("sflow collector not running")
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	for _, name := range []string{"flow_samples.bin", "counter_samples.bin"} {
+		b, err := os.ReadFile("flow/testdata/" + name)
+		if err != nil {
+			t.Fatalf("read fixture: %v", err)
+		}
+		conn.Write(b)
+	}
+
+	types := make(map[string]int)
+	var first flow.Record
+	var counters TelemetryRecord
+	deadline := time.Now().Add(5 * time.Second)
+	for len(types) < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		types = make(map[string]int)
+		rows, _ := bm.db.Query("SELECT timestamp, data_type, json_data, codec, source_ip FROM telemetry_buffer WHERE service = ? ORDER BY id", flowService)
+		for rows.Next() {
+			var r TelemetryRecord
+			rows.Scan(&r.Timestamp, &r.DataType, &r.JsonData, &r.Codec, &r.SourceIP)
+			bm.decodeRecord(&r)
+			if r.DataType == flow.TypeSFlowCounters {
+				if types[r.DataType] == 0 {
+					counters = r
+				}
+				types[r.DataType]++
+				continue
+			}
+			var f flow.Record
+			json.Unmarshal([]byte(r.JsonData), &f)
+			if types[f.FlowType] == 0 && f.FlowType == flow.TypeSFlow {
+				first = f
+			}
+			types[f.FlowType]++
+		}
+		rows.Close()
+	}
+	if types[flow.TypeSFlow] != 2 || types[flow.TypeSFlowCounters] == 0 {
+		t.Fatalf("buffered record types %v", types)
+	}
+	// Counter samples are metrics, not flows the netflow destination could export
+	line, n, err := encodeLineProtocol(counters)
+	if err != nil || n != 1 || !strings.HasPrefix(string(line), "sflow_interface,agent=192.0.2.1,if_index=3 ") ||
+		!strings.Contains(string(line), "if_speed=1e+09") {
+		t.Fatalf("counter record encodes as %q, %d, %v", line, n, err)
+	}
+	capture := &captureForwarder{}
+	bm.fwdMutex.Lock()
+	bm.forwarders = map[string]Forwarder{"metrics": capture}
+	bm.fwdMutex.Unlock()
+	if err := bm.forwardRecord(counters); err != nil || len(capture.payloads()) != 1 {
+		t.Fatalf("counter record not sent to the metrics destination: %v", err)
+	}
+	if first.Exporter != "192.0.2.1" || first.Packets != 1000 || first.Bytes != 1518*1000 {
+		t.Fatalf("unexpected sampled flow: %+v", first)
+	}
+}
@@ -0,0 +1,688 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// otlpMaxRecords bounds how many buffered records go into one export
+	otlpMaxRecords = 1000
+	otlpScopeName  = "noc-raven/buffer-service"
+)
+
+// OTLP severity numbers for syslog severities 0-7, per the OpenTelemetry
+// log data model's syslog mapping
+var otlpSyslogSeverity = []int{21, 19, 18, 17, 13, 10, 9, 5}
+
+// isOTLP reports whether a destination takes OTLP/HTTP
+func isOTLP(dest DestinationCfg) bool {
+	switch strings.ToLower(dest.Format) {
+	case "otlp", "otlp_proto", "otlp_json":
+		return true
+	}
+	return false
+}
+
+// applianceID names this appliance in exported resources. It defaults to the
+// hostname, which the terminal menu sets to the appliance name.
+func applianceID() string {
+	if id := os.Getenv("NOC_RAVEN_APPLIANCE_ID"); id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// otlpAttr is one attribute; value is a string, int64, float64 or bool
+type otlpAttr struct {
+	key   string
+	value interface{}
+}
+
+type otlpLogRecord struct {
+	time         int64 // unix nanoseconds
+	observed     int64
+	severity     int
+	severityText string
+	body         string
+	attrs        []otlpAttr
+}
+
+type otlpDataPoint struct {
+	name  string
+	time  int64
+	value float64
+	attrs []otlpAttr
+}
+
+// otlpResource holds what one collector buffered from one source
+type otlpResource struct {
+	attrs  []otlpAttr
+	logs   []otlpLogRecord
+	points []otlpDataPoint
+}
+
+// otlpForwarder exports buffered syslog and Windows events as OTLP logs, and
+// metrics as OTLP gauges, to an OpenTelemetry collector over HTTP.
+//
+// A throttled export (429, 502, 503 or 504) is retried no sooner than the
+// collector's Retry-After, and until then further exports fail without being
+// sent. A partial success is not retried, as the OTLP specification requires:
+// the collector has already decided about every record in it.
+type otlpForwarder struct {
+	dest      DestinationCfg
+	url       string
+	metrics   bool
+	json      bool
+	appliance string
+	client    *http.Client
+
+	mu             sync.Mutex
+	throttledUntil time.Time
+}
+
+func newOTLPForwarder(dataType string, dest DestinationCfg) (*otlpForwarder, error) {
+	f := &otlpForwarder{
+		dest:      dest,
+		json:      strings.EqualFold(dest.Format, "otlp_json"),
+		appliance: applianceID(),
+		client:    newHTTPClient(dest),
+	}
+	path := "/v1/logs"
+	switch dataType {
+	case "syslog", "windows_events":
+	case "metrics":
+		f.metrics = true
+		path = "/v1/metrics"
+	default:
+		return nil, fmt.Errorf("OTLP export does not support %s", dataType)
+	}
+	if dest.Path != "" && dest.Path != "/" {
+		path = dest.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	f.url = fmt.Sprintf("%s://%s%s", strings.ToLower(dest.Transport), net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)), path)
+	return f, nil
+}
+
+func (f *otlpForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch exports the records in requests of up to otlpMaxRecords,
+// grouped into one resource per collector and source. A record fails with
+// the request that carried it.
+func (f *otlpForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	for start := 0; start < len(records); start += otlpMaxRecords {
+		end := min(start+otlpMaxRecords, len(records))
+		f.export(records[start:end], errs[start:end])
+	}
+	return errs
+}
+
+func (f *otlpForwarder) export(records []TelemetryRecord, errs []error) {
+	resources := make(map[string]*otlpResource)
+	var keys []string
+	var owners []int
+	for i, record := range records {
+		key := record.Service + "\x00" + record.SourceIP
+		res, ok := resources[key]
+		if !ok {
+			res = &otlpResource{attrs: f.resourceAttrs(record)}
+		}
+		if f.metrics {
+			points, err := otlpDataPoints(record)
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			res.points = append(res.points, points...)
+		} else {
+			res.logs = append(res.logs, otlpLogFromRecord(record))
+		}
+		if !ok {
+			resources[key] = res
+			keys = append(keys, key)
+		}
+		owners = append(owners, i)
+	}
+	if len(owners) == 0 {
+		return
+	}
+
+	ordered := make([]*otlpResource, len(keys))
+	for i, key := range keys {
+		ordered[i] = resources[key]
+	}
+	var body []byte
+	switch {
+	case f.json:
+		body, _ = json.Marshal(otlpJSONRequest(ordered, f.metrics))
+	case f.metrics:
+		body = otlpMetricsRequest(ordered)
+	default:
+		body = otlpLogsRequest(ordered)
+	}
+	if err := f.post(body); err != nil {
+		for _, i := range owners {
+			errs[i] = err
+		}
+	}
+}
+
+func (f *otlpForwarder) resourceAttrs(record TelemetryRecord) []otlpAttr {
+	attrs := []otlpAttr{{"service.name", "noc-raven"}, {"noc_raven.appliance_id", f.appliance}}
+	if record.Service != "" {
+		attrs = append(attrs, otlpAttr{"noc_raven.service", record.Service})
+	}
+	if record.SourceIP != "" {
+		attrs = append(attrs, otlpAttr{"noc_raven.source_ip", record.SourceIP})
+	}
+	return attrs
+}
+
+// post sends one export request and interprets the collector's answer
+func (f *otlpForwarder) post(payload []byte) error {
+	f.mu.Lock()
+	wait := time.Until(f.throttledUntil)
+	f.mu.Unlock()
+	if wait > 0 {
+		return &retryAfterError{errors.New("OTLP destination is throttling exports"), wait}
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write(payload)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", f.url, &body)
+	if err != nil {
+		return err
+	}
+	contentType := "application/x-protobuf"
+	if f.json {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.dest.Auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	isJSON := mediaType == "application/json"
+
+	switch {
+	case resp.StatusCode < 300:
+		if rejected, msg := otlpPartialSuccess(reply, isJSON); rejected > 0 {
+			logger.WithField("url", f.url).WithField("rejected", rejected).WithField("reason", msg).
+				Warn("OTLP destination rejected part of an export")
+		}
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable, resp.StatusCode == http.StatusGatewayTimeout:
+		err := fmt.Errorf("HTTP %d: %s", resp.StatusCode, otlpStatusMessage(reply, isJSON))
+		after, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			return err
+		}
+		f.mu.Lock()
+		f.throttledUntil = time.Now().Add(after)
+		f.mu.Unlock()
+		return &retryAfterError{err, after}
+	case resp.StatusCode == http.StatusBadRequest:
+		// The collector will never accept this payload
+		return fmt.Errorf("%w: HTTP 400: %s", errRejected, otlpStatusMessage(reply, isJSON))
+	default:
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, otlpStatusMessage(reply, isJSON))
+	}
+}
+
+func (f *otlpForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+// otlpPartialSuccess reads partial_success from an Export*ServiceResponse,
+// whose first field is the rejected log record or data point count
+func otlpPartialSuccess(reply []byte, isJSON bool) (int64, string) {
+	if isJSON {
+		var resp struct {
+			PartialSuccess map[string]json.RawMessage `json:"partialSuccess"`
+		}
+		if json.Unmarshal(reply, &resp) != nil {
+			return 0, ""
+		}
+		var rejected int64
+		var msg string
+		for k, v := range resp.PartialSuccess {
+			switch k {
+			case "rejectedLogRecords", "rejectedDataPoints":
+				rejected, _ = strconv.ParseInt(strings.Trim(string(v), `"`), 10, 64)
+			case "errorMessage":
+				json.Unmarshal(v, &msg)
+			}
+		}
+		return rejected, msg
+	}
+
+	var rejected int64
+	var msg string
+	walkProto(reply, func(field int, v []byte, _ uint64) {
+		if field != 1 {
+			return
+		}
+		walkProto(v, func(field int, v []byte, n uint64) {
+			switch field {
+			case 1:
+				rejected = int64(n)
+			case 2:
+				msg = string(v)
+			}
+		})
+	})
+	return rejected, msg
+}
+
+// otlpStatusMessage reads the message of a google.rpc.Status error reply
+func otlpStatusMessage(reply []byte, isJSON bool) string {
+	var msg string
+	if isJSON {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(reply, &status)
+		msg = status.Message
+	} else if walkProto(reply, func(field int, v []byte, _ uint64) {
+		if field == 2 {
+			msg = string(v)
+		}
+	}) != nil {
+		// Not a Status; proxies answer in plain text
+		msg = string(reply)
+	}
+	if len(msg) > 512 {
+		msg = msg[:512]
+	}
+	return strings.TrimSpace(msg)
+}
+
+// otlpLogFromRecord maps a buffered syslog message or Windows event to a
+// LogRecord. Windows events are told apart by their event_id.
+func otlpLogFromRecord(record TelemetryRecord) otlpLogRecord {
+	observed := record.Timestamp * int64(time.Second)
+	var event map[string]interface{}
+	if json.Unmarshal([]byte(record.JsonData), &event) == nil && event["event_id"] != nil {
+		return otlpLogFromWindowsEvent(event, record.JsonData, observed)
+	}
+
+	msg := syslogFromRecord(record)
+	rec := otlpLogRecord{
+		time:         syslogTime(msg.Timestamp).UnixNano(),
+		observed:     observed,
+		severity:     otlpSyslogSeverity[msg.Severity],
+		severityText: syslogSeverities[msg.Severity],
+		body:         msg.Message,
+		attrs:        []otlpAttr{{"syslog.facility", int64(msg.Facility)}},
+	}
+	for _, a := range []otlpAttr{{"host.name", msg.Hostname}, {"syslog.appname", msg.AppName}, {"syslog.procid", msg.ProcID}, {"syslog.msgid", msg.MsgID}} {
+		if a.value != "" {
+			rec.attrs = append(rec.attrs, a)
+		}
+	}
+	for _, id := range sortedKeys(msg.StructuredData) {
+		for _, name := range sortedKeys(msg.StructuredData[id]) {
+			rec.attrs = append(rec.attrs, otlpAttr{"syslog.sd." + id + "." + name, msg.StructuredData[id][name]})
+		}
+	}
+	return rec
+}
+
+// windowsLevels maps Windows event levels, by number or Vector's name, to
+// OTLP severity numbers
+var windowsLevels = map[string]int{
+	"1": 21, "critical": 21,
+	"2": 17, "error": 17,
+	"3": 13, "warning": 13,
+	"4": 9, "information": 9, "0": 9,
+	"5": 5, "verbose": 5,
+}
+
+func otlpLogFromWindowsEvent(event map[string]interface{}, raw string, observed int64) otlpLogRecord {
+	rec := otlpLogRecord{time: observed, observed: observed, body: raw}
+	if msg, ok := event["message"].(string); ok {
+		rec.body = msg
+	}
+	if ts, ok := event["timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			rec.time = t.UnixNano()
+		}
+	}
+	if level, ok := firstString(event, "level"); ok {
+		rec.severity = windowsLevels[strings.ToLower(level)]
+		rec.severityText = level
+	}
+	otlpEventAttrs(&rec.attrs, "winlog.", event)
+	return rec
+}
+
+// otlpEventAttrs flattens an event's fields, other than its message, into
+// attributes
+func otlpEventAttrs(attrs *[]otlpAttr, prefix string, fields map[string]interface{}) {
+	for _, k := range sortedKeys(fields) {
+		if prefix == "winlog." && (k == "message" || k == "timestamp") {
+			continue
+		}
+		switch v := fields[k].(type) {
+		case string, bool:
+			*attrs = append(*attrs, otlpAttr{prefix + k, v})
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				*attrs = append(*attrs, otlpAttr{prefix + k, int64(v)})
+			} else {
+				*attrs = append(*attrs, otlpAttr{prefix + k, v})
+			}
+		case map[string]interface{}:
+			otlpEventAttrs(attrs, prefix+k+".", v)
+		}
+	}
+}
+
+// otlpDataPoints converts a Telegraf metrics record to one gauge point per
+// numeric field, named as for remote_write but keeping the original tags
+func otlpDataPoints(record TelemetryRecord) ([]otlpDataPoint, error) {
+	metrics, err := parseTelegrafMetrics(record.JsonData)
+	if err != nil {
+		return nil, err
+	}
+	var points []otlpDataPoint
+	for _, m := range metrics {
+		if m.Name == "" {
+			continue
+		}
+		var attrs []otlpAttr
+		for _, k := range sortedKeys(m.Tags) {
+			if v := tagValue(m.Tags[k]); v != "" {
+				attrs = append(attrs, otlpAttr{k, v})
+			}
+		}
+		values := make(map[string]float64)
+		numericFields(values, "", m.Fields)
+		for _, field := range sortedKeys(values) {
+			name := m.Name + "_" + field
+			if field == "value" {
+				name = m.Name
+			}
+			points = append(points, otlpDataPoint{name, timestampNanos(m.Timestamp, record.Timestamp), values[field], attrs})
+		}
+	}
+	if len(points) == 0 {
+		return nil, errNoMetrics
+	}
+	return points, nil
+}
+
+// otlpMetricNames returns the metric names of a resource's points in order of
+// first appearance, with the points of each
+func otlpMetricNames(points []otlpDataPoint) ([]string, map[string][]otlpDataPoint) {
+	var names []string
+	byName := make(map[string][]otlpDataPoint)
+	for _, p := range points {
+		if _, ok := byName[p.name]; !ok {
+			names = append(names, p.name)
+		}
+		byName[p.name] = append(byName[p.name], p)
+	}
+	return names, byName
+}
+
+// Protobuf encoding of ExportLogsServiceRequest and ExportMetricsServiceRequest
+// (opentelemetry/proto/collector, v1). Field numbers are noted where used.
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+// appendAnyValue encodes AnyValue{string_value = 1, bool_value = 2,
+// int_value = 3, double_value = 4}
+func appendAnyValue(b []byte, field int, value interface{}) []byte {
+	var v []byte
+	switch value := value.(type) {
+	case string:
+		v = appendProtoBytes(v, 1, []byte(value))
+	case bool:
+		n := uint64(0)
+		if value {
+			n = 1
+		}
+		v = appendProtoVarint(v, 2, n)
+	case int64:
+		v = appendProtoVarint(v, 3, uint64(value))
+	case float64:
+		v = appendProtoFixed64(v, 4, math.Float64bits(value))
+	}
+	return appendProtoBytes(b, field, v)
+}
+
+// appendAttributes encodes repeated KeyValue{key = 1, value = 2}
+func appendAttributes(b []byte, field int, attrs []otlpAttr) []byte {
+	for _, a := range attrs {
+		kv := appendProtoBytes(nil, 1, []byte(a.key))
+		kv = appendAnyValue(kv, 2, a.value)
+		b = appendProtoBytes(b, field, kv)
+	}
+	return b
+}
+
+// otlpResourceAndScope encodes Resource{attributes = 1} as field 1 and
+// returns the InstrumentationScope{name = 1} every scope message starts with
+func otlpResourceAndScope(res *otlpResource) (resource, scope []byte) {
+	resource = appendProtoBytes(nil, 1, appendAttributes(nil, 1, res.attrs))
+	scope = appendProtoBytes(nil, 1, appendProtoBytes(nil, 1, []byte(otlpScopeName)))
+	return resource, scope
+}
+
+// otlpLogsRequest encodes resource_logs = 1 of ResourceLogs{resource = 1,
+// scope_logs = 2}, ScopeLogs{scope = 1, log_records = 2} and
+// LogRecord{time_unix_nano = 1, severity_number = 2, severity_text = 3,
+// body = 5, attributes = 6, observed_time_unix_nano = 11}
+func otlpLogsRequest(resources []*otlpResource) []byte {
+	var req []byte
+	for _, res := range resources {
+		resource, scopeLogs := otlpResourceAndScope(res)
+		for _, l := range res.logs {
+			var rec []byte
+			rec = appendProtoFixed64(rec, 1, uint64(l.time))
+			if l.severity > 0 {
+				rec = appendProtoVarint(rec, 2, uint64(l.severity))
+			}
+			if l.severityText != "" {
+				rec = appendProtoBytes(rec, 3, []byte(l.severityText))
+			}
+			rec = appendAnyValue(rec, 5, l.body)
+			rec = appendAttributes(rec, 6, l.attrs)
+			rec = appendProtoFixed64(rec, 11, uint64(l.observed))
+			scopeLogs = appendProtoBytes(scopeLogs, 2, rec)
+		}
+		req = appendProtoBytes(req, 1, appendProtoBytes(resource, 2, scopeLogs))
+	}
+	return req
+}
+
+// otlpMetricsRequest encodes resource_metrics = 1 of ResourceMetrics{resource = 1,
+// scope_metrics = 2}, ScopeMetrics{scope = 1, metrics = 2}, Metric{name = 1,
+// gauge = 5}, Gauge{data_points = 1} and NumberDataPoint{time_unix_nano = 3,
+// as_double = 4, attributes = 7}
+func otlpMetricsRequest(resources []*otlpResource) []byte {
+	var req []byte
+	for _, res := range resources {
+		resource, scopeMetrics := otlpResourceAndScope(res)
+		names, byName := otlpMetricNames(res.points)
+		for _, name := range names {
+			var gauge []byte
+			for _, p := range byName[name] {
+				var point []byte
+				point = appendProtoFixed64(point, 3, uint64(p.time))
+				point = appendProtoFixed64(point, 4, math.Float64bits(p.value))
+				point = appendAttributes(point, 7, p.attrs)
+				gauge = appendProtoBytes(gauge, 1, point)
+			}
+			metric := appendProtoBytes(nil, 1, []byte(name))
+			metric = appendProtoBytes(metric, 5, gauge)
+			scopeMetrics = appendProtoBytes(scopeMetrics, 2, metric)
+		}
+		req = appendProtoBytes(req, 1, appendProtoBytes(resource, 2, scopeMetrics))
+	}
+	return req
+}
+
+// walkProto calls fn for each top-level field of a protobuf message: v holds
+// length-delimited contents, n varint and fixed values
+func walkProto(b []byte, fn func(field int, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		if k <= 0 {
+			return errors.New("malformed protobuf")
+		}
+		b = b[k:]
+		switch key & 7 {
+		case 0:
+			n, k := binary.Uvarint(b)
+			if k <= 0 {
+				return errors.New("malformed protobuf")
+			}
+			fn(int(key>>3), nil, n)
+			b = b[k:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("malformed protobuf")
+			}
+			fn(int(key>>3), nil, binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			n, k := binary.Uvarint(b)
+			if k <= 0 || uint64(len(b)-k) < n {
+				return errors.New("malformed protobuf")
+			}
+			fn(int(key>>3), b[k:k+int(n)], 0)
+			b = b[k+int(n):]
+		case 5:
+			if len(b) < 4 {
+				return errors.New("malformed protobuf")
+			}
+			fn(int(key>>3), nil, uint64(binary.LittleEndian.Uint32(b)))
+			b = b[4:]
+		default:
+			return errors.New("malformed protobuf")
+		}
+	}
+	return nil
+}
+
+// otlpJSONRequest builds the OTLP/JSON form of an export request, in which
+// 64-bit integers are strings and field names are lowerCamelCase
+func otlpJSONRequest(resources []*otlpResource, metrics bool) map[string]interface{} {
+	scope := map[string]interface{}{"name": otlpScopeName}
+	var out []interface{}
+	for _, res := range resources {
+		resource := map[string]interface{}{"attributes": otlpJSONAttrs(res.attrs)}
+		if !metrics {
+			var records []interface{}
+			for _, l := range res.logs {
+				rec := map[string]interface{}{
+					"timeUnixNano":         strconv.FormatInt(l.time, 10),
+					"observedTimeUnixNano": strconv.FormatInt(l.observed, 10),
+					"body":                 otlpJSONValue(l.body),
+					"attributes":           otlpJSONAttrs(l.attrs),
+				}
+				if l.severity > 0 {
+					rec["severityNumber"] = l.severity
+				}
+				if l.severityText != "" {
+					rec["severityText"] = l.severityText
+				}
+				records = append(records, rec)
+			}
+			out = append(out, map[string]interface{}{
+				"resource":  resource,
+				"scopeLogs": []interface{}{map[string]interface{}{"scope": scope, "logRecords": records}},
+			})
+			continue
+		}
+
+		var metricList []interface{}
+		names, byName := otlpMetricNames(res.points)
+		for _, name := range names {
+			var points []interface{}
+			for _, p := range byName[name] {
+				points = append(points, map[string]interface{}{
+					"timeUnixNano": strconv.FormatInt(p.time, 10),
+					"asDouble":     p.value,
+					"attributes":   otlpJSONAttrs(p.attrs),
+				})
+			}
+			metricList = append(metricList, map[string]interface{}{"name": name, "gauge": map[string]interface{}{"dataPoints": points}})
+		}
+		out = append(out, map[string]interface{}{
+			"resource":     resource,
+			"scopeMetrics": []interface{}{map[string]interface{}{"scope": scope, "metrics": metricList}},
+		})
+	}
+	if metrics {
+		return map[string]interface{}{"resourceMetrics": out}
+	}
+	return map[string]interface{}{"resourceLogs": out}
+}
+
+func otlpJSONAttrs(attrs []otlpAttr) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for _, a := range attrs {
+		out = append(out, map[string]interface{}{"key": a.key, "value": otlpJSONValue(a.value)})
+	}
+	return out
+}
+
+func otlpJSONValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	}
+	return map[string]interface{}{"stringValue": fmt.Sprint(value)}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// otlpReceiver records every decompressed export and answers with reply
+func otlpReceiver(t *testing.T, reply http.HandlerFunc) (*httptest.Server, *[][]byte) {
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil || r.Header.Get("Content-Encoding") != "gzip" {
+			http.Error(w, "expected gzip", http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		bodies = append(bodies, body)
+		reply(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &bodies
+}
+
+func otlpDest(ts *httptest.Server, format string) DestinationCfg {
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return DestinationCfg{Host: u.Hostname(), Port: port, Transport: "http", Format: format}
+}
+
+// protoAttrs decodes repeated KeyValue fields holding string or int values
+func protoAttrs(t *testing.T, msg []byte, field int) map[string]string {
+	attrs := map[string]string{}
+	protoFields(t, msg, func(f int, _ int, kv []byte, _ uint64) {
+		if f != field {
+			return
+		}
+		var key, value string
+		protoFields(t, kv, func(f int, _ int, v []byte, _ uint64) {
+			if f == 1 {
+				key = string(v)
+				return
+			}
+			protoFields(t, v, func(kind int, _ int, s []byte, n uint64) {
+				if kind == 1 {
+					value = string(s)
+				} else {
+					value = strconv.FormatUint(n, 10)
+				}
+			})
+		})
+		attrs[key] = value
+	})
+	return attrs
+}
+
+func TestOTLPForwarder_ExportsSyslogAsProtobufLogs(t *testing.T) {
+	t.Setenv("NOC_RAVEN_APPLIANCE_ID", "noc-raven-007")
+	var path string
+	ts, bodies := otlpReceiver(t, func(w http.ResponseWriter, r *http.Request) { path = r.URL.Path })
+	fwd, err := newForwarder("syslog", otlpDest(ts, "otlp"))
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	errs := fwd.(BatchForwarder).ForwardBatch([]TelemetryRecord{
+		{Service: "fluent-bit", SourceIP: "192.0.2.7", Timestamp: 1700000000,
+			JsonData: `{"pri":187,"time":"2023-11-14T22:13:20.5Z","host":"core-sw1","app":"ospfd","message":"neighbor down","sd":{"origin":{"ip":"192.0.2.7"}}}`},
+		{Service: "fluent-bit", SourceIP: "192.0.2.8", Timestamp: 1700000001, JsonData: `{"message":"second source"}`},
+	})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("ForwardBatch: %v", errs)
+	}
+	if path != "/v1/logs" || len(*bodies) != 1 {
+		t.Fatalf("path=%s requests=%d", path, len(*bodies))
+	}
+
+	var resources []map[string]string
+	var records [][]byte
+	protoFields(t, (*bodies)[0], func(_ int, _ int, rl []byte, _ uint64) {
+		protoFields(t, rl, func(f int, _ int, v []byte, _ uint64) {
+			if f == 1 {
+				resources = append(resources, protoAttrs(t, v, 1))
+				return
+			}
+			protoFields(t, v, func(f int, _ int, rec []byte, _ uint64) {
+				if f == 2 {
+					records = append(records, rec)
+				}
+			})
+		})
+	})
+	if len(resources) != 2 || resources[0]["noc_raven.appliance_id"] != "noc-raven-007" ||
+		resources[0]["noc_raven.source_ip"] != "192.0.2.7" || resources[0]["noc_raven.service"] != "fluent-bit" {
+		t.Fatalf("unexpected resources %v", resources)
+	}
+
+	var body, severity string
+	var timeNanos, severityNumber uint64
+	protoFields(t, records[0], func(f int, _ int, v []byte, n uint64) {
+		switch f {
+		case 1:
+			timeNanos = n
+		case 2:
+			severityNumber = n
+		case 3:
+			severity = string(v)
+		case 5:
+			protoFields(t, v, func(_ int, _ int, s []byte, _ uint64) { body = string(s) })
+		}
+	})
+	attrs := protoAttrs(t, records[0], 6)
+	if body != "neighbor down" || severityNumber != 17 || severity != "err" || timeNanos != 1700000000500000000 {
+		t.Fatalf("body=%q severity=%d/%s time=%d", body, severityNumber, severity, timeNanos)
+	}
+	if attrs["host.name"] != "core-sw1" || attrs["syslog.appname"] != "ospfd" || attrs["syslog.facility"] != "23" || attrs["syslog.sd.origin.ip"] != "192.0.2.7" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestOTLPForwarder_JSONMetricsAndWindowsEvents(t *testing.T) {
+	ts, bodies := otlpReceiver(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"partialSuccess":{"rejectedDataPoints":"1","errorMessage":"NaN not allowed"}}`))
+	})
+	fwd, err := newForwarder("metrics", otlpDest(ts, "otlp_json"))
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	// A partial success is final: the records count as delivered
+	err = fwd.Forward(TelemetryRecord{Service: "telegraf", JsonData: `{"name":"cpu","tags":{"host":"edge-01"},"fields":{"usage_idle":97.5,"value":3},"timestamp":1700000000}`})
+	if err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+
+	var req struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name  string
+					Gauge struct {
+						DataPoints []struct {
+							TimeUnixNano string
+							AsDouble     float64
+							Attributes   []struct {
+								Key   string
+								Value map[string]string
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal((*bodies)[0], &req); err != nil {
+		t.Fatalf("export is not OTLP/JSON: %v", err)
+	}
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 2 || metrics[0].Name != "cpu_usage_idle" || metrics[1].Name != "cpu" {
+		t.Fatalf("unexpected metrics %+v", metrics)
+	}
+	point := metrics[0].Gauge.DataPoints[0]
+	if point.AsDouble != 97.5 || point.TimeUnixNano != "1700000000000000000" || point.Attributes[0].Value["stringValue"] != "edge-01" {
+		t.Fatalf("unexpected data point %+v", point)
+	}
+
+	rec := otlpLogFromRecord(TelemetryRecord{Timestamp: 1700000000,
+		JsonData: `{"channel":"Security","event_id":4625,"level":"Warning","timestamp":"2023-11-14T22:13:21Z","message":"An account failed to log on.","event_data":{"TargetUserName":"bob"}}`})
+	attrs := map[string]interface{}{}
+	for _, a := range rec.attrs {
+		attrs[a.key] = a.value
+	}
+	if rec.body != "An account failed to log on." || rec.severity != 13 || rec.time != 1700000001*int64(time.Second) ||
+		attrs["winlog.event_id"] != int64(4625) || attrs["winlog.event_data.TargetUserName"] != "bob" || attrs["winlog.message"] != nil {
+		t.Fatalf("unexpected Windows event mapping %+v", rec)
+	}
+}
+
+func TestOTLPForwarder_ThrottlingAndRejection(t *testing.T) {
+	status := http.StatusTooManyRequests
+	ts, bodies := otlpReceiver(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(status)
+	})
+	fwd, _ := newOTLPForwarder("windows_events", otlpDest(ts, "otlp"))
+	record := TelemetryRecord{JsonData: `{"event_id":1,"message":"m"}`}
+
+	var throttled *retryAfterError
+	if err := fwd.Forward(record); !errors.As(err, &throttled) || throttled.after != 30*time.Second {
+		t.Fatalf("429: err = %v", err)
+	}
+	// Further exports wait out the Retry-After without being sent
+	if err := fwd.Forward(record); !errors.As(err, &throttled) || len(*bodies) != 1 {
+		t.Fatalf("export during throttle: err = %v, requests = %d", err, len(*bodies))
+	}
+
+	fwd.throttledUntil = time.Time{}
+	status = http.StatusBadRequest
+	if err := fwd.Forward(record); !errors.Is(err, errRejected) {
+		t.Fatalf("400: err = %v", err)
+	}
+}
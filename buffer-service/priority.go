@@ -0,0 +1,85 @@
+package main
+
+import (
+	"sort"
+)
+
+// defaultPriority is used for services without a configured priority
+const defaultPriority = 5
+
+// servicePriority returns a service's configured priority clamped to 1-10
+func (bm *BufferManager) servicePriority(service string) int {
+	priority := bm.config.Services[service].Priority
+	switch {
+	case priority <= 0:
+		return defaultPriority
+	case priority > 10:
+		return 10
+	default:
+		return priority
+	}
+}
+
+// byPriority orders services highest priority first, ties broken by name
+func (bm *BufferManager) byPriority(services []string) []string {
+	sorted := append([]string(nil), services...)
+	sort.Slice(sorted, func(i, j int) bool {
+		pi, pj := bm.servicePriority(sorted[i]), bm.servicePriority(sorted[j])
+		if pi != pj {
+			return pi > pj
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// drainShares splits size slots across services with pending records in proportion
+// to their priority. Every service gets at least one slot so low-priority telemetry
+// keeps moving, and slots a service cannot fill go to the highest priorities first.
+func (bm *BufferManager) drainShares(pending map[string]int, size int) map[string]int {
+	var services []string
+	totalWeight := 0
+	for service, n := range pending {
+		if n > 0 {
+			services = append(services, service)
+			totalWeight += bm.servicePriority(service)
+		}
+	}
+	services = bm.byPriority(services)
+
+	shares := make(map[string]int, len(services))
+	left := size
+	for _, service := range services {
+		share := size * bm.servicePriority(service) / totalWeight
+		if share < 1 {
+			share = 1
+		}
+		if share > pending[service] {
+			share = pending[service]
+		}
+		shares[service] = share
+		left -= share
+	}
+
+	for _, service := range services {
+		if left <= 0 {
+			break
+		}
+		extra := pending[service] - shares[service]
+		if extra > left {
+			extra = left
+		}
+		shares[service] += extra
+		left -= extra
+	}
+	return shares
+}
+
+// mapKeys returns the keys of a per-service map
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
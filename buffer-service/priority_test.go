@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+)
+
+// storeDatabaseRecords buffers n records for a service in SQLite with increasing timestamps
+func storeDatabaseRecords(t *testing.T, bm *BufferManager, service, dataType string, n int, firstTs int64) {
+	t.Helper()
+	cfg := bm.config.Services[service]
+	cfg.BufferMode = "database"
+	bm.config.Services[service] = cfg
+	for i := 0; i < n; i++ {
+		record := TelemetryRecord{Service: service, DataType: dataType, Timestamp: firstTs + int64(i), JsonData: `{"n":1}`}
+		if err := bm.StoreRecord(record); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+}
+
+func TestDrainShares_WeightedByPriority(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Services["lowly"] = ServiceCfg{Priority: 1}
+
+	shares := bm.drainShares(map[string]int{"goflow2": 1000, "telegraf": 1000, "lowly": 1000}, 180)
+	if shares["goflow2"] <= shares["telegraf"] || shares["telegraf"] <= shares["lowly"] {
+		t.Fatalf("shares not ordered by priority: %v", shares)
+	}
+	if shares["lowly"] < 1 {
+		t.Fatalf("low-priority service starved: %v", shares)
+	}
+	if total := shares["goflow2"] + shares["telegraf"] + shares["lowly"]; total != 180 {
+		t.Fatalf("shares add up to %d, want 180", total)
+	}
+
+	// Capacity a service cannot use goes to the others
+	shares = bm.drainShares(map[string]int{"goflow2": 5, "telegraf": 1000}, 100)
+	if shares["goflow2"] != 5 || shares["telegraf"] != 95 {
+		t.Fatalf("unused share not redistributed: %v", shares)
+	}
+}
+
+func TestLeaseBatch_HigherPriorityFirst(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	// telegraf (priority 7) holds the oldest records
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 50, 1000)
+	storeDatabaseRecords(t, bm, "goflow2", "netflow", 50, 2000)
+
+	batch, err := bm.leaseBatch(34, nil)
+	if err != nil {
+		t.Fatalf("leaseBatch: %v", err)
+	}
+	counts := map[string]int{}
+	for _, r := range batch {
+		counts[r.Service]++
+	}
+	if batch[0].Service != "goflow2" || counts["goflow2"] <= counts["telegraf"] || counts["telegraf"] == 0 {
+		t.Fatalf("unexpected batch split %v, first %s", counts, batch[0].Service)
+	}
+}
+
+func TestDropOldestRecords_EvictsLowestPriorityFirst(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeDatabaseRecords(t, bm, "goflow2", "netflow", 10, 1000)
+	storeDatabaseRecords(t, bm, "vector", "windows_events", 10, 2000)
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 10, 3000)
+
+	if _, err := bm.dropOldestRecords(15); err != nil {
+		t.Fatalf("dropOldestRecords: %v", err)
+	}
+
+	left := map[string]int{}
+	rows, err := bm.db.Query("SELECT service, COUNT(*) FROM telemetry_buffer GROUP BY service")
+	if err != nil {
+		t.Fatalf("query: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var service string
+		var n int
+		rows.Scan(&service, &n)
+		left[service] = n
+	}
+	if left["telegraf"] != 0 || left["vector"] != 5 || left["goflow2"] != 10 {
+		t.Fatalf("unexpected records left after eviction: %v", left)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// overflowDropBatch is how many SQLite records a size overflow evicts at a time
+	overflowDropBatch = 1000
+	// maxEvictionRounds bounds how long a single insert may spend freeing space
+	maxEvictionRounds = 64
+)
+
+// errBufferFull is returned when a record is rejected because a quota is exhausted
+var errBufferFull = errors.New("buffer full")
+
+// quota scopes, named after the setting that defines them
+const (
+	scopeServiceRecords = "max_records"
+	scopeBufferSize     = "max_buffer_size_mb"
+	scopeDatabaseSize   = "max_db_size_gb"
+	scopeFileSize       = "max_file_size_gb"
+)
+
+// quotaUsage is the running record count, stored size and pending count of one service
+type quotaUsage struct {
+	Records int64
+	Bytes   int64
+	Pending int64
+}
+
+// quotaAccountant keeps running SQLite usage per service so quotas can be checked
+// on every insert without scanning the table. Segment stores keep their own
+// running totals in their segment metadata.
+type quotaAccountant struct {
+	mu       sync.Mutex
+	services map[string]quotaUsage
+}
+
+func (q *quotaAccountant) add(service string, delta quotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.services == nil {
+		q.services = make(map[string]quotaUsage)
+	}
+	u := q.services[service]
+	u.Records += delta.Records
+	u.Bytes += delta.Bytes
+	u.Pending += delta.Pending
+	if u.Records < 0 || u.Bytes < 0 || u.Pending < 0 {
+		u = quotaUsage{}
+	}
+	q.services[service] = u
+}
+
+// snapshot returns a copy of every service's usage
+func (q *quotaAccountant) snapshot() map[string]quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out := make(map[string]quotaUsage, len(q.services))
+	for service, u := range q.services {
+		out[service] = u
+	}
+	return out
+}
+
+func (q *quotaAccountant) usage(service string) quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.services[service]
+}
+
+func (q *quotaAccountant) total() quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var total quotaUsage
+	for _, u := range q.services {
+		total.Records += u.Records
+		total.Bytes += u.Bytes
+		total.Pending += u.Pending
+	}
+	return total
+}
+
+func (q *quotaAccountant) reset(services map[string]quotaUsage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.services = services
+}
+
+// resyncQuota recounts SQLite usage per service. It runs at startup and after
+// bulk deletes whose per-service effect is not known up front.
+func (bm *BufferManager) resyncQuota() error {
+	query := `
+		SELECT service, COUNT(*), COALESCE(SUM(data_size), 0),
+		       COALESCE(SUM(CASE WHEN forwarded = 0 THEN 1 ELSE 0 END), 0)
+		FROM telemetry_buffer
+		GROUP BY service
+	`
+	rows, err := bm.db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	services := make(map[string]quotaUsage)
+	for rows.Next() {
+		var service string
+		var u quotaUsage
+		if err := rows.Scan(&service, &u.Records, &u.Bytes, &u.Pending); err != nil {
+			return err
+		}
+		services[service] = u
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	bm.quota.reset(services)
+	return nil
+}
+
+// fileUsage returns the records and bytes held in a service's segment files
+func (bm *BufferManager) fileUsage(service string) quotaUsage {
+	store, err := bm.segmentStoreFor(service, false)
+	if err != nil {
+		return quotaUsage{}
+	}
+	records, bytes := store.Usage()
+	return quotaUsage{Records: records, Bytes: bytes}
+}
+
+// serviceUsage returns a service's usage in the backend it buffers to
+func (bm *BufferManager) serviceUsage(service string, fileMode bool) quotaUsage {
+	if fileMode {
+		return bm.fileUsage(service)
+	}
+	return bm.quota.usage(service)
+}
+
+// exceededQuota returns the first quota a new record for service would exceed, or ""
+func (bm *BufferManager) exceededQuota(service string, fileMode bool) string {
+	if max := int64(bm.config.Services[service].MaxRecords); max > 0 && bm.serviceUsage(service, fileMode).Records >= max {
+		return scopeServiceRecords
+	}
+
+	if fileMode {
+		if max := gigabytes(bm.config.MaxFileSizeGB); max > 0 && bm.segmentBufferSize() >= max {
+			return scopeFileSize
+		}
+		return ""
+	}
+
+	dbBytes := bm.quota.total().Bytes
+	if max := megabytes(bm.config.MaxBufferSizeMB); max > 0 && dbBytes >= max {
+		return scopeBufferSize
+	}
+	if max := gigabytes(bm.config.MaxDbSizeGB); max > 0 && dbBytes >= max {
+		return scopeDatabaseSize
+	}
+	return ""
+}
+
+// enforceQuotas makes room for a new record for service according to OverflowAction.
+// It returns an error wrapping errBufferFull when the record must be rejected.
+func (bm *BufferManager) enforceQuotas(service string, fileMode bool) error {
+	for round := 0; round < maxEvictionRounds; round++ {
+		scope := bm.exceededQuota(service, fileMode)
+		if scope == "" {
+			return nil
+		}
+
+		switch bm.config.OverflowAction {
+		case "drop_newest":
+			return fmt.Errorf("%w: %s reached for %s, dropping newest record", errBufferFull, scope, service)
+		case "compress_more":
+			// Recompression runs in the background; until it frees space
+			// the oldest records are dropped as with drop_oldest
+			if !fileMode {
+				bm.requestRecompress()
+			}
+		}
+
+		freed, err := bm.evict(scope, service, fileMode)
+		if err != nil {
+			return err
+		}
+		if freed == 0 {
+			return fmt.Errorf("%w: %s reached for %s and nothing left to evict", errBufferFull, scope, service)
+		}
+	}
+	return fmt.Errorf("%w: could not free enough space for %s", errBufferFull, service)
+}
+
+// evict frees space for the given quota scope and returns how many records were removed
+func (bm *BufferManager) evict(scope, service string, fileMode bool) (int64, error) {
+	switch {
+	case scope == scopeServiceRecords && fileMode:
+		return bm.dropServiceSegment(service)
+	case scope == scopeServiceRecords:
+		count := int64(bm.config.Services[service].MaxRecords) / 100
+		if count < 1 {
+			count = 1
+		}
+		if count > overflowDropBatch {
+			count = overflowDropBatch
+		}
+		return bm.dropServiceRecords(service, count)
+	case fileMode:
+		return bm.evictSegment()
+	default:
+		return bm.dropOldestRecords(overflowDropBatch)
+	}
+}
+
+// dropServiceSegment removes a service's oldest segment
+func (bm *BufferManager) dropServiceSegment(service string) (int64, error) {
+	drop, err := bm.files.DropOldest(service, 1)
+	if err != nil {
+		return 0, err
+	}
+	if drop.Records > 0 {
+		bm.metrics.overflowDropped.add(float64(drop.Records), service)
+		logger.WithField("service", service).WithField("records", drop.Records).WithField("bytes", drop.Bytes).
+			Warn("Dropped oldest buffer segment, service exceeds max_records")
+	}
+	return drop.Records, nil
+}
+
+// QuotaStatus describes the usage of one limit
+type QuotaStatus struct {
+	Used     int64   `json:"used"`
+	Limit    int64   `json:"limit"` // 0 = unlimited
+	Headroom int64   `json:"headroom"`
+	UsagePct float64 `json:"usage_pct"`
+}
+
+// ServiceQuota describes a service's usage of its backend and record quota
+type ServiceQuota struct {
+	Backend string      `json:"backend"`
+	Bytes   int64       `json:"bytes"`
+	Records QuotaStatus `json:"records"`
+}
+
+// QuotaReport summarizes quota headroom across backends and services
+type QuotaReport struct {
+	OverflowAction string                  `json:"overflow_action"`
+	BufferBytes    QuotaStatus             `json:"buffer_bytes"`   // SQLite buffer vs max_buffer_size_mb
+	DatabaseBytes  QuotaStatus             `json:"database_bytes"` // SQLite buffer vs max_db_size_gb
+	FileBytes      QuotaStatus             `json:"file_bytes"`     // segment files vs max_file_size_gb
+	Services       map[string]ServiceQuota `json:"services"`
+}
+
+func newQuotaStatus(used, limit int64) QuotaStatus {
+	qs := QuotaStatus{Used: used, Limit: limit}
+	if limit > 0 {
+		qs.Headroom = limit - used
+		if qs.Headroom < 0 {
+			qs.Headroom = 0
+		}
+		qs.UsagePct = float64(used) / float64(limit) * 100
+	}
+	return qs
+}
+
+// QuotaReport returns current usage and headroom for every configured limit
+func (bm *BufferManager) QuotaReport() QuotaReport {
+	dbBytes := bm.quota.total().Bytes
+	report := QuotaReport{
+		OverflowAction: bm.config.OverflowAction,
+		BufferBytes:    newQuotaStatus(dbBytes, megabytes(bm.config.MaxBufferSizeMB)),
+		DatabaseBytes:  newQuotaStatus(dbBytes, gigabytes(bm.config.MaxDbSizeGB)),
+		FileBytes:      newQuotaStatus(bm.segmentBufferSize(), gigabytes(bm.config.MaxFileSizeGB)),
+		Services:       make(map[string]ServiceQuota),
+	}
+
+	for service, cfg := range bm.config.Services {
+		fileMode := cfg.BufferMode == "files"
+		usage := bm.serviceUsage(service, fileMode)
+		backend := "database"
+		if fileMode {
+			backend = "files"
+		}
+		report.Services[service] = ServiceQuota{
+			Backend: backend,
+			Bytes:   usage.Bytes,
+			Records: newQuotaStatus(usage.Records, int64(cfg.MaxRecords)),
+		}
+	}
+	return report
+}
+
+// storeErrorStatus maps a StoreRecord error to an HTTP status
+func storeErrorStatus(err error) int {
+	if errors.Is(err, errBufferFull) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func megabytes(mb int) int64 { return int64(mb) * 1024 * 1024 }
+func gigabytes(gb int) int64 { return int64(gb) * 1024 * 1024 * 1024 }
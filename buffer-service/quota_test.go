@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaxRecords_DropOldestKeepsNewest(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["telegraf"]
+	cfg.MaxRecords = 10
+	bm.config.Services["telegraf"] = cfg
+
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 15, 1000)
+
+	var count int
+	var oldest int64
+	bm.db.QueryRow("SELECT COUNT(*), MIN(timestamp) FROM telemetry_buffer WHERE service = 'telegraf'").Scan(&count, &oldest)
+	if count != 10 || oldest != 1005 {
+		t.Fatalf("count=%d oldest=%d, want 10 records starting at 1005", count, oldest)
+	}
+	if u := bm.quota.usage("telegraf"); u.Records != 10 {
+		t.Fatalf("accountant reports %d records, want 10", u.Records)
+	}
+}
+
+func TestMaxRecords_DropNewestRejects(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.OverflowAction = "drop_newest"
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services["vector"]
+		svc.MaxRecords = 2
+		cfg.Services["vector"] = svc
+	})
+
+	storeDatabaseRecords(t, bm, "vector", "windows_events", 2, 1000)
+	err := bm.StoreRecord(TelemetryRecord{Service: "vector", DataType: "windows_events", JsonData: `{}`})
+	if !errors.Is(err, errBufferFull) {
+		t.Fatalf("StoreRecord over quota returned %v, want errBufferFull", err)
+	}
+
+	rec := httptest.NewRecorder()
+	bm.ingestData(rec, httptest.NewRequest("POST", "/api/v1/ingest/windows", bytes.NewBufferString(`{"event_id":4625}`)), "vector", "windows_events")
+	if rec.Code != http.StatusInsufficientStorage {
+		t.Fatalf("ingest over quota returned %d, want %d", rec.Code, http.StatusInsufficientStorage)
+	}
+}
+
+func TestQuotaAccountant_TracksDeletes(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 1}
+	storeSyslog(t, bm, `{"n":1}`, `{"n":22}`, `{"n":333}`)
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 5, 1000)
+
+	useForwarder(bm, funcForwarder(func(TelemetryRecord) error { return errors.New("HTTP 400") }))
+	bm.forwardBufferedRecords()
+	if _, err := bm.dropOldestRecords(2); err != nil {
+		t.Fatalf("dropOldestRecords: %v", err)
+	}
+
+	tracked := map[string]quotaUsage{
+		"fluent-bit": bm.quota.usage("fluent-bit"),
+		"telegraf":   bm.quota.usage("telegraf"),
+	}
+	if err := bm.resyncQuota(); err != nil {
+		t.Fatalf("resyncQuota: %v", err)
+	}
+	for service, usage := range tracked {
+		if recount := bm.quota.usage(service); usage != recount {
+			t.Fatalf("%s: incremental usage %+v, recount %+v", service, usage, recount)
+		}
+	}
+	if tracked["fluent-bit"].Records != 0 || tracked["telegraf"].Records != 3 {
+		t.Fatalf("unexpected usage after dead-lettering and eviction: %+v", tracked)
+	}
+}
+
+func TestBufferStats_ReportsQuotaHeadroom(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["telegraf"]
+	cfg.MaxRecords = 100
+	bm.config.Services["telegraf"] = cfg
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 40, 1000)
+
+	rec := httptest.NewRecorder()
+	bm.handleBufferStats(rec, httptest.NewRequest("GET", "/api/buffer/stats", nil))
+	var stats struct {
+		Quotas QuotaReport `json:"quotas"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+
+	telegraf := stats.Quotas.Services["telegraf"]
+	if telegraf.Backend != "database" || telegraf.Records.Used != 40 || telegraf.Records.Headroom != 60 {
+		t.Fatalf("unexpected telegraf quota: %+v", telegraf)
+	}
+	if stats.Quotas.BufferBytes.Limit != megabytes(bm.config.MaxBufferSizeMB) || stats.Quotas.BufferBytes.Used != telegraf.Bytes {
+		t.Fatalf("unexpected buffer quota: %+v", stats.Quotas.BufferBytes)
+	}
+}
+
+func TestBufferStats_CountsSegmentFileRecords(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 3, 1000)
+	for i := 0; i < 5; i++ {
+		// goflow2 buffers to segment files by default
+		if err := bm.StoreRecord(TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: int64(500 + i), JsonData: `{}`}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	bm.handleBufferStats(rec, httptest.NewRequest("GET", "/api/buffer/stats", nil))
+	var stats struct {
+		TotalRecords int64 `json:"total_records"`
+		OldestRecord int64 `json:"oldest_record"`
+		NewestRecord int64 `json:"newest_record"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if stats.TotalRecords != 8 || stats.OldestRecord != 500 || stats.NewestRecord != 1002 {
+		t.Fatalf("unexpected totals: %+v", stats)
+	}
+}
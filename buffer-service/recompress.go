@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RecompressCfg controls the compress_more overflow strategy
+type RecompressCfg struct {
+	MinAgeMinutes     int    `json:"min_age_minutes"`     // rows younger than this are left alone
+	Codec             string `json:"codec"`               // "zstd" or "gzip"
+	Level             int    `json:"level"`               // target compression level
+	RowsPerRun        int    `json:"rows_per_run"`        // rows examined per run
+	BatchSmallRecords bool   `json:"batch_small_records"` // roll small records into shared blobs
+	SmallRecordBytes  int    `json:"small_record_bytes"`  // raw size at or below which a record is "small"
+	RecordsPerBlob    int    `json:"records_per_blob"`    // records rolled into one blob
+}
+
+// defaultRecompressCfg returns the recompression policy used when none is configured
+func defaultRecompressCfg() RecompressCfg {
+	return RecompressCfg{
+		MinAgeMinutes:    60,
+		Codec:            "zstd",
+		Level:            19,
+		RowsPerRun:       5000,
+		SmallRecordBytes: 512,
+		RecordsPerBlob:   100,
+	}
+}
+
+// recompressPolicy returns the configured recompression policy with unset fields defaulted
+func (bm *BufferManager) recompressPolicy() RecompressCfg {
+	policy := bm.config.Recompress
+	def := defaultRecompressCfg()
+	if policy.MinAgeMinutes <= 0 {
+		policy.MinAgeMinutes = def.MinAgeMinutes
+	}
+	if policy.Codec != "gzip" && policy.Codec != "zstd" {
+		policy.Codec = def.Codec
+	}
+	if policy.Level <= 0 {
+		policy.Level = def.Level
+		if policy.Codec == "gzip" {
+			policy.Level = 9
+		}
+	}
+	if policy.RowsPerRun <= 0 {
+		policy.RowsPerRun = def.RowsPerRun
+	}
+	if policy.SmallRecordBytes <= 0 {
+		policy.SmallRecordBytes = def.SmallRecordBytes
+	}
+	if policy.RecordsPerBlob < 2 {
+		policy.RecordsPerBlob = def.RecordsPerBlob
+	}
+	return policy
+}
+
+// RecompressRun reports the outcome of one recompression run
+type RecompressRun struct {
+	StartedAt      int64 `json:"started_at"`
+	DurationMs     int64 `json:"duration_ms"`
+	Examined       int64 `json:"examined"`
+	Recompressed   int64 `json:"recompressed"`
+	Batched        int64 `json:"batched"` // records rolled into blobs
+	Blobs          int64 `json:"blobs"`
+	BytesBefore    int64 `json:"bytes_before"`
+	BytesAfter     int64 `json:"bytes_after"`
+	BytesReclaimed int64 `json:"bytes_reclaimed"`
+}
+
+// recompressState serializes runs and remembers the last one
+type recompressState struct {
+	running sync.Mutex
+	mu      sync.Mutex
+	last    RecompressRun
+	trigger chan struct{} // wakes the background worker
+}
+
+// batchMember is one record inside a batch blob, stored as a line of NDJSON
+type batchMember struct {
+	Timestamp int64  `json:"t"`
+	SourceIP  string `json:"ip,omitempty"`
+	Data      string `json:"d"`
+}
+
+// compressOldRecords re-encodes aged SQLite rows at the recompression level and,
+// if enabled, rolls small records into batch blobs
+func (bm *BufferManager) compressOldRecords() error {
+	run, err := bm.RecompressOldRecords()
+	if err != nil {
+		return err
+	}
+	logger.WithField("examined", run.Examined).WithField("recompressed", run.Recompressed).
+		WithField("batched", run.Batched).WithField("bytes_reclaimed", run.BytesReclaimed).
+		Info("Recompressed old buffer records")
+	return nil
+}
+
+// requestRecompress asks the background worker for a run without waiting for it
+func (bm *BufferManager) requestRecompress() {
+	select {
+	case bm.recompress.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// startRecompressWorker runs the recompression that compress_more requests,
+// keeping level 19 encoding off the ingest path
+func (bm *BufferManager) startRecompressWorker() {
+	for {
+		select {
+		case <-bm.recompress.trigger:
+			if err := bm.compressOldRecords(); err != nil {
+				logger.WithError(err).Warn("Failed to recompress old records")
+			}
+		case <-bm.stopChan:
+			return
+		}
+	}
+}
+
+// RecompressOldRecords performs one recompression run and reports the bytes reclaimed
+func (bm *BufferManager) RecompressOldRecords() (RecompressRun, error) {
+	bm.recompress.running.Lock()
+	defer bm.recompress.running.Unlock()
+
+	started := time.Now()
+	run := RecompressRun{StartedAt: started.Unix()}
+	if !bm.config.CompressionEnabled {
+		return run, nil
+	}
+
+	policy := bm.recompressPolicy()
+	cutoff := started.Add(-time.Duration(policy.MinAgeMinutes) * time.Minute).Unix()
+
+	err := bm.recompressRows(policy, cutoff, &run)
+	if err == nil && policy.BatchSmallRecords {
+		err = bm.batchSmallRecords(policy, cutoff, &run)
+	}
+
+	run.BytesReclaimed = run.BytesBefore - run.BytesAfter
+	run.DurationMs = time.Since(started).Milliseconds()
+	bm.recompress.mu.Lock()
+	bm.recompress.last = run
+	bm.recompress.mu.Unlock()
+	return run, err
+}
+
+// recompressRows re-encodes individual rows that have not reached the target level yet
+func (bm *BufferManager) recompressRows(policy RecompressCfg, cutoff int64, run *RecompressRun) error {
+	query := `
+		SELECT id, service, json_data, codec, data_size
+		FROM telemetry_buffer
+		WHERE compression_level < ? AND created_at <= ? AND lease_until <= ? AND batch_count = 0
+		ORDER BY created_at ASC
+		LIMIT ?
+	`
+	rows, err := bm.db.Query(query, policy.Level, cutoff, time.Now().Unix(), policy.RowsPerRun)
+	if err != nil {
+		return err
+	}
+	var records []TelemetryRecord
+	for rows.Next() {
+		var record TelemetryRecord
+		if err := rows.Scan(&record.ID, &record.Service, &record.JsonData, &record.Codec, &record.DataSize); err != nil {
+			rows.Close()
+			return err
+		}
+		records = append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	update := "UPDATE telemetry_buffer SET json_data = ?, codec = ?, data_size = ?, compression_level = ? WHERE id = ?"
+	for _, record := range records {
+		run.Examined++
+		oldSize := record.DataSize
+		if err := bm.decodeRecord(&record); err != nil {
+			// Leave undecodable rows for the drain to dead-letter
+			continue
+		}
+
+		encoded, err := bm.compressAt(record.Service, []byte(record.JsonData), policy.Codec, policy.Level)
+		if err != nil {
+			return fmt.Errorf("failed to recompress record %d: %v", record.ID, err)
+		}
+
+		run.BytesBefore += oldSize
+		if int64(len(encoded)) >= oldSize {
+			// Not worth rewriting; remember the row has been tried at this level
+			run.BytesAfter += oldSize
+			if _, err := bm.db.Exec("UPDATE telemetry_buffer SET compression_level = ? WHERE id = ?", policy.Level, record.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := bm.db.Exec(update, encoded, policy.Codec, len(encoded), policy.Level, record.ID); err != nil {
+			return err
+		}
+		run.BytesAfter += int64(len(encoded))
+		run.Recompressed++
+		bm.quota.add(record.Service, quotaUsage{Bytes: int64(len(encoded)) - oldSize})
+	}
+	return nil
+}
+
+// batchGroup collects small rows that can share a blob
+type batchGroup struct {
+	service   string
+	dataType  string
+	forwarded int
+	rows      []TelemetryRecord
+}
+
+// batchSmallRecords rolls small aged records of the same service and data type into
+// blobs of NDJSON compressed together, which compress far better than one at a time
+func (bm *BufferManager) batchSmallRecords(policy RecompressCfg, cutoff int64, run *RecompressRun) error {
+	query := `
+		SELECT id, service, timestamp, data_type, data_size, json_data, source_ip, codec,
+		       forwarded, created_at, expires_at
+		FROM telemetry_buffer
+		WHERE batch_count = 0 AND retry_count = 0 AND raw_size > 0 AND raw_size <= ?
+		  AND created_at <= ? AND lease_until <= ?
+		ORDER BY service, data_type, forwarded, timestamp
+		LIMIT ?
+	`
+	rows, err := bm.db.Query(query, policy.SmallRecordBytes, cutoff, time.Now().Unix(), policy.RowsPerRun)
+	if err != nil {
+		return err
+	}
+	var groups []*batchGroup
+	for rows.Next() {
+		var record TelemetryRecord
+		if err := rows.Scan(&record.ID, &record.Service, &record.Timestamp, &record.DataType, &record.DataSize,
+			&record.JsonData, &record.SourceIP, &record.Codec, &record.Forwarded, &record.CreatedAt, &record.ExpiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		last := len(groups) - 1
+		if last < 0 || groups[last].service != record.Service || groups[last].dataType != record.DataType ||
+			groups[last].forwarded != record.Forwarded || len(groups[last].rows) >= policy.RecordsPerBlob {
+			groups = append(groups, &batchGroup{service: record.Service, dataType: record.DataType, forwarded: record.Forwarded})
+			last++
+		}
+		groups[last].rows = append(groups[last].rows, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if len(group.rows) < 2 {
+			continue
+		}
+		if err := bm.writeBatchBlob(group, policy, run); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchBlob replaces a group of rows with a single blob row in one transaction
+func (bm *BufferManager) writeBatchBlob(group *batchGroup, policy RecompressCfg, run *RecompressRun) error {
+	var ndjson bytes.Buffer
+	enc := json.NewEncoder(&ndjson)
+	first := group.rows[0]
+	var before, rawSize int64
+	createdAt, expiresAt := first.CreatedAt, first.ExpiresAt
+	ids := make([]int64, 0, len(group.rows))
+
+	for _, record := range group.rows {
+		size := record.DataSize
+		if err := bm.decodeRecord(&record); err != nil {
+			continue
+		}
+		if err := enc.Encode(batchMember{Timestamp: record.Timestamp, SourceIP: record.SourceIP, Data: record.JsonData}); err != nil {
+			return err
+		}
+		before += size
+		rawSize += int64(len(record.JsonData))
+		if record.CreatedAt < createdAt {
+			createdAt = record.CreatedAt
+		}
+		if record.ExpiresAt > expiresAt {
+			expiresAt = record.ExpiresAt
+		}
+		ids = append(ids, record.ID)
+	}
+	if len(ids) < 2 {
+		return nil
+	}
+
+	blob, err := bm.compressAt(group.service, ndjson.Bytes(), policy.Codec, policy.Level)
+	if err != nil {
+		return err
+	}
+	if int64(len(blob)) >= before {
+		return nil
+	}
+
+	tx, err := bm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := `
+		INSERT INTO telemetry_buffer
+		(service, timestamp, data_type, data_size, file_path, json_data, source_ip,
+		 forwarded, retry_count, created_at, expires_at, codec, raw_size, compression_level, batch_count)
+		VALUES (?, ?, ?, ?, '', ?, '', ?, 0, ?, ?, ?, ?, ?, ?)
+	`
+	if _, err := tx.Exec(insert, group.service, first.Timestamp, group.dataType, len(blob), blob,
+		group.forwarded, createdAt, expiresAt, policy.Codec, rawSize, policy.Level, len(ids)); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("DELETE FROM telemetry_buffer WHERE id = ? AND lease_until <= ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	now := time.Now().Unix()
+	for _, id := range ids {
+		result, err := stmt.Exec(id, now)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			// A drain leased the row meanwhile; leave the group alone
+			return nil
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	run.Examined += int64(len(ids))
+	run.Batched += int64(len(ids))
+	run.Blobs++
+	run.BytesBefore += before
+	run.BytesAfter += int64(len(blob))
+	delta := quotaUsage{Records: 1 - int64(len(ids)), Bytes: int64(len(blob)) - before}
+	if group.forwarded == 0 {
+		delta.Pending = delta.Records
+	}
+	bm.quota.add(group.service, delta)
+	return nil
+}
+
+// unbatchRecord expands a decoded batch blob into its member records
+func unbatchRecord(blob TelemetryRecord) ([]TelemetryRecord, error) {
+	var members []TelemetryRecord
+	scanner := bufio.NewScanner(bytes.NewReader([]byte(blob.JsonData)))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var m batchMember
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("corrupt batch record %d: %v", blob.ID, err)
+		}
+		member := blob
+		member.Timestamp = m.Timestamp
+		member.SourceIP = m.SourceIP
+		member.JsonData = m.Data
+		member.DataSize = int64(len(m.Data))
+		member.BatchCount = 0
+		members = append(members, member)
+	}
+	return members, scanner.Err()
+}
+
+// forwardBuffered forwards a decoded buffered row, expanding batch blobs. A blob
+// succeeds only once every member has been forwarded; when a member fails, the
+// blob is cut down to the members not yet sent so a retry does not repeat them.
+func (bm *BufferManager) forwardBuffered(record TelemetryRecord) error {
+	if record.BatchCount == 0 {
+		return bm.forwardRecord(record)
+	}
+	members, err := unbatchRecord(record)
+	if err != nil {
+		return err
+	}
+	for i, member := range members {
+		if err := bm.forwardRecord(member); err != nil {
+			if i > 0 {
+				if terr := bm.trimBatchBlob(record, members[i:]); terr != nil {
+					logger.WithError(terr).WithField("id", record.ID).Warn("Failed to trim partly forwarded batch record")
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// trimBatchBlob rewrites a blob row to hold only the given members, the ones
+// a partial forward left undelivered
+func (bm *BufferManager) trimBatchBlob(blob TelemetryRecord, members []TelemetryRecord) error {
+	var ndjson bytes.Buffer
+	enc := json.NewEncoder(&ndjson)
+	for _, m := range members {
+		if err := enc.Encode(batchMember{Timestamp: m.Timestamp, SourceIP: m.SourceIP, Data: m.JsonData}); err != nil {
+			return err
+		}
+	}
+
+	policy := bm.recompressPolicy()
+	data, err := bm.compressAt(blob.Service, ndjson.Bytes(), policy.Codec, policy.Level)
+	if err != nil {
+		return err
+	}
+
+	var before int64
+	if err := bm.db.QueryRow("SELECT data_size FROM telemetry_buffer WHERE id = ?", blob.ID).Scan(&before); err != nil {
+		return err
+	}
+	update := `
+		UPDATE telemetry_buffer
+		SET json_data = ?, data_size = ?, raw_size = ?, codec = ?, compression_level = ?, batch_count = ?, timestamp = ?
+		WHERE id = ?
+	`
+	_, err = bm.db.Exec(update, data, len(data), ndjson.Len(), policy.Codec, policy.Level, len(members), members[0].Timestamp, blob.ID)
+	if err != nil {
+		return err
+	}
+	bm.quota.add(blob.Service, quotaUsage{Bytes: int64(len(data)) - before})
+	return nil
+}
+
+// handleRecompress runs compress_more on demand and reports the bytes reclaimed
+func (bm *BufferManager) handleRecompress(w http.ResponseWriter, r *http.Request) {
+	run, err := bm.RecompressOldRecords()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Recompression failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
+
+// lastRecompressRun returns the outcome of the most recent recompression run
+func (bm *BufferManager) lastRecompressRun() RecompressRun {
+	bm.recompress.mu.Lock()
+	defer bm.recompress.mu.Unlock()
+	return bm.recompress.last
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// ageRecords backdates every buffered row so compress_more considers it
+func ageRecords(t *testing.T, bm *BufferManager) {
+	t.Helper()
+	if _, err := bm.db.Exec("UPDATE telemetry_buffer SET created_at = created_at - 86400"); err != nil {
+		t.Fatalf("age records: %v", err)
+	}
+}
+
+func metricPayload(i int) string {
+	return fmt.Sprintf(`{"name":"interface","tags":{"host":"edge-01","ifName":"Gi0/%d"},"fields":{"in_octets":%d,"out_octets":%d,"oper_status":1}}`, i, i*1000, i*2000)
+}
+
+func TestRecompressOldRecords_ReclaimsBytes(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["telegraf"]
+	cfg.BufferMode = "database"
+	bm.config.Services["telegraf"] = cfg
+	for i := 0; i < 20; i++ {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "telegraf", DataType: "metrics", Timestamp: int64(1000 + i), JsonData: metricPayload(i)}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+	ageRecords(t, bm)
+	before := bm.quota.usage("telegraf").Bytes
+
+	run, err := bm.RecompressOldRecords()
+	if err != nil {
+		t.Fatalf("RecompressOldRecords: %v", err)
+	}
+	if run.Examined != 20 || run.Recompressed == 0 || run.BytesReclaimed <= 0 {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+	if after := bm.quota.usage("telegraf").Bytes; before-after != run.BytesReclaimed {
+		t.Fatalf("accountant freed %d bytes, run reports %d", before-after, run.BytesReclaimed)
+	}
+	if last := bm.lastRecompressRun(); last != run {
+		t.Fatalf("last run %+v, want %+v", last, run)
+	}
+
+	// A second run has nothing left to do at this level
+	if again, _ := bm.RecompressOldRecords(); again.Examined != 0 {
+		t.Fatalf("rows recompressed twice: %+v", again)
+	}
+
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+	got := capture.payloads()
+	sort.Strings(got)
+	want := make([]string, 20)
+	for i := range want {
+		want[i] = metricPayload(i)
+	}
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("recompressed payloads changed")
+	}
+}
+
+func TestRecompressOldRecords_BatchesSmallRecords(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Recompress.BatchSmallRecords = true
+	bm.config.Recompress.RecordsPerBlob = 10
+	payloads := make([]string, 25)
+	for i := range payloads {
+		payloads[i] = fmt.Sprintf(`{"host":"sw%d","severity":"info","message":"link up"}`, i)
+	}
+	storeSyslog(t, bm, payloads...)
+	ageRecords(t, bm)
+
+	run, err := bm.RecompressOldRecords()
+	if err != nil {
+		t.Fatalf("RecompressOldRecords: %v", err)
+	}
+	if run.Batched != 25 || run.Blobs != 3 {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+
+	var rows int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer").Scan(&rows)
+	if rows != 3 || bm.quota.usage("fluent-bit").Records != 3 {
+		t.Fatalf("%d rows after batching, accountant %d", rows, bm.quota.usage("fluent-bit").Records)
+	}
+
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	if len(capture.records) != 25 {
+		t.Fatalf("forwarded %d records from blobs, want 25", len(capture.records))
+	}
+	for _, r := range capture.records {
+		var i int
+		fmt.Sscanf(r.JsonData, `{"host":"sw%d"`, &i)
+		if r.JsonData != payloads[i] || r.Timestamp != int64(1000+i) {
+			t.Fatalf("member %d came back as %q at %d", i, r.JsonData, r.Timestamp)
+		}
+	}
+}
+
+func TestCompressMore_FallsBackToDropping(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.OverflowAction = "compress_more"
+	cfg := bm.config.Services["telegraf"]
+	cfg.MaxRecords = 5
+	bm.config.Services["telegraf"] = cfg
+
+	storeDatabaseRecords(t, bm, "telegraf", "metrics", 8, 1000)
+
+	var count int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer").Scan(&count)
+	if count != 5 {
+		t.Fatalf("%d records buffered, want 5 after falling back to drop_oldest", count)
+	}
+}
+
+// batchFuncForwarder is a BatchForwarder that sends each record through its funcForwarder
+type batchFuncForwarder struct{ funcForwarder }
+
+func (f batchFuncForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	for i, r := range records {
+		errs[i] = f.funcForwarder(r)
+	}
+	return errs
+}
+
+func TestPartlyForwardedBlobIsNotResent(t *testing.T) {
+	for name, wrap := range map[string]func(funcForwarder) Forwarder{
+		"single": func(f funcForwarder) Forwarder { return f },
+		"batch":  func(f funcForwarder) Forwarder { return batchFuncForwarder{f} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			bm := newTestBufferManager(t, "")
+			bm.config.Recompress.BatchSmallRecords = true
+			bm.config.Recompress.RecordsPerBlob = 10
+			payloads := make([]string, 10)
+			for i := range payloads {
+				payloads[i] = fmt.Sprintf(`{"host":"sw%d","severity":"info","message":"link up"}`, i)
+			}
+			storeSyslog(t, bm, payloads...)
+			ageRecords(t, bm)
+			if run, err := bm.RecompressOldRecords(); err != nil || run.Blobs != 1 {
+				t.Fatalf("RecompressOldRecords: %+v, %v", run, err)
+			}
+
+			// Member sw3 fails the first time it is sent
+			sent := make(map[string]int)
+			failed := false
+			useForwarder(bm, wrap(func(r TelemetryRecord) error {
+				if r.JsonData == payloads[3] && !failed {
+					failed = true
+					return errors.New("connection reset")
+				}
+				sent[r.JsonData]++
+				return nil
+			}))
+			bm.forwardBufferedRecords()
+
+			var batchCount int
+			bm.db.QueryRow("SELECT batch_count FROM telemetry_buffer WHERE forwarded = 0").Scan(&batchCount)
+			if batchCount == 0 || batchCount >= 10 {
+				t.Fatalf("blob kept %d members after a partial forward", batchCount)
+			}
+			bm.db.Exec("UPDATE telemetry_buffer SET next_attempt_at = 0")
+			bm.forwardBufferedRecords()
+
+			for _, p := range payloads {
+				if sent[p] != 1 {
+					t.Fatalf("%s sent %d times", p, sent[p])
+				}
+			}
+		})
+	}
+}
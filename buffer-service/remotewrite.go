@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	// remoteWriteMaxSamples bounds one request, as Prometheus' max_samples_per_send
+	remoteWriteMaxSamples = 2000
+	// remoteWriteMaxSeries bounds the per-series newest-sample memory
+	remoteWriteMaxSeries = 100000
+)
+
+// isRemoteWrite reports whether a metrics destination takes Prometheus remote_write
+func isRemoteWrite(dest DestinationCfg) bool {
+	switch strings.ToLower(dest.Format) {
+	case "remote_write", "prometheus":
+		return true
+	case "":
+		path := strings.SplitN(dest.Path, "?", 2)[0]
+		return strings.HasSuffix(path, "/api/v1/write")
+	}
+	return false
+}
+
+// promLabel and promSample mirror the remote_write protobuf messages
+type promLabel struct{ name, value string }
+
+type promSample struct {
+	value     float64
+	timestamp int64 // unix milliseconds
+	owner     int   // index of the record the sample came from
+}
+
+type promSeries struct {
+	labels  []promLabel
+	samples []promSample
+}
+
+// remoteWriteForwarder sends buffered Telegraf metrics to a Prometheus
+// remote_write endpoint as snappy-compressed protobuf.
+//
+// Prometheus only accepts a sample newer than the last one it has for the
+// series, unless it falls within out_of_order_time_window. Samples are sorted
+// per series before sending, and a sample already behind what this forwarder
+// sent by more than the window is rejected here instead of being retried.
+type remoteWriteForwarder struct {
+	dest   DestinationCfg
+	url    string
+	client *http.Client
+	window int64 // out-of-order window, milliseconds
+
+	mu     sync.Mutex // serializes requests so each series is sent in order
+	newest map[string]int64
+}
+
+func newRemoteWriteForwarder(dest DestinationCfg) (*remoteWriteForwarder, error) {
+	path := dest.Path
+	if path == "" {
+		path = "/api/v1/write"
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return &remoteWriteForwarder{
+		dest:   dest,
+		url:    fmt.Sprintf("%s://%s%s", strings.ToLower(dest.Transport), net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)), path),
+		client: newHTTPClient(dest),
+		window: int64(dest.OutOfOrderWindowSec) * 1000,
+		newest: make(map[string]int64),
+	}, nil
+}
+
+func (f *remoteWriteForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch converts every record to series and sends them in requests of
+// about remoteWriteMaxSamples samples. A record fails with its request.
+func (f *remoteWriteForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	var pending []promSeries
+	var owners []int
+	samples := 0
+	flush := func() {
+		if len(owners) > 0 {
+			f.send(pending, owners, errs)
+		}
+		pending, owners, samples = nil, nil, 0
+	}
+
+	for i, record := range records {
+		series, err := metricSeries(record, i)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		n := 0
+		for _, s := range series {
+			n += len(s.samples)
+		}
+		if samples > 0 && samples+n > remoteWriteMaxSamples {
+			flush()
+		}
+		pending = append(pending, series...)
+		owners = append(owners, i)
+		samples += n
+	}
+	flush()
+	return errs
+}
+
+// send merges the series of one request, holds back samples that are too late
+// for the receiver and posts the rest
+func (f *remoteWriteForwarder) send(series []promSeries, owners []int, errs []error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	merged := make(map[string]*promSeries)
+	var keys []string
+	for _, s := range series {
+		key := seriesKey(s.labels)
+		if m, ok := merged[key]; ok {
+			m.samples = append(m.samples, s.samples...)
+			continue
+		}
+		s := s
+		merged[key] = &s
+		keys = append(keys, key)
+	}
+
+	sent := make(map[int]int)
+	late := make(map[int]int)
+	var req []byte
+	for _, key := range keys {
+		s := merged[key]
+		sort.SliceStable(s.samples, func(i, j int) bool { return s.samples[i].timestamp < s.samples[j].timestamp })
+		newest, seen := f.newest[key]
+		kept := s.samples[:0]
+		for _, sample := range s.samples {
+			if seen && sample.timestamp < newest-f.window {
+				late[sample.owner]++
+				continue
+			}
+			kept = append(kept, sample)
+			sent[sample.owner]++
+		}
+		if len(kept) > 0 {
+			s.samples = kept
+			req = appendTimeSeries(req, s)
+		}
+	}
+
+	for _, owner := range owners {
+		if sent[owner] == 0 && late[owner] > 0 {
+			errs[owner] = fmt.Errorf("%w: %d samples older than the out-of-order window", errRejected, late[owner])
+		}
+	}
+	if len(req) == 0 {
+		return
+	}
+	if n := len(late); n > 0 {
+		logger.WithField("records", n).Warn("Dropped remote_write samples older than the out-of-order window")
+	}
+
+	if err := f.post(req); err != nil {
+		for _, owner := range owners {
+			if sent[owner] > 0 {
+				errs[owner] = err
+			}
+		}
+		return
+	}
+
+	if len(f.newest) > remoteWriteMaxSeries {
+		f.newest = make(map[string]int64)
+	}
+	for _, key := range keys {
+		s := merged[key]
+		if n := len(s.samples); n > 0 && s.samples[n-1].timestamp > f.newest[key] {
+			f.newest[key] = s.samples[n-1].timestamp
+		}
+	}
+}
+
+// post sends one encoded WriteRequest. Prometheus answers samples it will
+// never accept with 400; those are not retried.
+func (f *remoteWriteForwarder) post(writeRequest []byte) error {
+	req, err := http.NewRequest("POST", f.url, bytes.NewReader(snappy.Encode(nil, writeRequest)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "noc-raven/2.0")
+	for k, v := range f.dest.Headers {
+		req.Header.Set(k, v)
+	}
+	applyAuth(req, f.dest.Auth)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := fmt.Errorf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		if resp.StatusCode == http.StatusBadRequest {
+			return fmt.Errorf("%w: %v", errRejected, err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (f *remoteWriteForwarder) Close() error {
+	f.client.CloseIdleConnections()
+	return nil
+}
+
+// metricSeries converts a Telegraf metrics record to one series per numeric
+// field, named measurement_field as Telegraf's Prometheus output does
+func metricSeries(record TelemetryRecord, owner int) ([]promSeries, error) {
+	metrics, err := parseTelegrafMetrics(record.JsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	var series []promSeries
+	for _, m := range metrics {
+		if m.Name == "" {
+			continue
+		}
+		timestamp := timestampNanos(m.Timestamp, record.Timestamp) / 1e6
+		var tags []promLabel
+		for _, k := range sortedKeys(m.Tags) {
+			if v := tagValue(m.Tags[k]); v != "" {
+				tags = append(tags, promLabel{promName(k, false), v})
+			}
+		}
+
+		values := make(map[string]float64)
+		numericFields(values, "", m.Fields)
+		for _, field := range sortedKeys(values) {
+			name := m.Name + "_" + field
+			if field == "value" {
+				name = m.Name
+			}
+			labels := append([]promLabel{{"__name__", promName(name, true)}}, tags...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+			series = append(series, promSeries{labels: labels, samples: []promSample{{values[field], timestamp, owner}}})
+		}
+	}
+	if len(series) == 0 {
+		return nil, errNoMetrics
+	}
+	return series, nil
+}
+
+// numericFields collects number and boolean fields, flattening nested ones
+func numericFields(out map[string]float64, prefix string, fields map[string]interface{}) {
+	for k, v := range fields {
+		key := k
+		if prefix != "" {
+			key = prefix + "_" + k
+		}
+		switch v := v.(type) {
+		case json.Number:
+			if f, err := v.Float64(); err == nil {
+				out[key] = f
+			}
+		case bool:
+			out[key] = 0
+			if v {
+				out[key] = 1
+			}
+		case map[string]interface{}:
+			numericFields(out, key, v)
+		}
+	}
+}
+
+// promName replaces characters Prometheus does not allow in metric (colons
+// included) or label names
+func promName(s string, metric bool) string {
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || metric && c == ':') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func seriesKey(labels []promLabel) string {
+	var b strings.Builder
+	for _, l := range labels {
+		b.WriteString(l.name + "\xff" + l.value + "\xff")
+	}
+	return b.String()
+}
+
+// appendTimeSeries encodes WriteRequest.timeseries (field 1):
+// TimeSeries{labels = 1, samples = 2}, Label{name = 1, value = 2},
+// Sample{value = 1 (double), timestamp = 2 (int64)}
+func appendTimeSeries(b []byte, s *promSeries) []byte {
+	var ts []byte
+	for _, l := range s.labels {
+		var label []byte
+		label = appendProtoBytes(label, 1, []byte(l.name))
+		label = appendProtoBytes(label, 2, []byte(l.value))
+		ts = appendProtoBytes(ts, 1, label)
+	}
+	for _, sample := range s.samples {
+		var enc []byte
+		enc = binary.AppendUvarint(enc, 1<<3|1) // fixed64
+		enc = binary.LittleEndian.AppendUint64(enc, math.Float64bits(sample.value))
+		enc = binary.AppendUvarint(enc, 2<<3|0) // varint
+		enc = binary.AppendUvarint(enc, uint64(sample.timestamp))
+		ts = appendProtoBytes(ts, 2, enc)
+	}
+	return appendProtoBytes(b, 1, ts)
+}
+
+// appendProtoBytes appends a length-delimited field
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
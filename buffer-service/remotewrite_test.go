@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// decodedSeries is a remote_write series as the test receiver sees it
+type decodedSeries struct {
+	labels     map[string]string
+	timestamps []int64
+	values     []float64
+}
+
+// protoFields walks the top-level fields of a protobuf message
+func protoFields(t *testing.T, b []byte, fn func(field int, wire int, v []byte, n uint64)) {
+	t.Helper()
+	for len(b) > 0 {
+		key, k := binary.Uvarint(b)
+		b = b[k:]
+		field, wire := int(key>>3), int(key&7)
+		switch wire {
+		case 0:
+			n, k := binary.Uvarint(b)
+			fn(field, wire, nil, n)
+			b = b[k:]
+		case 1:
+			fn(field, wire, b[:8], binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		case 2:
+			n, k := binary.Uvarint(b)
+			fn(field, wire, b[k:k+int(n)], 0)
+			b = b[k+int(n):]
+		default:
+			t.Fatalf("unexpected wire type %d", wire)
+		}
+	}
+}
+
+func decodeWriteRequest(t *testing.T, body []byte) []decodedSeries {
+	t.Helper()
+	var out []decodedSeries
+	protoFields(t, body, func(_ int, _ int, ts []byte, _ uint64) {
+		s := decodedSeries{labels: map[string]string{}}
+		protoFields(t, ts, func(field int, _ int, v []byte, _ uint64) {
+			if field == 1 {
+				var name, value string
+				protoFields(t, v, func(f int, _ int, b []byte, _ uint64) {
+					if f == 1 {
+						name = string(b)
+					} else {
+						value = string(b)
+					}
+				})
+				s.labels[name] = value
+				return
+			}
+			protoFields(t, v, func(f int, _ int, _ []byte, n uint64) {
+				if f == 1 {
+					s.values = append(s.values, math.Float64frombits(n))
+				} else {
+					s.timestamps = append(s.timestamps, int64(n))
+				}
+			})
+		})
+		out = append(out, s)
+	})
+	return out
+}
+
+// remoteWriteReceiver decodes every request and answers with status
+func remoteWriteReceiver(t *testing.T, status *int) (*httptest.Server, func() []decodedSeries) {
+	var mu sync.Mutex
+	var got []decodedSeries
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil || r.Header.Get("Content-Encoding") != "snappy" || r.URL.Path != "/api/v1/write" {
+			http.Error(w, "bad request", http.StatusUnsupportedMediaType)
+			return
+		}
+		mu.Lock()
+		got = append(got, decodeWriteRequest(t, body)...)
+		mu.Unlock()
+		if *status != 0 {
+			http.Error(w, "out of order sample", *status)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, func() []decodedSeries {
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+}
+
+func remoteWriteDest(t *testing.T, ts *httptest.Server) DestinationCfg {
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return DestinationCfg{Host: u.Hostname(), Port: port, Transport: "http", Path: "/api/v1/write"}
+}
+
+func TestRemoteWriteForwarder_SendsSortedSeries(t *testing.T) {
+	status := 0
+	ts, received := remoteWriteReceiver(t, &status)
+	fwd, err := newForwarder("metrics", remoteWriteDest(t, ts))
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	// Out of order across records, as a replayed backlog can be
+	errs := fwd.(BatchForwarder).ForwardBatch([]TelemetryRecord{
+		{JsonData: `{"name":"cpu","tags":{"host":"edge-01","cpu-id":"0"},"fields":{"usage idle":97.5,"up":true},"timestamp":1700000060}`},
+		{JsonData: `{"name":"cpu","tags":{"host":"edge-01","cpu-id":"0"},"fields":{"usage idle":95},"timestamp":1700000000}`},
+		{JsonData: `{"name":"temp","fields":{"value":41,"label":"text"},"timestamp":1700000000000}`},
+	})
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+
+	series := map[string]decodedSeries{}
+	for _, s := range received() {
+		series[s.labels["__name__"]] = s
+	}
+	idle := series["cpu_usage_idle"]
+	if idle.labels["host"] != "edge-01" || idle.labels["cpu_id"] != "0" || fmt.Sprint(idle.timestamps) != "[1700000000000 1700000060000]" || fmt.Sprint(idle.values) != "[95 97.5]" {
+		t.Fatalf("unexpected cpu_usage_idle series %+v", idle)
+	}
+	if up := series["cpu_up"]; len(up.values) != 1 || up.values[0] != 1 {
+		t.Fatalf("boolean field not sent as 1: %+v", up)
+	}
+	if temp := series["temp"]; len(temp.values) != 1 || temp.values[0] != 41 || len(series) != 3 {
+		t.Fatalf("unexpected series %+v", series)
+	}
+}
+
+func TestRemoteWriteForwarder_RejectsSamplesBeyondOutOfOrderWindow(t *testing.T) {
+	status := 0
+	ts, received := remoteWriteReceiver(t, &status)
+	dest := remoteWriteDest(t, ts)
+	dest.OutOfOrderWindowSec = 600
+	fwd, _ := newRemoteWriteForwarder(dest)
+
+	metric := func(ts int64) TelemetryRecord {
+		return TelemetryRecord{JsonData: fmt.Sprintf(`{"name":"mem","fields":{"free":1},"timestamp":%d}`, ts)}
+	}
+	if err := fwd.Forward(metric(1700003600)); err != nil {
+		t.Fatalf("live sample: %v", err)
+	}
+	// Replayed after the outage: inside the window goes out, older is held back
+	if err := fwd.Forward(metric(1700003100)); err != nil {
+		t.Fatalf("sample inside the window: %v", err)
+	}
+	if err := fwd.Forward(metric(1700000000)); !errors.Is(err, errRejected) {
+		t.Fatalf("sample beyond the window: err = %v", err)
+	}
+	if n := len(received()); n != 2 {
+		t.Fatalf("receiver got %d series, want 2", n)
+	}
+
+	status = http.StatusBadRequest
+	if err := fwd.Forward(metric(1700007200)); !errors.Is(err, errRejected) || !strings.Contains(err.Error(), "out of order") {
+		t.Fatalf("400 from the receiver: err = %v", err)
+	}
+}
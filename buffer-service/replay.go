@@ -0,0 +1,468 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"buffer-service/flow"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultReplayRate is the replay rate in records per second when none is given
+	defaultReplayRate = 500
+	// replayChunk is how many rows a replay reads per query
+	replayChunk = 100
+	// replayMaxAttempts bounds the sends of one record within a replay
+	replayMaxAttempts = 3
+	// replayHistory is how many finished jobs are kept for GET /api/buffer/replay
+	replayHistory = 20
+)
+
+var (
+	errReplayNotFound = errors.New("replay not found")
+	errReplayRunning  = errors.New("replay already running")
+)
+
+// replayTime is a time given as unix seconds or an RFC 3339 string
+type replayTime int64
+
+func (t *replayTime) UnmarshalJSON(b []byte) error {
+	v, err := parseTimeParam(strings.Trim(string(b), `"`))
+	*t = replayTime(v)
+	return err
+}
+
+// ReplayRequest selects already-forwarded records to send again
+type ReplayRequest struct {
+	Service     string          `json:"service,omitempty"` // all services when empty
+	DataType    string          `json:"data_type"`
+	Since       replayTime      `json:"since"`
+	Until       replayTime      `json:"until,omitempty"`        // defaults to now
+	Destination *DestinationCfg `json:"destination,omitempty"`  // defaults to the data type's destination
+	RatePerSec  int             `json:"rate_per_sec,omitempty"` // records per second
+}
+
+// ReplayJob reports the progress of a replay
+type ReplayJob struct {
+	ID          string `json:"id"`
+	State       string `json:"state"` // running, completed, cancelled or failed
+	Service     string `json:"service,omitempty"`
+	DataType    string `json:"data_type"`
+	Since       int64  `json:"since"`
+	Until       int64  `json:"until"`
+	Destination string `json:"destination"`
+	RatePerSec  int    `json:"rate_per_sec"`
+	Total       int64  `json:"total"`   // buffered rows selected when the job started
+	Scanned     int64  `json:"scanned"` // rows read so far
+	Sent        int64  `json:"sent"`    // records the destination accepted
+	Failed      int64  `json:"failed"`
+	LastError   string `json:"last_error,omitempty"`
+	StartedAt   int64  `json:"started_at"`
+	FinishedAt  int64  `json:"finished_at,omitempty"`
+}
+
+// replayJob is a running or finished replay. status is guarded by replayState.mu.
+type replayJob struct {
+	status    ReplayJob
+	cancel    chan struct{}
+	cancelled bool
+}
+
+// replayState tracks replay jobs, newest last
+type replayState struct {
+	mu   sync.Mutex
+	jobs []*replayJob
+}
+
+// update applies fn to a job's status under the lock
+func (s *replayState) update(job *replayJob, fn func(*ReplayJob)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&job.status)
+}
+
+// find returns the job with the given ID, or nil
+func (s *replayState) find(id string) *replayJob {
+	for _, job := range s.jobs {
+		if job.status.ID == id {
+			return job
+		}
+	}
+	return nil
+}
+
+// add registers a job unless one is already running for its data type, and
+// drops the oldest finished jobs beyond replayHistory
+func (s *replayState) add(job *replayJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	finished := 0
+	for _, j := range s.jobs {
+		if j.status.State != "running" {
+			finished++
+		} else if j.status.DataType == job.status.DataType {
+			return fmt.Errorf("%w for %s: %s", errReplayRunning, j.status.DataType, j.status.ID)
+		}
+	}
+	kept := s.jobs[:0]
+	for _, j := range s.jobs {
+		if j.status.State != "running" && finished > replayHistory-1 {
+			finished--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	s.jobs = append(kept, job)
+	return nil
+}
+
+// StartReplay validates a request and starts sending the selected records in
+// the background. Forwarded flags are left as they are.
+func (bm *BufferManager) StartReplay(req ReplayRequest) (ReplayJob, error) {
+	switch req.DataType {
+	case "syslog", "netflow", "snmp", "windows_events", "metrics", flow.TypeSFlowCounters:
+	default:
+		return ReplayJob{}, fmt.Errorf("unknown data_type %q", req.DataType)
+	}
+	if req.Since <= 0 {
+		return ReplayJob{}, errors.New("since is required")
+	}
+	if req.Until <= 0 {
+		req.Until = replayTime(time.Now().Unix())
+	}
+	if req.Until < req.Since {
+		return ReplayJob{}, errors.New("until is before since")
+	}
+	if req.RatePerSec <= 0 {
+		req.RatePerSec = defaultReplayRate
+	}
+
+	// The replay gets its own forwarder, so a config reload cannot close it
+	// mid-job and stateful outputs start fresh
+	var dest DestinationCfg
+	if req.Destination != nil {
+		dest = *req.Destination
+	} else {
+		dest = bm.config.Destinations[req.DataType]
+		if !dest.Enabled {
+			return ReplayJob{}, fmt.Errorf("%w for %s", errNoDestination, req.DataType)
+		}
+		bm.fwdMutex.RLock()
+		appliance := bm.applianceForwarding
+		bm.fwdMutex.RUnlock()
+		dest = appliance.override(req.DataType, dest)
+	}
+	fwd, err := newForwarder(req.DataType, dest)
+	if err != nil {
+		return ReplayJob{}, err
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &replayJob{
+		status: ReplayJob{
+			ID:          hex.EncodeToString(id),
+			State:       "running",
+			Service:     req.Service,
+			DataType:    req.DataType,
+			Since:       int64(req.Since),
+			Until:       int64(req.Until),
+			Destination: net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)),
+			RatePerSec:  req.RatePerSec,
+			StartedAt:   time.Now().Unix(),
+		},
+		cancel: make(chan struct{}),
+	}
+	where, args := job.status.where()
+	if err := bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE "+where, args...).Scan(&job.status.Total); err != nil {
+		fwd.Close()
+		return ReplayJob{}, err
+	}
+	if err := bm.replay.add(job); err != nil {
+		fwd.Close()
+		return ReplayJob{}, err
+	}
+
+	status := job.status
+	logger.WithField("id", status.ID).WithField("data_type", status.DataType).WithField("rows", status.Total).
+		Info("Starting replay")
+	go bm.runReplay(job, fwd, status)
+	return status, nil
+}
+
+// where selects a job's forwarded rows. Blob rows carry the earliest member's
+// timestamp, so they pass the since bound and their members are checked as
+// they are sent.
+func (j ReplayJob) where() (string, []interface{}) {
+	where := "forwarded = 1 AND data_type = ? AND timestamp <= ? AND (timestamp >= ? OR batch_count > 0)"
+	args := []interface{}{j.DataType, j.Until, j.Since}
+	if j.Service != "" {
+		where += " AND service = ?"
+		args = append(args, j.Service)
+	}
+	return where, args
+}
+
+// runReplay sends a job's records in id order, paced to its rate. status is
+// the job as it started.
+func (bm *BufferManager) runReplay(job *replayJob, fwd Forwarder, status ReplayJob) {
+	defer fwd.Close()
+
+	where, args := status.where()
+	interval := time.Second / time.Duration(status.RatePerSec)
+	// Send a tenth of a second's worth at a time so the rate holds over short spans
+	sendSize := min(max(status.RatePerSec/10, 1), replayChunk)
+	next := time.Now()
+	var lastID int64
+
+	finish := func(state string, err error) {
+		bm.replay.update(job, func(s *ReplayJob) {
+			s.State = state
+			s.FinishedAt = time.Now().Unix()
+			if err != nil {
+				s.LastError = err.Error()
+			}
+		})
+		fields := logger.WithField("id", status.ID).WithField("state", state)
+		if err != nil {
+			fields = fields.WithError(err)
+		}
+		fields.Info("Replay finished")
+	}
+
+	for {
+		rows, err := bm.db.Query(`SELECT id, service, timestamp, data_type, json_data, COALESCE(source_ip, ''), codec, batch_count
+			FROM telemetry_buffer WHERE `+where+` AND id > ? ORDER BY id LIMIT ?`, append(args, lastID, replayChunk)...)
+		if err != nil {
+			finish("failed", err)
+			return
+		}
+		var chunk []TelemetryRecord
+		for rows.Next() {
+			var r TelemetryRecord
+			if err := rows.Scan(&r.ID, &r.Service, &r.Timestamp, &r.DataType, &r.JsonData, &r.SourceIP, &r.Codec, &r.BatchCount); err != nil {
+				rows.Close()
+				finish("failed", err)
+				return
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			finish("failed", err)
+			return
+		}
+		if len(chunk) == 0 {
+			finish("completed", nil)
+			return
+		}
+		lastID = chunk[len(chunk)-1].ID
+
+		var records []TelemetryRecord
+		failed := 0
+		for _, r := range chunk {
+			if err := bm.decodeRecord(&r); err != nil {
+				failed++
+				continue
+			}
+			if r.BatchCount == 0 {
+				records = append(records, r)
+				continue
+			}
+			members, err := unbatchRecord(r)
+			if err != nil {
+				failed++
+				continue
+			}
+			for _, m := range members {
+				if m.Timestamp >= status.Since && m.Timestamp <= status.Until {
+					records = append(records, m)
+				}
+			}
+		}
+		bm.replay.update(job, func(s *ReplayJob) {
+			s.Scanned += int64(len(chunk))
+			s.Failed += int64(failed)
+		})
+
+		for len(records) > 0 {
+			n := min(sendSize, len(records))
+			if !bm.replayWait(job, time.Until(next)) {
+				finish("cancelled", nil)
+				return
+			}
+			if now := time.Now(); next.Before(now) {
+				next = now
+			}
+			next = next.Add(time.Duration(n) * interval)
+
+			sent, err := bm.replaySend(job, fwd, records[:n])
+			bm.replay.update(job, func(s *ReplayJob) {
+				s.Sent += int64(sent)
+				s.Failed += int64(n - sent)
+				if err != nil {
+					s.LastError = err.Error()
+				}
+			})
+			if sent == 0 && err != nil && !errors.Is(err, errRejected) && !errors.Is(err, errItemFailed) {
+				finish("failed", err)
+				return
+			}
+			records = records[n:]
+		}
+	}
+}
+
+// replaySend forwards records, retrying failures with the retry policy's
+// backoff up to replayMaxAttempts. It returns how many were accepted and the
+// last error seen.
+func (bm *BufferManager) replaySend(job *replayJob, fwd Forwarder, records []TelemetryRecord) (int, error) {
+	policy := bm.retryPolicy()
+	sent := 0
+	var lastErr error
+	for attempt := 1; len(records) > 0; attempt++ {
+		var errs []error
+		if batch, ok := fwd.(BatchForwarder); ok {
+			errs = batch.ForwardBatch(records)
+		} else {
+			errs = make([]error, len(records))
+			for i, r := range records {
+				errs[i] = fwd.Forward(r)
+			}
+		}
+
+		var retry []TelemetryRecord
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				sent++
+			case errors.Is(err, errRejected):
+				lastErr = err
+			default:
+				lastErr = err
+				retry = append(retry, records[i])
+			}
+		}
+		if attempt >= replayMaxAttempts || len(retry) == 0 || !bm.replayWait(job, policy.retryDelay(attempt, lastErr)) {
+			break
+		}
+		records = retry
+	}
+	return sent, lastErr
+}
+
+// replayWait sleeps for d and reports false if the job is cancelled or the
+// service stops first
+func (bm *BufferManager) replayWait(job *replayJob, d time.Duration) bool {
+	timer := time.NewTimer(max(d, 0))
+	defer timer.Stop()
+	select {
+	case <-job.cancel:
+		return false
+	case <-bm.stopChan:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// CancelReplay stops a running job after its in-flight send
+func (bm *BufferManager) CancelReplay(id string) (ReplayJob, error) {
+	bm.replay.mu.Lock()
+	defer bm.replay.mu.Unlock()
+	job := bm.replay.find(id)
+	if job == nil {
+		return ReplayJob{}, errReplayNotFound
+	}
+	if job.status.State != "running" {
+		return job.status, fmt.Errorf("replay %s is already %s", id, job.status.State)
+	}
+	if !job.cancelled {
+		job.cancelled = true
+		close(job.cancel)
+	}
+	return job.status, nil
+}
+
+// ReplayJobs returns every tracked job, newest first
+func (bm *BufferManager) ReplayJobs() []ReplayJob {
+	bm.replay.mu.Lock()
+	defer bm.replay.mu.Unlock()
+	jobs := make([]ReplayJob, 0, len(bm.replay.jobs))
+	for i := len(bm.replay.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, bm.replay.jobs[i].status)
+	}
+	return jobs
+}
+
+// handleReplayStart serves POST /api/buffer/replay
+func (bm *BufferManager) handleReplayStart(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid replay request: %v", err), http.StatusBadRequest)
+		return
+	}
+	job, err := bm.StartReplay(req)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errReplayRunning) {
+			status = http.StatusConflict
+		}
+		http.Error(w, fmt.Sprintf("Replay not started: %v", err), status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleReplayList serves GET /api/buffer/replay
+func (bm *BufferManager) handleReplayList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"jobs": bm.ReplayJobs()})
+}
+
+// handleReplayGet serves GET /api/buffer/replay/{id}
+func (bm *BufferManager) handleReplayGet(w http.ResponseWriter, r *http.Request) {
+	bm.replay.mu.Lock()
+	job := bm.replay.find(mux.Vars(r)["id"])
+	var status ReplayJob
+	if job != nil {
+		status = job.status
+	}
+	bm.replay.mu.Unlock()
+	if job == nil {
+		http.Error(w, "Replay not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// handleReplayCancel serves POST /api/buffer/replay/{id}/cancel
+func (bm *BufferManager) handleReplayCancel(w http.ResponseWriter, r *http.Request) {
+	job, err := bm.CancelReplay(mux.Vars(r)["id"])
+	switch {
+	case errors.Is(err, errReplayNotFound):
+		http.Error(w, "Replay not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
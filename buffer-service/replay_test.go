@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// replayReceiver collects the bodies posted to it
+type replayReceiver struct {
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newReplayReceiver(t *testing.T) (*replayReceiver, DestinationCfg) {
+	t.Helper()
+	rr := &replayReceiver{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		rr.mu.Lock()
+		rr.bodies = append(rr.bodies, string(body))
+		rr.mu.Unlock()
+	}))
+	t.Cleanup(ts.Close)
+	u, _ := url.Parse(ts.URL)
+	port, _ := strconv.Atoi(u.Port())
+	return rr, DestinationCfg{Enabled: true, Host: u.Hostname(), Port: port, Transport: "http"}
+}
+
+func (rr *replayReceiver) received() []string {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return append([]string(nil), rr.bodies...)
+}
+
+// waitReplay polls a job until it leaves the running state
+func waitReplay(t *testing.T, bm *BufferManager, id string) ReplayJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, job := range bm.ReplayJobs() {
+			if job.ID == id && job.State != "running" {
+				return job
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("replay %s did not finish", id)
+	return ReplayJob{}
+}
+
+func TestReplay_ResendsForwardedWindowAtRate(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Recompress.BatchSmallRecords = true
+	bm.config.Recompress.RecordsPerBlob = 10
+	storeLinkEvents(t, bm, 0, 20)
+	ageRecords(t, bm)
+	if _, err := bm.RecompressOldRecords(); err != nil {
+		t.Fatalf("RecompressOldRecords: %v", err)
+	}
+	storeLinkEvents(t, bm, 20, 20)
+	bm.db.Exec("UPDATE telemetry_buffer SET forwarded = 1 WHERE batch_count > 0 OR timestamp < 1035")
+
+	rr, dest := newReplayReceiver(t)
+	bm.config.Destinations["syslog"] = dest
+	started := time.Now()
+	rec := httptest.NewRecorder()
+	bm.handleReplayStart(rec, httptest.NewRequest("POST", "/api/buffer/replay",
+		strings.NewReader(`{"data_type":"syslog","since":1005,"until":"1970-01-01T00:17:14Z","rate_per_sec":100}`)))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var job ReplayJob
+	json.NewDecoder(rec.Body).Decode(&job)
+
+	job = waitReplay(t, bm, job.ID)
+	// 30 records (1005 to 1034) in sends of 10 at 100 per second
+	if job.State != "completed" || job.Sent != 30 || job.Failed != 0 || job.Total != 17 || job.Scanned != 17 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if elapsed := time.Since(started); elapsed < 180*time.Millisecond {
+		t.Fatalf("30 records at 100/s took %v", elapsed)
+	}
+	got := rr.received()
+	if len(got) != 30 || !strings.Contains(got[0], `"n":5,`) || !strings.Contains(got[29], `"n":34,`) {
+		t.Fatalf("replayed %d records: first %q", len(got), got[0])
+	}
+
+	var pending int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending)
+	if pending != 5 {
+		t.Fatalf("replay changed forwarded flags: %d pending, want 5", pending)
+	}
+}
+
+func TestReplay_CancelAndAlternateDestination(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeLinkEvents(t, bm, 0, 10)
+	bm.db.Exec("UPDATE telemetry_buffer SET forwarded = 1")
+
+	rr, dest := newReplayReceiver(t)
+	body, _ := json.Marshal(map[string]interface{}{"data_type": "syslog", "since": 1, "rate_per_sec": 1, "destination": dest})
+	rec := httptest.NewRecorder()
+	bm.handleReplayStart(rec, httptest.NewRequest("POST", "/api/buffer/replay", bytes.NewReader(body)))
+	var job ReplayJob
+	if err := json.NewDecoder(rec.Body).Decode(&job); err != nil || rec.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+
+	// A second replay of the same data type waits for the first
+	rec = httptest.NewRecorder()
+	bm.handleReplayStart(rec, httptest.NewRequest("POST", "/api/buffer/replay", bytes.NewReader(body)))
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("concurrent replay: status %d", rec.Code)
+	}
+
+	for len(rr.received()) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel := func() int {
+		rec := httptest.NewRecorder()
+		bm.handleReplayCancel(rec, mux.SetURLVars(httptest.NewRequest("POST", "/", nil), map[string]string{"id": job.ID}))
+		return rec.Code
+	}
+	if code := cancel(); code != http.StatusOK {
+		t.Fatalf("cancel: status %d", code)
+	}
+	job = waitReplay(t, bm, job.ID)
+	if job.State != "cancelled" || job.Sent != 1 || len(rr.received()) != 1 {
+		t.Fatalf("unexpected job after cancel %+v", job)
+	}
+	if code := cancel(); code != http.StatusConflict {
+		t.Fatalf("cancelling a finished replay: status %d", code)
+	}
+
+	rec = httptest.NewRecorder()
+	bm.handleReplayGet(rec, mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"id": "missing"}))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown replay: status %d", rec.Code)
+	}
+}
+
+func TestStartReplay_Validates(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Destinations["snmp"] = DestinationCfg{}
+	for name, req := range map[string]ReplayRequest{
+		"unknown data type": {DataType: "traces", Since: 1},
+		"missing since":     {DataType: "syslog"},
+		"inverted range":    {DataType: "syslog", Since: 10, Until: 5},
+		"no destination":    {DataType: "snmp", Since: 1},
+		"invalid alternate": {DataType: "syslog", Since: 1, Destination: &DestinationCfg{Host: "siem"}},
+		"unknown transport": {DataType: "syslog", Since: 1, Destination: &DestinationCfg{Host: "siem", Port: 514, Transport: "sctp"}},
+	} {
+		if _, err := bm.StartReplay(req); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
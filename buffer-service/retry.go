@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxConsecutiveFailures stops a drain pass for a data type whose destination keeps failing,
+// so an unreachable collector does not burn through every record's retry budget
+const maxConsecutiveFailures = 3
+
+// errRejected marks a record the destination refused for good, such as a
+// sample older than it accepts. It is dead-lettered without further attempts.
+var errRejected = errors.New("rejected by destination")
+
+// errItemFailed marks a record the destination refused within a request it
+// otherwise accepted. The record is retried as usual, but the destination
+// answered, so it does not count as failing.
+var errItemFailed = errors.New("record failed at destination")
+
+// retryAfterError is a failure the destination asked not to be retried for a
+// while, as with HTTP 429 or 503 and a Retry-After header
+type retryAfterError struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.err, e.after)
+}
+
+func (e *retryAfterError) Unwrap() error { return e.err }
+
+// parseRetryAfter reads a Retry-After header given as seconds or an HTTP date
+func parseRetryAfter(header string, now time.Time) (time.Duration, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil {
+		return time.Duration(max(secs, 0)) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// RetryCfg controls per-record retry scheduling for failed forwards
+type RetryCfg struct {
+	MaxAttempts  int `json:"max_attempts"`       // attempts before a record is dead-lettered
+	BaseDelaySec int `json:"base_delay_seconds"` // delay after the first failure
+	MaxDelaySec  int `json:"max_delay_seconds"`  // cap on the exponential delay
+}
+
+// defaultRetryCfg returns the retry policy used when none is configured
+func defaultRetryCfg() RetryCfg {
+	return RetryCfg{
+		MaxAttempts:  10,
+		BaseDelaySec: 5,
+		MaxDelaySec:  3600,
+	}
+}
+
+// retryPolicy returns the configured retry policy with unset fields defaulted
+func (bm *BufferManager) retryPolicy() RetryCfg {
+	policy := bm.config.Retry
+	def := defaultRetryCfg()
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = def.MaxAttempts
+	}
+	if policy.BaseDelaySec <= 0 {
+		policy.BaseDelaySec = def.BaseDelaySec
+	}
+	if policy.MaxDelaySec < policy.BaseDelaySec {
+		policy.MaxDelaySec = def.MaxDelaySec
+	}
+	return policy
+}
+
+// backoffDelay returns the delay before the given attempt number, doubling per
+// attempt up to the cap, with the upper half randomized to spread retries out
+func (p RetryCfg) backoffDelay(attempt int) time.Duration {
+	delay := time.Duration(p.BaseDelaySec) * time.Second
+	max := time.Duration(p.MaxDelaySec) * time.Second
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryDelay is the backoff before the given attempt, stretched to what the
+// destination asked for when it throttled the request
+func (p RetryCfg) retryDelay(attempt int, forwardErr error) time.Duration {
+	delay := p.backoffDelay(attempt)
+	var throttled *retryAfterError
+	if errors.As(forwardErr, &throttled) && throttled.after > delay {
+		delay = throttled.after
+	}
+	return delay
+}
+
+// recordForwardFailure schedules the next attempt for a buffered record, or
+// moves it to the dead-letter table once its attempts are exhausted
+func (bm *BufferManager) recordForwardFailure(record TelemetryRecord, forwardErr error) error {
+	policy := bm.retryPolicy()
+	attempts := record.RetryCount + 1
+
+	if attempts >= policy.MaxAttempts || errors.Is(forwardErr, errRejected) {
+		logger.WithError(forwardErr).WithField("id", record.ID).WithField("attempts", attempts).
+			Warn("Record exhausted forward attempts, moving to dead-letter queue")
+		return bm.deadLetterBufferedRecord(record.ID, attempts, forwardErr.Error())
+	}
+
+	nextAttempt := time.Now().Add(policy.retryDelay(attempts, forwardErr)).Unix()
+	query := "UPDATE telemetry_buffer SET retry_count = ?, next_attempt_at = ?, last_error = ? WHERE id = ?"
+	_, err := bm.db.Exec(query, attempts, nextAttempt, forwardErr.Error(), record.ID)
+	return err
+}
+
+// segmentRetry tracks attempts for the record at the head of a segment store's cursor
+type segmentRetry struct {
+	Pos         segmentCursor
+	Attempts    int
+	NextAttempt int64
+	LastError   string
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// funcForwarder adapts a function to the Forwarder interface
+type funcForwarder func(TelemetryRecord) error
+
+func (f funcForwarder) Forward(record TelemetryRecord) error { return f(record) }
+func (f funcForwarder) Close() error                         { return nil }
+
+func useForwarder(bm *BufferManager, fwd Forwarder) {
+	bm.fwdMutex.Lock()
+	bm.forwarders = map[string]Forwarder{"syslog": fwd}
+	bm.fwdMutex.Unlock()
+}
+
+func storeSyslog(t *testing.T, bm *BufferManager, payloads ...string) {
+	t.Helper()
+	cfg := bm.config.Services["fluent-bit"]
+	cfg.BufferMode = "database"
+	bm.config.Services["fluent-bit"] = cfg
+	for i, p := range payloads {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", Timestamp: int64(1000 + i), JsonData: p}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+}
+
+func TestBackoffDelay_GrowsAndCaps(t *testing.T) {
+	p := RetryCfg{MaxAttempts: 5, BaseDelaySec: 2, MaxDelaySec: 10}
+	for attempt, max := range map[int]time.Duration{1: 2 * time.Second, 2: 4 * time.Second, 3: 8 * time.Second, 6: 10 * time.Second} {
+		d := p.backoffDelay(attempt)
+		if d < max/2 || d > max {
+			t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, max/2, max)
+		}
+	}
+}
+
+func TestPoisonRecordIsRetriedThenDeadLettered(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 2, BaseDelaySec: 60, MaxDelaySec: 60}
+	storeSyslog(t, bm, `{"n":1}`, `{"poison":true}`, `{"n":3}`)
+
+	var delivered []string
+	useForwarder(bm, funcForwarder(func(r TelemetryRecord) error {
+		if strings.Contains(r.JsonData, "poison") {
+			return errors.New("collector rejected record")
+		}
+		delivered = append(delivered, r.JsonData)
+		return nil
+	}))
+
+	bm.forwardBufferedRecords()
+	if len(delivered) != 2 {
+		t.Fatalf("poison record stalled the backlog: delivered %q", delivered)
+	}
+
+	var retries int
+	var nextAttempt int64
+	bm.db.QueryRow("SELECT retry_count, next_attempt_at FROM telemetry_buffer WHERE forwarded = 0").Scan(&retries, &nextAttempt)
+	if retries != 1 || nextAttempt <= time.Now().Unix() {
+		t.Fatalf("retry_count=%d next_attempt_at=%d", retries, nextAttempt)
+	}
+
+	// Not yet due: the record must be left alone
+	bm.forwardBufferedRecords()
+	bm.db.QueryRow("SELECT retry_count FROM telemetry_buffer WHERE forwarded = 0").Scan(&retries)
+	if retries != 1 {
+		t.Fatalf("record retried before its backoff elapsed")
+	}
+
+	bm.db.Exec("UPDATE telemetry_buffer SET next_attempt_at = 0")
+	bm.forwardBufferedRecords()
+
+	var pending, dead int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending)
+	bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter").Scan(&dead)
+	if pending != 0 || dead != 1 {
+		t.Fatalf("pending=%d dead=%d, want 0 and 1", pending, dead)
+	}
+}
+
+func TestRejectedRecordIsDeadLetteredWithoutRetries(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeSyslog(t, bm, `{"n":1}`, `{"too_old":true}`)
+	useForwarder(bm, funcForwarder(func(r TelemetryRecord) error {
+		if strings.Contains(r.JsonData, "too_old") {
+			return fmt.Errorf("%w: sample too old", errRejected)
+		}
+		return nil
+	}))
+
+	bm.forwardBufferedRecords()
+	var pending, dead int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE forwarded = 0").Scan(&pending)
+	bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter").Scan(&dead)
+	if pending != 0 || dead != 1 {
+		t.Fatalf("pending=%d dead=%d, want the rejected record dead-lettered at once", pending, dead)
+	}
+}
+
+func TestThrottledRecordWaitsOutRetryAfter(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 5, BaseDelaySec: 1, MaxDelaySec: 2}
+	storeSyslog(t, bm, `{"n":1}`)
+	useForwarder(bm, funcForwarder(func(TelemetryRecord) error {
+		return &retryAfterError{errors.New("HTTP 429"), 10 * time.Minute}
+	}))
+
+	bm.forwardBufferedRecords()
+	var nextAttempt int64
+	bm.db.QueryRow("SELECT next_attempt_at FROM telemetry_buffer").Scan(&nextAttempt)
+	if wait := time.Until(time.Unix(nextAttempt, 0)); wait < 9*time.Minute {
+		t.Fatalf("next attempt in %v, want the destination's 10m Retry-After", wait)
+	}
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for header, want := range map[string]time.Duration{"120": 2 * time.Minute, "Wed, 01 Jan 2025 00:00:30 GMT": 30 * time.Second} {
+		if got, ok := parseRetryAfter(header, now); !ok || got != want {
+			t.Fatalf("Retry-After %q = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestUnreachableDestinationDoesNotExhaustBacklog(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeSyslog(t, bm, `{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`)
+
+	calls := 0
+	useForwarder(bm, funcForwarder(func(TelemetryRecord) error {
+		calls++
+		return errors.New("connection refused")
+	}))
+	bm.forwardBufferedRecords()
+
+	var retried int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer WHERE retry_count > 0").Scan(&retried)
+	if calls != maxConsecutiveFailures || retried != maxConsecutiveFailures {
+		t.Fatalf("calls=%d retried=%d, want %d", calls, retried, maxConsecutiveFailures)
+	}
+}
+
+func TestDeadLetterAPI_InspectRequeuePurge(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 1}
+	storeSyslog(t, bm, `{"bad":1}`, `{"bad":2}`)
+	useForwarder(bm, funcForwarder(func(TelemetryRecord) error { return errors.New("HTTP 400") }))
+	bm.forwardBufferedRecords()
+
+	rec := httptest.NewRecorder()
+	bm.handleDeadLetterList(rec, httptest.NewRequest("GET", "/api/buffer/deadletter", nil))
+	var list struct {
+		Records []DeadLetterRecord `json:"records"`
+		Total   int64              `json:"total"`
+	}
+	json.NewDecoder(rec.Body).Decode(&list)
+	if list.Total != 2 || list.Records[0].LastError != "HTTP 400" {
+		t.Fatalf("unexpected list: %+v", list)
+	}
+
+	id := strconv.FormatInt(list.Records[0].ID, 10)
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/api/buffer/deadletter/"+id, nil), map[string]string{"id": id})
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterGet(rec, req)
+	var got DeadLetterRecord
+	json.NewDecoder(rec.Body).Decode(&got)
+	if !strings.HasPrefix(got.JsonData, `{"bad":`) {
+		t.Fatalf("inspect returned payload %q", got.JsonData)
+	}
+
+	req = mux.SetURLVars(httptest.NewRequest("POST", "/api/buffer/deadletter/"+id+"/requeue", nil), map[string]string{"id": id})
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterRequeue(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("requeue status %d", rec.Code)
+	}
+	var retries int
+	bm.db.QueryRow("SELECT retry_count FROM telemetry_buffer WHERE forwarded = 0").Scan(&retries)
+	if retries != 0 {
+		t.Fatalf("requeued record kept retry_count %d", retries)
+	}
+
+	// Id 0 must not fall through to an unfiltered requeue or purge
+	zero := map[string]string{"id": "0"}
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterPurge(rec, mux.SetURLVars(httptest.NewRequest("DELETE", "/api/buffer/deadletter/0", nil), zero))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("purge of id 0 returned %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterRequeue(rec, mux.SetURLVars(httptest.NewRequest("POST", "/api/buffer/deadletter/0/requeue", nil), zero))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("requeue of id 0 returned %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterRequeue(rec, httptest.NewRequest("POST", "/api/buffer/deadletter/requeue", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unfiltered requeue without all=true returned %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterPurge(rec, httptest.NewRequest("DELETE", "/api/buffer/deadletter", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unfiltered purge without all=true returned %d", rec.Code)
+	}
+	var remaining int
+	bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter").Scan(&remaining)
+	if remaining != 1 {
+		t.Fatalf("%d dead letters left, want 1", remaining)
+	}
+	rec = httptest.NewRecorder()
+	bm.handleDeadLetterPurge(rec, httptest.NewRequest("DELETE", "/api/buffer/deadletter?all=true", nil))
+	var dead int
+	bm.db.QueryRow("SELECT COUNT(*) FROM dead_letter").Scan(&dead)
+	if rec.Code != http.StatusOK || dead != 0 {
+		t.Fatalf("purge status %d, %d dead letters left", rec.Code, dead)
+	}
+}
+
+func TestSegmentPoisonRecordIsDeadLettered(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 1}
+	cfg := bm.config.Services["fluent-bit"]
+	cfg.BufferMode = "files"
+	bm.config.Services["fluent-bit"] = cfg
+	for _, p := range []string{`{"n":1}`, `{"poison":true}`, `{"n":3}`} {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", JsonData: p}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	var delivered []string
+	useForwarder(bm, funcForwarder(func(r TelemetryRecord) error {
+		if strings.Contains(r.JsonData, "poison") {
+			return errors.New("rejected")
+		}
+		mu.Lock()
+		delivered = append(delivered, r.JsonData)
+		mu.Unlock()
+		return nil
+	}))
+	bm.forwardBufferedRecords()
+
+	if len(delivered) != 2 {
+		t.Fatalf("delivered %q", delivered)
+	}
+	dl, err := bm.GetDeadLetter(1)
+	if err != nil || dl.JsonData != `{"poison":true}` {
+		t.Fatalf("dead letter = %+v, err %v", dl, err)
+	}
+}
+
+func TestSegmentFailingHeadRecordDoesNotHoldStore(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["fluent-bit"]
+	cfg.BufferMode = "files"
+	bm.config.Services["fluent-bit"] = cfg
+	store := func(payloads ...string) {
+		for _, p := range payloads {
+			if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", JsonData: p}); err != nil {
+				t.Fatalf("StoreRecord: %v", err)
+			}
+		}
+	}
+	store(`{"poison":true}`, `{"n":2}`, `{"n":3}`)
+
+	var mu sync.Mutex
+	var delivered []string
+	unreachable := false
+	useForwarder(bm, funcForwarder(func(r TelemetryRecord) error {
+		if unreachable {
+			return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		}
+		if strings.Contains(r.JsonData, "poison") {
+			return errors.New("HTTP 500")
+		}
+		mu.Lock()
+		delivered = append(delivered, r.JsonData)
+		mu.Unlock()
+		return nil
+	}))
+
+	// The failing head record is re-appended with a backoff and the records
+	// behind it go out in the same pass, then again past the requeued record
+	bm.forwardBufferedRecords()
+	store(`{"n":4}`)
+	bm.forwardBufferedRecords()
+	if len(delivered) != 3 {
+		t.Fatalf("delivered %q, want the three records behind the failing one", delivered)
+	}
+	if pending := bm.segmentPending(nil)["fluent-bit"]; pending != 1 {
+		t.Fatalf("%d records pending, want the requeued one", pending)
+	}
+	if _, err := bm.GetDeadLetter(1); err == nil {
+		t.Fatal("failing record dead-lettered before its attempts ran out")
+	}
+
+	// An unreachable destination holds the store instead of charging every record
+	unreachable = true
+	store(`{"n":5}`, `{"n":6}`)
+	bm.forwardBufferedRecords()
+	if pending := bm.segmentPending(nil)["fluent-bit"]; pending != 3 {
+		t.Fatalf("%d records pending after a dial failure, want 3", pending)
+	}
+	records, _, err := bm.segmentStoreList()["fluent-bit"].ReadPending(3)
+	if err != nil || len(records) != 3 || records[0].RetryCount != 0 || records[1].RetryCount != 0 {
+		t.Fatalf("records after a dial failure = %+v, err %v", records, err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// searchChunk is how many rows a search reads per query
+	searchChunk = 500
+	// searchMaxScan bounds the rows one page examines, so a rare match cannot
+	// turn a request into a scan of the whole buffer; the cursor resumes it
+	searchMaxScan = 20000
+)
+
+// SearchCfg controls the optional full-text index behind GET /api/buffer/records
+type SearchCfg struct {
+	// FullText indexes decoded payloads with SQLite FTS5. The binary must be
+	// built with the sqlite_fts5 tag; without it searches scan instead.
+	FullText bool `json:"full_text"`
+}
+
+// searchState tracks whether the FTS5 index is in use
+type searchState struct {
+	mu  sync.Mutex // serializes indexing runs
+	fts bool
+}
+
+// RecordQuery selects buffered records
+type RecordQuery struct {
+	Service   string
+	DataType  string
+	SourceIP  string
+	Since     int64 // unix seconds, inclusive; 0 for no bound
+	Until     int64
+	Forwarded *bool
+	Text      string
+	Cursor    string // next_cursor of the previous page
+	Limit     int
+}
+
+// RecordMatch is a buffered record with its payload decoded. Records rolled
+// into a compress_more blob share the blob's id and differ in batch_index.
+type RecordMatch struct {
+	TelemetryRecord
+	BatchIndex *int `json:"batch_index,omitempty"`
+}
+
+// RecordPage is one page of search results, newest row first
+type RecordPage struct {
+	Records    []RecordMatch `json:"records"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+	Scanned    int           `json:"scanned"`   // rows examined for this page
+	FullText   bool          `json:"full_text"` // whether text was matched through FTS5
+}
+
+// initSearchIndex creates the FTS5 index when it is enabled. A trigger keeps
+// deletions in step; inserts are picked up by indexSearchText. Without the
+// index the trigger is dropped, since it would fail every delete on a build
+// lacking FTS5.
+func (bm *BufferManager) initSearchIndex() {
+	if bm.config.Search.FullText {
+		schema := `
+		CREATE VIRTUAL TABLE IF NOT EXISTS telemetry_fts USING fts5(content);
+		CREATE TRIGGER IF NOT EXISTS telemetry_fts_delete AFTER DELETE ON telemetry_buffer BEGIN
+			DELETE FROM telemetry_fts WHERE rowid = old.id;
+		END;
+		DELETE FROM telemetry_fts WHERE rowid NOT IN (SELECT id FROM telemetry_buffer);
+		`
+		_, err := bm.db.Exec(schema)
+		if err == nil {
+			bm.search.fts = true
+			go func() {
+				if err := bm.indexSearchText(); err != nil {
+					logger.WithError(err).Warn("Failed to build full-text index")
+				}
+			}()
+			return
+		}
+		logger.WithError(err).Warn("Full-text search unavailable, record searches will scan")
+	}
+	if _, err := bm.db.Exec("DROP TRIGGER IF EXISTS telemetry_fts_delete"); err != nil {
+		logger.WithError(err).Warn("Failed to drop full-text index trigger")
+	}
+}
+
+// indexSearchText adds rows written since the last run to the FTS5 index.
+// Row ids only grow, so every row above the index's highest rowid is new.
+func (bm *BufferManager) indexSearchText() error {
+	if !bm.search.fts {
+		return nil
+	}
+	bm.search.mu.Lock()
+	defer bm.search.mu.Unlock()
+
+	for {
+		var last int64
+		if err := bm.db.QueryRow("SELECT COALESCE(MAX(rowid), 0) FROM telemetry_fts").Scan(&last); err != nil {
+			return err
+		}
+		rows, err := bm.db.Query(`SELECT id, json_data, codec, batch_count FROM telemetry_buffer
+			WHERE id > ? ORDER BY id LIMIT ?`, last, searchChunk)
+		if err != nil {
+			return err
+		}
+		var batch []TelemetryRecord
+		for rows.Next() {
+			var record TelemetryRecord
+			if err := rows.Scan(&record.ID, &record.JsonData, &record.Codec, &record.BatchCount); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, record)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil || len(batch) == 0 {
+			return err
+		}
+
+		tx, err := bm.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, record := range batch {
+			// Undecodable rows are indexed empty so they are not retried forever
+			var text string
+			if bm.decodeRecord(&record) == nil {
+				text = record.JsonData
+				if record.BatchCount > 0 {
+					var lines []string
+					members, _ := unbatchRecord(record)
+					for _, m := range members {
+						lines = append(lines, m.JsonData)
+					}
+					text = strings.Join(lines, "\n")
+				}
+			}
+			if _, err := tx.Exec("INSERT INTO telemetry_fts (rowid, content) VALUES (?, ?)", record.ID, text); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+// parseSearchCursor reads "id" or "id.member", the last position returned
+func parseSearchCursor(cursor string) (id int64, member int, err error) {
+	if cursor == "" {
+		return 0, -1, nil
+	}
+	idPart, memberPart, inBlob := strings.Cut(cursor, ".")
+	id, err = strconv.ParseInt(idPart, 10, 64)
+	member = -1
+	if err == nil && inBlob {
+		member, err = strconv.Atoi(memberPart)
+	}
+	if err != nil || id <= 0 || (inBlob && member < 0) {
+		return 0, -1, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return id, member, nil
+}
+
+// SearchRecords returns buffered records matching q, newest row first.
+// Payloads are decoded and compress_more blobs expanded, so source_ip, time
+// and text filters apply to each record inside a blob.
+func (bm *BufferManager) SearchRecords(q RecordQuery) (*RecordPage, error) {
+	afterID, afterMember, err := parseSearchCursor(q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	useFTS := bm.search.fts && q.Text != ""
+	if useFTS {
+		if err := bm.indexSearchText(); err != nil {
+			return nil, fmt.Errorf("update full-text index: %v", err)
+		}
+	}
+
+	// Blob rows carry the earliest member's timestamp and no source IP, so
+	// those filters only narrow plain rows here and are rechecked per member
+	var where []string
+	var args []interface{}
+	filter := func(clause string, arg interface{}) {
+		where = append(where, clause)
+		args = append(args, arg)
+	}
+	if q.Service != "" {
+		filter("service = ?", q.Service)
+	}
+	if q.DataType != "" {
+		filter("data_type = ?", q.DataType)
+	}
+	if q.Forwarded != nil {
+		forwarded := 0
+		if *q.Forwarded {
+			forwarded = 1
+		}
+		filter("forwarded = ?", forwarded)
+	}
+	if q.SourceIP != "" {
+		filter("(source_ip = ? OR batch_count > 0)", q.SourceIP)
+	}
+	if q.Since > 0 {
+		filter("(timestamp >= ? OR batch_count > 0)", q.Since)
+	}
+	if q.Until > 0 {
+		filter("timestamp <= ?", q.Until)
+	}
+	if useFTS {
+		filter("id IN (SELECT rowid FROM telemetry_fts WHERE telemetry_fts MATCH ?)", `"`+strings.ReplaceAll(q.Text, `"`, `""`)+`"`)
+	}
+	text := strings.ToLower(q.Text)
+
+	page := &RecordPage{Records: []RecordMatch{}, FullText: useFTS}
+	matches := func(r TelemetryRecord, plain bool) bool {
+		switch {
+		case q.SourceIP != "" && r.SourceIP != q.SourceIP,
+			q.Since > 0 && r.Timestamp < q.Since,
+			q.Until > 0 && r.Timestamp > q.Until:
+			return false
+		case text == "" || useFTS && plain:
+			return true
+		}
+		return strings.Contains(strings.ToLower(r.JsonData), text)
+	}
+
+	for page.Scanned < searchMaxScan {
+		clauses, chunkArgs := append([]string{}, where...), append([]interface{}{}, args...)
+		if afterID > 0 {
+			// Resume inside the blob the last page stopped in, or below it
+			op := "<"
+			if afterMember >= 0 {
+				op = "<="
+			}
+			clauses = append(clauses, "id "+op+" ?")
+			chunkArgs = append(chunkArgs, afterID)
+		}
+		query := `SELECT id, service, timestamp, data_type, data_size, json_data, COALESCE(source_ip, ''),
+			codec, forwarded, retry_count, last_error, created_at, expires_at, batch_count
+			FROM telemetry_buffer`
+		if len(clauses) > 0 {
+			query += " WHERE " + strings.Join(clauses, " AND ")
+		}
+		query += " ORDER BY id DESC LIMIT ?"
+		rows, err := bm.db.Query(query, append(chunkArgs, searchChunk)...)
+		if err != nil {
+			return nil, err
+		}
+		var chunk []TelemetryRecord
+		for rows.Next() {
+			var r TelemetryRecord
+			if err := rows.Scan(&r.ID, &r.Service, &r.Timestamp, &r.DataType, &r.DataSize, &r.JsonData, &r.SourceIP,
+				&r.Codec, &r.Forwarded, &r.RetryCount, &r.LastError, &r.CreatedAt, &r.ExpiresAt, &r.BatchCount); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			chunk = append(chunk, r)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if len(chunk) == 0 {
+			return page, nil
+		}
+
+		for _, r := range chunk {
+			page.Scanned++
+			resumeMember := -1
+			if r.ID == afterID {
+				resumeMember = afterMember
+			}
+			afterID, afterMember = r.ID, -1
+			if err := bm.decodeRecord(&r); err != nil {
+				continue
+			}
+			if r.BatchCount == 0 {
+				if matches(r, true) {
+					page.Records = append(page.Records, RecordMatch{TelemetryRecord: r})
+				}
+			} else {
+				members, err := unbatchRecord(r)
+				if err != nil {
+					continue
+				}
+				last := len(members) - 1
+				if resumeMember >= 0 {
+					last = resumeMember - 1
+				}
+				for i := last; i >= 0; i-- {
+					if !matches(members[i], false) {
+						continue
+					}
+					index := i
+					page.Records = append(page.Records, RecordMatch{TelemetryRecord: members[i], BatchIndex: &index})
+					if len(page.Records) == q.Limit && i > 0 {
+						page.NextCursor = fmt.Sprintf("%d.%d", r.ID, i)
+						return page, nil
+					}
+				}
+			}
+			if len(page.Records) >= q.Limit || page.Scanned >= searchMaxScan {
+				page.NextCursor = strconv.FormatInt(r.ID, 10)
+				return page, nil
+			}
+		}
+	}
+	return page, nil
+}
+
+// parseTimeParam accepts unix seconds or RFC 3339
+func parseTimeParam(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: use unix seconds or RFC 3339", s)
+	}
+	return t.Unix(), nil
+}
+
+// handleSearchRecords serves GET /api/buffer/records
+func (bm *BufferManager) handleSearchRecords(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := RecordQuery{
+		Service:  params.Get("service"),
+		DataType: params.Get("data_type"),
+		SourceIP: params.Get("source_ip"),
+		Text:     params.Get("q"),
+		Cursor:   params.Get("cursor"),
+	}
+	if _, _, err := parseSearchCursor(q.Cursor); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var err error
+	if q.Since, err = parseTimeParam(params.Get("since")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.Until, err = parseTimeParam(params.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v := params.Get("forwarded"); v != "" {
+		forwarded, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid forwarded %q", v), http.StatusBadRequest)
+			return
+		}
+		q.Forwarded = &forwarded
+	}
+	q.Limit, _ = strconv.Atoi(params.Get("limit"))
+	if q.Limit <= 0 || q.Limit > 1000 {
+		q.Limit = 100
+	}
+
+	page, err := bm.SearchRecords(q)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Search failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// storeLinkEvents buffers syslog records numbered from first, alternating
+// between two source addresses and between link up and link down
+func storeLinkEvents(t *testing.T, bm *BufferManager, first, n int) {
+	t.Helper()
+	storeSyslog(t, bm)
+	for i := first; i < first+n; i++ {
+		state := []string{"up", "DOWN"}[i%2]
+		if err := bm.StoreRecord(TelemetryRecord{
+			Service: "fluent-bit", DataType: "syslog", Timestamp: int64(1000 + i),
+			SourceIP: fmt.Sprintf("10.0.0.%d", 1+i%2), JsonData: fmt.Sprintf(`{"n":%d,"message":"link %s"}`, i, state),
+		}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+}
+
+// searchAll follows next_cursor to the end and returns each record's n
+func searchAll(t *testing.T, bm *BufferManager, q RecordQuery) ([]int, []string) {
+	t.Helper()
+	var got []int
+	var cursors []string
+	for {
+		page, err := bm.SearchRecords(q)
+		if err != nil {
+			t.Fatalf("SearchRecords: %v", err)
+		}
+		for _, r := range page.Records {
+			var rec struct{ N int }
+			json.Unmarshal([]byte(r.JsonData), &rec)
+			got = append(got, rec.N)
+		}
+		if page.NextCursor == "" {
+			return got, cursors
+		}
+		cursors = append(cursors, page.NextCursor)
+		q.Cursor = page.NextCursor
+	}
+}
+
+func TestSearchRecords_FiltersAndPagesThroughBlobs(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Recompress.BatchSmallRecords = true
+	bm.config.Recompress.RecordsPerBlob = 10
+	storeLinkEvents(t, bm, 0, 25)
+	ageRecords(t, bm)
+	if run, err := bm.RecompressOldRecords(); err != nil || run.Blobs != 3 {
+		t.Fatalf("RecompressOldRecords: %+v, %v", run, err)
+	}
+	storeLinkEvents(t, bm, 25, 5)
+
+	got, cursors := searchAll(t, bm, RecordQuery{SourceIP: "10.0.0.1", Limit: 4})
+	if len(got) != 15 {
+		t.Fatalf("got %d records from 10.0.0.1, want 15: %v", len(got), got)
+	}
+	seen := map[int]bool{}
+	for _, n := range got {
+		if n%2 != 0 || seen[n] {
+			t.Fatalf("unexpected or repeated record %d in %v", n, got)
+		}
+		seen[n] = true
+	}
+	if !strings.Contains(strings.Join(cursors, " "), ".") {
+		t.Fatalf("no page stopped inside a blob: cursors %v", cursors)
+	}
+
+	got, _ = searchAll(t, bm, RecordQuery{Text: "link down", Since: 1008, Until: 1026, Limit: 100})
+	if fmt.Sprint(got) != "[25 23 21 19 17 15 13 11 9]" {
+		t.Fatalf("text and time filters matched %v", got)
+	}
+
+	bm.db.Exec("UPDATE telemetry_buffer SET forwarded = 1 WHERE batch_count = 0")
+	forwarded := false
+	got, _ = searchAll(t, bm, RecordQuery{Forwarded: &forwarded, Limit: 100})
+	if len(got) != 25 {
+		t.Fatalf("got %d unforwarded records, want the 25 in blobs", len(got))
+	}
+}
+
+func TestHandleSearchRecords(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	storeLinkEvents(t, bm, 0, 3)
+
+	for _, query := range []string{"cursor=abc", "cursor=5.-1", "since=yesterday", "forwarded=maybe"} {
+		rec := httptest.NewRecorder()
+		bm.handleSearchRecords(rec, httptest.NewRequest("GET", "/api/buffer/records?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status %d, want 400", query, rec.Code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	bm.handleSearchRecords(rec, httptest.NewRequest("GET", "/api/buffer/records?service=fluent-bit&since=1970-01-01T00:16:41Z&limit=1", nil))
+	var page RecordPage
+	if err := json.NewDecoder(rec.Body).Decode(&page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(page.Records) != 1 || page.Records[0].Timestamp != 1002 || page.NextCursor == "" {
+		t.Fatalf("unexpected page %+v", page)
+	}
+}
+
+func TestSearchRecords_FullTextIndex(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Search.FullText = true
+	bm.initSearchIndex()
+	storeLinkEvents(t, bm, 0, 6)
+
+	page, err := bm.SearchRecords(RecordQuery{Text: "link DOWN"})
+	if err != nil {
+		t.Fatalf("SearchRecords: %v", err)
+	}
+	if len(page.Records) != 3 || page.FullText != bm.search.fts {
+		t.Fatalf("unexpected page %+v", page)
+	}
+
+	// Deleting must work whether or not the index could be created
+	if _, err := bm.db.Exec("DELETE FROM telemetry_buffer WHERE timestamp < 1003"); err != nil {
+		t.Fatalf("delete with full_text enabled: %v", err)
+	}
+	if page, _ := bm.SearchRecords(RecordQuery{Text: "link"}); len(page.Records) != 3 {
+		t.Fatalf("got %d records after delete, want 3", len(page.Records))
+	}
+	if !bm.search.fts {
+		t.Skip("built without sqlite_fts5; scanned instead")
+	}
+	var indexed int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_fts").Scan(&indexed)
+	if indexed != 3 {
+		t.Fatalf("%d rows left in the index, want 3", indexed)
+	}
+}
@@ -0,0 +1,1194 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segment files are append-only logs of framed records:
+//
+//	[4 byte frame length][4 byte CRC32][2 byte header length][header JSON][data]
+//
+// Each segment has a sidecar index with one fixed-size entry per record so
+// readers can seek by position without scanning, and the store keeps a
+// forwarding cursor pointing at the first record not yet forwarded.
+const (
+	segmentFramePrefix    = 8
+	segmentIndexEntrySize = 37 // offset(8) timestamp(8) expires(8) length(4) stored(4) raw(4) codec(1)
+	defaultSegmentSizeMB  = 100
+	segmentCursorFile     = "cursor.json"
+)
+
+var segmentCodecs = []string{"none", "gzip", "zstd"}
+
+func segmentCodecID(codec string) byte {
+	for i, c := range segmentCodecs {
+		if c == codec {
+			return byte(i)
+		}
+	}
+	return 0
+}
+
+func segmentCodecName(id byte) string {
+	if int(id) < len(segmentCodecs) {
+		return segmentCodecs[id]
+	}
+	return "none"
+}
+
+// segmentCursor identifies a record position within a segment store
+type segmentCursor struct {
+	Segment uint64 `json:"segment"`
+	Entry   int    `json:"entry"`
+}
+
+// segmentIndexEntry is the decoded form of a single index record
+type segmentIndexEntry struct {
+	Offset    int64
+	Timestamp int64
+	ExpiresAt int64
+	Length    uint32 // frame payload length
+	Stored    uint32 // stored (possibly compressed) data length
+	Raw       uint32 // uncompressed data length
+	Codec     byte
+}
+
+func (e segmentIndexEntry) encode() []byte {
+	b := make([]byte, segmentIndexEntrySize)
+	binary.BigEndian.PutUint64(b[0:], uint64(e.Offset))
+	binary.BigEndian.PutUint64(b[8:], uint64(e.Timestamp))
+	binary.BigEndian.PutUint64(b[16:], uint64(e.ExpiresAt))
+	binary.BigEndian.PutUint32(b[24:], e.Length)
+	binary.BigEndian.PutUint32(b[28:], e.Stored)
+	binary.BigEndian.PutUint32(b[32:], e.Raw)
+	b[36] = e.Codec
+	return b
+}
+
+func decodeSegmentIndexEntry(b []byte) segmentIndexEntry {
+	return segmentIndexEntry{
+		Offset:    int64(binary.BigEndian.Uint64(b[0:])),
+		Timestamp: int64(binary.BigEndian.Uint64(b[8:])),
+		ExpiresAt: int64(binary.BigEndian.Uint64(b[16:])),
+		Length:    binary.BigEndian.Uint32(b[24:]),
+		Stored:    binary.BigEndian.Uint32(b[28:]),
+		Raw:       binary.BigEndian.Uint32(b[32:]),
+		Codec:     b[36],
+	}
+}
+
+// segmentMeta holds the in-memory summary of one segment
+type segmentMeta struct {
+	Seq        uint64
+	DataSize   int64
+	Entries    int
+	Oldest     int64
+	Newest     int64
+	MaxExpires int64
+	Codecs     map[string]CodecStats
+}
+
+func (m *segmentMeta) add(e segmentIndexEntry, frameSize int64) {
+	if m.Entries == 0 || e.Timestamp < m.Oldest {
+		m.Oldest = e.Timestamp
+	}
+	if e.Timestamp > m.Newest {
+		m.Newest = e.Timestamp
+	}
+	if e.ExpiresAt > m.MaxExpires {
+		m.MaxExpires = e.ExpiresAt
+	}
+	m.Entries++
+	m.DataSize += frameSize
+
+	codec := segmentCodecName(e.Codec)
+	cs := m.Codecs[codec]
+	cs.Records++
+	cs.RawBytes += int64(e.Raw)
+	cs.StoredBytes += int64(e.Stored)
+	m.Codecs[codec] = cs
+}
+
+// segmentStats summarizes a segment store
+type segmentStats struct {
+	Records   int64
+	Bytes     int64
+	Oldest    int64
+	Newest    int64
+	Forwarded int64
+	Pending   int64
+	Segments  int
+	Codecs    map[string]CodecStats
+}
+
+// segmentStore is an append-only, rotated segment-file buffer for one service
+type segmentStore struct {
+	mu       sync.Mutex
+	dir      string
+	segments []*segmentMeta
+	active   *os.File
+	activeIx *os.File
+	cursor   segmentCursor
+	nextSeq  uint64
+	retry    segmentRetry // attempts for the record at the cursor
+}
+
+func segmentDataPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("seg-%020d.log", seq))
+}
+
+func segmentIndexPath(dir string, seq uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("seg-%020d.idx", seq))
+}
+
+// openSegmentStore opens or creates a segment store, repairing torn writes
+func openSegmentStore(dir string) (*segmentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create segment directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "seg-") || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "seg-"), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	s := &segmentStore{dir: dir}
+	for _, seq := range seqs {
+		meta, err := loadSegmentMeta(dir, seq)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load segment %d: %v", seq, err)
+		}
+		s.segments = append(s.segments, meta)
+	}
+
+	if err := s.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	// Sequence numbers are never reused so the cursor cannot skip new segments
+	s.nextSeq = s.cursor.Segment
+	if n := len(s.segments); n > 0 && s.segments[n-1].Seq+1 > s.nextSeq {
+		s.nextSeq = s.segments[n-1].Seq + 1
+	}
+	return s, nil
+}
+
+// loadSegmentMeta rebuilds a segment summary from its index, truncating any
+// index entries or data bytes left behind by an interrupted append
+func loadSegmentMeta(dir string, seq uint64) (*segmentMeta, error) {
+	dataInfo, err := os.Stat(segmentDataPath(dir, seq))
+	if err != nil {
+		return nil, err
+	}
+	index, err := os.ReadFile(segmentIndexPath(dir, seq))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	meta := &segmentMeta{Seq: seq, Codecs: make(map[string]CodecStats)}
+	var validEnd int64
+	valid := 0
+	for off := 0; off+segmentIndexEntrySize <= len(index); off += segmentIndexEntrySize {
+		e := decodeSegmentIndexEntry(index[off : off+segmentIndexEntrySize])
+		end := e.Offset + segmentFrameSize(e)
+		if e.Offset != validEnd || end > dataInfo.Size() {
+			break
+		}
+		meta.add(e, end-e.Offset)
+		validEnd = end
+		valid++
+	}
+
+	if validEnd != dataInfo.Size() {
+		if err := os.Truncate(segmentDataPath(dir, seq), validEnd); err != nil {
+			return nil, err
+		}
+	}
+	if valid*segmentIndexEntrySize != len(index) {
+		if err := os.Truncate(segmentIndexPath(dir, seq), int64(valid*segmentIndexEntrySize)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// segmentFrameSize returns the on-disk size of an indexed record
+func segmentFrameSize(e segmentIndexEntry) int64 {
+	return int64(e.Length) + segmentFramePrefix
+}
+
+func (s *segmentStore) loadCursor() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, segmentCursorFile))
+	if os.IsNotExist(err) {
+		s.resetCursor()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.cursor); err != nil {
+		return fmt.Errorf("invalid segment cursor: %v", err)
+	}
+	s.clampCursor()
+	return nil
+}
+
+// resetCursor points the cursor at the first stored record
+func (s *segmentStore) resetCursor() {
+	if len(s.segments) > 0 {
+		s.cursor = segmentCursor{Segment: s.segments[0].Seq}
+	} else {
+		s.cursor = segmentCursor{Segment: 1}
+	}
+}
+
+// clampCursor moves a cursor that references a removed segment to the oldest one kept
+func (s *segmentStore) clampCursor() {
+	if len(s.segments) > 0 && s.cursor.Segment < s.segments[0].Seq {
+		s.cursor = segmentCursor{Segment: s.segments[0].Seq}
+	}
+}
+
+func (s *segmentStore) saveCursor() error {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, segmentCursorFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, segmentCursorFile))
+}
+
+// rotate closes the active segment and starts a new one
+func (s *segmentStore) rotate() error {
+	s.closeActive()
+
+	seq := s.nextSeq
+	s.nextSeq++
+
+	data, err := os.OpenFile(segmentDataPath(s.dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(segmentIndexPath(s.dir, seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		data.Close()
+		return err
+	}
+
+	s.active, s.activeIx = data, index
+	s.segments = append(s.segments, &segmentMeta{Seq: seq, Codecs: make(map[string]CodecStats)})
+	return nil
+}
+
+// openActive reopens the newest segment for appending after a restart
+func (s *segmentStore) openActive() error {
+	last := s.segments[len(s.segments)-1]
+	data, err := os.OpenFile(segmentDataPath(s.dir, last.Seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	index, err := os.OpenFile(segmentIndexPath(s.dir, last.Seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		data.Close()
+		return err
+	}
+	s.active, s.activeIx = data, index
+	return nil
+}
+
+func (s *segmentStore) closeActive() {
+	if s.active != nil {
+		s.active.Close()
+		s.activeIx.Close()
+		s.active, s.activeIx = nil, nil
+	}
+}
+
+// Append writes a record whose payload has already been compressed with record.Codec
+func (s *segmentStore) Append(record TelemetryRecord, data []byte, rawSize int64, maxSegmentBytes int64) error {
+	record.JsonData = ""
+	header, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if len(header) > 0xFFFF {
+		return errors.New("segment record header too large")
+	}
+
+	payload := make([]byte, 2+len(header)+len(data))
+	binary.BigEndian.PutUint16(payload, uint16(len(header)))
+	copy(payload[2:], header)
+	copy(payload[2+len(header):], data)
+
+	frame := make([]byte, segmentFramePrefix+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	copy(frame[segmentFramePrefix:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil && len(s.segments) > 0 {
+		if err := s.openActive(); err != nil {
+			return err
+		}
+	}
+	if s.active == nil {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	meta := s.segments[len(s.segments)-1]
+	if meta.Entries > 0 && meta.DataSize+int64(len(frame)) > maxSegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		meta = s.segments[len(s.segments)-1]
+	}
+
+	entry := segmentIndexEntry{
+		Offset:    meta.DataSize,
+		Timestamp: record.Timestamp,
+		ExpiresAt: record.ExpiresAt,
+		Length:    uint32(len(payload)),
+		Stored:    uint32(len(data)),
+		Raw:       uint32(rawSize),
+		Codec:     segmentCodecID(record.Codec),
+	}
+
+	// Data is written before the index so a crash never leaves an index
+	// entry pointing past the end of the segment
+	if _, err := s.active.Write(frame); err != nil {
+		return err
+	}
+	if _, err := s.activeIx.Write(entry.encode()); err != nil {
+		return err
+	}
+
+	meta.add(entry, int64(len(frame)))
+	return nil
+}
+
+// readEntry reads and verifies the record at position entry of segment seq
+func (s *segmentStore) readEntry(seq uint64, entry int) (TelemetryRecord, error) {
+	var record TelemetryRecord
+
+	index, err := os.Open(segmentIndexPath(s.dir, seq))
+	if err != nil {
+		return record, err
+	}
+	defer index.Close()
+
+	buf := make([]byte, segmentIndexEntrySize)
+	if _, err := index.ReadAt(buf, int64(entry*segmentIndexEntrySize)); err != nil {
+		return record, err
+	}
+	ie := decodeSegmentIndexEntry(buf)
+
+	data, err := os.Open(segmentDataPath(s.dir, seq))
+	if err != nil {
+		return record, err
+	}
+	defer data.Close()
+
+	frame := make([]byte, segmentFrameSize(ie))
+	if _, err := data.ReadAt(frame, ie.Offset); err != nil {
+		return record, err
+	}
+	return decodeSegmentFrame(frame, segmentDataPath(s.dir, seq))
+}
+
+func decodeSegmentFrame(frame []byte, path string) (TelemetryRecord, error) {
+	var record TelemetryRecord
+
+	length := binary.BigEndian.Uint32(frame)
+	payload := frame[segmentFramePrefix:]
+	if int(length) != len(payload) || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(frame[4:]) {
+		return record, fmt.Errorf("corrupt segment record in %s", path)
+	}
+
+	headerLen := int(binary.BigEndian.Uint16(payload))
+	if 2+headerLen > len(payload) {
+		return record, fmt.Errorf("corrupt segment header in %s", path)
+	}
+	if err := json.Unmarshal(payload[2:2+headerLen], &record); err != nil {
+		return record, err
+	}
+	record.JsonData = string(payload[2+headerLen:])
+	record.FilePath = path
+	return record, nil
+}
+
+// ReadPending returns up to limit records starting at the forwarding cursor,
+// together with the cursor position just after each returned record
+func (s *segmentStore) ReadPending(limit int) ([]TelemetryRecord, []segmentCursor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []TelemetryRecord
+	var next []segmentCursor
+	pos := s.cursor
+	for _, meta := range s.segments {
+		if meta.Seq < pos.Segment {
+			continue
+		}
+		if meta.Seq > pos.Segment {
+			pos = segmentCursor{Segment: meta.Seq}
+		}
+		for pos.Entry < meta.Entries && len(records) < limit {
+			record, err := s.readEntry(meta.Seq, pos.Entry)
+			if err != nil {
+				return records, next, err
+			}
+			pos.Entry++
+			records = append(records, record)
+			next = append(next, pos)
+		}
+		if len(records) >= limit {
+			break
+		}
+	}
+	return records, next, nil
+}
+
+// Position returns the current forwarding cursor
+func (s *segmentStore) Position() segmentCursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursor
+}
+
+// Commit advances the forwarding cursor to pos and persists it
+func (s *segmentStore) Commit(pos segmentCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cursor = pos
+	s.clampCursor()
+	return s.saveCursor()
+}
+
+// Tail returns up to limit of the most recently appended records
+func (s *segmentStore) Tail(limit int) ([]TelemetryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records []TelemetryRecord
+	for i := len(s.segments) - 1; i >= 0 && len(records) < limit; i-- {
+		meta := s.segments[i]
+		for e := meta.Entries - 1; e >= 0 && len(records) < limit; e-- {
+			record, err := s.readEntry(meta.Seq, e)
+			if err != nil {
+				return records, err
+			}
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// removeSegment deletes the oldest segment's files; callers hold s.mu
+func (s *segmentStore) removeOldestSegment() (*segmentMeta, error) {
+	meta := s.segments[0]
+	if len(s.segments) == 1 {
+		s.closeActive()
+	}
+	if err := os.Remove(segmentDataPath(s.dir, meta.Seq)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := os.Remove(segmentIndexPath(s.dir, meta.Seq)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	s.segments = s.segments[1:]
+	if len(s.segments) == 0 {
+		s.cursor = segmentCursor{Segment: s.nextSeq}
+	} else {
+		s.clampCursor()
+	}
+	return meta, s.saveCursor()
+}
+
+// Cleanup removes segments whose records have all expired
+func (s *segmentStore) Cleanup(now int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for len(s.segments) > 0 && s.segments[0].Entries > 0 && s.segments[0].MaxExpires < now {
+		meta, err := s.removeOldestSegment()
+		if err != nil {
+			return removed, err
+		}
+		removed += meta.Entries
+	}
+	return removed, nil
+}
+
+// DropOldest removes the oldest segment to free space
+func (s *segmentStore) DropOldest() (int64, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.segments) == 0 {
+		return 0, 0, nil
+	}
+	meta, err := s.removeOldestSegment()
+	if err != nil {
+		return 0, 0, err
+	}
+	return meta.DataSize, meta.Entries, nil
+}
+
+// Oldest returns the timestamp of the oldest stored record, or 0 when empty
+func (s *segmentStore) Oldest() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, meta := range s.segments {
+		if meta.Entries > 0 {
+			return meta.Oldest
+		}
+	}
+	return 0
+}
+
+// Size returns the total bytes held in segment files
+func (s *segmentStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var total int64
+	for _, meta := range s.segments {
+		total += meta.DataSize
+	}
+	return total
+}
+
+// Usage returns the number of records and bytes held in segment files
+func (s *segmentStore) Usage() (int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var records, bytes int64
+	for _, meta := range s.segments {
+		records += int64(meta.Entries)
+		bytes += meta.DataSize
+	}
+	return records, bytes
+}
+
+// Stats summarizes the records held by the store
+func (s *segmentStore) Stats() segmentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := segmentStats{Segments: len(s.segments), Codecs: make(map[string]CodecStats)}
+	for _, meta := range s.segments {
+		if meta.Entries == 0 {
+			continue
+		}
+		if stats.Records == 0 || meta.Oldest < stats.Oldest {
+			stats.Oldest = meta.Oldest
+		}
+		if meta.Newest > stats.Newest {
+			stats.Newest = meta.Newest
+		}
+		stats.Records += int64(meta.Entries)
+		stats.Bytes += meta.DataSize
+
+		switch {
+		case meta.Seq < s.cursor.Segment:
+			stats.Forwarded += int64(meta.Entries)
+		case meta.Seq == s.cursor.Segment:
+			stats.Forwarded += int64(s.cursor.Entry)
+		}
+
+		for codec, cs := range meta.Codecs {
+			total := stats.Codecs[codec]
+			total.Records += cs.Records
+			total.RawBytes += cs.RawBytes
+			total.StoredBytes += cs.StoredBytes
+			stats.Codecs[codec] = total
+		}
+	}
+	stats.Pending = stats.Records - stats.Forwarded
+	return stats
+}
+
+// Close releases the active segment file handles
+func (s *segmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeActive()
+	return nil
+}
+
+// errSegmentStoreMissing is returned when a service has no segment store
+var errSegmentStoreMissing = errors.New("segment store not found")
+
+// segmentFiles is the Store for services buffering to segment files, with
+// one segmentStore per service under root
+type segmentFiles struct {
+	root string
+	// segmentBytes returns the size at which a service's active segment rotates
+	segmentBytes func(service string) int64
+	mu           sync.Mutex
+	stores       map[string]*segmentStore
+}
+
+// openSegmentFiles opens every segment store already present under root
+func openSegmentFiles(root string, segmentBytes func(string) int64) (*segmentFiles, error) {
+	f := &segmentFiles{root: root, segmentBytes: segmentBytes, stores: make(map[string]*segmentStore)}
+
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := f.storeFor(entry.Name(), true); err != nil {
+			return nil, fmt.Errorf("failed to open segment store %s: %v", entry.Name(), err)
+		}
+	}
+	return f, nil
+}
+
+// storeFor returns the segment store for a service, opening it if create is set
+func (f *segmentFiles) storeFor(service string, create bool) (*segmentStore, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if store, ok := f.stores[service]; ok {
+		return store, nil
+	}
+	if !create {
+		return nil, errSegmentStoreMissing
+	}
+
+	store, err := openSegmentStore(filepath.Join(f.root, service))
+	if err != nil {
+		return nil, err
+	}
+	f.stores[service] = store
+	return store, nil
+}
+
+// list returns a snapshot of all open segment stores by service
+func (f *segmentFiles) list() map[string]*segmentStore {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make(map[string]*segmentStore, len(f.stores))
+	for service, store := range f.stores {
+		out[service] = store
+	}
+	return out
+}
+
+func (f *segmentFiles) Append(record TelemetryRecord, data []byte, rawSize int64) error {
+	store, err := f.storeFor(record.Service, true)
+	if err != nil {
+		return err
+	}
+	return store.Append(record, data, rawSize, f.segmentBytes(record.Service))
+}
+
+func (f *segmentFiles) Stats(service string) (StoreStats, error) {
+	stats := StoreStats{Codecs: make(map[string]CodecStats)}
+	store, err := f.storeFor(service, false)
+	if err != nil {
+		return stats, nil
+	}
+	seg := store.Stats()
+	stats.merge(StoreStats{
+		Records:   seg.Records,
+		Bytes:     seg.Bytes,
+		Oldest:    seg.Oldest,
+		Newest:    seg.Newest,
+		Forwarded: seg.Forwarded,
+		Pending:   seg.Pending,
+		Codecs:    seg.Codecs,
+	})
+	return stats, nil
+}
+
+func (f *segmentFiles) Services() ([]string, error) {
+	var services []string
+	for service, store := range f.list() {
+		if records, _ := store.Usage(); records > 0 {
+			services = append(services, service)
+		}
+	}
+	return services, nil
+}
+
+func (f *segmentFiles) Tail(service string, limit int) ([]TelemetryRecord, error) {
+	store, err := f.storeFor(service, false)
+	if err != nil {
+		return nil, nil
+	}
+	return store.Tail(limit)
+}
+
+// DropOldest removes the service's oldest segment, whatever count asks for
+func (f *segmentFiles) DropOldest(service string, count int64) (StoreDrop, error) {
+	store, err := f.storeFor(service, false)
+	if err != nil {
+		return StoreDrop{}, nil
+	}
+	pending := store.Stats().Pending
+	freed, records, err := store.DropOldest()
+	if err != nil {
+		return StoreDrop{}, err
+	}
+	return StoreDrop{Records: int64(records), Bytes: freed, Pending: pending - store.Stats().Pending}, nil
+}
+
+// Cleanup removes segments whose records have all expired. A store that
+// fails does not hold up the others; the first error is returned.
+func (f *segmentFiles) Cleanup(now int64) (int64, error) {
+	var removed int64
+	var firstErr error
+	for service, store := range f.list() {
+		n, err := store.Cleanup(now)
+		removed += int64(n)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("segments for %s: %v", service, err)
+		}
+	}
+	return removed, firstErr
+}
+
+func (f *segmentFiles) Close() error {
+	for _, store := range f.list() {
+		store.Close()
+	}
+	return nil
+}
+
+// segmentStoreFor returns the segment store for a service, opening it if create is set
+func (bm *BufferManager) segmentStoreFor(service string, create bool) (*segmentStore, error) {
+	return bm.files.storeFor(service, create)
+}
+
+// segmentStoreList returns a snapshot of all open segment stores by service
+func (bm *BufferManager) segmentStoreList() map[string]*segmentStore {
+	return bm.files.list()
+}
+
+// segmentBytes returns the configured segment size for a service
+func (bm *BufferManager) segmentBytes(service string) int64 {
+	maxSegmentMB := bm.config.Services[service].MaxFileSizeMB
+	if maxSegmentMB <= 0 {
+		maxSegmentMB = defaultSegmentSizeMB
+	}
+	return int64(maxSegmentMB) * 1024 * 1024
+}
+
+// segmentBufferSize returns the total size of all segment stores in bytes
+func (bm *BufferManager) segmentBufferSize() int64 {
+	var total int64
+	for _, store := range bm.segmentStoreList() {
+		total += store.Size()
+	}
+	return total
+}
+
+// evictSegment drops the oldest segment of the lowest-priority service holding
+// segment files and returns how many records were removed
+func (bm *BufferManager) evictSegment() (int64, error) {
+	var victimService string
+	var victim *segmentStore
+	var victimTs int64
+	for service, store := range bm.segmentStoreList() {
+		ts := store.Oldest()
+		if ts == 0 {
+			continue
+		}
+		if victim != nil {
+			p, vp := bm.servicePriority(service), bm.servicePriority(victimService)
+			if p > vp || (p == vp && ts >= victimTs) {
+				continue
+			}
+		}
+		victimService, victim, victimTs = service, store, ts
+	}
+	if victim == nil {
+		return 0, nil
+	}
+
+	freed, records, err := victim.DropOldest()
+	if err != nil {
+		return 0, err
+	}
+	bm.metrics.overflowDropped.add(float64(records), victimService)
+	logger.WithField("service", victimService).WithField("records", records).WithField("bytes", freed).
+		Warn("Dropped oldest buffer segment, file buffer exceeds max_file_size_gb")
+	return int64(records), nil
+}
+
+// segmentPending counts the records waiting in each segment store, skipping
+// services listed in exclude
+func (bm *BufferManager) segmentPending(exclude map[string]bool) map[string]int {
+	pending := make(map[string]int)
+	for service, store := range bm.segmentStoreList() {
+		if n := store.Stats().Pending; n > 0 && !exclude[service] {
+			pending[service] = int(n)
+		}
+	}
+	return pending
+}
+
+// forwardSegmentRecords forwards up to shares[service] records from each
+// service's segment store, the stores in parallel. Services that forward
+// nothing are added to stalled so the rest of the pass skips them.
+func (bm *BufferManager) forwardSegmentRecords(shares map[string]int, stalled map[string]bool) (int, int) {
+	stores := bm.segmentStoreList()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	forwarded, failed := 0, 0
+	for service, share := range shares {
+		store, ok := stores[service]
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(service string, store *segmentStore, share int) {
+			defer wg.Done()
+			ok, bad := bm.forwardSegmentStore(service, store, share)
+			mu.Lock()
+			defer mu.Unlock()
+			forwarded += ok
+			failed += bad
+			if ok == 0 {
+				stalled[service] = true
+			}
+		}(service, store, share)
+	}
+	wg.Wait()
+	return forwarded, failed
+}
+
+// forwardSegmentStore forwards up to limit records from the head of a segment
+// store. The cursor can only move forward, so records the destination does
+// not take are re-appended with a backoff, or dead-lettered, and the cursor
+// moves past them. Only a destination that cannot be reached holds the store
+// at its head. After maxConsecutiveFailures records fail in a row the store is
+// left for the next pass, as the database drain does.
+func (bm *BufferManager) forwardSegmentStore(service string, store *segmentStore, limit int) (int, int) {
+	forwarded, failed := 0, 0
+	for streak := 0; limit > 0 && streak < maxConsecutiveFailures; streak++ {
+		ok, bad, moved := bm.forwardSegmentWindow(service, store, limit)
+		forwarded += ok
+		failed += bad
+		limit -= ok + bad
+		if !moved {
+			break
+		}
+	}
+	return forwarded, failed
+}
+
+// forwardSegmentWindow forwards one window of records from the head of a
+// segment store. It reports true when the destination took none of them and
+// the failed head record was moved out of the cursor's way, so the records
+// behind it can be tried at once.
+func (bm *BufferManager) forwardSegmentWindow(service string, store *segmentStore, limit int) (int, int, bool) {
+	now := time.Now().Unix()
+	start := store.Position()
+	store.mu.Lock()
+	waiting := store.retry.Pos == start && store.retry.NextAttempt > now
+	store.mu.Unlock()
+	if waiting {
+		return 0, 0, false
+	}
+
+	records, next, err := store.ReadPending(limit)
+	if err != nil {
+		logger.WithError(err).WithField("service", service).Error("Failed to read buffered segment records")
+	}
+	// Re-appended records still waiting out their backoff are moved behind
+	// the backlog again, unless nothing in the window is due yet
+	due := false
+	for _, record := range records {
+		if record.NextAttempt <= now {
+			due = true
+			break
+		}
+	}
+	if !due {
+		return 0, 0, false
+	}
+	position := func(i int) segmentCursor {
+		if i == 0 {
+			return start
+		}
+		return next[i-1]
+	}
+
+	stored := append([]TelemetryRecord(nil), records...)
+	var decoded []TelemetryRecord
+	var index []int    // position in records of each decoded record
+	var deferred []int // position in records of each record not yet due
+	dead := 0
+	for i := range records {
+		if err := bm.decodeRecord(&records[i]); err != nil {
+			if len(decoded) > 0 {
+				// Dead-lettered on a later pass, once the records before it are settled
+				records, next = records[:i], next[:i]
+				break
+			}
+			logger.WithError(err).WithField("service", service).Warn("Dead-lettering undecodable segment record")
+			if err := bm.deadLetterStoredRecord(stored[i], 0, 0, err.Error()); err != nil {
+				logger.WithError(err).WithField("service", service).Error("Failed to dead-letter segment record")
+				records, next = records[:i], next[:i]
+				break
+			}
+			dead++
+			continue
+		}
+		if records[i].NextAttempt > now {
+			deferred = append(deferred, i)
+			continue
+		}
+		decoded = append(decoded, records[i])
+		index = append(index, i)
+	}
+	// commit re-appends the deferred records before end and moves the cursor
+	// past them, stopping short of one that could not be re-appended
+	commit := func(end int) bool {
+		reached := true
+		for _, i := range deferred {
+			if i >= end {
+				break
+			}
+			if err := store.Append(stored[i], []byte(stored[i].JsonData), int64(len(records[i].JsonData)), bm.segmentBytes(service)); err != nil {
+				logger.WithError(err).WithField("service", service).Error("Failed to requeue segment record")
+				end, reached = i, false
+				break
+			}
+		}
+		if end > 0 {
+			bm.commitSegment(store, next[end-1])
+		}
+		return reached
+	}
+	if len(records) == 0 {
+		return 0, 0, false
+	}
+	if len(decoded) == 0 {
+		commit(len(records))
+		return 0, dead, false
+	}
+
+	errs := bm.forwardDecoded(decoded)
+	accepted, answered := 0, false
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			accepted++
+		case errors.Is(err, errRejected), errors.Is(err, errItemFailed):
+			answered = true
+		}
+	}
+
+	if accepted == 0 && !answered {
+		first := index[0]
+		forwardErr := errs[0]
+		logger.WithError(forwardErr).WithField("service", service).Warn("Failed to forward buffered segment record")
+		if isTransportFailure(forwardErr) {
+			// The destination is unreachable; the store waits at the first record it could not send
+			if first > 0 && !commit(first) {
+				return 0, dead, false
+			}
+			if !errors.Is(forwardErr, errNoDestination) && bm.segmentForwardFailed(store, position(first), stored[first], forwardErr) {
+				bm.commitSegment(store, next[first])
+			}
+			return 0, dead + len(decoded), false
+		}
+
+		// The destination answered but failed the first record; move it out of
+		// the way and leave the records behind it for the next window
+		if rerr := bm.requeueSegmentRecord(store, stored[first], int64(len(decoded[0].JsonData)), forwardErr); rerr != nil {
+			logger.WithError(rerr).WithField("service", service).Error("Failed to requeue segment record")
+			commit(first)
+			return 0, dead, false
+		}
+		commit(first + 1)
+		return 0, dead + 1, true
+	}
+
+	// Move the cursor past the window, stopping short of a failed record
+	// that could be neither re-appended nor dead-lettered
+	end := len(records)
+	failed := dead
+	for k, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed++
+		i := index[k]
+		if rerr := bm.requeueSegmentRecord(store, stored[i], int64(len(decoded[k].JsonData)), err); rerr != nil {
+			logger.WithError(rerr).WithField("service", service).Error("Failed to requeue segment record")
+			end = i
+			break
+		}
+	}
+	commit(end)
+	return accepted, failed, false
+}
+
+// isTransportFailure reports whether a forward error means the destination
+// could not be reached at all, rather than that it failed the record
+func isTransportFailure(err error) bool {
+	var netErr net.Error
+	var throttled *retryAfterError
+	return errors.Is(err, errNoDestination) || errors.As(err, &netErr) || errors.As(err, &throttled)
+}
+
+// commitSegment persists a segment store's forwarding cursor
+func (bm *BufferManager) commitSegment(store *segmentStore, pos segmentCursor) {
+	if err := store.Commit(pos); err != nil {
+		logger.WithError(err).Error("Failed to persist segment cursor")
+	}
+}
+
+// forwardDecoded forwards decoded records and returns one error per record.
+// Batch-capable destinations take each data type's records in one call; for
+// the others the first record probes the destination and the rest are sent
+// with up to the destination's concurrency in flight.
+func (bm *BufferManager) forwardDecoded(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	groups := make(map[string][]int)
+	for i, record := range records {
+		groups[record.DataType] = append(groups[record.DataType], i)
+	}
+
+	for dataType, indexes := range groups {
+		group := make([]TelemetryRecord, len(indexes))
+		for k, i := range indexes {
+			group[k] = records[i]
+		}
+
+		if fwd, ok := bm.getForwarder(dataType).(BatchForwarder); ok {
+			for k, err := range bm.forwardBufferedBatch(fwd, group) {
+				errs[indexes[k]] = err
+			}
+			continue
+		}
+
+		errs[indexes[0]] = bm.forwardRecord(group[0])
+		if err := errs[indexes[0]]; err != nil && !errors.Is(err, errRejected) && !errors.Is(err, errItemFailed) {
+			for _, i := range indexes[1:] {
+				errs[i] = err
+			}
+			continue
+		}
+
+		concurrency := bm.config.Destinations[dataType].Concurrency
+		if concurrency <= 0 {
+			concurrency = defaultDrainConcurrency
+		}
+		sem := make(chan struct{}, concurrency)
+		var wg sync.WaitGroup
+		for k := 1; k < len(group); k++ {
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(k int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				errs[indexes[k]] = bm.forwardRecord(group[k])
+			}(k)
+		}
+		wg.Wait()
+	}
+	return errs
+}
+
+// requeueSegmentRecord re-appends a record the destination did not take, with
+// the attempt counted and a backoff, or dead-letters it once attempts run out
+// or the destination rejected it
+func (bm *BufferManager) requeueSegmentRecord(store *segmentStore, stored TelemetryRecord, rawSize int64, forwardErr error) error {
+	policy := bm.retryPolicy()
+	attempts := stored.RetryCount + 1
+	if attempts >= policy.MaxAttempts || errors.Is(forwardErr, errRejected) {
+		logger.WithError(forwardErr).WithField("service", stored.Service).WithField("attempts", attempts).
+			Warn("Segment record exhausted forward attempts, moving to dead-letter queue")
+		return bm.deadLetterStoredRecord(stored, rawSize, attempts, forwardErr.Error())
+	}
+
+	stored.RetryCount = attempts
+	stored.NextAttempt = time.Now().Add(policy.retryDelay(attempts, forwardErr)).Unix()
+	stored.LastError = forwardErr.Error()
+	stored.FilePath = ""
+	return store.Append(stored, []byte(stored.JsonData), rawSize, bm.segmentBytes(stored.Service))
+}
+
+// segmentForwardFailed records a failed attempt for the record at pos. Segment
+// stores forward strictly in order, so the whole store waits out the backoff;
+// once attempts are exhausted the record is dead-lettered and true is returned
+// so the cursor can move past it.
+func (bm *BufferManager) segmentForwardFailed(store *segmentStore, pos segmentCursor, stored TelemetryRecord, forwardErr error) bool {
+	policy := bm.retryPolicy()
+
+	store.mu.Lock()
+	retry := store.retry
+	if retry.Pos != pos {
+		retry = segmentRetry{Pos: pos}
+	}
+	retry.Attempts++
+	retry.LastError = forwardErr.Error()
+
+	if retry.Attempts < policy.MaxAttempts && !errors.Is(forwardErr, errRejected) {
+		retry.NextAttempt = time.Now().Add(policy.retryDelay(retry.Attempts, forwardErr)).Unix()
+		store.retry = retry
+		store.mu.Unlock()
+		return false
+	}
+	store.retry = segmentRetry{}
+	store.mu.Unlock()
+
+	logger.WithError(forwardErr).WithField("service", stored.Service).WithField("attempts", retry.Attempts).
+		Warn("Segment record exhausted forward attempts, moving to dead-letter queue")
+	if err := bm.deadLetterStoredRecord(stored, 0, retry.Attempts, forwardErr.Error()); err != nil {
+		logger.WithError(err).WithField("service", stored.Service).Error("Failed to dead-letter segment record")
+		return false
+	}
+	return true
+}
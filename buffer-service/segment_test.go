@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func appendTestRecords(t *testing.T, s *segmentStore, n int, maxSegment int64) {
+	t.Helper()
+	now := time.Now().Unix()
+	for i := 0; i < n; i++ {
+		data := []byte(fmt.Sprintf(`{"seq":%d}`, i))
+		record := TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: now + int64(i), Codec: "none", ExpiresAt: now + 3600}
+		if err := s.Append(record, data, int64(len(data)), maxSegment); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestSegmentStore_RotateReadCommitReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openSegmentStore(dir)
+	if err != nil {
+		t.Fatalf("openSegmentStore: %v", err)
+	}
+	appendTestRecords(t, s, 50, 512)
+
+	stats := s.Stats()
+	if stats.Records != 50 || stats.Segments < 2 || stats.Pending != 50 {
+		t.Fatalf("unexpected stats after append: %+v", stats)
+	}
+
+	records, next, err := s.ReadPending(30)
+	if err != nil || len(records) != 30 {
+		t.Fatalf("ReadPending: %d records, err %v", len(records), err)
+	}
+	if records[29].JsonData != `{"seq":29}` {
+		t.Fatalf("unexpected record: %q", records[29].JsonData)
+	}
+	if err := s.Commit(next[len(next)-1]); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	s.Close()
+
+	// Simulate a crash mid-append by leaving a torn frame at the end of the last segment
+	last := segmentDataPath(dir, s.segments[len(s.segments)-1].Seq)
+	f, _ := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	f.Close()
+
+	s, err = openSegmentStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	if stats := s.Stats(); stats.Records != 50 || stats.Forwarded != 30 {
+		t.Fatalf("unexpected stats after reopen: %+v", stats)
+	}
+	records, _, err = s.ReadPending(100)
+	if err != nil || len(records) != 20 || records[0].JsonData != `{"seq":30}` {
+		t.Fatalf("ReadPending after reopen: %d records, err %v", len(records), err)
+	}
+
+	// Appends after recovery land after the repaired tail
+	appendTestRecords(t, s, 1, 512)
+	if stats := s.Stats(); stats.Records != 51 {
+		t.Fatalf("unexpected record count after append: %d", stats.Records)
+	}
+}
+
+func TestSegmentStore_CleanupAndDropOldest(t *testing.T) {
+	s, err := openSegmentStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("openSegmentStore: %v", err)
+	}
+	defer s.Close()
+
+	appendTestRecords(t, s, 40, 256)
+	segments := s.Stats().Segments
+
+	freed, dropped, err := s.DropOldest()
+	if err != nil || freed == 0 || dropped == 0 {
+		t.Fatalf("DropOldest: freed %d dropped %d err %v", freed, dropped, err)
+	}
+	if s.Stats().Segments != segments-1 {
+		t.Fatalf("expected one segment removed")
+	}
+
+	removed, err := s.Cleanup(time.Now().Unix() + 7200)
+	if err != nil || removed != 40-dropped {
+		t.Fatalf("Cleanup removed %d, err %v", removed, err)
+	}
+
+	// New records after everything expired must still be readable
+	appendTestRecords(t, s, 3, 256)
+	records, _, err := s.ReadPending(10)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("ReadPending after cleanup: %d records, err %v", len(records), err)
+	}
+}
+
+func TestStoreRecord_FilesModeBypassesSQLite(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := bm.config.Services["goflow2"]
+	cfg.BufferMode = "files"
+	cfg.CompressionMode = "none"
+	bm.config.Services["goflow2"] = cfg
+
+	for i := 0; i < 10; i++ {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: int64(i), JsonData: `{"bytes":1}`}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	var rows int
+	bm.db.QueryRow("SELECT COUNT(*) FROM telemetry_buffer").Scan(&rows)
+	if rows != 0 {
+		t.Fatalf("files mode wrote %d rows to SQLite", rows)
+	}
+	if _, err := os.Stat(segmentDataPath(filepath.Join(bm.dataPath, "buffer", "files", "goflow2"), 1)); err != nil {
+		t.Fatalf("expected segment file on disk: %v", err)
+	}
+
+	stats, err := bm.GetStats("goflow2")
+	if err != nil || stats.TotalRecords != 10 || stats.Pending != 10 {
+		t.Fatalf("GetStats = %+v, err %v", stats, err)
+	}
+
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+	if got := len(capture.payloads()); got != 10 {
+		t.Fatalf("forwarded %d records, want 10", got)
+	}
+	if stats, _ := bm.GetStats("goflow2"); stats.Pending != 0 || stats.Forwarded != 10 {
+		t.Fatalf("GetStats after forward = %+v", stats)
+	}
+}
+
+func TestSegmentDrain_BatchDestinationRetriesOnlyFailedItems(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.config.Retry = RetryCfg{MaxAttempts: 3, BaseDelaySec: 1, MaxDelaySec: 1}
+	cfg := bm.config.Services["fluent-bit"]
+	cfg.BufferMode = "files"
+	bm.config.Services["fluent-bit"] = cfg
+	for i := 0; i < 5; i++ {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", JsonData: fmt.Sprintf(`{"n":%d}`, i)}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	// Item 2 fails once, item 4 is rejected for good
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	useForwarder(bm, batchFuncForwarder{func(r TelemetryRecord) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.JsonData == `{"n":4}`:
+			return fmt.Errorf("%w: mapper_parsing_exception", errRejected)
+		case r.JsonData == `{"n":2}` && sent["failed"] == 0:
+			sent["failed"]++
+			return fmt.Errorf("%w: es_rejected_execution_exception", errItemFailed)
+		}
+		sent[r.JsonData]++
+		return nil
+	}})
+	bm.forwardBufferedRecords()
+
+	tail, err := bm.files.Tail("fluent-bit", 1)
+	if err == nil && len(tail) == 1 {
+		err = bm.decodeRecord(&tail[0])
+	}
+	if err != nil || len(tail) != 1 || tail[0].JsonData != `{"n":2}` || tail[0].RetryCount != 1 || tail[0].NextAttempt == 0 {
+		t.Fatalf("failed item was not requeued: %+v, %v", tail, err)
+	}
+	if dl, err := bm.GetDeadLetter(1); err != nil || dl.JsonData != `{"n":4}` {
+		t.Fatalf("dead letter = %+v, err %v", dl, err)
+	}
+
+	// The requeued item goes out once its backoff has passed
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		bm.forwardBufferedRecords()
+		mu.Lock()
+		done := sent[`{"n":2}`] > 0
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		if n := sent[fmt.Sprintf(`{"n":%d}`, i)]; n != 1 {
+			t.Fatalf("item %d sent %d times", i, n)
+		}
+	}
+	if stats, _ := bm.files.Stats("fluent-bit"); stats.Pending != 0 {
+		t.Fatalf("%d segment records left pending", stats.Pending)
+	}
+}
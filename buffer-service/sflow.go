@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"buffer-service/flow"
+)
+
+// SFlowListenerCfg is collection.sflow from the config-service file. The
+// native decoder only binds when Native is set, since GoFlow2 owns the port
+// by default.
+type SFlowListenerCfg struct {
+	Enabled     bool   `json:"enabled"`
+	Native      bool   `json:"native"` // decode in buffer-service instead of GoFlow2
+	Port        int    `json:"port"`
+	BindAddress string `json:"bindAddress"`
+}
+
+func (c SFlowListenerCfg) active() bool {
+	return c.Enabled && c.Native
+}
+
+// startSFlowListener binds the sFlow port. Flow samples are buffered as
+// sampling-rate-adjusted netflow records and interface counters as
+// sflow_counters records. The caller holds collectors.mu.
+func startSFlowListener(bm *BufferManager, cfg SFlowListenerCfg) (*udpCollector, error) {
+	decoder := bm.flowDecoder(0)
+	host := cfg.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := cfg.Port
+	if port <= 0 {
+		port = 6343
+	}
+	return startUDPCollector(bm, "sflow", []string{net.JoinHostPort(host, strconv.Itoa(port))}, func(packet []byte, remote net.Addr) []byte {
+		now := time.Now()
+		source := remoteIP(remote)
+		dg, err := decoder.DecodeSFlow(source, packet, now)
+		if err != nil {
+			bm.metrics.collectorErrors.add(1, "sflow", "decode")
+			logger.WithError(err).WithField("agent", source).Debug("Failed to decode sFlow datagram")
+		}
+		for _, f := range dg.Flows {
+			bm.storeFlowRecord("sflow", "netflow", f, source, now)
+		}
+		for _, c := range dg.Counters {
+			bm.storeFlowRecord("sflow", flow.TypeSFlowCounters, counterMetric(c), source, now)
+		}
+		return nil
+	})
+}
+
+// counterMetric shapes an interface counter record as a Telegraf metric, so
+// sflow_counters records go out through the metrics destination
+func counterMetric(c flow.InterfaceCounters) telegrafMetric {
+	tags := map[string]interface{}{
+		"agent":    c.Exporter,
+		"if_index": strconv.FormatUint(uint64(c.IfIndex), 10),
+	}
+	if c.SubAgentID != 0 {
+		tags["sub_agent_id"] = strconv.FormatUint(uint64(c.SubAgentID), 10)
+	}
+	return telegrafMetric{
+		Name: "sflow_interface",
+		Tags: tags,
+		Fields: map[string]interface{}{
+			"if_type":            c.IfType,
+			"if_speed":           c.IfSpeed,
+			"if_direction":       c.IfDirection,
+			"if_status":          c.IfStatus,
+			"in_octets":          c.InOctets,
+			"in_ucast_pkts":      c.InUcastPkts,
+			"in_multicast_pkts":  c.InMulticastPkts,
+			"in_broadcast_pkts":  c.InBroadcastPkts,
+			"in_discards":        c.InDiscards,
+			"in_errors":          c.InErrors,
+			"in_unknown_protos":  c.InUnknownProtos,
+			"out_octets":         c.OutOctets,
+			"out_ucast_pkts":     c.OutUcastPkts,
+			"out_multicast_pkts": c.OutMulticastPkts,
+			"out_broadcast_pkts": c.OutBroadcastPkts,
+			"out_discards":       c.OutDiscards,
+			"out_errors":         c.OutErrors,
+			"promiscuous":        c.Promiscuous,
+		},
+	}
+}
@@ -0,0 +1,324 @@
+package snmp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// BER tags used by SNMP (RFC 1157, RFC 3416)
+const (
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagNull        = 0x05
+	tagOID         = 0x06
+	tagSequence    = 0x30
+
+	tagIPAddress  = 0x40
+	tagCounter32  = 0x41
+	tagGauge32    = 0x42
+	tagTimeTicks  = 0x43
+	tagOpaque     = 0x44
+	tagCounter64  = 0x46
+	tagNoSuchObj  = 0x80
+	tagNoSuchInst = 0x81
+	tagEndOfView  = 0x82
+
+	pduResponse = 0xa2
+	pduTrapV1   = 0xa4
+	pduInform   = 0xa6
+	pduTrapV2   = 0xa7
+	pduReport   = 0xa8
+)
+
+// berReader walks a sequence of TLVs. It tracks the offset of each value in
+// the outermost message so USM can locate the authentication parameters.
+type berReader struct {
+	b    []byte
+	pos  int // offset of b[0] in the message
+	last int // offset of the value returned by the latest next
+}
+
+func (r *berReader) empty() bool { return len(r.b) == 0 }
+
+// next reads one TLV
+func (r *berReader) next() (byte, []byte, error) {
+	if len(r.b) < 2 {
+		return 0, nil, ErrMalformed
+	}
+	tag := r.b[0]
+	length := int(r.b[1])
+	off := 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(r.b) < 2+n {
+			return 0, nil, ErrMalformed
+		}
+		length = 0
+		for _, c := range r.b[2 : 2+n] {
+			length = length<<8 | int(c)
+		}
+		off += n
+	}
+	if length < 0 || len(r.b)-off < length {
+		return 0, nil, ErrMalformed
+	}
+	v := r.b[off : off+length : off+length]
+	r.b = r.b[off+length:]
+	r.last = r.pos + off
+	r.pos += off + length
+	return tag, v, nil
+}
+
+// expect reads one TLV that must carry the given tag
+func (r *berReader) expect(tag byte) ([]byte, error) {
+	t, v, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if t != tag {
+		return nil, fmt.Errorf("%w: tag 0x%02x, want 0x%02x", ErrMalformed, t, tag)
+	}
+	return v, nil
+}
+
+func (r *berReader) integer() (int64, error) {
+	v, err := r.expect(tagInteger)
+	if err != nil {
+		return 0, err
+	}
+	return parseInt(v)
+}
+
+func (r *berReader) sequence() (*berReader, error) {
+	v, err := r.expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	return &berReader{b: v, pos: r.last}, nil
+}
+
+func parseInt(b []byte) (int64, error) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, ErrMalformed
+	}
+	v := int64(int8(b[0]))
+	for _, c := range b[1:] {
+		v = v<<8 | int64(c)
+	}
+	return v, nil
+}
+
+// parseUint reads the unsigned application types, which may carry a leading
+// zero octet
+func parseUint(b []byte) (uint64, error) {
+	if len(b) == 0 || len(b) > 9 || (len(b) == 9 && b[0] != 0) {
+		return 0, ErrMalformed
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func parseOID(b []byte) (string, error) {
+	if len(b) == 0 {
+		return "", ErrMalformed
+	}
+	var parts []string
+	var v uint64
+	for i, c := range b {
+		v = v<<7 | uint64(c&0x7f)
+		if c&0x80 != 0 {
+			if i == len(b)-1 || v > 1<<56 {
+				return "", ErrMalformed
+			}
+			continue
+		}
+		if parts == nil {
+			// the first subidentifier packs the first two arcs
+			first := v / 40
+			if first > 2 {
+				first = 2
+			}
+			parts = append(parts, strconv.FormatUint(first, 10), strconv.FormatUint(v-first*40, 10))
+		} else {
+			parts = append(parts, strconv.FormatUint(v, 10))
+		}
+		v = 0
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// Varbind is one decoded variable binding
+type Varbind struct {
+	OID   string      `json:"oid"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// parseVarbinds decodes a VarBindList
+func parseVarbinds(b []byte) ([]Varbind, error) {
+	list := &berReader{b: b}
+	varbinds := []Varbind{}
+	for !list.empty() {
+		vb, err := list.sequence()
+		if err != nil {
+			return nil, err
+		}
+		oidBytes, err := vb.expect(tagOID)
+		if err != nil {
+			return nil, err
+		}
+		oid, err := parseOID(oidBytes)
+		if err != nil {
+			return nil, err
+		}
+		tag, value, err := vb.next()
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeValue(tag, value)
+		if err != nil {
+			return nil, fmt.Errorf("varbind %s: %w", oid, err)
+		}
+		v.OID = oid
+		varbinds = append(varbinds, v)
+	}
+	return varbinds, nil
+}
+
+// decodeValue renders a varbind value as a JSON-friendly type
+func decodeValue(tag byte, b []byte) (Varbind, error) {
+	switch tag {
+	case tagInteger:
+		v, err := parseInt(b)
+		return Varbind{Type: "integer", Value: v}, err
+	case tagOctetString:
+		if printable(b) {
+			return Varbind{Type: "octet_string", Value: string(b)}, nil
+		}
+		return Varbind{Type: "hex_string", Value: hexString(b)}, nil
+	case tagNull:
+		return Varbind{Type: "null"}, nil
+	case tagOID:
+		v, err := parseOID(b)
+		return Varbind{Type: "oid", Value: v}, err
+	case tagIPAddress:
+		if len(b) != net.IPv4len {
+			return Varbind{}, ErrMalformed
+		}
+		return Varbind{Type: "ip_address", Value: net.IP(b).String()}, nil
+	case tagCounter32, tagGauge32, tagTimeTicks, tagCounter64:
+		v, err := parseUint(b)
+		names := map[byte]string{tagCounter32: "counter32", tagGauge32: "gauge32", tagTimeTicks: "timeticks", tagCounter64: "counter64"}
+		return Varbind{Type: names[tag], Value: v}, err
+	case tagOpaque:
+		return Varbind{Type: "opaque", Value: hexString(b)}, nil
+	case tagNoSuchObj:
+		return Varbind{Type: "no_such_object"}, nil
+	case tagNoSuchInst:
+		return Varbind{Type: "no_such_instance"}, nil
+	case tagEndOfView:
+		return Varbind{Type: "end_of_mib_view"}, nil
+	}
+	return Varbind{}, fmt.Errorf("%w: value tag 0x%02x", ErrMalformed, tag)
+}
+
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// hexString renders octets the way net-snmp prints Hex-STRING values
+func hexString(b []byte) string {
+	s := hex.EncodeToString(b)
+	var out strings.Builder
+	for i := 0; i < len(s); i += 2 {
+		if i > 0 {
+			out.WriteByte(':')
+		}
+		out.WriteString(s[i : i+2])
+	}
+	return out.String()
+}
+
+// appendTLV encodes one TLV with a definite length
+func appendTLV(b []byte, tag byte, value []byte) []byte {
+	b = append(b, tag)
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, value...)
+}
+
+// appendInt encodes a signed INTEGER in the fewest octets
+func appendInt(b []byte, v int64) []byte {
+	n := 1
+	for n < 8 && (v>>(8*n-1) != 0 && v>>(8*n-1) != -1) {
+		n++
+	}
+	value := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		value[i] = byte(v)
+		v >>= 8
+	}
+	return appendTLV(b, tagInteger, value)
+}
+
+// appendUint encodes an unsigned application type such as Counter32
+func appendUint(b []byte, tag byte, v uint64) []byte {
+	value := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		value = append([]byte{byte(v)}, value...)
+	}
+	if value[0]&0x80 != 0 {
+		value = append([]byte{0}, value...)
+	}
+	return appendTLV(b, tag, value)
+}
+
+// appendOID encodes a dotted object identifier
+func appendOID(b []byte, oid string) []byte {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	arcs := make([]uint64, len(parts))
+	for i, p := range parts {
+		arcs[i], _ = strconv.ParseUint(p, 10, 64)
+	}
+	var value []byte
+	appendArc := func(v uint64) {
+		var enc []byte
+		enc = append(enc, byte(v&0x7f))
+		for v >>= 7; v > 0; v >>= 7 {
+			enc = append([]byte{byte(v&0x7f) | 0x80}, enc...)
+		}
+		value = append(value, enc...)
+	}
+	if len(arcs) < 2 {
+		arcs = append(arcs, 0)
+	}
+	appendArc(arcs[0]*40 + arcs[1])
+	for _, a := range arcs[2:] {
+		appendArc(a)
+	}
+	return appendTLV(b, tagOID, value)
+}
@@ -0,0 +1,611 @@
+// Package snmp decodes SNMP v1, v2c and v3 (USM) notifications and
+// acknowledges informs.
+package snmp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrMalformed is returned for messages that are not valid BER or SNMP
+	ErrMalformed = errors.New("malformed SNMP message")
+	// ErrUnsupportedVersion is returned for versions other than v1, v2c and v3
+	ErrUnsupportedVersion = errors.New("unsupported SNMP version")
+	// ErrUnsupportedPDU is returned for PDUs other than traps and informs
+	ErrUnsupportedPDU = errors.New("unsupported SNMP PDU type")
+	// ErrUnknownUser is returned for v3 messages from an unconfigured user
+	ErrUnknownUser = errors.New("unknown SNMPv3 user")
+	// ErrUnsupportedSecLevel is returned when a message asks for more security than its user has
+	ErrUnsupportedSecLevel = errors.New("unsupported SNMPv3 security level")
+	// ErrWrongDigest is returned when authentication fails
+	ErrWrongDigest = errors.New("wrong SNMPv3 authentication digest")
+	// ErrDecryption is returned when a scoped PDU cannot be decrypted
+	ErrDecryption = errors.New("SNMPv3 decryption error")
+	// ErrNotInTimeWindow is returned for informs outside this engine's time window
+	ErrNotInTimeWindow = errors.New("SNMPv3 message not in time window")
+	// ErrUnknownEngineID is returned for informs addressed to another engine
+	ErrUnknownEngineID = errors.New("SNMPv3 unknown engine ID")
+)
+
+// msgFlags bits
+const (
+	flagAuth       = 0x01
+	flagPriv       = 0x02
+	flagReportable = 0x04
+)
+
+// Well-known OIDs
+const (
+	oidSysUpTime        = "1.3.6.1.2.1.1.3.0"
+	oidSnmpTrapOID      = "1.3.6.1.6.3.1.1.4.1.0"
+	oidStandardTraps    = "1.3.6.1.6.3.1.1.5"
+	oidNotInTimeWindows = "1.3.6.1.6.3.15.1.1.2.0"
+	oidUnknownEngineIDs = "1.3.6.1.6.3.15.1.1.4.0"
+)
+
+// timeWindow is the USM timeliness window in seconds
+const timeWindow = 150
+
+// maxLocalizedKeys bounds the key cache; every trap-sending engine needs its own keys
+const maxLocalizedKeys = 4096
+
+// Notification is one decoded trap or inform
+type Notification struct {
+	Source        string    `json:"source"`
+	Version       string    `json:"version"`  // "v1", "v2c" or "v3"
+	PDUType       string    `json:"pdu_type"` // "trap" or "inform"
+	RequestID     int64     `json:"request_id,omitempty"`
+	SecurityName  string    `json:"security_name,omitempty"`  // v3 user
+	SecurityLevel string    `json:"security_level,omitempty"` // noAuthNoPriv, authNoPriv or authPriv
+	EngineID      string    `json:"engine_id,omitempty"`      // hex authoritative engine ID
+	ContextName   string    `json:"context_name,omitempty"`
+	Enterprise    string    `json:"enterprise,omitempty"` // v1 only
+	AgentAddress  string    `json:"agent_address,omitempty"`
+	GenericTrap   int64     `json:"generic_trap,omitempty"`
+	SpecificTrap  int64     `json:"specific_trap,omitempty"`
+	Uptime        uint64    `json:"uptime"` // hundredths of a second
+	TrapOID       string    `json:"trap_oid"`
+	Varbinds      []Varbind `json:"varbinds"`
+}
+
+// Engine identifies this receiver as an authoritative SNMPv3 engine. Inform
+// senders discover its ID, boots and time before sending.
+type Engine struct {
+	ID    []byte
+	Boots int64
+	Start time.Time // engine time counts from here
+}
+
+// NewEngineID returns an RFC 3411 engine ID with random octets, in the
+// format net-snmp generates
+func NewEngineID() []byte {
+	id := []byte{0x80, 0x00, 0x1f, 0x88, 0x05}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return append(id, random...)
+}
+
+func (e Engine) time(now time.Time) int64 {
+	return int64(now.Sub(e.Start) / time.Second)
+}
+
+// Receiver decodes notifications and builds the responses informs expect
+type Receiver struct {
+	engine Engine
+	users  map[string]*usmUser
+
+	mu   sync.Mutex
+	keys map[string]*localKeys // user name + engine ID
+	salt uint64
+
+	notInTimeWindows, unknownEngineIDs uint32 // usmStats counters sent in reports
+}
+
+// NewReceiver returns a receiver for engine that accepts v3 messages from users
+func NewReceiver(engine Engine, users ...User) (*Receiver, error) {
+	r := &Receiver{engine: engine, users: make(map[string]*usmUser), keys: make(map[string]*localKeys)}
+	for _, u := range users {
+		if u.Name == "" {
+			continue
+		}
+		uu, err := newUSMUser(u)
+		if err != nil {
+			return nil, err
+		}
+		r.users[u.Name] = uu
+	}
+	var salt [8]byte
+	rand.Read(salt[:])
+	r.salt = binary.BigEndian.Uint64(salt[:])
+	return r, nil
+}
+
+// Handle decodes one datagram from source. It returns the notification, if
+// any, and a datagram to send back: the response to an inform or a USM report.
+// A response may accompany an error.
+func (r *Receiver) Handle(source string, b []byte, now time.Time) (*Notification, []byte, error) {
+	msg := &berReader{b: b}
+	body, err := msg.sequence()
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := body.integer()
+	if err != nil {
+		return nil, nil, err
+	}
+	var n *Notification
+	var resp []byte
+	switch version {
+	case 0, 1:
+		n, resp, err = handleCommunity(version, body)
+	case 3:
+		n, resp, err = r.handleV3(b, body, now)
+	default:
+		return nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	if n != nil {
+		n.Source = source
+	}
+	return n, resp, err
+}
+
+// pdu is a v2 trap, inform or response PDU
+type pdu struct {
+	tag       byte
+	requestID int64
+	varbinds  []byte // VarBindList contents, echoed in inform responses
+}
+
+func parsePDU(tag byte, b []byte) (pdu, error) {
+	p := pdu{tag: tag}
+	r := &berReader{b: b}
+	var err error
+	if p.requestID, err = r.integer(); err != nil {
+		return p, err
+	}
+	if _, err = r.integer(); err != nil { // error-status
+		return p, err
+	}
+	if _, err = r.integer(); err != nil { // error-index
+		return p, err
+	}
+	p.varbinds, err = r.expect(tagSequence)
+	return p, err
+}
+
+func (p pdu) encode(tag byte) []byte {
+	body := appendInt(nil, p.requestID)
+	body = appendInt(body, 0)
+	body = appendInt(body, 0)
+	body = appendTLV(body, tagSequence, p.varbinds)
+	return appendTLV(nil, tag, body)
+}
+
+// notification decodes a v2 trap or inform PDU
+func (p pdu) notification(version string) (*Notification, error) {
+	varbinds, err := parseVarbinds(p.varbinds)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notification{Version: version, PDUType: "trap", RequestID: p.requestID, Varbinds: varbinds}
+	if p.tag == pduInform {
+		n.PDUType = "inform"
+	}
+	for _, vb := range varbinds {
+		switch vb.OID {
+		case oidSysUpTime:
+			n.Uptime, _ = vb.Value.(uint64)
+		case oidSnmpTrapOID:
+			n.TrapOID, _ = vb.Value.(string)
+		}
+	}
+	return n, nil
+}
+
+// handleCommunity decodes v1 and v2c messages. Communities are not checked
+// or kept; the upstream only needs the notification.
+func handleCommunity(version int64, body *berReader) (*Notification, []byte, error) {
+	community, err := body.expect(tagOctetString)
+	if err != nil {
+		return nil, nil, err
+	}
+	tag, data, err := body.next()
+	if err != nil {
+		return nil, nil, err
+	}
+	if version == 0 {
+		if tag != pduTrapV1 {
+			return nil, nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedPDU, tag)
+		}
+		n, err := parseTrapV1(data)
+		return n, nil, err
+	}
+
+	if tag != pduTrapV2 && tag != pduInform {
+		return nil, nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedPDU, tag)
+	}
+	p, err := parsePDU(tag, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := p.notification("v2c")
+	if err != nil || tag != pduInform {
+		return n, nil, err
+	}
+	resp := appendInt(nil, version)
+	resp = appendTLV(resp, tagOctetString, community)
+	resp = append(resp, p.encode(pduResponse)...)
+	return n, appendTLV(nil, tagSequence, resp), nil
+}
+
+// parseTrapV1 decodes a Trap-PDU and derives the v2 snmpTrapOID (RFC 3584)
+func parseTrapV1(b []byte) (*Notification, error) {
+	r := &berReader{b: b}
+	enterpriseBytes, err := r.expect(tagOID)
+	if err != nil {
+		return nil, err
+	}
+	n := &Notification{Version: "v1", PDUType: "trap"}
+	if n.Enterprise, err = parseOID(enterpriseBytes); err != nil {
+		return nil, err
+	}
+	addr, err := r.expect(tagIPAddress)
+	if err != nil {
+		return nil, err
+	}
+	if a, err := decodeValue(tagIPAddress, addr); err == nil {
+		n.AgentAddress, _ = a.Value.(string)
+	}
+	if n.GenericTrap, err = r.integer(); err != nil {
+		return nil, err
+	}
+	if n.SpecificTrap, err = r.integer(); err != nil {
+		return nil, err
+	}
+	ticks, err := r.expect(tagTimeTicks)
+	if err != nil {
+		return nil, err
+	}
+	if n.Uptime, err = parseUint(ticks); err != nil {
+		return nil, err
+	}
+	list, err := r.expect(tagSequence)
+	if err != nil {
+		return nil, err
+	}
+	if n.Varbinds, err = parseVarbinds(list); err != nil {
+		return nil, err
+	}
+	if n.GenericTrap >= 0 && n.GenericTrap < 6 {
+		n.TrapOID = fmt.Sprintf("%s.%d", oidStandardTraps, n.GenericTrap+1)
+	} else {
+		n.TrapOID = fmt.Sprintf("%s.0.%d", n.Enterprise, n.SpecificTrap)
+	}
+	return n, nil
+}
+
+// v3Header is the cleartext part of an SNMPv3 message
+type v3Header struct {
+	msgID      int64
+	flags      byte
+	engineID   []byte
+	boots      int64
+	engineTime int64
+	user       []byte
+	authParams []byte
+	authOffset int // of authParams within the message
+	privParams []byte
+	dataTag    byte
+	data       []byte // scoped PDU, or its ciphertext
+}
+
+func parseV3Header(body *berReader) (*v3Header, error) {
+	h := &v3Header{}
+	global, err := body.sequence()
+	if err != nil {
+		return nil, err
+	}
+	if h.msgID, err = global.integer(); err != nil {
+		return nil, err
+	}
+	if _, err = global.integer(); err != nil { // msgMaxSize
+		return nil, err
+	}
+	flags, err := global.expect(tagOctetString)
+	if err != nil || len(flags) != 1 {
+		return nil, ErrMalformed
+	}
+	h.flags = flags[0]
+	if model, err := global.integer(); err != nil || model != 3 {
+		return nil, fmt.Errorf("%w: security model is not USM", ErrMalformed)
+	}
+	if h.flags&(flagAuth|flagPriv) == flagPriv {
+		return nil, fmt.Errorf("%w: privacy without authentication", ErrMalformed)
+	}
+
+	params, err := body.expect(tagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	sp, err := (&berReader{b: params, pos: body.last}).sequence()
+	if err != nil {
+		return nil, err
+	}
+	if h.engineID, err = sp.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	if h.boots, err = sp.integer(); err != nil {
+		return nil, err
+	}
+	if h.engineTime, err = sp.integer(); err != nil {
+		return nil, err
+	}
+	if h.user, err = sp.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	if h.authParams, err = sp.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	h.authOffset = sp.last
+	if h.privParams, err = sp.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	h.dataTag, h.data, err = body.next()
+	return h, err
+}
+
+// scopedPDU is the context and PDU of a v3 message
+type scopedPDU struct {
+	contextEngineID []byte
+	contextName     []byte
+	pdu             pdu
+}
+
+// parseScopedPDU reads a ScopedPDU. Trailing bytes are DES padding.
+func parseScopedPDU(b []byte) (*scopedPDU, error) {
+	r, err := (&berReader{b: b}).sequence()
+	if err != nil {
+		return nil, ErrDecryption
+	}
+	s := &scopedPDU{}
+	if s.contextEngineID, err = r.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	if s.contextName, err = r.expect(tagOctetString); err != nil {
+		return nil, err
+	}
+	tag, data, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if tag != pduTrapV2 && tag != pduInform {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrUnsupportedPDU, tag)
+	}
+	s.pdu, err = parsePDU(tag, data)
+	return s, err
+}
+
+func (s *scopedPDU) encode(p []byte) []byte {
+	body := appendTLV(nil, tagOctetString, s.contextEngineID)
+	body = appendTLV(body, tagOctetString, s.contextName)
+	return appendTLV(nil, tagSequence, append(body, p...))
+}
+
+func (r *Receiver) handleV3(raw []byte, body *berReader, now time.Time) (*Notification, []byte, error) {
+	h, err := parseV3Header(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	reportable := h.flags&flagReportable != 0
+
+	// Discovery: an inform sender asks for our engine ID with an empty one
+	if len(h.engineID) == 0 {
+		if h.flags&flagAuth != 0 || h.dataTag != tagSequence {
+			return nil, nil, ErrUnknownEngineID
+		}
+		var requestID int64
+		if s, err := parseScopedPDUHeader(h.data); err == nil {
+			requestID = s
+		}
+		if !reportable {
+			return nil, nil, nil
+		}
+		return nil, r.report(h.msgID, requestID, nil, oidUnknownEngineIDs, &r.unknownEngineIDs, now), nil
+	}
+
+	u, ok := r.users[string(h.user)]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownUser, h.user)
+	}
+	level := h.flags & (flagAuth | flagPriv)
+	if level != u.level() {
+		return nil, nil, ErrUnsupportedSecLevel
+	}
+	keys := r.localKeys(u, h.engineID)
+	if level&flagAuth != 0 && !keys.verify(raw, h.authOffset, h.authParams) {
+		return nil, nil, ErrWrongDigest
+	}
+
+	var scoped []byte
+	switch {
+	case level&flagPriv != 0:
+		if h.dataTag != tagOctetString {
+			return nil, nil, ErrDecryption
+		}
+		if scoped, err = keys.decrypt(h.data, h.privParams, h.boots, h.engineTime); err != nil {
+			return nil, nil, err
+		}
+	case h.dataTag == tagSequence:
+		scoped = appendTLV(nil, tagSequence, h.data)
+	default:
+		return nil, nil, ErrMalformed
+	}
+	s, err := parseScopedPDU(scoped)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n, err := s.pdu.notification("v3")
+	if err != nil {
+		return nil, nil, err
+	}
+	n.SecurityName = u.name
+	n.SecurityLevel = levelName(level)
+	n.EngineID = hex.EncodeToString(h.engineID)
+	n.ContextName = string(s.contextName)
+	if s.pdu.tag != pduInform {
+		// traps are sent by their own authoritative engine; nothing to check
+		return n, nil, nil
+	}
+
+	// Informs are authoritative on our side: they must use our engine and be timely
+	if !bytes.Equal(h.engineID, r.engine.ID) {
+		var resp []byte
+		if reportable {
+			resp = r.report(h.msgID, s.pdu.requestID, nil, oidUnknownEngineIDs, &r.unknownEngineIDs, now)
+		}
+		return nil, resp, ErrUnknownEngineID
+	}
+	if level&flagAuth != 0 {
+		t := r.engine.time(now)
+		if h.boots != r.engine.Boots || h.engineTime < t-timeWindow || h.engineTime > t+timeWindow {
+			var resp []byte
+			if reportable {
+				resp = r.report(h.msgID, s.pdu.requestID, keys, oidNotInTimeWindows, &r.notInTimeWindows, now)
+			}
+			return nil, resp, ErrNotInTimeWindow
+		}
+	}
+
+	resp, err := r.encodeV3(h.msgID, level, keys, s.encode(s.pdu.encode(pduResponse)), now)
+	return n, resp, err
+}
+
+// parseScopedPDUHeader returns the request ID of a cleartext scoped PDU
+// without decoding its varbinds
+func parseScopedPDUHeader(b []byte) (int64, error) {
+	r := &berReader{b: b}
+	if _, err := r.expect(tagOctetString); err != nil {
+		return 0, err
+	}
+	if _, err := r.expect(tagOctetString); err != nil {
+		return 0, err
+	}
+	_, data, err := r.next()
+	if err != nil {
+		return 0, err
+	}
+	return (&berReader{b: data}).integer()
+}
+
+func levelName(level byte) string {
+	switch level {
+	case flagAuth | flagPriv:
+		return "authPriv"
+	case flagAuth:
+		return "authNoPriv"
+	}
+	return "noAuthNoPriv"
+}
+
+// localKeys returns u's keys for engineID, localizing them on first use
+func (r *Receiver) localKeys(u *usmUser, engineID []byte) *localKeys {
+	id := u.name + "\x00" + string(engineID)
+	r.mu.Lock()
+	k, ok := r.keys[id]
+	r.mu.Unlock()
+	if ok {
+		return k
+	}
+	k = u.localize(engineID)
+	r.mu.Lock()
+	if len(r.keys) >= maxLocalizedKeys {
+		r.keys = make(map[string]*localKeys)
+	}
+	r.keys[id] = k
+	r.mu.Unlock()
+	return k
+}
+
+// report builds a USM Report PDU carrying one usmStats counter. Reports about
+// time windows are authenticated so the sender can trust our boots and time.
+func (r *Receiver) report(msgID, requestID int64, keys *localKeys, oid string, counter *uint32, now time.Time) []byte {
+	r.mu.Lock()
+	*counter++
+	count := *counter
+	r.mu.Unlock()
+
+	vb := appendOID(nil, oid)
+	vb = appendUint(vb, tagCounter32, uint64(count))
+	p := pdu{requestID: requestID, varbinds: appendTLV(nil, tagSequence, vb)}
+	s := &scopedPDU{contextEngineID: r.engine.ID}
+	var level byte
+	if keys != nil {
+		level = flagAuth
+	}
+	resp, _ := r.encodeV3(msgID, level, keys, s.encode(p.encode(pduReport)), now)
+	return resp
+}
+
+// encodeV3 builds an SNMPv3 message from this engine, authenticating and
+// encrypting it as flags ask
+func (r *Receiver) encodeV3(msgID int64, flags byte, keys *localKeys, scoped []byte, now time.Time) ([]byte, error) {
+	boots, engineTime := r.engine.Boots, r.engine.time(now)
+	data := scoped
+	var authParams, privParams []byte
+	var user []byte
+	if keys != nil {
+		user = []byte(keys.user.name)
+		if flags&flagAuth != 0 {
+			authParams = make([]byte, keys.user.auth.macLen)
+		}
+		if flags&flagPriv != 0 {
+			r.mu.Lock()
+			r.salt++
+			salt := r.salt
+			r.mu.Unlock()
+			encrypted, params, err := keys.encrypt(scoped, salt, boots, engineTime)
+			if err != nil {
+				return nil, err
+			}
+			data = appendTLV(nil, tagOctetString, encrypted)
+			privParams = params
+		}
+	}
+
+	sp := appendTLV(nil, tagOctetString, r.engine.ID)
+	sp = appendInt(sp, boots)
+	sp = appendInt(sp, engineTime)
+	sp = appendTLV(sp, tagOctetString, user)
+	sp = appendTLV(sp, tagOctetString, authParams)
+	sp = appendTLV(sp, tagOctetString, privParams)
+
+	global := appendInt(nil, msgID)
+	global = appendInt(global, 65507)
+	global = appendTLV(global, tagOctetString, []byte{flags})
+	global = appendInt(global, 3)
+
+	body := appendInt(nil, 3)
+	body = appendTLV(body, tagSequence, global)
+	body = appendTLV(body, tagOctetString, appendTLV(nil, tagSequence, sp))
+	body = append(body, data...)
+	msg := appendTLV(nil, tagSequence, body)
+
+	if flags&flagAuth != 0 {
+		outer, _ := (&berReader{b: msg}).sequence()
+		outer.integer()
+		h, err := parseV3Header(outer)
+		if err != nil {
+			return nil, err
+		}
+		copy(msg[h.authOffset:], keys.mac(msg))
+	}
+	return msg, nil
+}
@@ -0,0 +1,228 @@
+package snmp
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPasswordToKey_RFC3414Vectors(t *testing.T) {
+	engineID, _ := hex.DecodeString("000000000000000000000002")
+	for _, tc := range []struct {
+		protocol, want string
+	}{
+		{"MD5", "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		auth, _ := lookupAuth(tc.protocol)
+		if got := hex.EncodeToString(passwordToKey(auth.hash, "maplesyrup", engineID)); got != tc.want {
+			t.Errorf("%s key = %s, want %s", tc.protocol, got, tc.want)
+		}
+	}
+}
+
+// varbindList encodes sysUpTime, snmpTrapOID and any extra bindings
+func varbindList(uptime uint64, trapOID string, extra ...[]byte) []byte {
+	vb := func(oid string, value []byte) []byte {
+		return appendTLV(nil, tagSequence, append(appendOID(nil, oid), value...))
+	}
+	list := vb(oidSysUpTime, appendUint(nil, tagTimeTicks, uptime))
+	list = append(list, vb(oidSnmpTrapOID, appendOID(nil, trapOID))...)
+	for i := 0; i+1 < len(extra); i += 2 {
+		list = append(list, vb(string(extra[i]), extra[i+1])...)
+	}
+	return list
+}
+
+func TestHandle_V1TrapTranslatesTrapOID(t *testing.T) {
+	ifIndex := appendTLV(nil, tagSequence, append(appendOID(nil, "1.3.6.1.2.1.2.2.1.1.3"), appendInt(nil, 3)...))
+	mac := appendTLV(nil, tagSequence, append(appendOID(nil, "1.3.6.1.2.1.2.2.1.6.3"), appendTLV(nil, tagOctetString, []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55})...))
+	trap := appendOID(nil, "1.3.6.1.4.1.9.1.1")
+	trap = appendTLV(trap, tagIPAddress, []byte{192, 0, 2, 10})
+	trap = appendInt(trap, 2) // linkDown
+	trap = appendInt(trap, 0)
+	trap = appendUint(trap, tagTimeTicks, 123456)
+	trap = appendTLV(trap, tagSequence, append(ifIndex, mac...))
+	body := appendInt(nil, 0)
+	body = appendTLV(body, tagOctetString, []byte("public"))
+	msg := appendTLV(nil, tagSequence, appendTLV(body, pduTrapV1, trap))
+
+	r, _ := NewReceiver(Engine{ID: NewEngineID(), Start: time.Now()})
+	n, resp, err := r.Handle("198.51.100.7", msg, time.Now())
+	if err != nil || resp != nil {
+		t.Fatalf("Handle: %v (response %x)", err, resp)
+	}
+	if n.Version != "v1" || n.TrapOID != "1.3.6.1.6.3.1.1.5.3" || n.Enterprise != "1.3.6.1.4.1.9.1.1" ||
+		n.AgentAddress != "192.0.2.10" || n.Uptime != 123456 || n.Source != "198.51.100.7" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+	if len(n.Varbinds) != 2 || n.Varbinds[0].Value != int64(3) || n.Varbinds[1].Type != "hex_string" || n.Varbinds[1].Value != "00:11:22:33:44:55" {
+		t.Fatalf("unexpected varbinds: %+v", n.Varbinds)
+	}
+}
+
+func TestHandle_V2cInformIsAcknowledged(t *testing.T) {
+	extra := [][]byte{[]byte("1.3.6.1.2.1.1.5.0"), appendTLV(nil, tagOctetString, []byte("core-sw1"))}
+	p := pdu{requestID: 4242, varbinds: varbindList(500, "1.3.6.1.6.3.1.1.5.1", extra...)}
+	body := appendInt(nil, 1)
+	body = appendTLV(body, tagOctetString, []byte("n0crav3n"))
+	msg := appendTLV(nil, tagSequence, append(body, p.encode(pduInform)...))
+
+	r, _ := NewReceiver(Engine{ID: NewEngineID(), Start: time.Now()})
+	n, resp, err := r.Handle("198.51.100.7", msg, time.Now())
+	if err != nil {
+		t.Fatalf("Handle: %v", err)
+	}
+	if n.Version != "v2c" || n.PDUType != "inform" || n.TrapOID != "1.3.6.1.6.3.1.1.5.1" || n.Uptime != 500 || n.Varbinds[2].Value != "core-sw1" {
+		t.Fatalf("unexpected notification: %+v", n)
+	}
+
+	outer, err := (&berReader{b: resp}).sequence()
+	if err != nil {
+		t.Fatalf("response: %v", err)
+	}
+	version, _ := outer.integer()
+	community, _ := outer.expect(tagOctetString)
+	tag, data, _ := outer.next()
+	got, err := parsePDU(tag, data)
+	if err != nil || version != 1 || string(community) != "n0crav3n" || tag != pduResponse || got.requestID != 4242 || string(got.varbinds) != string(p.varbinds) {
+		t.Fatalf("unexpected response: version %d community %q tag 0x%x pdu %+v err %v", version, community, tag, got, err)
+	}
+}
+
+// v3Sender builds messages the way an agent does, reusing the receiver's
+// encoder with the sender's notion of the authoritative engine
+func v3Sender(t *testing.T, authoritative Engine, user User) (*Receiver, *localKeys) {
+	t.Helper()
+	s, err := NewReceiver(authoritative, user)
+	if err != nil {
+		t.Fatalf("NewReceiver: %v", err)
+	}
+	return s, s.localKeys(s.users[user.Name], authoritative.ID)
+}
+
+func TestHandle_V3TrapsAuthenticateAndDecrypt(t *testing.T) {
+	now := time.Now()
+	agent := Engine{ID: []byte{0x80, 0, 0, 9, 3, 1, 2, 3, 4, 5, 6}, Boots: 7, Start: now.Add(-time.Hour)}
+	for _, user := range []User{
+		{Name: "noc", AuthProtocol: "SHA", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"},
+		{Name: "noc", AuthProtocol: "MD5", AuthPassword: "authpass1", PrivProtocol: "DES", PrivPassword: "privpass1"},
+		{Name: "noc", AuthProtocol: "SHA-256", AuthPassword: "authpass1"},
+	} {
+		sender, keys := v3Sender(t, agent, user)
+		flags := keys.user.level()
+		p := pdu{requestID: 99, varbinds: varbindList(777, "1.3.6.1.4.1.8072.2.3.0.1")}
+		scoped := (&scopedPDU{contextEngineID: agent.ID}).encode(p.encode(pduTrapV2))
+		msg, err := sender.encodeV3(1, flags, keys, scoped, now)
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+
+		r, _ := NewReceiver(Engine{ID: NewEngineID(), Start: now}, user)
+		n, resp, err := r.Handle("192.0.2.1", msg, now)
+		if err != nil || resp != nil {
+			t.Fatalf("%s/%s: Handle: %v", user.AuthProtocol, user.PrivProtocol, err)
+		}
+		if n.Version != "v3" || n.SecurityName != "noc" || n.SecurityLevel != levelName(flags) ||
+			n.TrapOID != "1.3.6.1.4.1.8072.2.3.0.1" || n.EngineID != hex.EncodeToString(agent.ID) {
+			t.Fatalf("unexpected notification: %+v", n)
+		}
+
+		tampered := append([]byte(nil), msg...)
+		tampered[len(tampered)-1] ^= 0xff
+		if _, _, err := r.Handle("192.0.2.1", tampered, now); !errors.Is(err, ErrWrongDigest) {
+			t.Fatalf("tampered message: %v", err)
+		}
+		// A message below the user's level must not skip authentication
+		for _, lower := range []byte{0, flagAuth} {
+			if lower == flags {
+				break
+			}
+			downgraded, err := sender.encodeV3(2, lower, keys, scoped, now)
+			if err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+			if _, _, err := r.Handle("192.0.2.1", downgraded, now); !errors.Is(err, ErrUnsupportedSecLevel) {
+				t.Fatalf("%s/%s: message at level %d: %v", user.AuthProtocol, user.PrivProtocol, lower, err)
+			}
+		}
+		wrong := user
+		wrong.AuthPassword = "otherpass"
+		r2, _ := NewReceiver(Engine{ID: NewEngineID(), Start: now}, wrong)
+		if _, _, err := r2.Handle("192.0.2.1", msg, now); !errors.Is(err, ErrWrongDigest) {
+			t.Fatalf("wrong password: %v", err)
+		}
+	}
+
+	r, _ := NewReceiver(Engine{ID: NewEngineID(), Start: now})
+	sender, keys := v3Sender(t, agent, User{Name: "noc", AuthProtocol: "SHA", AuthPassword: "authpass1"})
+	msg, _ := sender.encodeV3(1, flagAuth, keys, (&scopedPDU{}).encode(pdu{varbinds: varbindList(1, "1.3.6.1.6.3.1.1.5.1")}.encode(pduTrapV2)), now)
+	if _, _, err := r.Handle("192.0.2.1", msg, now); !errors.Is(err, ErrUnknownUser) {
+		t.Fatalf("unknown user: %v", err)
+	}
+}
+
+func TestHandle_V3InformDiscoveryAndResponse(t *testing.T) {
+	now := time.Now()
+	local := Engine{ID: NewEngineID(), Boots: 3, Start: now.Add(-10 * time.Minute)}
+	user := User{Name: "noc", AuthProtocol: "SHA", AuthPassword: "authpass1", PrivProtocol: "AES", PrivPassword: "privpass1"}
+	r, err := NewReceiver(local, user)
+	if err != nil {
+		t.Fatalf("NewReceiver: %v", err)
+	}
+
+	// Discovery probe: no engine ID, no user, reportable
+	probe, _ := NewReceiver(Engine{Start: now})
+	msg, _ := probe.encodeV3(10, flagReportable, nil, (&scopedPDU{}).encode(pdu{requestID: 1, varbinds: nil}.encode(0xa0)), now)
+	n, report, err := r.Handle("192.0.2.1", msg, now)
+	if err != nil || n != nil || report == nil {
+		t.Fatalf("discovery: n=%v report=%x err=%v", n, report, err)
+	}
+	outer, _ := (&berReader{b: report}).sequence()
+	outer.integer()
+	h, err := parseV3Header(outer)
+	if err != nil || h.msgID != 10 || string(h.engineID) != string(local.ID) || h.boots != 3 || h.engineTime != 600 {
+		t.Fatalf("unexpected report header %+v: %v", h, err)
+	}
+
+	// Inform using the discovered engine
+	sender, keys := v3Sender(t, Engine{ID: h.engineID, Boots: h.boots, Start: now.Add(-time.Duration(h.engineTime) * time.Second)}, user)
+	p := pdu{requestID: 55, varbinds: varbindList(9, "1.3.6.1.6.3.1.1.5.4")}
+	scoped := (&scopedPDU{contextEngineID: local.ID}).encode(p.encode(pduInform))
+	msg, _ = sender.encodeV3(11, flagAuth|flagPriv|flagReportable, keys, scoped, now)
+	n, resp, err := r.Handle("192.0.2.1", msg, now)
+	if err != nil || n == nil || n.PDUType != "inform" || n.RequestID != 55 {
+		t.Fatalf("inform: n=%+v err=%v", n, err)
+	}
+	outer, _ = (&berReader{b: resp}).sequence()
+	outer.integer()
+	h, err = parseV3Header(outer)
+	if err != nil || h.msgID != 11 || h.flags != flagAuth|flagPriv || !keys.verify(resp, h.authOffset, h.authParams) {
+		t.Fatalf("response does not authenticate: %+v %v", h, err)
+	}
+	plain, err := keys.decrypt(h.data, h.privParams, h.boots, h.engineTime)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	sp, _ := (&berReader{b: plain}).sequence()
+	sp.expect(tagOctetString)
+	sp.expect(tagOctetString)
+	tag, data, _ := sp.next()
+	if got, err := parsePDU(tag, data); err != nil || tag != pduResponse || got.requestID != 55 {
+		t.Fatalf("unexpected response PDU 0x%x %+v: %v", tag, got, err)
+	}
+
+	// A stale inform gets an authenticated notInTimeWindow report
+	stale, _ := v3Sender(t, Engine{ID: local.ID, Boots: 2, Start: local.Start}, user)
+	msg, _ = stale.encodeV3(12, flagAuth|flagPriv|flagReportable, keys, scoped, now)
+	n, report, err = r.Handle("192.0.2.1", msg, now)
+	if !errors.Is(err, ErrNotInTimeWindow) || n != nil || report == nil {
+		t.Fatalf("stale inform: n=%v err=%v", n, err)
+	}
+	outer, _ = (&berReader{b: report}).sequence()
+	outer.integer()
+	if h, err = parseV3Header(outer); err != nil || h.boots != 3 || h.flags != flagAuth || !keys.verify(report, h.authOffset, h.authParams) {
+		t.Fatalf("unexpected time window report %+v: %v", h, err)
+	}
+}
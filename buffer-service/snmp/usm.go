@@ -0,0 +1,259 @@
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// User is an SNMPv3 USM user. Protocol names follow net-snmp: MD5, SHA,
+// SHA-224, SHA-256, SHA-384 or SHA-512 for authentication and DES or AES
+// (128-bit CFB) for privacy. Empty protocols disable that level.
+type User struct {
+	Name         string
+	AuthProtocol string
+	AuthPassword string
+	PrivProtocol string
+	PrivPassword string
+}
+
+// authProtocol is an HMAC authentication protocol (RFC 3414, RFC 7860)
+type authProtocol struct {
+	hash   func() hash.Hash
+	macLen int // truncated length of msgAuthenticationParameters
+}
+
+var authProtocols = map[string]*authProtocol{
+	"MD5":    {md5.New, 12},
+	"SHA":    {sha1.New, 12},
+	"SHA1":   {sha1.New, 12},
+	"SHA224": {sha256.New224, 16},
+	"SHA256": {sha256.New, 24},
+	"SHA384": {sha512.New384, 32},
+	"SHA512": {sha512.New, 48},
+}
+
+type privProtocol int
+
+const (
+	privNone privProtocol = iota
+	privDES
+	privAES
+)
+
+// protocolName normalizes "sha-256", "SHA_256" and "HMAC-SHA-256" to "SHA256"
+func protocolName(name string) string {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	name = strings.TrimPrefix(name, "HMAC")
+	return strings.NewReplacer("-", "", "_", "").Replace(name)
+}
+
+func lookupAuth(name string) (*authProtocol, error) {
+	switch n := protocolName(name); n {
+	case "", "NONE":
+		return nil, nil
+	default:
+		if p, ok := authProtocols[n]; ok {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported SNMPv3 auth protocol %q", name)
+}
+
+func lookupPriv(name string) (privProtocol, error) {
+	switch protocolName(name) {
+	case "", "NONE":
+		return privNone, nil
+	case "DES", "CBCDES":
+		return privDES, nil
+	case "AES", "AES128", "CFBAES128":
+		return privAES, nil
+	}
+	return privNone, fmt.Errorf("unsupported SNMPv3 privacy protocol %q", name)
+}
+
+// usmUser is a validated User
+type usmUser struct {
+	name string
+	auth *authProtocol
+	priv privProtocol
+	user User
+}
+
+func newUSMUser(u User) (*usmUser, error) {
+	auth, err := lookupAuth(u.AuthProtocol)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := lookupPriv(u.PrivProtocol)
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil && u.AuthPassword == "" {
+		// an auth protocol without a password is how the UI leaves v3 unconfigured
+		auth = nil
+	}
+	if auth == nil || u.PrivPassword == "" {
+		priv = privNone
+	}
+	if auth != nil && len(u.AuthPassword) < 8 {
+		return nil, fmt.Errorf("SNMPv3 auth password for %q is shorter than 8 characters", u.Name)
+	}
+	if priv != privNone && len(u.PrivPassword) < 8 {
+		return nil, fmt.Errorf("SNMPv3 privacy password for %q is shorter than 8 characters", u.Name)
+	}
+	return &usmUser{name: u.Name, auth: auth, priv: priv, user: u}, nil
+}
+
+// level returns the highest msgFlags security bits the user supports
+func (u *usmUser) level() byte {
+	switch {
+	case u.priv != privNone:
+		return flagAuth | flagPriv
+	case u.auth != nil:
+		return flagAuth
+	}
+	return 0
+}
+
+// localKeys are a user's keys localized to one authoritative engine
+type localKeys struct {
+	user    *usmUser
+	authKey []byte
+	privKey []byte
+}
+
+// localize derives the user's keys for engineID (RFC 3414 A.2)
+func (u *usmUser) localize(engineID []byte) *localKeys {
+	k := &localKeys{user: u}
+	if u.auth == nil {
+		return k
+	}
+	k.authKey = passwordToKey(u.auth.hash, u.user.AuthPassword, engineID)
+	if u.priv != privNone {
+		k.privKey = passwordToKey(u.auth.hash, u.user.PrivPassword, engineID)
+	}
+	return k
+}
+
+// passwordToKey hashes a megabyte of the repeated password, then localizes
+// the result to the engine
+func passwordToKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	h := newHash()
+	pw := []byte(password)
+	buf := make([]byte, 64)
+	for i, n := 0, 0; n < 1<<20; n += len(buf) {
+		for j := range buf {
+			buf[j] = pw[i%len(pw)]
+			i++
+		}
+		h.Write(buf)
+	}
+	ku := h.Sum(nil)
+	h.Reset()
+	h.Write(ku)
+	h.Write(engineID)
+	h.Write(ku)
+	return h.Sum(nil)
+}
+
+// mac computes msgAuthenticationParameters over a whole message whose
+// authentication parameters are zeroed
+func (k *localKeys) mac(msg []byte) []byte {
+	m := hmac.New(k.user.auth.hash, k.authKey)
+	m.Write(msg)
+	return m.Sum(nil)[:k.user.auth.macLen]
+}
+
+// verify checks the digest of an incoming message. authOffset locates the
+// authentication parameters inside msg.
+func (k *localKeys) verify(msg []byte, authOffset int, digest []byte) bool {
+	if len(digest) != k.user.auth.macLen {
+		return false
+	}
+	zeroed := append([]byte(nil), msg...)
+	copy(zeroed[authOffset:authOffset+len(digest)], make([]byte, len(digest)))
+	return hmac.Equal(k.mac(zeroed), digest)
+}
+
+// decrypt recovers the scoped PDU of an authPriv message
+func (k *localKeys) decrypt(data, salt []byte, boots, engineTime int64) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, ErrDecryption
+	}
+	out := make([]byte, len(data))
+	switch k.user.priv {
+	case privDES:
+		if len(data) == 0 || len(data)%des.BlockSize != 0 {
+			return nil, ErrDecryption
+		}
+		block, err := des.NewCipher(k.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.privKey[8+i] ^ salt[i]
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	case privAES:
+		block, err := aes.NewCipher(k.privKey[:16])
+		if err != nil {
+			return nil, err
+		}
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(out, data)
+	default:
+		return nil, ErrDecryption
+	}
+	return out, nil
+}
+
+// encrypt protects an outgoing scoped PDU. salt is the per-message counter;
+// the returned privacy parameters go into the security parameters.
+func (k *localKeys) encrypt(plain []byte, salt uint64, boots, engineTime int64) ([]byte, []byte, error) {
+	switch k.user.priv {
+	case privDES:
+		params := binary.BigEndian.AppendUint32(nil, uint32(boots))
+		params = binary.BigEndian.AppendUint32(params, uint32(salt))
+		block, err := des.NewCipher(k.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = k.privKey[8+i] ^ params[i]
+		}
+		padded := append([]byte(nil), plain...)
+		for len(padded)%des.BlockSize != 0 {
+			padded = append(padded, 0)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(padded, padded)
+		return padded, params, nil
+	case privAES:
+		params := binary.BigEndian.AppendUint64(nil, salt)
+		block, err := aes.NewCipher(k.privKey[:16])
+		if err != nil {
+			return nil, nil, err
+		}
+		out := make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, params)).XORKeyStream(out, plain)
+		return out, params, nil
+	}
+	return plain, nil, nil
+}
+
+// aesIV concatenates the authoritative engine boots and time with the salt (RFC 3826)
+func aesIV(boots, engineTime int64, salt []byte) []byte {
+	iv := binary.BigEndian.AppendUint32(nil, uint32(boots))
+	iv = binary.BigEndian.AppendUint32(iv, uint32(engineTime))
+	return append(iv, salt...)
+}
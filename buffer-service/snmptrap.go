@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"buffer-service/snmp"
+)
+
+// snmpService is the buffer service that owns SNMP records, as with Telegraf ingest
+const snmpService = "telegraf"
+
+// SNMPTrapListenerCfg is collection.snmp from the config-service file. The
+// native receiver only binds when Native is set, since Telegraf's snmp_trap
+// input owns the trap port by default.
+type SNMPTrapListenerCfg struct {
+	Enabled     bool   `json:"enabled"`
+	Native      bool   `json:"native"` // receive traps in buffer-service instead of Telegraf
+	TrapPort    int    `json:"trap_port"`
+	BindAddress string `json:"bindAddress"`
+
+	// USM is filled from forwarding.snmp, which holds the appliance's SNMPv3 user
+	USM SNMPUserCfg `json:"-"`
+}
+
+// SNMPUserCfg is the SNMPv3 user from forwarding.snmp
+type SNMPUserCfg struct {
+	Username     string `json:"username"`
+	AuthProtocol string `json:"authProtocol"`
+	AuthPassword string `json:"authPassword"`
+	PrivProtocol string `json:"privProtocol"`
+	PrivPassword string `json:"privPassword"`
+}
+
+func (c SNMPTrapListenerCfg) active() bool {
+	return c.Enabled && c.Native
+}
+
+func (c SNMPTrapListenerCfg) bindAddr() string {
+	host := c.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	port := c.TrapPort
+	if port <= 0 {
+		port = 162
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// snmpEngineState persists the engine ID and boot counter informs rely on
+type snmpEngineState struct {
+	EngineID string `json:"engine_id"`
+	Boots    int64  `json:"boots"`
+}
+
+// snmpEngine returns this appliance's SNMPv3 engine, loading it on first use
+// and counting a boot. The caller holds collectors.mu.
+func (bm *BufferManager) snmpEngine() snmp.Engine {
+	if bm.collectors.snmpEngine != nil {
+		return *bm.collectors.snmpEngine
+	}
+	path := filepath.Join(bm.dataPath, "buffer", "config", "snmp-engine.json")
+	var state snmpEngineState
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	engine := snmp.Engine{Boots: state.Boots + 1, Start: time.Now()}
+	if id, err := hex.DecodeString(state.EngineID); err == nil && len(id) >= 5 {
+		engine.ID = id
+	} else {
+		engine.ID = snmp.NewEngineID()
+	}
+
+	state = snmpEngineState{EngineID: hex.EncodeToString(engine.ID), Boots: engine.Boots}
+	data, _ := json.MarshalIndent(state, "", "  ")
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Failed to save SNMP engine boots")
+	}
+	bm.collectors.snmpEngine = &engine
+	return engine
+}
+
+// startSNMPTrapListener binds the trap port. The caller holds collectors.mu.
+func startSNMPTrapListener(bm *BufferManager, cfg SNMPTrapListenerCfg) (*udpCollector, error) {
+	receiver, err := snmp.NewReceiver(bm.snmpEngine(), snmp.User{
+		Name:         cfg.USM.Username,
+		AuthProtocol: cfg.USM.AuthProtocol,
+		AuthPassword: cfg.USM.AuthPassword,
+		PrivProtocol: cfg.USM.PrivProtocol,
+		PrivPassword: cfg.USM.PrivPassword,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return startUDPCollector(bm, "snmp", []string{cfg.bindAddr()}, func(packet []byte, remote net.Addr) []byte {
+		now := time.Now()
+		source := remoteIP(remote)
+		n, reply, err := receiver.Handle(source, packet, now)
+		if err != nil {
+			bm.metrics.collectorErrors.add(1, "snmp", snmpErrorReason(err))
+			logger.WithError(err).WithField("agent", source).Debug("Failed to decode SNMP notification")
+		}
+		if n != nil {
+			bm.storeSNMPNotification(n, now)
+		}
+		return reply
+	})
+}
+
+// snmpErrorReason groups receiver errors for collector_errors_total
+func snmpErrorReason(err error) string {
+	switch {
+	case errors.Is(err, snmp.ErrUnknownUser), errors.Is(err, snmp.ErrWrongDigest),
+		errors.Is(err, snmp.ErrDecryption), errors.Is(err, snmp.ErrUnsupportedSecLevel):
+		return "auth"
+	case errors.Is(err, snmp.ErrNotInTimeWindow), errors.Is(err, snmp.ErrUnknownEngineID):
+		return "engine"
+	}
+	return "decode"
+}
+
+// storeSNMPNotification buffers one decoded trap or inform as an snmp record
+func (bm *BufferManager) storeSNMPNotification(n *snmp.Notification, now time.Time) {
+	data, err := json.Marshal(n)
+	if err != nil {
+		bm.metrics.collectorErrors.add(1, "snmp", "encode")
+		return
+	}
+	record := TelemetryRecord{
+		Service:   snmpService,
+		Timestamp: now.Unix(),
+		DataType:  "snmp",
+		DataSize:  int64(len(data)),
+		JsonData:  string(data),
+		SourceIP:  n.Source,
+	}
+	if err := bm.acceptRecord(record); err != nil {
+		bm.metrics.collectorErrors.add(1, "snmp", "store")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"buffer-service/snmp"
+)
+
+// tlv encodes one short-form BER TLV
+func tlv(tag byte, value ...byte) []byte {
+	return append([]byte{tag, byte(len(value))}, value...)
+}
+
+// v2cInform builds an InformRequest carrying sysUpTime and snmpTrapOID (linkUp)
+func v2cInform(requestID byte) []byte {
+	seq := func(parts ...[]byte) []byte {
+		var b []byte
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return tlv(0x30, b...)
+	}
+	uptime := seq(tlv(0x06, 0x2b, 6, 1, 2, 1, 1, 3, 0), tlv(0x43, 0x01, 0x00))
+	trapOID := seq(tlv(0x06, 0x2b, 6, 1, 6, 3, 1, 1, 4, 1, 0), tlv(0x06, 0x2b, 6, 1, 6, 3, 1, 1, 5, 4))
+	pdu := append(tlv(0x02, requestID), tlv(0x02, 0)...)
+	pdu = append(pdu, tlv(0x02, 0)...)
+	pdu = append(pdu, seq(uptime, trapOID)...)
+	return seq(tlv(0x02, 1), tlv(0x04, []byte("public")...), tlv(0xa6, pdu...))
+}
+
+func TestSNMPTrapListener_AcknowledgesAndBuffersInforms(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services[snmpService]
+		svc.BufferMode = "database"
+		cfg.Services[snmpService] = svc
+	})
+
+	port := freePort(t)
+	bm.applyCollection(CollectionCfg{SNMP: SNMPTrapListenerCfg{Enabled: true, Native: true, TrapPort: port, BindAddress: "127.0.0.1"}})
+	defer bm.stopCollectors()
+	if bm.collectors.running["snmp"] == nil {
+		t.Fatalf("snmp collector not running")
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.Write(v2cInform(42))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 512)
+	n, err := conn.Read(reply)
+	if err != nil {
+		t.Fatalf("no inform response: %v", err)
+	}
+	// Response PDU tag after version and community, echoing the request ID
+	if n < 16 || reply[13] != 0xa2 || reply[17] != 42 {
+		t.Fatalf("unexpected response % x", reply[:n])
+	}
+
+	var notification snmp.Notification
+	deadline := time.Now().Add(5 * time.Second)
+	for notification.TrapOID == "" && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		var r TelemetryRecord
+		err := bm.db.QueryRow("SELECT json_data, codec FROM telemetry_buffer WHERE service = ? AND data_type = 'snmp'", snmpService).Scan(&r.JsonData, &r.Codec)
+		if err == nil {
+			bm.decodeRecord(&r)
+			json.Unmarshal([]byte(r.JsonData), &notification)
+		}
+	}
+	if notification.TrapOID != "1.3.6.1.6.3.1.1.5.4" || notification.PDUType != "inform" || notification.Uptime != 256 || notification.Source != "127.0.0.1" {
+		t.Fatalf("unexpected buffered notification: %+v", notification)
+	}
+
+	engine := bm.collectors.snmpEngine
+	if engine == nil || engine.Boots != 1 || len(engine.ID) == 0 {
+		t.Fatalf("engine not initialised: %+v", engine)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+	"sync"
+)
+
+// Store is a backend holding buffered records for any number of services.
+// BufferManager keeps SQLite-mode services in an sqliteStore and files-mode
+// services in segmentFiles, and uses Store for storing, stats, eviction and
+// expiry. It always opens SQLite: draining, dead letters, recompression,
+// search, replay and archives work on the SQLite tables directly, so
+// memoryStore only backs tests of Store itself.
+type Store interface {
+	// Append buffers a record. data is the payload as stored, encoded with
+	// record.Codec, and rawSize its decoded size.
+	Append(record TelemetryRecord, data []byte, rawSize int64) error
+	// Stats summarizes the records held for a service
+	Stats(service string) (StoreStats, error)
+	// Services lists the services that have records
+	Services() ([]string, error)
+	// Tail returns up to limit of a service's newest records, newest first,
+	// with payloads as stored
+	Tail(service string, limit int) ([]TelemetryRecord, error)
+	// DropOldest removes about count of a service's oldest records. Backends
+	// that evict in larger units remove at least one whole unit.
+	DropOldest(service string, count int64) (StoreDrop, error)
+	// Cleanup removes records that expired before now and returns how many
+	Cleanup(now int64) (int64, error)
+	Close() error
+}
+
+// StoreStats summarizes the records a backend holds for a service
+type StoreStats struct {
+	Records   int64
+	Bytes     int64
+	Oldest    int64 // timestamps; 0 when empty
+	Newest    int64
+	Forwarded int64
+	Pending   int64
+	Codecs    map[string]CodecStats // records with a known raw size, by codec
+}
+
+// merge adds another backend's stats for the same service
+func (s *StoreStats) merge(o StoreStats) {
+	if o.Records > 0 {
+		if s.Records == 0 || (o.Oldest < s.Oldest && o.Oldest > 0) {
+			s.Oldest = o.Oldest
+		}
+		if o.Newest > s.Newest {
+			s.Newest = o.Newest
+		}
+	}
+	s.Records += o.Records
+	s.Bytes += o.Bytes
+	s.Forwarded += o.Forwarded
+	s.Pending += o.Pending
+	if s.Codecs == nil {
+		s.Codecs = make(map[string]CodecStats)
+	}
+	for codec, cs := range o.Codecs {
+		total := s.Codecs[codec]
+		total.Records += cs.Records
+		total.RawBytes += cs.RawBytes
+		total.StoredBytes += cs.StoredBytes
+		if total.StoredBytes > 0 {
+			total.Ratio = float64(total.RawBytes) / float64(total.StoredBytes)
+		}
+		s.Codecs[codec] = total
+	}
+}
+
+// StoreDrop reports what DropOldest removed
+type StoreDrop struct {
+	Records int64
+	Bytes   int64
+	Pending int64
+}
+
+// sqliteStore keeps records in the telemetry_buffer table
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteStore) Append(record TelemetryRecord, data []byte, rawSize int64) error {
+	return insertBufferedRecord(s.db, record, data, rawSize)
+}
+
+// insertBufferedRecord writes a telemetry_buffer row through the database or
+// a transaction that must commit together with it
+func insertBufferedRecord(db interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}, record TelemetryRecord, data []byte, rawSize int64) error {
+	codec := record.Codec
+	if codec == "" {
+		codec = "none"
+	}
+	// Compressed payloads are stored as BLOBs so the bytes survive unchanged
+	var payload interface{} = string(data)
+	if codec != "none" {
+		payload = data
+	}
+
+	query := `
+		INSERT INTO telemetry_buffer
+		(service, timestamp, data_type, data_size, file_path, json_data, source_ip,
+		 forwarded, retry_count, created_at, expires_at, codec, raw_size)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db.Exec(query,
+		record.Service, record.Timestamp, record.DataType, record.DataSize,
+		record.FilePath, payload, record.SourceIP,
+		record.Forwarded, record.RetryCount, record.CreatedAt, record.ExpiresAt, codec, rawSize)
+	return err
+}
+
+func (s *sqliteStore) Stats(service string) (StoreStats, error) {
+	stats := StoreStats{Codecs: make(map[string]CodecStats)}
+
+	query := `
+		SELECT
+			COUNT(*) as total_records,
+			COALESCE(SUM(data_size), 0) as total_size,
+			COALESCE(MIN(timestamp), 0) as oldest_record,
+			COALESCE(MAX(timestamp), 0) as newest_record,
+			COALESCE(SUM(CASE WHEN forwarded = 1 THEN 1 ELSE 0 END), 0) as forwarded,
+			COALESCE(SUM(CASE WHEN forwarded = 0 THEN 1 ELSE 0 END), 0) as pending
+		FROM telemetry_buffer
+		WHERE service = ?
+	`
+	err := s.db.QueryRow(query, service).Scan(
+		&stats.Records,
+		&stats.Bytes,
+		&stats.Oldest,
+		&stats.Newest,
+		&stats.Forwarded,
+		&stats.Pending,
+	)
+	if err != nil {
+		return stats, err
+	}
+
+	// Legacy rows without a raw size are left out of the ratios
+	query = `
+		SELECT codec, COUNT(*), COALESCE(SUM(raw_size), 0), COALESCE(SUM(data_size), 0)
+		FROM telemetry_buffer
+		WHERE service = ? AND raw_size > 0
+		GROUP BY codec
+	`
+	rows, err := s.db.Query(query, service)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var codec string
+		var cs CodecStats
+		if err := rows.Scan(&codec, &cs.Records, &cs.RawBytes, &cs.StoredBytes); err != nil {
+			return stats, err
+		}
+		if cs.StoredBytes > 0 {
+			cs.Ratio = float64(cs.RawBytes) / float64(cs.StoredBytes)
+		}
+		stats.Codecs[codec] = cs
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqliteStore) Services() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT service FROM telemetry_buffer")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var services []string
+	for rows.Next() {
+		var service string
+		if err := rows.Scan(&service); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
+
+func (s *sqliteStore) Tail(service string, limit int) ([]TelemetryRecord, error) {
+	query := `
+		SELECT id, service, timestamp, data_type, data_size, json_data, COALESCE(source_ip, ''),
+		       codec, forwarded, retry_count, created_at, expires_at, batch_count
+		FROM telemetry_buffer
+		WHERE service = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`
+	rows, err := s.db.Query(query, service, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []TelemetryRecord
+	for rows.Next() {
+		var r TelemetryRecord
+		if err := rows.Scan(&r.ID, &r.Service, &r.Timestamp, &r.DataType, &r.DataSize, &r.JsonData, &r.SourceIP,
+			&r.Codec, &r.Forwarded, &r.RetryCount, &r.CreatedAt, &r.ExpiresAt, &r.BatchCount); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteStore) DropOldest(service string, count int64) (StoreDrop, error) {
+	var drop StoreDrop
+	tx, err := s.db.Begin()
+	if err != nil {
+		return drop, err
+	}
+	defer tx.Rollback()
+
+	oldest := "SELECT id, data_size, forwarded FROM telemetry_buffer WHERE service = ? ORDER BY timestamp ASC LIMIT ?"
+	summary := "SELECT COUNT(*), COALESCE(SUM(data_size), 0), COALESCE(SUM(CASE WHEN forwarded = 0 THEN 1 ELSE 0 END), 0) FROM ("
+	err = tx.QueryRow(summary+oldest+")", service, count).Scan(&drop.Records, &drop.Bytes, &drop.Pending)
+	if err != nil || drop.Records == 0 {
+		return StoreDrop{}, err
+	}
+	query := "DELETE FROM telemetry_buffer WHERE id IN (SELECT id FROM (" + oldest + "))"
+	if _, err := tx.Exec(query, service, count); err != nil {
+		return StoreDrop{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return StoreDrop{}, err
+	}
+	return drop, nil
+}
+
+func (s *sqliteStore) Cleanup(now int64) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM telemetry_buffer WHERE expires_at < ?", now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Close is a no-op; the database is shared with the rest of BufferManager
+func (s *sqliteStore) Close() error { return nil }
+
+// memoryStore keeps records in memory. Nothing survives a restart. It backs
+// the Store conformance tests and cannot back a BufferManager.
+type memoryStore struct {
+	mu      sync.Mutex
+	nextID  int64
+	records []memoryRecord // in append order
+}
+
+type memoryRecord struct {
+	TelemetryRecord
+	rawSize int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Append(record TelemetryRecord, data []byte, rawSize int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.Codec == "" {
+		record.Codec = "none"
+	}
+	s.nextID++
+	record.ID = s.nextID
+	record.JsonData = string(data)
+	s.records = append(s.records, memoryRecord{record, rawSize})
+	return nil
+}
+
+func (s *memoryStore) Stats(service string) (StoreStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := StoreStats{Codecs: make(map[string]CodecStats)}
+	for _, r := range s.records {
+		if r.Service != service {
+			continue
+		}
+		if stats.Records == 0 || r.Timestamp < stats.Oldest {
+			stats.Oldest = r.Timestamp
+		}
+		if r.Timestamp > stats.Newest {
+			stats.Newest = r.Timestamp
+		}
+		stats.Records++
+		stats.Bytes += r.DataSize
+		if r.Forwarded == 1 {
+			stats.Forwarded++
+		} else {
+			stats.Pending++
+		}
+		if r.rawSize > 0 {
+			cs := stats.Codecs[r.Codec]
+			cs.Records++
+			cs.RawBytes += r.rawSize
+			cs.StoredBytes += r.DataSize
+			cs.Ratio = float64(cs.RawBytes) / float64(cs.StoredBytes)
+			stats.Codecs[r.Codec] = cs
+		}
+	}
+	return stats, nil
+}
+
+func (s *memoryStore) Services() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, r := range s.records {
+		seen[r.Service] = true
+	}
+	return mapKeys(seen), nil
+}
+
+func (s *memoryStore) Tail(service string, limit int) ([]TelemetryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var records []TelemetryRecord
+	for i := len(s.records) - 1; i >= 0 && len(records) < limit; i-- {
+		if s.records[i].Service == service {
+			records = append(records, s.records[i].TelemetryRecord)
+		}
+	}
+	return records, nil
+}
+
+func (s *memoryStore) DropOldest(service string, count int64) (StoreDrop, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Oldest by timestamp, as in SQLite
+	var owned []int
+	for i, r := range s.records {
+		if r.Service == service {
+			owned = append(owned, i)
+		}
+	}
+	sort.SliceStable(owned, func(a, b int) bool { return s.records[owned[a]].Timestamp < s.records[owned[b]].Timestamp })
+	if int64(len(owned)) > count {
+		owned = owned[:count]
+	}
+	victims := make(map[int]bool, len(owned))
+	for _, i := range owned {
+		victims[i] = true
+	}
+
+	var drop StoreDrop
+	kept := s.records[:0]
+	for i, r := range s.records {
+		if !victims[i] {
+			kept = append(kept, r)
+			continue
+		}
+		drop.Records++
+		drop.Bytes += r.DataSize
+		if r.Forwarded == 0 {
+			drop.Pending++
+		}
+	}
+	s.records = kept
+	return drop, nil
+}
+
+func (s *memoryStore) Cleanup(now int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed int64
+	kept := s.records[:0]
+	for _, r := range s.records {
+		if r.ExpiresAt < now {
+			removed++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	s.records = kept
+	return removed, nil
+}
+
+func (s *memoryStore) Close() error { return nil }
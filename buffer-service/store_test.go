@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// storeBackends lists every Store implementation; each must pass the
+// conformance suite below
+var storeBackends = map[string]func(t *testing.T) Store{
+	"sqlite": func(t *testing.T) Store {
+		// A bare store on a freshly migrated database, without a manager's workers
+		bm := &BufferManager{dataPath: t.TempDir()}
+		if err := bm.initDatabase(); err != nil {
+			t.Fatalf("initDatabase: %v", err)
+		}
+		t.Cleanup(func() { bm.db.Close() })
+		return &sqliteStore{db: bm.db}
+	},
+	"files": func(t *testing.T) Store {
+		// Small segments so dropping the oldest leaves records behind
+		files, err := openSegmentFiles(t.TempDir(), func(string) int64 { return 512 })
+		if err != nil {
+			t.Fatalf("openSegmentFiles: %v", err)
+		}
+		return files
+	},
+	"memory": func(t *testing.T) Store {
+		return newMemoryStore()
+	},
+}
+
+// appendStoreRecords appends n records for a service with timestamps from first
+func appendStoreRecords(t *testing.T, s Store, service string, first, n int, expiresAt int64) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		data := []byte(fmt.Sprintf(`{"seq":%d}`, i))
+		record := TelemetryRecord{
+			Service: service, DataType: "netflow", Timestamp: int64(1000 + i), DataSize: int64(len(data)),
+			SourceIP: "10.0.0.1", Codec: "none", CreatedAt: 1000, ExpiresAt: expiresAt,
+		}
+		if err := s.Append(record, data, int64(len(data))); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, newStore := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			t.Run("AppendStats", func(t *testing.T) { testStoreAppendStats(t, newStore(t)) })
+			t.Run("Tail", func(t *testing.T) { testStoreTail(t, newStore(t)) })
+			t.Run("DropOldest", func(t *testing.T) { testStoreDropOldest(t, newStore(t)) })
+			t.Run("Cleanup", func(t *testing.T) { testStoreCleanup(t, newStore(t)) })
+		})
+	}
+}
+
+func testStoreAppendStats(t *testing.T, s Store) {
+	defer s.Close()
+	if stats, err := s.Stats("goflow2"); err != nil || stats.Records != 0 || stats.Oldest != 0 {
+		t.Fatalf("empty store: %+v, %v", stats, err)
+	}
+	appendStoreRecords(t, s, "goflow2", 0, 10, 5000)
+	appendStoreRecords(t, s, "telegraf", 0, 3, 5000)
+
+	stats, err := s.Stats("goflow2")
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Records != 10 || stats.Pending != 10 || stats.Forwarded != 0 || stats.Bytes <= 0 ||
+		stats.Oldest != 1000 || stats.Newest != 1009 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if cs := stats.Codecs["none"]; cs.Records != 10 || cs.RawBytes <= 0 || cs.StoredBytes <= 0 {
+		t.Fatalf("unexpected codec stats %+v", stats.Codecs)
+	}
+
+	services, err := s.Services()
+	sort.Strings(services)
+	if err != nil || len(services) != 2 || services[0] != "goflow2" || services[1] != "telegraf" {
+		t.Fatalf("Services: %v, %v", services, err)
+	}
+}
+
+func testStoreTail(t *testing.T, s Store) {
+	defer s.Close()
+	appendStoreRecords(t, s, "goflow2", 0, 10, 5000)
+
+	// Compressed payloads come back exactly as stored
+	blob := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0xff, 0x10}
+	record := TelemetryRecord{Service: "goflow2", DataType: "netflow", Timestamp: 1010, DataSize: int64(len(blob)),
+		Codec: "zstd", CreatedAt: 1000, ExpiresAt: 5000}
+	if err := s.Append(record, blob, 64); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	records, err := s.Tail("goflow2", 3)
+	if err != nil || len(records) != 3 {
+		t.Fatalf("Tail: %d records, %v", len(records), err)
+	}
+	if records[0].Codec != "zstd" || records[0].JsonData != string(blob) {
+		t.Fatalf("newest record %+v", records[0])
+	}
+	if records[1].JsonData != `{"seq":9}` || records[2].JsonData != `{"seq":8}` || records[1].Codec != "none" {
+		t.Fatalf("unexpected tail %q, %q", records[1].JsonData, records[2].JsonData)
+	}
+	if records, err := s.Tail("telegraf", 3); err != nil || len(records) != 0 {
+		t.Fatalf("Tail of unknown service: %d records, %v", len(records), err)
+	}
+}
+
+func testStoreDropOldest(t *testing.T, s Store) {
+	defer s.Close()
+	appendStoreRecords(t, s, "goflow2", 0, 40, 5000)
+	appendStoreRecords(t, s, "telegraf", 0, 5, 5000)
+
+	drop, err := s.DropOldest("goflow2", 5)
+	if err != nil || drop.Records == 0 || drop.Records >= 40 || drop.Bytes <= 0 || drop.Pending != drop.Records {
+		t.Fatalf("DropOldest: %+v, %v", drop, err)
+	}
+	stats, _ := s.Stats("goflow2")
+	if stats.Records != 40-drop.Records || stats.Oldest != 1000+drop.Records || stats.Newest != 1039 {
+		t.Fatalf("stats after dropping %d: %+v", drop.Records, stats)
+	}
+	if other, _ := s.Stats("telegraf"); other.Records != 5 {
+		t.Fatalf("DropOldest touched another service: %+v", other)
+	}
+	if drop, err := s.DropOldest("vector", 5); err != nil || drop.Records != 0 {
+		t.Fatalf("DropOldest of unknown service: %+v, %v", drop, err)
+	}
+}
+
+func testStoreCleanup(t *testing.T, s Store) {
+	defer s.Close()
+	appendStoreRecords(t, s, "goflow2", 0, 20, 5000)
+	appendStoreRecords(t, s, "telegraf", 0, 5, 5000)
+
+	if removed, err := s.Cleanup(4000); err != nil || removed != 0 {
+		t.Fatalf("Cleanup before expiry removed %d, %v", removed, err)
+	}
+	if removed, err := s.Cleanup(6000); err != nil || removed != 25 {
+		t.Fatalf("Cleanup after expiry removed %d, %v", removed, err)
+	}
+	if stats, _ := s.Stats("goflow2"); stats.Records != 0 {
+		t.Fatalf("records left after cleanup: %+v", stats)
+	}
+	services, err := s.Services()
+	if err != nil || len(services) != 0 {
+		t.Fatalf("Services after cleanup: %v, %v", services, err)
+	}
+
+	// The store keeps accepting records once emptied
+	appendStoreRecords(t, s, "goflow2", 30, 2, 9000)
+	if records, err := s.Tail("goflow2", 5); err != nil || len(records) != 2 || records[0].JsonData != `{"seq":31}` {
+		t.Fatalf("Tail after cleanup: %d records, %v", len(records), err)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// syslogService is the buffer service that owns syslog records, whichever
+	// collector received them
+	syslogService = "fluent-bit"
+
+	defaultSyslogMaxMessage  = 64 * 1024
+	defaultSyslogIdleTimeout = 5 * time.Minute
+	syslogDefaultPriority    = 13 // user.notice, RFC 3164 section 4.3.3
+	syslogNilValue           = "-"
+	syslogFrameTrimming      = "\r\n\x00"
+)
+
+var (
+	errEmptySyslog     = errors.New("empty syslog message")
+	errSyslogFrameSize = errors.New("syslog frame exceeds maximum message size")
+	utf8BOM            = []byte{0xEF, 0xBB, 0xBF}
+	rfc3164Stamps      = []string{time.StampMicro, time.StampMilli, time.Stamp}
+)
+
+// SyslogListenerCfg is collection.syslog from the config-service file. The
+// native listener only binds when Native is set, since Fluent Bit owns the
+// same port by default.
+type SyslogListenerCfg struct {
+	Enabled         bool   `json:"enabled"`
+	Native          bool   `json:"native"`                       // bind listeners in buffer-service instead of Fluent Bit
+	Port            int    `json:"port"`                         // UDP and TCP port
+	Protocol        string `json:"protocol"`                     // "UDP", "TCP" or "BOTH"
+	BindAddress     string `json:"bindAddress"`                  // default 0.0.0.0
+	TLSPort         int    `json:"tls_port,omitempty"`           // RFC 5425 listener, conventionally 6514; 0 = off
+	TLSCertFile     string `json:"tls_cert_file,omitempty"`      // PEM server certificate
+	TLSKeyFile      string `json:"tls_key_file,omitempty"`       // PEM private key
+	TLSClientCAFile string `json:"tls_client_ca_file,omitempty"` // require client certificates signed by this CA
+	MaxMessageSize  int    `json:"max_message_size,omitempty"`   // bytes; default 64KiB
+}
+
+// active reports whether the native listener should be running
+func (c SyslogListenerCfg) active() bool {
+	return c.Enabled && c.Native
+}
+
+func (c SyslogListenerCfg) maxMessage() int {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return defaultSyslogMaxMessage
+}
+
+func (c SyslogListenerCfg) bindAddr(port int) string {
+	host := c.BindAddress
+	if host == "" {
+		host = "0.0.0.0"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// SyslogMessage is a parsed RFC 3164 or RFC 5424 message as buffered
+type SyslogMessage struct {
+	Format         string                       `json:"format"` // "rfc3164" or "rfc5424"
+	Priority       int                          `json:"pri"`
+	Facility       int                          `json:"facility"`
+	Severity       int                          `json:"severity"`
+	Version        int                          `json:"version,omitempty"`
+	Timestamp      string                       `json:"time,omitempty"` // as sent by the device, RFC 3339
+	Hostname       string                       `json:"host,omitempty"`
+	AppName        string                       `json:"app,omitempty"` // RFC 3164 tag
+	ProcID         string                       `json:"procid,omitempty"`
+	MsgID          string                       `json:"msgid,omitempty"`
+	StructuredData map[string]map[string]string `json:"sd,omitempty"`
+	Message        string                       `json:"message"`
+	Transport      string                       `json:"transport,omitempty"` // "udp", "tcp" or "tls"
+}
+
+// parseSyslog parses a single syslog message. RFC 5424 is detected by its
+// version field; anything else is parsed leniently as RFC 3164, so a message
+// from a misbehaving device is kept rather than dropped.
+func parseSyslog(b []byte, now time.Time) (SyslogMessage, error) {
+	b = bytes.TrimRight(b, syslogFrameTrimming)
+	b = bytes.TrimLeft(b, " ")
+	if len(b) == 0 {
+		return SyslogMessage{}, errEmptySyslog
+	}
+
+	pri, rest := parsePriority(b)
+	msg := SyslogMessage{Priority: pri, Facility: pri / 8, Severity: pri % 8}
+	if len(rest) >= 2 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		if parseRFC5424(&msg, rest) == nil {
+			return msg, nil
+		}
+		msg = SyslogMessage{Priority: pri, Facility: pri / 8, Severity: pri % 8}
+	}
+	parseRFC3164(&msg, rest, now)
+	return msg, nil
+}
+
+// parsePriority reads a leading <PRI>, defaulting to user.notice when absent
+func parsePriority(b []byte) (int, []byte) {
+	if b[0] != '<' {
+		return syslogDefaultPriority, b
+	}
+	end := bytes.IndexByte(b, '>')
+	if end < 2 || end > 4 {
+		return syslogDefaultPriority, b
+	}
+	pri, err := strconv.Atoi(string(b[1:end]))
+	if err != nil || pri < 0 || pri > 191 {
+		return syslogDefaultPriority, b
+	}
+	return pri, b[end+1:]
+}
+
+// nextField splits off the next space-delimited header field
+func nextField(b []byte) (string, []byte, bool) {
+	i := bytes.IndexByte(b, ' ')
+	if i <= 0 {
+		return "", b, false
+	}
+	return string(b[:i]), b[i+1:], true
+}
+
+// parseRFC5424 parses VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD [MSG]
+func parseRFC5424(msg *SyslogMessage, b []byte) error {
+	var fields [6]string
+	for i := range fields {
+		var ok bool
+		if fields[i], b, ok = nextField(b); !ok {
+			// Header may end at MSGID when there is neither SD nor MSG
+			if i == 5 && len(b) > 0 {
+				fields[i], b = string(b), nil
+				break
+			}
+			return fmt.Errorf("truncated RFC 5424 header")
+		}
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return err
+	}
+	msg.Format = "rfc5424"
+	msg.Version = version
+	if fields[1] != syslogNilValue {
+		ts, err := time.Parse(time.RFC3339Nano, fields[1])
+		if err != nil {
+			return err
+		}
+		msg.Timestamp = ts.Format(time.RFC3339Nano)
+	}
+	msg.Hostname = nilValue(fields[2])
+	msg.AppName = nilValue(fields[3])
+	msg.ProcID = nilValue(fields[4])
+	msg.MsgID = nilValue(fields[5])
+
+	if len(b) > 0 && b[0] == '[' {
+		sd, rest, err := parseStructuredData(b)
+		if err != nil {
+			return err
+		}
+		msg.StructuredData = sd
+		b = rest
+	} else if len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+	}
+	b = bytes.TrimPrefix(b, []byte(" "))
+	msg.Message = string(bytes.TrimPrefix(b, utf8BOM))
+	return nil
+}
+
+func nilValue(s string) string {
+	if s == syslogNilValue {
+		return ""
+	}
+	return s
+}
+
+// parseStructuredData parses one or more [SD-ID PARAM="VALUE" ...] elements
+func parseStructuredData(b []byte) (map[string]map[string]string, []byte, error) {
+	sd := make(map[string]map[string]string)
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		end := bytes.IndexAny(b, " ]")
+		if end <= 0 {
+			return nil, nil, fmt.Errorf("malformed SD-ID")
+		}
+		params := make(map[string]string)
+		sd[string(b[:end])] = params
+		b = b[end:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			eq := bytes.IndexByte(b, '=')
+			if eq <= 0 || eq+1 >= len(b) || b[eq+1] != '"' {
+				return nil, nil, fmt.Errorf("malformed SD-PARAM")
+			}
+			name := string(b[:eq])
+			b = b[eq+2:]
+			var value []byte
+			closed := false
+			for i := 0; i < len(b); i++ {
+				if b[i] == '\\' && i+1 < len(b) && (b[i+1] == '"' || b[i+1] == '\\' || b[i+1] == ']') {
+					value = append(value, b[i+1])
+					i++
+					continue
+				}
+				if b[i] == '"' {
+					b = b[i+1:]
+					closed = true
+					break
+				}
+				value = append(value, b[i])
+			}
+			if !closed {
+				return nil, nil, fmt.Errorf("unterminated SD-PARAM value")
+			}
+			params[name] = string(value)
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, nil, fmt.Errorf("unterminated SD-ELEMENT")
+		}
+		b = b[1:]
+	}
+	return sd, b, nil
+}
+
+// parseRFC3164 parses TIMESTAMP HOSTNAME TAG[PID]: MSG, keeping whatever
+// cannot be recognised as the message
+func parseRFC3164(msg *SyslogMessage, b []byte, now time.Time) {
+	msg.Format = "rfc3164"
+	if ts, rest, ok := parseRFC3164Time(b, now); ok {
+		msg.Timestamp = ts.Format(time.RFC3339Nano)
+		b = rest
+		// A hostname follows the timestamp unless the device went straight to its tag
+		if host, after, ok := nextField(b); ok && !strings.ContainsAny(host, ":[") {
+			msg.Hostname = host
+			b = after
+		}
+	}
+
+	if tag, pid, rest, ok := parseTag(b); ok {
+		msg.AppName, msg.ProcID = tag, pid
+		b = rest
+	}
+	msg.Message = string(b)
+}
+
+// parseRFC3164Time reads a BSD timestamp, inferring the year, or an RFC 3339
+// timestamp as sent by newer BSD-style senders
+func parseRFC3164Time(b []byte, now time.Time) (time.Time, []byte, bool) {
+	for _, layout := range rfc3164Stamps {
+		if len(b) <= len(layout) || b[len(layout)] != ' ' {
+			continue
+		}
+		ts, err := time.ParseInLocation(layout, string(b[:len(layout)]), now.Location())
+		if err != nil {
+			continue
+		}
+		ts = time.Date(now.Year(), ts.Month(), ts.Day(), ts.Hour(), ts.Minute(), ts.Second(), ts.Nanosecond(), now.Location())
+		// A December message received in January belongs to last year
+		if ts.After(now.Add(24 * time.Hour)) {
+			ts = ts.AddDate(-1, 0, 0)
+		}
+		return ts, b[len(layout)+1:], true
+	}
+	if field, rest, ok := nextField(b); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, field); err == nil {
+			return ts, rest, true
+		}
+	}
+	return time.Time{}, b, false
+}
+
+// parseTag reads an RFC 3164 TAG with optional [PID] terminated by a colon
+func parseTag(b []byte) (tag, pid string, rest []byte, ok bool) {
+	i := 0
+	for i < len(b) && i < 48 && isTagChar(b[i]) {
+		i++
+	}
+	if i == 0 || i >= len(b) {
+		return "", "", b, false
+	}
+	tag = string(b[:i])
+	j := i
+	if b[j] == '[' {
+		end := bytes.IndexByte(b[j:], ']')
+		if end < 0 {
+			return "", "", b, false
+		}
+		pid = string(b[j+1 : j+end])
+		j += end + 1
+	}
+	if j >= len(b) || b[j] != ':' {
+		return "", "", b, false
+	}
+	return tag, pid, bytes.TrimPrefix(b[j+1:], []byte(" ")), true
+}
+
+func isTagChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.' || c == '/'
+}
+
+// syslogFrameReader splits a syslog stream into messages, accepting both
+// octet-counted and newline-delimited framing (RFC 6587) on the same connection
+type syslogFrameReader struct {
+	r   *bufio.Reader
+	max int
+}
+
+func newSyslogFrameReader(r io.Reader, max int) *syslogFrameReader {
+	return &syslogFrameReader{r: bufio.NewReader(r), max: max}
+}
+
+// next returns the next frame. Oversized newline frames are truncated to the
+// maximum message size; an oversized octet count is an error because the
+// stream cannot be trusted after it.
+func (f *syslogFrameReader) next() ([]byte, error) {
+	for {
+		c, err := f.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if strings.IndexByte(syslogFrameTrimming, c) >= 0 {
+			continue
+		}
+		if c < '1' || c > '9' {
+			f.r.UnreadByte()
+			return f.line(nil)
+		}
+
+		// MSG-LEN SP SYSLOG-MSG, unless the digits turn out to start a plain line
+		prefix := []byte{c}
+		for {
+			c, err = f.r.ReadByte()
+			if err != nil {
+				return prefix, err
+			}
+			if c == ' ' {
+				break
+			}
+			if c < '0' || c > '9' || len(prefix) >= 10 {
+				f.r.UnreadByte()
+				return f.line(prefix)
+			}
+			prefix = append(prefix, c)
+		}
+		n, _ := strconv.Atoi(string(prefix))
+		if n > f.max {
+			return nil, errSyslogFrameSize
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(f.r, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+}
+
+// line reads a newline-terminated frame
+func (f *syslogFrameReader) line(frame []byte) ([]byte, error) {
+	for {
+		chunk, err := f.r.ReadSlice('\n')
+		if room := f.max - len(frame); room > 0 {
+			if len(chunk) > room {
+				chunk = chunk[:room]
+			}
+			frame = append(frame, chunk...)
+		}
+		switch {
+		case err == bufio.ErrBufferFull:
+			continue
+		case err == io.EOF && len(frame) > 0:
+			return frame, nil
+		default:
+			return frame, err
+		}
+	}
+}
+
+// syslogListener is the native UDP, TCP and TLS syslog receiver
+type syslogListener struct {
+	bm        *BufferManager
+	cfg       SyslogListenerCfg
+	udp       net.PacketConn
+	tcp       net.Listener
+	tls       net.Listener
+	wg        sync.WaitGroup // receive loops and open connections
+	accepting sync.WaitGroup // TCP and TLS accept loops
+	mu        sync.Mutex
+	conns     map[net.Conn]struct{}
+}
+
+// startSyslogListener binds the transports selected by cfg
+func startSyslogListener(bm *BufferManager, cfg SyslogListenerCfg) (*syslogListener, error) {
+	l := &syslogListener{bm: bm, cfg: cfg, conns: make(map[net.Conn]struct{})}
+	protocol := strings.ToUpper(cfg.Protocol)
+
+	if protocol == "UDP" || protocol == "BOTH" || protocol == "" {
+		conn, err := net.ListenPacket("udp", cfg.bindAddr(cfg.Port))
+		if err != nil {
+			return nil, fmt.Errorf("syslog udp listen: %v", err)
+		}
+		l.udp = conn
+	}
+	if protocol == "TCP" || protocol == "BOTH" || protocol == "" {
+		ln, err := net.Listen("tcp", cfg.bindAddr(cfg.Port))
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("syslog tcp listen: %v", err)
+		}
+		l.tcp = ln
+	}
+	if cfg.TLSPort > 0 {
+		tlsCfg, err := cfg.tlsConfig()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		ln, err := tls.Listen("tcp", cfg.bindAddr(cfg.TLSPort), tlsCfg)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("syslog tls listen: %v", err)
+		}
+		l.tls = ln
+	}
+	if l.udp == nil && l.tcp == nil && l.tls == nil {
+		return nil, fmt.Errorf("unsupported syslog protocol %q", cfg.Protocol)
+	}
+
+	fields := logrus.Fields{"protocol": cfg.Protocol}
+	if l.udp != nil {
+		fields["udp"] = l.udp.LocalAddr().String()
+		l.wg.Add(1)
+		go l.serveUDP()
+	}
+	if l.tcp != nil {
+		fields["tcp"] = l.tcp.Addr().String()
+		l.accepting.Add(1)
+		go l.serveStream(l.tcp, "tcp")
+	}
+	if l.tls != nil {
+		fields["tls"] = l.tls.Addr().String()
+		l.accepting.Add(1)
+		go l.serveStream(l.tls, "tls")
+	}
+	logger.WithFields(fields).Info("Native syslog listener started")
+	return l, nil
+}
+
+// tlsConfig loads the RFC 5425 server certificate and optional client CA
+func (c SyslogListenerCfg) tlsConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" || c.TLSKeyFile == "" {
+		return nil, fmt.Errorf("syslog tls_port requires tls_cert_file and tls_key_file")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load syslog tls certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read syslog client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", c.TLSClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Close stops every transport and waits for open connections to finish
+func (l *syslogListener) Close() error {
+	if l.udp != nil {
+		l.udp.Close()
+	}
+	for _, ln := range []net.Listener{l.tcp, l.tls} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	// Stop accepting before the sweep so no connection slips in after it
+	l.accepting.Wait()
+	l.mu.Lock()
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return nil
+}
+
+func (l *syslogListener) serveUDP() {
+	defer l.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := l.udp.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.bm.metrics.collectorErrors.add(1, "syslog", "read")
+			continue
+		}
+		l.receive(buf[:n], "udp", addr)
+	}
+}
+
+func (l *syslogListener) serveStream(ln net.Listener, transport string) {
+	defer l.accepting.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.bm.metrics.collectorErrors.add(1, "syslog", "accept")
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		l.mu.Lock()
+		l.conns[conn] = struct{}{}
+		l.mu.Unlock()
+		l.wg.Add(1)
+		go l.serveConn(conn, transport)
+	}
+}
+
+func (l *syslogListener) serveConn(conn net.Conn, transport string) {
+	defer func() {
+		conn.Close()
+		l.mu.Lock()
+		delete(l.conns, conn)
+		l.mu.Unlock()
+		l.wg.Done()
+	}()
+
+	frames := newSyslogFrameReader(conn, l.cfg.maxMessage())
+	for {
+		conn.SetReadDeadline(time.Now().Add(defaultSyslogIdleTimeout))
+		frame, err := frames.next()
+		if len(frame) > 0 {
+			l.receive(frame, transport, conn.RemoteAddr())
+		}
+		if err != nil {
+			if errors.Is(err, errSyslogFrameSize) {
+				l.bm.metrics.collectorErrors.add(1, "syslog", "frame")
+				logger.WithField("remote", conn.RemoteAddr().String()).Warn("Closing syslog connection after oversized frame")
+			}
+			return
+		}
+	}
+}
+
+// receive parses one message and hands it to the buffer
+func (l *syslogListener) receive(frame []byte, transport string, remote net.Addr) {
+	now := time.Now()
+	if len(frame) > l.cfg.maxMessage() {
+		frame = frame[:l.cfg.maxMessage()]
+	}
+	msg, err := parseSyslog(frame, now)
+	if err != nil {
+		return
+	}
+	msg.Transport = transport
+	data, err := json.Marshal(msg)
+	if err != nil {
+		l.bm.metrics.collectorErrors.add(1, "syslog", "encode")
+		return
+	}
+	l.bm.metrics.collected.add(1, "syslog", transport)
+
+	record := TelemetryRecord{
+		Service:   syslogService,
+		Timestamp: now.Unix(),
+		DataType:  "syslog",
+		DataSize:  int64(len(data)),
+		JsonData:  string(data),
+		SourceIP:  remoteIP(remote),
+	}
+	if err := l.bm.acceptRecord(record); err != nil {
+		l.bm.metrics.collectorErrors.add(1, "syslog", "store")
+	}
+}
+
+// remoteIP strips the port from a peer address
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2025, time.January, 2, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		in   string
+		want SyslogMessage
+	}{
+		{
+			name: "rfc3164",
+			in:   "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed for lonvick on /dev/pts/8\n",
+			want: SyslogMessage{Format: "rfc3164", Priority: 34, Facility: 4, Severity: 2, Timestamp: "2024-10-11T22:14:15Z",
+				Hostname: "mymachine", AppName: "su", ProcID: "230", Message: "'su root' failed for lonvick on /dev/pts/8"},
+		},
+		{
+			name: "rfc3164 without hostname",
+			in:   "<189>Jan  2 11:59:01.250 %LINK-3-UPDOWN: Interface Gi0/1, changed state to down",
+			want: SyslogMessage{Format: "rfc3164", Priority: 189, Facility: 23, Severity: 5, Timestamp: "2025-01-02T11:59:01.25Z",
+				Message: "%LINK-3-UPDOWN: Interface Gi0/1, changed state to down"},
+		},
+		{
+			name: "no priority or header",
+			in:   "plain text from a broken device",
+			want: SyslogMessage{Format: "rfc3164", Priority: 13, Facility: 1, Severity: 5, Message: "plain text from a broken device"},
+		},
+		{
+			name: "rfc5424 with structured data",
+			in:   `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication\]"][meta seq="7"] ` + "\xef\xbb\xbfAn application event",
+			want: SyslogMessage{Format: "rfc5424", Priority: 165, Facility: 20, Severity: 5, Version: 1, Timestamp: "2003-10-11T22:14:15.003Z",
+				Hostname: "mymachine.example.com", AppName: "evntslog", MsgID: "ID47", Message: "An application event",
+				StructuredData: map[string]map[string]string{
+					"exampleSDID@32473": {"iut": "3", "eventSource": `App"lication]`},
+					"meta":              {"seq": "7"},
+				}},
+		},
+		{
+			name: "rfc5424 nil values",
+			in:   "<13>1 - - - - - -",
+			want: SyslogMessage{Format: "rfc5424", Priority: 13, Facility: 1, Severity: 5, Version: 1},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseSyslog([]byte(tc.in), now)
+			if err != nil {
+				t.Fatalf("parseSyslog: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("parseSyslog(%q)\n got %+v\nwant %+v", tc.in, got, tc.want)
+			}
+		})
+	}
+
+	if _, err := parseSyslog([]byte("\r\n"), now); err != errEmptySyslog {
+		t.Fatalf("empty message returned %v", err)
+	}
+}
+
+func TestSyslogFrameReader_MixedFraming(t *testing.T) {
+	stream := "<13>first line\n" + "19 <13>octet counted\nx" + "\r\n<13>second line" + "\n2025-01-02 no priority\n" + "9999 <13>too big"
+	frames := newSyslogFrameReader(strings.NewReader(stream), 100)
+
+	for _, want := range []string{"<13>first line\n", "<13>octet counted\nx", "<13>second line\n", "2025-01-02 no priority\n"} {
+		got, err := frames.next()
+		if err != nil || string(got) != want {
+			t.Fatalf("next() = %q, %v; want %q", got, err, want)
+		}
+	}
+	if _, err := frames.next(); err != errSyslogFrameSize {
+		t.Fatalf("oversized octet count returned %v", err)
+	}
+}
+
+// writeTestCertificate writes a self-signed localhost certificate and key
+func writeTestCertificate(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// waitForSyslog polls the buffer until n syslog records arrive
+func waitForSyslog(t *testing.T, bm *BufferManager, n int) []SyslogMessage {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rows, err := bm.db.Query("SELECT json_data, codec, source_ip FROM telemetry_buffer WHERE service = ?", syslogService)
+		if err != nil {
+			t.Fatalf("query: %v", err)
+		}
+		var msgs []SyslogMessage
+		for rows.Next() {
+			var r TelemetryRecord
+			rows.Scan(&r.JsonData, &r.Codec, &r.SourceIP)
+			if err := bm.decodeRecord(&r); err != nil {
+				t.Fatalf("decodeRecord: %v", err)
+			}
+			if r.SourceIP != "127.0.0.1" {
+				t.Fatalf("source_ip = %q", r.SourceIP)
+			}
+			var m SyslogMessage
+			json.Unmarshal([]byte(r.JsonData), &m)
+			msgs = append(msgs, m)
+		}
+		rows.Close()
+		if len(msgs) >= n || time.Now().After(deadline) {
+			return msgs
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSyslogListener_UDPTCPAndTLS(t *testing.T) {
+	bm := newTestBufferManagerWith(t, func(cfg *BufferConfig) {
+		cfg.VPNFailoverEnabled = false
+		svc := cfg.Services[syslogService]
+		svc.BufferMode = "database"
+		cfg.Services[syslogService] = svc
+	})
+
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	// Port 0 lets each transport pick its own free port
+	l, err := startSyslogListener(bm, SyslogListenerCfg{Enabled: true, Native: true, Protocol: "BOTH", BindAddress: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("startSyslogListener: %v", err)
+	}
+	defer l.Close()
+	tlsListener, err := startSyslogListener(bm, SyslogListenerCfg{
+		Enabled: true, Native: true, Protocol: "TCP", BindAddress: "127.0.0.1",
+		TLSPort: freePort(t), TLSCertFile: certFile, TLSKeyFile: keyFile,
+	})
+	if err != nil {
+		t.Fatalf("start TLS listener: %v", err)
+	}
+	defer tlsListener.Close()
+
+	udp, err := net.Dial("udp", l.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("dial udp: %v", err)
+	}
+	defer udp.Close()
+	fmt.Fprint(udp, "<14>Oct 11 22:14:15 sw1 kernel: udp message\n")
+
+	tcp, err := net.Dial("tcp", l.tcp.Addr().String())
+	if err != nil {
+		t.Fatalf("dial tcp: %v", err)
+	}
+	fmt.Fprint(tcp, "<14>Oct 11 22:14:15 sw2 kernel: newline framed\n")
+	msg := "<14>1 2025-01-02T10:00:00Z sw3 app - - - octet\ncounted"
+	fmt.Fprintf(tcp, "%d %s", len(msg), msg)
+	tcp.Close()
+
+	conn, err := tls.Dial("tcp", tlsListener.tls.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("dial tls: %v", err)
+	}
+	msg = "<14>1 2025-01-02T10:00:00Z sw4 app - - - over tls"
+	fmt.Fprintf(conn, "%d %s", len(msg), msg)
+	conn.Close()
+
+	msgs := waitForSyslog(t, bm, 4)
+	var got []string
+	for _, m := range msgs {
+		got = append(got, m.Hostname+"/"+m.Transport+"/"+m.Message)
+	}
+	sort.Strings(got)
+	want := []string{"sw1/udp/udp message", "sw2/tcp/newline framed", "sw3/tcp/octet\ncounted", "sw4/tls/over tls"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("received %q, want %q", got, want)
+	}
+	expectSeries(t, scrape(t, bm), `noc_raven_buffer_collector_messages_total{collector="syslog",transport="tcp"} 2`)
+}
+
+// freePort reserves and releases a TCP port for listeners that need a fixed port
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestApplyCollection_StartsAndStopsListener(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	cfg := CollectionCfg{Syslog: SyslogListenerCfg{Enabled: true, Native: false, Protocol: "UDP", BindAddress: "127.0.0.1"}}
+
+	bm.applyCollection(cfg)
+	if bm.collectors.running["syslog"] != nil {
+		t.Fatalf("listener bound while Fluent Bit owns syslog")
+	}
+	cfg.Syslog.Native = true
+	bm.applyCollection(cfg)
+	if bm.collectors.running["syslog"] == nil {
+		t.Fatalf("native listener not started")
+	}
+	bm.stopCollectors()
+	if bm.collectors.running["syslog"] != nil {
+		t.Fatalf("listener still running after stop")
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyslogUDPMessage = 2048 // RFC 5426 section 3.2 SHOULD for IPv4
+	syslogBatchBytes        = 64 * 1024
+	syslogMinBackoff        = time.Second
+	syslogMaxBackoff        = time.Minute
+)
+
+var (
+	syslogFacilities = []string{"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7"}
+	syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+	syslogAliases    = map[string]string{"emergency": "emerg", "panic": "emerg", "critical": "crit",
+		"error": "err", "warn": "warning", "informational": "info", "security": "auth"}
+)
+
+// syslogForwarder renders buffered records back to RFC 3164 or RFC 5424 and
+// sends them over UDP, or over a persistent TCP or TLS connection with
+// octet-counted framing (RFC 6587, RFC 5425)
+type syslogForwarder struct {
+	dest      DestinationCfg
+	network   string // "udp", "tcp" or "tls"
+	rfc5424   bool
+	addr      string
+	tlsConfig *tls.Config
+
+	mu        sync.Mutex
+	conn      net.Conn
+	backoff   time.Duration
+	nextDial  time.Time
+	lastError error
+}
+
+func newSyslogForwarder(dest DestinationCfg) (*syslogForwarder, error) {
+	f := &syslogForwarder{
+		dest:    dest,
+		network: strings.ToLower(dest.Transport),
+		addr:    net.JoinHostPort(dest.Host, strconv.Itoa(dest.Port)),
+	}
+	if f.network == "" {
+		f.network = "udp"
+	}
+
+	switch strings.ToLower(strings.ReplaceAll(dest.Format, " ", "")) {
+	case "", "rfc3164", "bsd":
+	case "rfc5424", "ietf":
+		f.rfc5424 = true
+	default:
+		return nil, fmt.Errorf("unsupported syslog format %q", dest.Format)
+	}
+
+	if f.network == "tls" {
+		cfg, err := dest.clientTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		f.tlsConfig = cfg
+	}
+	return f, nil
+}
+
+// clientTLSConfig builds the TLS settings for a destination
+func (d DestinationCfg) clientTLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: d.TLSServerName, MinVersion: tls.VersionTLS12}
+	if cfg.ServerName == "" {
+		cfg.ServerName = d.Host
+	}
+	if d.TLSCAFile != "" {
+		pem, err := os.ReadFile(d.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls_ca_file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", d.TLSCAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if d.TLSCertFile != "" || d.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.TLSCertFile, d.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+func (f *syslogForwarder) Forward(record TelemetryRecord) error {
+	return f.ForwardBatch([]TelemetryRecord{record})[0]
+}
+
+// ForwardBatch renders every record and writes them over one connection. On
+// TCP and TLS the frames are coalesced into writes of up to 64KiB.
+func (f *syslogForwarder) ForwardBatch(records []TelemetryRecord) []error {
+	errs := make([]error, len(records))
+	frames := make([][]byte, len(records))
+	for i, record := range records {
+		frames[i] = f.frame(renderSyslog(record, f.rfc5424))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for start := 0; start < len(frames); {
+		// Coalesce frames into one write; UDP sends one message per datagram
+		end := start + 1
+		size := len(frames[start])
+		for f.network != "udp" && end < len(frames) && size+len(frames[end]) <= syslogBatchBytes {
+			size += len(frames[end])
+			end++
+		}
+		buf := frames[start]
+		if end > start+1 {
+			buf = make([]byte, 0, size)
+			for _, fr := range frames[start:end] {
+				buf = append(buf, fr...)
+			}
+		}
+
+		if err := f.write(buf); err != nil {
+			for i := start; i < len(errs); i++ {
+				errs[i] = err
+			}
+			break
+		}
+		start = end
+	}
+	return errs
+}
+
+// frame applies the transport's framing and size limit to a rendered message
+func (f *syslogForwarder) frame(msg []byte) []byte {
+	max := f.dest.MaxMessageBytes
+	if max <= 0 && f.network == "udp" {
+		max = defaultSyslogUDPMessage
+	}
+	if max > 0 && len(msg) > max {
+		msg = msg[:max]
+	}
+	if f.network == "udp" {
+		return msg
+	}
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+// write sends b on the persistent connection, dialing it first when needed.
+// After a failure the connection is dropped and redials back off
+// exponentially, so a dead collector is not hammered by every drain batch.
+// The caller holds f.mu.
+func (f *syslogForwarder) write(b []byte) error {
+	if f.conn == nil {
+		if wait := time.Until(f.nextDial); wait > 0 {
+			return fmt.Errorf("syslog destination %s unavailable, redialing in %s: %v", f.addr, wait.Round(time.Second), f.lastError)
+		}
+		conn, err := f.dial()
+		if err != nil {
+			f.fail(err)
+			return err
+		}
+		f.conn = conn
+		f.backoff = 0
+	}
+
+	f.conn.SetWriteDeadline(time.Now().Add(secondsOr(f.dest.WriteTimeoutSec, 5)))
+	if _, err := f.conn.Write(b); err != nil {
+		f.conn.Close()
+		f.conn = nil
+		f.fail(err)
+		return err
+	}
+	return nil
+}
+
+// fail schedules the next dial attempt. The caller holds f.mu.
+func (f *syslogForwarder) fail(err error) {
+	f.backoff *= 2
+	if f.backoff < syslogMinBackoff {
+		f.backoff = syslogMinBackoff
+	}
+	if f.backoff > syslogMaxBackoff {
+		f.backoff = syslogMaxBackoff
+	}
+	f.nextDial = time.Now().Add(f.backoff)
+	f.lastError = err
+}
+
+func (f *syslogForwarder) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: secondsOr(f.dest.DialTimeoutSec, 5)}
+	if f.network == "tls" {
+		return tls.DialWithDialer(dialer, "tcp", f.addr, f.tlsConfig)
+	}
+	return dialer.Dial(f.network, f.addr)
+}
+
+func (f *syslogForwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn != nil {
+		f.conn.Close()
+		f.conn = nil
+	}
+	return nil
+}
+
+// renderSyslog turns a buffered record back into a syslog message. Records
+// from the native listener carry the parsed message; Fluent Bit records are
+// mapped by their usual keys. Anything else is sent whole as the message.
+func renderSyslog(record TelemetryRecord, rfc5424 bool) []byte {
+	msg := syslogFromRecord(record)
+	if rfc5424 {
+		return renderRFC5424(msg)
+	}
+	return renderRFC3164(msg)
+}
+
+// syslogFromRecord recovers the syslog fields of a buffered record
+func syslogFromRecord(record TelemetryRecord) SyslogMessage {
+	msg := SyslogMessage{Priority: syslogDefaultPriority, Message: record.JsonData}
+	var fields map[string]interface{}
+	if json.Unmarshal([]byte(record.JsonData), &fields) == nil {
+		if text, ok := firstString(fields, "message", "msg", "log"); ok {
+			msg.Message = text
+			msg.Priority = syslogPriority(fields)
+			msg.Timestamp, _ = firstString(fields, "time", "timestamp", "@timestamp")
+			if t, ok := fields["time"].(float64); ok {
+				msg.Timestamp = time.Unix(int64(t), 0).Format(time.RFC3339)
+			}
+			msg.Hostname, _ = firstString(fields, "host", "hostname")
+			msg.AppName, _ = firstString(fields, "app", "ident", "appname", "tag", "program")
+			msg.ProcID, _ = firstString(fields, "procid", "pid")
+			msg.MsgID, _ = firstString(fields, "msgid")
+			if sd, ok := fields["sd"].(map[string]interface{}); ok {
+				msg.StructuredData = structuredData(sd)
+			}
+		}
+	}
+	msg.Facility, msg.Severity = msg.Priority/8, msg.Priority%8
+
+	if _, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err != nil {
+		// Fall back to when the record was buffered
+		msg.Timestamp = time.Unix(record.Timestamp, 0).UTC().Format(time.RFC3339)
+	}
+	if msg.Hostname == "" {
+		msg.Hostname = record.SourceIP
+	}
+	return msg
+}
+
+// firstString returns the first of keys holding a string or number
+func firstString(fields map[string]interface{}, keys ...string) (string, bool) {
+	for _, key := range keys {
+		switch v := fields[key].(type) {
+		case string:
+			return v, true
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), true
+		}
+	}
+	return "", false
+}
+
+// syslogPriority reads pri, or facility and severity given as numbers or names
+func syslogPriority(fields map[string]interface{}) int {
+	if pri, ok := fields["pri"]; ok {
+		if n, ok := syslogCode(pri, nil); ok && n >= 0 && n <= 191 {
+			return n
+		}
+	}
+	facility, ok := syslogCode(fields["facility"], syslogFacilities)
+	if !ok || facility > 23 {
+		facility = syslogDefaultPriority / 8
+	}
+	severity, ok := syslogCode(fields["severity"], syslogSeverities)
+	if !ok || severity > 7 {
+		severity = syslogDefaultPriority % 8
+	}
+	return facility*8 + severity
+}
+
+// syslogCode reads a numeric code, or looks a keyword up in names
+func syslogCode(v interface{}, names []string) (int, bool) {
+	switch v := v.(type) {
+	case float64:
+		return int(v), v >= 0
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n, n >= 0
+		}
+		name := strings.ToLower(v)
+		if alias, ok := syslogAliases[name]; ok {
+			name = alias
+		}
+		for i, n := range names {
+			if n == name {
+				return i, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func structuredData(sd map[string]interface{}) map[string]map[string]string {
+	out := make(map[string]map[string]string, len(sd))
+	for id, params := range sd {
+		p, _ := params.(map[string]interface{})
+		out[id] = make(map[string]string, len(p))
+		for name, value := range p {
+			if s, ok := value.(string); ok {
+				out[id][name] = s
+			}
+		}
+	}
+	return out
+}
+
+// syslogTime parses a timestamp from syslogFromRecord, keeping the sender's offset
+func syslogTime(s string) time.Time {
+	ts, _ := time.Parse(time.RFC3339Nano, s)
+	return ts
+}
+
+// renderRFC3164 writes <PRI>Mmm dd hh:mm:ss HOST TAG[PID]: MSG
+func renderRFC3164(msg SyslogMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>%s %s ", msg.Priority, syslogTime(msg.Timestamp).Format(time.Stamp), headerField(msg.Hostname, 255))
+	if tag := headerField(msg.AppName, 32); tag != syslogNilValue {
+		b.WriteString(tag)
+		if msg.ProcID != "" {
+			b.WriteString("[" + headerField(msg.ProcID, 128) + "]")
+		}
+		b.WriteString(": ")
+	}
+	b.WriteString(msg.Message)
+	return []byte(b.String())
+}
+
+// renderRFC5424 writes <PRI>1 TIMESTAMP HOST APP PROCID MSGID SD MSG
+func renderRFC5424(msg SyslogMessage) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ", msg.Priority,
+		syslogTime(msg.Timestamp).Format(time.RFC3339Nano),
+		headerField(msg.Hostname, 255), headerField(msg.AppName, 48),
+		headerField(msg.ProcID, 128), headerField(msg.MsgID, 32))
+	writeStructuredData(&b, msg.StructuredData)
+	if msg.Message != "" {
+		b.WriteString(" " + msg.Message)
+	}
+	return []byte(b.String())
+}
+
+// headerField restricts a header value to printable ASCII without spaces
+func headerField(s string, max int) string {
+	out := make([]byte, 0, len(s))
+	for i := 0; i < len(s) && len(out) < max; i++ {
+		if s[i] > ' ' && s[i] < 0x7f {
+			out = append(out, s[i])
+		}
+	}
+	if len(out) == 0 {
+		return syslogNilValue
+	}
+	return string(out)
+}
+
+// writeStructuredData writes SD elements in a stable order, escaping values
+// as RFC 5424 section 6.3.3 requires
+func writeStructuredData(b *strings.Builder, sd map[string]map[string]string) {
+	if len(sd) == 0 {
+		b.WriteString(syslogNilValue)
+		return
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+	for _, id := range sortedKeys(sd) {
+		b.WriteString("[" + sdName(id))
+		params := sd[id]
+		for _, name := range sortedKeys(params) {
+			fmt.Fprintf(b, ` %s="%s"`, sdName(name), escaper.Replace(params[name]))
+		}
+		b.WriteString("]")
+	}
+}
+
+// sdName drops the characters SD-NAME excludes
+func sdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, headerField(s, 32))
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderSyslog_RoundTripsNativeRecords(t *testing.T) {
+	now := time.Date(2025, 3, 14, 9, 26, 53, 0, time.UTC)
+	in := `<165>1 2025-03-14T09:26:53.5+01:00 core-sw1 sshd 4242 LOGIN [origin ip="192.0.2.1" note="a \"quoted\\ value\]"] Accepted publickey`
+	parsed, _ := parseSyslog([]byte(in), now)
+	data, _ := json.Marshal(parsed)
+
+	for _, rfc5424 := range []bool{true, false} {
+		out := renderSyslog(TelemetryRecord{JsonData: string(data), Timestamp: now.Unix()}, rfc5424)
+		got, err := parseSyslog(out, now)
+		if err != nil {
+			t.Fatalf("reparse %q: %v", out, err)
+		}
+		if got.Priority != 165 || got.Hostname != "core-sw1" || got.AppName != "sshd" || got.ProcID != "4242" || got.Message != "Accepted publickey" {
+			t.Fatalf("rfc5424=%v: %q parsed as %+v", rfc5424, out, got)
+		}
+		if rfc5424 && (got.MsgID != "LOGIN" || got.StructuredData["origin"]["note"] != `a "quoted\ value]` || got.Timestamp != parsed.Timestamp) {
+			t.Fatalf("RFC 5424 lost header fields: %q parsed as %+v", out, got)
+		}
+	}
+}
+
+func TestRenderSyslog_FluentBitAndOpaqueRecords(t *testing.T) {
+	record := TelemetryRecord{
+		JsonData:  `{"host":"edge-01","facility":"local7","severity":"warning","ident":"kernel","message":"link down"}`,
+		Timestamp: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC).Unix(),
+		SourceIP:  "192.0.2.7",
+	}
+	if got := string(renderSyslog(record, false)); !strings.HasSuffix(got, " edge-01 kernel: link down") || !strings.HasPrefix(got, "<188>Jan  2 ") {
+		t.Fatalf("RFC 3164 render = %q", got)
+	}
+
+	record.JsonData = `{"event":"no message field"}`
+	want := `<13>1 2025-01-02T03:04:05Z 192.0.2.7 - - - - {"event":"no message field"}`
+	if got := string(renderSyslog(record, true)); got != want {
+		t.Fatalf("opaque render = %q, want %q", got, want)
+	}
+}
+
+// acceptSyslog serves one TCP or TLS listener, sending each connection's
+// frames and a marker per accepted connection
+func acceptSyslog(t *testing.T, ln net.Listener) (frames chan string, conns chan struct{}) {
+	t.Helper()
+	frames, conns = make(chan string, 100), make(chan struct{}, 10)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- struct{}{}
+			go func() {
+				defer conn.Close()
+				r := newSyslogFrameReader(conn, defaultSyslogMaxMessage)
+				for {
+					frame, err := r.next()
+					if err != nil {
+						return
+					}
+					frames <- string(frame)
+				}
+			}()
+		}
+	}()
+	return frames, conns
+}
+
+func TestSyslogForwarder_BatchesOverOnePersistentTLSConnection(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, t.TempDir())
+	cert, _ := tls.LoadX509KeyPair(certFile, keyFile)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	frames, conns := acceptSyslog(t, ln)
+
+	fwd, err := newForwarder("syslog", DestinationCfg{
+		Host: "127.0.0.1", Port: ln.Addr().(*net.TCPAddr).Port, Transport: "tls", Format: "RFC5424", TLSCAFile: certFile,
+	})
+	if err != nil {
+		t.Fatalf("newForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	records := make([]TelemetryRecord, 5)
+	for i := range records {
+		// Newlines in a message are why octet counting is used
+		records[i] = TelemetryRecord{JsonData: fmt.Sprintf(`{"host":"h","message":"line %d\nsecond line"}`, i), Timestamp: 1}
+	}
+	for _, err := range fwd.(BatchForwarder).ForwardBatch(records[:4]) {
+		if err != nil {
+			t.Fatalf("ForwardBatch: %v", err)
+		}
+	}
+	if err := fwd.Forward(records[4]); err != nil {
+		t.Fatalf("Forward: %v", err)
+	}
+
+	for i := range records {
+		select {
+		case frame := <-frames:
+			if want := fmt.Sprintf("line %d\nsecond line", i); !strings.HasSuffix(frame, want) {
+				t.Fatalf("frame %d = %q", i, frame)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("only %d of %d frames arrived", i, len(records))
+		}
+	}
+	if len(conns) != 1 {
+		t.Fatalf("%d connections for two writes, want one", len(conns))
+	}
+}
+
+func TestSyslogForwarder_BacksOffAfterFailedDial(t *testing.T) {
+	fwd, err := newSyslogForwarder(DestinationCfg{Host: "127.0.0.1", Port: freePort(t), Transport: "tcp"})
+	if err != nil {
+		t.Fatalf("newSyslogForwarder: %v", err)
+	}
+	defer fwd.Close()
+
+	record := TelemetryRecord{JsonData: `{"message":"hi"}`}
+	if err := fwd.Forward(record); err == nil {
+		t.Fatal("expected dial error")
+	}
+	if err := fwd.Forward(record); err == nil || !strings.Contains(err.Error(), "redialing in") {
+		t.Fatalf("second attempt should wait out the backoff, got %v", err)
+	}
+
+	fwd.mu.Lock()
+	fwd.nextDial = time.Time{}
+	fwd.mu.Unlock()
+	ln, err := net.Listen("tcp", fwd.addr)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	frames, _ := acceptSyslog(t, ln)
+	if err := fwd.Forward(record); err != nil {
+		t.Fatalf("Forward after the collector came back: %v", err)
+	}
+	select {
+	case frame := <-frames:
+		if !strings.HasSuffix(frame, "hi") {
+			t.Fatalf("frame = %q", frame)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no frame after reconnecting")
+	}
+}
+
+func TestBuildForwarders_AppliesApplianceSyslogSettings(t *testing.T) {
+	bm := newTestBufferManager(t, "")
+	bm.applyForwarding(ApplianceForwardingCfg{Syslog: SyslogForwardingCfg{Protocol: "TCP", Format: "RFC5424"}})
+
+	fwd, ok := bm.getForwarder("syslog").(*syslogForwarder)
+	if !ok || fwd.network != "tcp" || !fwd.rfc5424 {
+		t.Fatalf("syslog forwarder ignores forwarding.syslog: %+v", fwd)
+	}
+}
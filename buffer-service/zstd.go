@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// dictSampleLimit bounds how many recent records are used to train a dictionary
+	dictSampleLimit = 5000
+	// dictMinSamples is the minimum number of records needed to train a dictionary
+	dictMinSamples = 20
+	// dictMaxSize is the maximum size of a trained dictionary
+	dictMaxSize = 64 << 10
+)
+
+// DictionaryInfo describes a trained zstd dictionary
+type DictionaryInfo struct {
+	Service   string `json:"service"`
+	ID        uint32 `json:"id"`
+	Size      int    `json:"size"`
+	Active    bool   `json:"active"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// zstdState holds zstd encoders, the shared decoder and trained dictionaries.
+// Dictionaries are never removed because older rows may still reference them.
+type zstdState struct {
+	mu       sync.RWMutex
+	dir      string
+	encoders map[string]*zstd.Encoder // keyed by level and dictionary ID
+	decoder  *zstd.Decoder
+	dicts    map[uint32][]byte // every known dictionary by ID
+	infos    []DictionaryInfo
+	active   map[string]uint32 // service -> active dictionary ID
+}
+
+// newZstdState loads every dictionary found in dir
+func newZstdState(dir string) (*zstdState, error) {
+	zs := &zstdState{
+		dir:      dir,
+		encoders: make(map[string]*zstd.Encoder),
+		dicts:    make(map[uint32][]byte),
+		active:   make(map[string]uint32),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".zdict") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		service := strings.TrimSuffix(name, ".zdict")
+		if i := strings.LastIndex(service, "-"); i > 0 {
+			service = service[:i]
+		}
+		if err := zs.register(service, data, info.ModTime().Unix()); err != nil {
+			logger.WithError(err).WithField("file", name).Warn("Ignoring invalid zstd dictionary")
+		}
+	}
+
+	if err := zs.rebuildDecoder(); err != nil {
+		return nil, err
+	}
+	return zs, nil
+}
+
+// register adds a dictionary and makes it the service's active one if it is the newest
+func (zs *zstdState) register(service string, data []byte, createdAt int64) error {
+	d, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return err
+	}
+	id := d.ID()
+	zs.dicts[id] = data
+
+	info := DictionaryInfo{Service: service, ID: id, Size: len(data), CreatedAt: createdAt}
+	zs.infos = append(zs.infos, info)
+	sort.Slice(zs.infos, func(i, j int) bool { return zs.infos[i].CreatedAt < zs.infos[j].CreatedAt })
+
+	for _, di := range zs.infos {
+		zs.active[di.Service] = di.ID
+	}
+	return nil
+}
+
+// rebuildDecoder recreates the decoder so it knows every registered dictionary
+func (zs *zstdState) rebuildDecoder() error {
+	dicts := make([][]byte, 0, len(zs.dicts))
+	for _, d := range zs.dicts {
+		dicts = append(dicts, d)
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...))
+	if err != nil {
+		return err
+	}
+	if zs.decoder != nil {
+		zs.decoder.Close()
+	}
+	zs.decoder = decoder
+	return nil
+}
+
+// compress encodes data at the given zstd level, with the service dictionary if requested
+func (zs *zstdState) compress(service string, data []byte, level int, useDict bool) ([]byte, error) {
+	if level <= 0 {
+		level = 3
+	}
+
+	zs.mu.RLock()
+	var dictID uint32
+	if useDict {
+		dictID = zs.active[service]
+	}
+	key := fmt.Sprintf("%d:%d", level, dictID)
+	enc := zs.encoders[key]
+	zs.mu.RUnlock()
+
+	if enc == nil {
+		zs.mu.Lock()
+		if enc = zs.encoders[key]; enc == nil {
+			opts := []zstd.EOption{zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level))}
+			if dictID != 0 {
+				opts = append(opts, zstd.WithEncoderDict(zs.dicts[dictID]))
+			}
+			var err error
+			enc, err = zstd.NewWriter(nil, opts...)
+			if err != nil {
+				zs.mu.Unlock()
+				return nil, err
+			}
+			zs.encoders[key] = enc
+		}
+		zs.mu.Unlock()
+	}
+
+	return enc.EncodeAll(data, nil), nil
+}
+
+// decompress decodes a zstd frame, resolving its dictionary by ID
+func (zs *zstdState) decompress(data []byte) ([]byte, error) {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+	return zs.decoder.DecodeAll(data, nil)
+}
+
+// addDictionary persists a new dictionary for a service and activates it
+func (zs *zstdState) addDictionary(service string, data []byte) (DictionaryInfo, error) {
+	d, err := zstd.InspectDictionary(data)
+	if err != nil {
+		return DictionaryInfo{}, err
+	}
+
+	if err := os.MkdirAll(zs.dir, 0755); err != nil {
+		return DictionaryInfo{}, err
+	}
+	path := filepath.Join(zs.dir, fmt.Sprintf("%s-%d.zdict", service, d.ID()))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return DictionaryInfo{}, err
+	}
+
+	zs.mu.Lock()
+	defer zs.mu.Unlock()
+	now := time.Now().Unix()
+	if err := zs.register(service, data, now); err != nil {
+		return DictionaryInfo{}, err
+	}
+	if err := zs.rebuildDecoder(); err != nil {
+		return DictionaryInfo{}, err
+	}
+	return DictionaryInfo{Service: service, ID: d.ID(), Size: len(data), Active: true, CreatedAt: now}, nil
+}
+
+// list returns every known dictionary
+func (zs *zstdState) list() []DictionaryInfo {
+	zs.mu.RLock()
+	defer zs.mu.RUnlock()
+
+	out := make([]DictionaryInfo, len(zs.infos))
+	for i, info := range zs.infos {
+		info.Active = zs.active[info.Service] == info.ID
+		out[i] = info
+	}
+	return out
+}
+
+// TrainDictionary builds a zstd dictionary for a service from its recent records
+func (bm *BufferManager) TrainDictionary(service string) (DictionaryInfo, error) {
+	records, err := bm.store.Tail(service, dictSampleLimit)
+	if err != nil {
+		return DictionaryInfo{}, err
+	}
+
+	// Services buffering to segment files contribute their newest records too
+	if len(records) < dictSampleLimit {
+		more, err := bm.files.Tail(service, dictSampleLimit-len(records))
+		if err != nil {
+			return DictionaryInfo{}, err
+		}
+		records = append(records, more...)
+	}
+
+	var samples [][]byte
+	for _, record := range records {
+		if err := bm.decodeRecord(&record); err == nil {
+			samples = append(samples, []byte(record.JsonData))
+		}
+	}
+
+	if len(samples) < dictMinSamples {
+		return DictionaryInfo{}, fmt.Errorf("need at least %d records to train a dictionary, have %d", dictMinSamples, len(samples))
+	}
+
+	level := bm.config.Services[service].CompressionLevel
+	if level <= 0 {
+		level = 3
+	}
+	data, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: dictMaxSize,
+		HashBytes:   6,
+		ZstdLevel:   zstd.EncoderLevelFromZstd(level),
+	})
+	if err != nil {
+		return DictionaryInfo{}, err
+	}
+
+	return bm.zstd.addDictionary(service, data)
+}
+
+// handleDictionaries lists trained zstd dictionaries
+func (bm *BufferManager) handleDictionaries(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dictionaries": bm.zstd.list(),
+	})
+}
+
+// handleTrainDictionary trains a new zstd dictionary for a service
+func (bm *BufferManager) handleTrainDictionary(w http.ResponseWriter, r *http.Request) {
+	service := mux.Vars(r)["service"]
+	if _, ok := bm.config.Services[service]; !ok {
+		http.Error(w, fmt.Sprintf("Unknown service: %s", service), http.StatusNotFound)
+		return
+	}
+
+	info, err := bm.TrainDictionary(service)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Training failed: %v", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	logger.WithField("service", service).WithField("dict_id", info.ID).Info("Trained zstd dictionary")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestZstdDictionaryRoundTripAndStats(t *testing.T) {
+	dataPath := t.TempDir()
+	bm := newTestBufferManager(t, dataPath)
+	cfg := bm.config.Services["fluent-bit"]
+	cfg.BufferMode = "database"
+	cfg.CompressionMode = "zstd"
+	cfg.CompressionLevel = 9
+	bm.config.Services["fluent-bit"] = cfg
+
+	payload := func(i int) string {
+		return fmt.Sprintf(`{"host":"access-sw%02d","facility":"local7","severity":"warning","message":"%%LINEPROTO-5-UPDOWN: Line protocol on Interface GigabitEthernet1/0/%d, changed state to down"}`, i%7, i)
+	}
+	for i := 0; i < 200; i++ {
+		if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", Timestamp: time.Now().Unix(), JsonData: payload(i)}); err != nil {
+			t.Fatalf("StoreRecord: %v", err)
+		}
+	}
+
+	info, err := bm.TrainDictionary("fluent-bit")
+	if err != nil {
+		t.Fatalf("TrainDictionary: %v", err)
+	}
+	if info.ID == 0 || !info.Active {
+		t.Fatalf("unexpected dictionary info: %+v", info)
+	}
+
+	cfg.ZstdDictionary = true
+	bm.config.Services["fluent-bit"] = cfg
+	if err := bm.StoreRecord(TelemetryRecord{Service: "fluent-bit", DataType: "syslog", Timestamp: time.Now().Unix() + 1, JsonData: payload(999)}); err != nil {
+		t.Fatalf("StoreRecord with dictionary: %v", err)
+	}
+
+	stats, err := bm.GetStats("fluent-bit")
+	if err != nil {
+		t.Fatalf("GetStats: %v", err)
+	}
+	zs, ok := stats.Compression["zstd"]
+	if !ok || zs.Records != 201 || zs.Ratio <= 1 {
+		t.Fatalf("unexpected zstd stats: %+v", stats.Compression)
+	}
+
+	// A restarted manager must still decode dictionary-compressed rows
+	reloaded, err := newZstdState(bm.zstd.dir)
+	if err != nil {
+		t.Fatalf("newZstdState: %v", err)
+	}
+	bm.zstd = reloaded
+
+	capture := useCapture(bm)
+	bm.forwardBufferedRecords()
+	got := capture.payloads()
+	if len(got) != 201 {
+		t.Fatalf("forwarded %d records, want 201", len(got))
+	}
+	found := false
+	for _, p := range got {
+		found = found || p == payload(999)
+	}
+	if !found {
+		t.Fatalf("dictionary-compressed record was not forwarded")
+	}
+}